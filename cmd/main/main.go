@@ -2,44 +2,100 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/config"
+	"github.com/marcosArruda/purchases-multi-country/pkg/consistency"
 	"github.com/marcosArruda/purchases-multi-country/pkg/exchangeservice"
 	"github.com/marcosArruda/purchases-multi-country/pkg/httpservice"
 	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/metrics"
 	"github.com/marcosArruda/purchases-multi-country/pkg/persistence"
+	"github.com/marcosArruda/purchases-multi-country/pkg/ratecache"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"github.com/marcosArruda/purchases-multi-country/pkg/tracing"
 	"github.com/marcosArruda/purchases-multi-country/pkg/treasuryaccess"
 )
 
 func main() {
 	ctx := context.Background()
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(ctx, os.Args[2:]))
+	}
 	//time.Sleep(5 * time.Second)
 	asyncWorkChannel := make(chan func() error)
 	stop := make(chan struct{})
 
 	sm := services.NewManager(asyncWorkChannel, stop).
+		WithConfigService(config.NewConfigService(os.Args[1:])).
 		WithLogsService(logs.NewLogsService()).
-		WithDatabase(persistence.NewDatabase()).
+		WithTracingService(tracing.NewTracingService()).
+		WithMetricsService(metrics.NewMetricsService()).
+		WithDatabase(persistence.NewDatabaseOfDriver()).
 		WithPersistenceService(persistence.NewPersistenceService()).
 		WithExchangeService(exchangeservice.NewExchangeService()).
 		WithTreasuryAccessService(treasuryaccess.NewTreasuryAccessService()).
 		WithHttpService(httpservice.NewHttpService())
+	sm.Register(services.RateCacheName, ratecache.NewRateCache().WithServiceManager(sm), services.PersistenceServiceName)
+	sm.Register(services.ConsistencyCheckerName, consistency.NewConsistencyChecker().WithServiceManager(sm), services.ExchangeServiceName)
 
-	// This is the goroutine that will execute any async work
-	go func() {
-	basicLoop:
-		for {
-			select {
-			case w := <-asyncWorkChannel:
-				if err := w(); err != nil {
-					sm.LogsService().Warn(ctx, fmt.Sprintf("an async work failed: %s", err.Error()))
-				}
-			case <-stop: // triggered when the stop channel is closed
-				break basicLoop // stop listening
-			}
+	// Run starts every service, the async worker included, and blocks until SIGINT/SIGTERM to close them all.
+	if err := sm.Run(ctx); err != nil {
+		sm.LogsService().Error(ctx, fmt.Sprintf("shutdown finished with errors: %s", err.Error()))
+		os.Exit(1)
+	}
+}
+
+// check runs the consistency check once, without the http server, and prints the report to stdout. With -repair
+// the issues that can be are repaired. The exit code is 1 when issues are left, 2 when the check did not run.
+func check(ctx context.Context, args []string) int {
+	repair := false
+	var rest []string
+	for _, a := range args {
+		if a == "-repair" || a == "--repair" {
+			repair = true
+			continue
+		}
+		rest = append(rest, a)
+	}
+
+	sm := services.NewManager(make(chan func() error), make(chan struct{})).
+		WithConfigService(config.NewConfigService(rest)).
+		WithLogsService(logs.NewLogsService()).
+		WithTracingService(tracing.NewTracingService()).
+		WithMetricsService(metrics.NewMetricsService()).
+		WithDatabase(persistence.NewDatabaseOfDriver()).
+		WithPersistenceService(persistence.NewPersistenceService()).
+		WithExchangeService(exchangeservice.NewExchangeService()).
+		WithTreasuryAccessService(treasuryaccess.NewTreasuryAccessService())
+	checker := consistency.NewConsistencyChecker().WithServiceManager(sm)
+	sm.Register(services.ConsistencyCheckerName, checker, services.ExchangeServiceName)
+	defer func() {
+		cctx, cancel := context.WithTimeout(context.Background(), sm.ConfigService().Config().App.ShutdownTimeout)
+		defer cancel()
+		if err := sm.Close(cctx); err != nil {
+			sm.LogsService().Error(ctx, fmt.Sprintf("shutdown finished with errors: %s", err.Error()))
 		}
 	}()
+	if err := sm.Start(ctx); err != nil {
+		return 2
+	}
 
-	sm.Start(ctx)
+	report, err := checker.Check(ctx, repair)
+	if err != nil {
+		sm.LogsService().Error(ctx, fmt.Sprintf("consistency not checked: %s", err.Error()))
+		return 2
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		sm.LogsService().Error(ctx, err.Error())
+		return 2
+	}
+	if !report.Consistent() {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,318 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfigFileEnv and the -config flag give the path of a YAML or JSON config file, the flag wins.
+	ConfigFileEnv  = "CONFIG_FILE"
+	configFileFlag = "config"
+)
+
+type (
+	configServiceFinal struct {
+		sm     services.ServiceManager
+		args   []string
+		config atomic.Pointer[models.Config]
+	}
+
+	// setting is one field of models.Config, found by its env and flag tags.
+	setting struct {
+		value reflect.Value
+		env   string
+		flag  string
+	}
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// NewConfigService builds a ConfigService that loads its settings from the command line args, without the
+// program name, like os.Args[1:].
+func NewConfigService(args []string) services.ConfigService {
+	n := &configServiceFinal{args: args}
+	n.config.Store(models.DefaultConfig())
+	return n
+}
+
+// Start loads and validates the settings, it must be the first service started since the others read their
+// section on their own Start.
+func (n *configServiceFinal) Start(ctx context.Context) error {
+	c, err := n.Load()
+	if err != nil {
+		return err
+	}
+	n.config.Store(c)
+	return nil
+}
+
+func (n *configServiceFinal) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *configServiceFinal) Healthy(ctx context.Context) error {
+	return nil
+}
+
+// Reconfigure starts using cfg, the ServiceManager calls it only after every other service accepted cfg.
+func (n *configServiceFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	if err := Validate(cfg); err != nil {
+		return err
+	}
+	n.config.Store(cfg)
+	return nil
+}
+
+func (n *configServiceFinal) WithServiceManager(sm services.ServiceManager) services.ConfigService {
+	n.sm = sm
+	return n
+}
+
+func (n *configServiceFinal) ServiceManager() services.ServiceManager {
+	return n.sm
+}
+
+func (n *configServiceFinal) Config() *models.Config {
+	return n.config.Load()
+}
+
+func (n *configServiceFinal) Load() (*models.Config, error) {
+	return Load(n.args)
+}
+
+// Load builds the settings from, in order of precedence, the defaults, the config file, the environment
+// variables and the command line flags, and validates them.
+func Load(args []string) (*models.Config, error) {
+	c := models.DefaultConfig()
+	settings := settingsOf(reflect.ValueOf(c).Elem())
+
+	fs := flag.NewFlagSet("purchases-multi-country-app", flag.ContinueOnError)
+	configFile := fs.String(configFileFlag, os.Getenv(ConfigFileEnv), "path of a YAML or JSON config file, or "+ConfigFileEnv)
+	// the flags are only collected here, they are applied after the file and the env, which they override.
+	flags := make(map[string]string)
+	for _, s := range settings {
+		name := s.flag
+		fs.Func(name, "overrides "+s.env, func(v string) error {
+			flags[name] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("%w: %s", messages.ErrInvalidConfig, err.Error())
+	}
+
+	if *configFile != "" {
+		if err := loadFile(c, *configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := set(s.value, v); err != nil {
+				return nil, fmt.Errorf("%w: %s '%s': %s", messages.ErrInvalidConfig, s.env, v, err.Error())
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flags[s.flag]; ok {
+			if err := set(s.value, v); err != nil {
+				return nil, fmt.Errorf("%w: -%s '%s': %s", messages.ErrInvalidConfig, s.flag, v, err.Error())
+			}
+		}
+	}
+
+	if err := Validate(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile reads a YAML file, or a JSON one since JSON is also YAML, over the settings already in c.
+// Unknown keys are rejected, so a typo does not silently keep the default.
+func loadFile(c *models.Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s", messages.ErrInvalidConfig, err.Error())
+	}
+	defer f.Close()
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+	if err := d.Decode(c); err != nil {
+		return fmt.Errorf("%w: %s: %s", messages.ErrInvalidConfig, path, err.Error())
+	}
+	return nil
+}
+
+// Validate checks the settings, it returns all the problems found joined.
+func Validate(c *models.Config) error {
+	var errs []error
+	invalid := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{messages.ErrInvalidConfig}, a...)...))
+	}
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			invalid("%s must be positive, got %s", name, d)
+		}
+	}
+
+	if c.App.Env == "" {
+		invalid("app.env is required")
+	}
+	if _, err := zapcore.ParseLevel(c.App.LogLevel); err != nil {
+		invalid("app.logLevel '%s': %s", c.App.LogLevel, err.Error())
+	}
+	if c.App.Name == "" {
+		invalid("app.name is required")
+	}
+	switch c.App.LogEncoding {
+	case models.LogEncodingJSON, models.LogEncodingConsole:
+	default:
+		invalid("app.logEncoding must be %s or %s, got '%s'", models.LogEncodingJSON, models.LogEncodingConsole, c.App.LogEncoding)
+	}
+	if c.App.LogSamplingInitial < 0 || c.App.LogSamplingThereafter < 0 {
+		invalid("app.logSamplingInitial and app.logSamplingThereafter cannot be negative, got %d and %d", c.App.LogSamplingInitial, c.App.LogSamplingThereafter)
+	}
+	if c.App.LogFile != "" {
+		if c.App.LogFileMaxSizeMB < 1 {
+			invalid("app.logFileMaxSizeMB must be at least 1, got %d", c.App.LogFileMaxSizeMB)
+		}
+		if c.App.LogFileMaxBackups < 0 || c.App.LogFileMaxAgeDays < 0 {
+			invalid("app.logFileMaxBackups and app.logFileMaxAgeDays cannot be negative, got %d and %d", c.App.LogFileMaxBackups, c.App.LogFileMaxAgeDays)
+		}
+	}
+	if _, err := c.App.Redaction(); err != nil {
+		invalid("app.logRedact %s", err.Error())
+	}
+	positive("app.shutdownTimeout", c.App.ShutdownTimeout)
+
+	if _, _, err := net.SplitHostPort(c.Http.Addr); err != nil {
+		invalid("http.addr '%s': %s", c.Http.Addr, err.Error())
+	}
+	positive("http.idempotencyKeyTTL", c.Http.IdempotencyKeyTTL)
+	positive("http.healthCheckTimeout", c.Http.HealthCheckTimeout)
+	if _, err := c.Http.AdminActors(); err != nil {
+		invalid("http.adminTokens %s", err.Error())
+	}
+
+	if c.Database.Name == "" {
+		invalid("database.name is required")
+	}
+	switch c.Database.Driver {
+	case models.DatabaseDriverMySQL:
+		if _, _, err := net.SplitHostPort(c.Database.HostPort); err != nil {
+			invalid("database.hostPort '%s': %s", c.Database.HostPort, err.Error())
+		}
+	case models.DatabaseDriverSQLite:
+		if c.Database.Path == "" {
+			invalid("database.path is required by the %s driver", models.DatabaseDriverSQLite)
+		}
+	case models.DatabaseDriverMemory:
+	default:
+		invalid("database.driver must be %s, %s or %s, got '%s'", models.DatabaseDriverMySQL, models.DatabaseDriverSQLite, models.DatabaseDriverMemory, c.Database.Driver)
+	}
+	if c.Database.MaxOpenConns < 1 {
+		invalid("database.maxOpenConns must be at least 1, got %d", c.Database.MaxOpenConns)
+	}
+	if c.Database.MaxIdleConns < 0 {
+		invalid("database.maxIdleConns cannot be negative, got %d", c.Database.MaxIdleConns)
+	}
+	positive("database.connMaxLifetime", c.Database.ConnMaxLifetime)
+
+	if u, err := url.Parse(c.Treasury.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		invalid("treasury.baseURL '%s' must be an http or https url", c.Treasury.BaseURL)
+	}
+	positive("treasury.timeout", c.Treasury.Timeout)
+	if c.Treasury.MaxRetries < 0 {
+		invalid("treasury.maxRetries cannot be negative, got %d", c.Treasury.MaxRetries)
+	}
+	if c.Treasury.RetryBackoff < 0 {
+		invalid("treasury.retryBackoff cannot be negative, got %s", c.Treasury.RetryBackoff)
+	}
+	if c.Treasury.FailureThreshold < 1 {
+		invalid("treasury.failureThreshold must be at least 1, got %d", c.Treasury.FailureThreshold)
+	}
+	positive("treasury.openCooldown", c.Treasury.OpenCooldown)
+
+	if c.Exchange.DedupPolicy != models.DedupPolicyNone && c.Exchange.DedupPolicy != models.DedupPolicySignature {
+		invalid("exchange.dedupPolicy '%s' must be '%s' or '%s'", c.Exchange.DedupPolicy, models.DedupPolicyNone, models.DedupPolicySignature)
+	}
+	positive("exchange.collectTimeout", c.Exchange.CollectTimeout)
+	if c.Exchange.StaleRates != models.StaleRatesNone && c.Exchange.StaleRates != models.StaleRatesNewest {
+		invalid("exchange.staleRates '%s' must be '%s' or '%s'", c.Exchange.StaleRates, models.StaleRatesNone, models.StaleRatesNewest)
+	}
+
+	if c.RateCache.Size < 1 {
+		invalid("rateCache.size must be at least 1, got %d", c.RateCache.Size)
+	}
+	positive("rateCache.ttl", c.RateCache.TTL)
+	if c.RateCache.WarmupQuarters < 0 {
+		invalid("rateCache.warmupQuarters cannot be negative, got %d", c.RateCache.WarmupQuarters)
+	}
+
+	switch c.Tracing.Exporter {
+	case models.TracingExporterNone, models.TracingExporterStdout:
+	case models.TracingExporterOTLP:
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("tracing.endpoint '%s' must be an http or https url", c.Tracing.Endpoint)
+		}
+	default:
+		invalid("tracing.exporter '%s' must be '%s', '%s' or '%s'", c.Tracing.Exporter, models.TracingExporterNone, models.TracingExporterStdout, models.TracingExporterOTLP)
+	}
+
+	return errors.Join(errs...)
+}
+
+// settingsOf lists the fields of the sections in v that have an env tag.
+func settingsOf(v reflect.Value) []*setting {
+	var settings []*setting
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			settings = append(settings, settingsOf(field)...)
+			continue
+		}
+		tag := v.Type().Field(i).Tag
+		if env := tag.Get("env"); env != "" {
+			settings = append(settings, &setting{value: field, env: env, flag: tag.Get("flag")})
+		}
+	}
+	return settings
+}
+
+func set(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("an error '%s' was not expected when writing the config file", err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	yamlFile := writeConfigFile(t, "config.yaml", `
+http:
+  addr: ":9090"
+  idempotencyKeyTTL: 1h
+database:
+  name: file-db
+  maxOpenConns: 10
+exchange:
+  dedupPolicy: signature
+`)
+	jsonFile := writeConfigFile(t, "config.json", `{"http": {"addr": ":9191"}, "treasury": {"openCooldown": "1m"}}`)
+	unknownKeyFile := writeConfigFile(t, "unknown.yaml", "http:\n  adr: \":9090\"\n")
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		check   func(c *models.Config) bool
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			check: func(c *models.Config) bool { return *c == *models.DefaultConfig() },
+		},
+		{
+			name:  "exampleFile",
+			args:  []string{"-config", "../../config.example.yaml"},
+			check: func(c *models.Config) bool { return *c == *models.DefaultConfig() },
+		},
+		{
+			name: "yamlFile",
+			args: []string{"-config", yamlFile},
+			check: func(c *models.Config) bool {
+				return c.Http.Addr == ":9090" && c.Http.IdempotencyKeyTTL == time.Hour && c.Database.Name == "file-db" &&
+					c.Database.MaxOpenConns == 10 && c.Exchange.DedupPolicy == models.DedupPolicySignature &&
+					c.Database.MaxIdleConns == 5
+			},
+		},
+		{
+			name: "jsonFileFromEnv",
+			env:  map[string]string{ConfigFileEnv: jsonFile},
+			check: func(c *models.Config) bool {
+				return c.Http.Addr == ":9191" && c.Treasury.OpenCooldown == time.Minute
+			},
+		},
+		{
+			name: "envOverridesFile",
+			args: []string{"-config", yamlFile},
+			env:  map[string]string{"HTTP_ADDR": ":7070", "DB_MAX_OPEN_CONNS": "20"},
+			check: func(c *models.Config) bool {
+				return c.Http.Addr == ":7070" && c.Database.MaxOpenConns == 20 && c.Database.Name == "file-db"
+			},
+		},
+		{
+			name: "flagOverridesEnv",
+			args: []string{"-config", yamlFile, "-http-addr", ":6060", "-idempotency-key-ttl", "30m"},
+			env:  map[string]string{"HTTP_ADDR": ":7070", "IDEMPOTENCY_KEY_TTL": "2h"},
+			check: func(c *models.Config) bool {
+				return c.Http.Addr == ":6060" && c.Http.IdempotencyKeyTTL == 30*time.Minute
+			},
+		},
+		{
+			name: "currenciesFromEnv",
+			env:  map[string]string{"EXCHANGE_CURRENCIES": "Brazil-Real, Canada-Dollar,,Brazil-Real"},
+			check: func(c *models.Config) bool {
+				return reflect.DeepEqual(c.Exchange.CurrencyList(), []string{"Brazil-Real", "Canada-Dollar"})
+			},
+		},
+		{
+			name:    "missingFile",
+			args:    []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+			wantErr: true,
+		},
+		{
+			name:    "unknownKey",
+			args:    []string{"-config", unknownKeyFile},
+			wantErr: true,
+		},
+		{
+			name:    "invalidEnvDuration",
+			env:     map[string]string{"IDEMPOTENCY_KEY_TTL": "one day"},
+			wantErr: true,
+		},
+		{
+			name:    "invalidFlagInt",
+			args:    []string{"-db-max-open-conns", "many"},
+			wantErr: true,
+		},
+		{
+			name:    "unknownFlag",
+			args:    []string{"-port", "8080"},
+			wantErr: true,
+		},
+		{
+			name:    "invalidDedupPolicy",
+			env:     map[string]string{"PURCHASE_DEDUP_POLICY": "everything"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(ConfigFileEnv, "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			got, err := Load(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, messages.ErrInvalidConfig) {
+					t.Errorf("Load() error = %v, want %v", err, messages.ErrInvalidConfig)
+				}
+				return
+			}
+			if !tt.check(got) {
+				t.Errorf("Load() = %+v, unexpected settings", got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *models.Config)
+		wantErr bool
+	}{
+		{
+			name:    "defaults",
+			change:  func(c *models.Config) {},
+			wantErr: false,
+		},
+		{
+			name:    "addrWithoutPort",
+			change:  func(c *models.Config) { c.Http.Addr = "localhost" },
+			wantErr: true,
+		},
+		{
+			name:    "zeroShutdownTimeout",
+			change:  func(c *models.Config) { c.App.ShutdownTimeout = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "unknownLogEncoding",
+			change:  func(c *models.Config) { c.App.LogEncoding = "xml" },
+			wantErr: true,
+		},
+		{
+			name:    "unknownRedactPolicy",
+			change:  func(c *models.Config) { c.App.LogRedact = "description:erase" },
+			wantErr: true,
+		},
+		{
+			name:    "logFileWithoutSize",
+			change:  func(c *models.Config) { c.App.LogFile, c.App.LogFileMaxSizeMB = "app.log", 0 },
+			wantErr: true,
+		},
+		{
+			name:    "unknownDatabaseDriver",
+			change:  func(c *models.Config) { c.Database.Driver = "postgres" },
+			wantErr: true,
+		},
+		{
+			name:    "sqliteWithoutHostPort",
+			change:  func(c *models.Config) { c.Database.Driver, c.Database.HostPort = models.DatabaseDriverSQLite, "" },
+			wantErr: false,
+		},
+		{
+			name:    "memoryWithoutHostPort",
+			change:  func(c *models.Config) { c.Database.Driver, c.Database.HostPort = models.DatabaseDriverMemory, "" },
+			wantErr: false,
+		},
+		{
+			name:    "noOpenConns",
+			change:  func(c *models.Config) { c.Database.MaxOpenConns = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "relativeTreasuryURL",
+			change:  func(c *models.Config) { c.Treasury.BaseURL = "/rates_of_exchange" },
+			wantErr: true,
+		},
+		{
+			name:    "unknownTracingExporter",
+			change:  func(c *models.Config) { c.Tracing.Exporter = "jaeger" },
+			wantErr: true,
+		},
+		{
+			name:    "otlpWithoutEndpoint",
+			change:  func(c *models.Config) { c.Tracing.Exporter, c.Tracing.Endpoint = models.TracingExporterOTLP, "" },
+			wantErr: true,
+		},
+		{
+			name:    "noFailureThreshold",
+			change:  func(c *models.Config) { c.Treasury.FailureThreshold = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "unknownStaleRates",
+			change:  func(c *models.Config) { c.Exchange.StaleRates = "oldest" },
+			wantErr: true,
+		},
+		{
+			name:    "emptyRateCache",
+			change:  func(c *models.Config) { c.RateCache.Size = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "rateCacheWithoutWarmup",
+			change:  func(c *models.Config) { c.RateCache.WarmupQuarters = 0 },
+			wantErr: false,
+		},
+		{
+			name:    "adminTokens",
+			change:  func(c *models.Config) { c.Http.AdminTokens = "finance@example.com:s3cr3t, ops:t0k3n" },
+			wantErr: false,
+		},
+		{
+			name:    "adminTokenWithoutActor",
+			change:  func(c *models.Config) { c.Http.AdminTokens = "finance@example.com:s3cr3t,:t0k3n" },
+			wantErr: true,
+		},
+		{
+			name:    "adminTokenRepeated",
+			change:  func(c *models.Config) { c.Http.AdminTokens = "finance@example.com:s3cr3t,ops:s3cr3t" },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := models.DefaultConfig()
+			tt.change(c)
+			err := Validate(c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), "s3cr3t") {
+				t.Errorf("Validate() error = %v, want the admin tokens out of it", err)
+			}
+		})
+	}
+}
+
+func Test_configServiceFinal_Start(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantAddr string
+		wantErr  bool
+	}{
+		{
+			name:     "success",
+			args:     []string{"-http-addr", "127.0.0.1:0"},
+			wantAddr: "127.0.0.1:0",
+			wantErr:  false,
+		},
+		{
+			name:     "invalid",
+			args:     []string{"-http-addr", "nowhere"},
+			wantAddr: models.DefaultConfig().Http.Addr,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(ConfigFileEnv, "")
+			sm := services.NewManager(nil, nil).WithConfigService(NewConfigService(tt.args))
+			if err := sm.ConfigService().Start(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("configServiceFinal.Start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := sm.ConfigService().Config().Http.Addr; got != tt.wantAddr {
+				t.Errorf("configServiceFinal.Config().Http.Addr = %s, want %s", got, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func Test_configServiceFinal_Reconfigure(t *testing.T) {
+	invalid := models.DefaultConfig()
+	invalid.App.LogLevel = "loud"
+	tests := []struct {
+		name    string
+		cfg     *models.Config
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			cfg:     models.DefaultConfig(),
+			wantErr: false,
+		},
+		{
+			name:    "invalid",
+			cfg:     invalid,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewConfigService(nil)
+			before := n.Config()
+			err := n.Reconfigure(context.Background(), tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("configServiceFinal.Reconfigure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			want := tt.cfg
+			if tt.wantErr {
+				want = before
+			}
+			if got := n.Config(); got != want {
+				t.Errorf("configServiceFinal.Config() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func Test_configServiceFinal_Load(t *testing.T) {
+	t.Setenv(ConfigFileEnv, "")
+	n := NewConfigService(nil)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("configServiceFinal.Start() error = %v", err)
+	}
+	t.Setenv("LOG_LEVEL", "debug")
+	got, err := n.Load()
+	if err != nil {
+		t.Fatalf("configServiceFinal.Load() error = %v", err)
+	}
+	if got.App.LogLevel != "debug" {
+		t.Errorf("configServiceFinal.Load() log level = %s, want debug", got.App.LogLevel)
+	}
+	if n.Config().App.LogLevel != "info" {
+		t.Errorf("configServiceFinal.Load() changed the settings in use to %s", n.Config().App.LogLevel)
+	}
+}
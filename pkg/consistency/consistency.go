@@ -0,0 +1,366 @@
+package consistency
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"github.com/shopspring/decimal"
+)
+
+type (
+	consistencyCheckerFinal struct {
+		sm services.ServiceManager
+		mu sync.Mutex // one check at a time, so two repairs never merge the same purchases
+	}
+)
+
+// NewConsistencyChecker builds a ConsistencyChecker to be registered under services.ConsistencyCheckerName, like
+// sm.Register(services.ConsistencyCheckerName, consistency.NewConsistencyChecker().WithServiceManager(sm), services.ExchangeServiceName).
+func NewConsistencyChecker() services.ConsistencyChecker {
+	return &consistencyCheckerFinal{}
+}
+
+func (n *consistencyCheckerFinal) Start(ctx context.Context) error {
+	n.sm.LogsService().Info(ctx, "Consistency Checker Started!")
+	return nil
+}
+
+func (n *consistencyCheckerFinal) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *consistencyCheckerFinal) Healthy(ctx context.Context) error {
+	return nil
+}
+
+// Reconfigure does nothing, the currencies and the dedup policy are read on every check.
+func (n *consistencyCheckerFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func (n *consistencyCheckerFinal) WithServiceManager(sm services.ServiceManager) services.ConsistencyChecker {
+	n.sm = sm
+	return n
+}
+
+func (n *consistencyCheckerFinal) ServiceManager() services.ServiceManager {
+	return n.sm
+}
+
+// Check scans every live purchase: the unparsable ones are only reported, the others are checked for duplicated
+// signatures (with the signature dedup policy) and for a rate of each of exchange.currencies. The locked
+// conversions to those currencies are checked against the purchases left after the repair, so the ones of a
+// duplicate deleted are reported as orphaned.
+func (n *consistencyCheckerFinal) Check(ctx context.Context, repair bool) (*models.ConsistencyReport, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ConsistencyChecker.Check")
+	defer span.End()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	cfg := n.sm.ConfigService().Config().Exchange
+	purchases, err := n.sm.PersistenceService().ListAllPurchases(ctx)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	report := &models.ConsistencyReport{
+		CheckedAt:  time.Now().UnixMilli(),
+		Purchases:  len(purchases),
+		Currencies: cfg.CurrencyList(),
+		Repair:     repair,
+		Issues:     make([]*models.ConsistencyIssue, 0),
+	}
+	if report.Currencies == nil {
+		report.Currencies = make([]string, 0)
+	}
+
+	parsable := checkParsable(report, purchases)
+	merged := make(map[string]string)
+	if cfg.DedupPolicy == models.DedupPolicySignature {
+		if merged, err = n.checkDuplicates(ctx, report, parsable, repair); err != nil {
+			return nil, err
+		}
+		purchases, parsable = without(purchases, merged), without(parsable, merged)
+	}
+	if err = n.checkRates(ctx, report, parsable, repair); err != nil {
+		return nil, err
+	}
+	if err = n.checkConversions(ctx, report, purchases, merged); err != nil {
+		return nil, err
+	}
+
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			report.Repaired++
+		}
+	}
+	n.sm.LogsService().Info(ctx, "Consistency checked", "purchases", report.Purchases, "issues", len(report.Issues), "repaired", report.Repaired)
+	return report, nil
+}
+
+// checkParsable reports the purchases whose amount or date cannot be read, and returns the others.
+func checkParsable(report *models.ConsistencyReport, purchases []*models.Purchase) []*models.Purchase {
+	parsable := make([]*models.Purchase, 0, len(purchases))
+	for _, p := range purchases {
+		ok := true
+		if _, err := time.Parse(models.DateLayout, p.Date); err != nil {
+			report.Issues = append(report.Issues, &models.ConsistencyIssue{Kind: models.IssueUnparsableDate, PurchaseId: p.Id, Detail: fmt.Sprintf("date '%s' is not in the YYYY-MM-DD format", p.Date)})
+			ok = false
+		}
+		if _, err := decimal.NewFromString(p.Amount); err != nil {
+			report.Issues = append(report.Issues, &models.ConsistencyIssue{Kind: models.IssueUnparsableAmount, PurchaseId: p.Id, Detail: fmt.Sprintf("amount '%s' is not a decimal value", p.Amount)})
+			ok = false
+		}
+		if ok {
+			parsable = append(parsable, p)
+		}
+	}
+	return parsable
+}
+
+// checkDuplicates reports the purchases with the signature of an older one, and with repair deletes them so only
+// the oldest is left. Only the purchases stored with their signature are merged: the ones created with no dedup
+// policy may be distinct purchases of the same amount on the same day, so they are reported and left as they are.
+// It returns the oldest each purchase deleted was merged into, by the id of the one deleted.
+func (n *consistencyCheckerFinal) checkDuplicates(ctx context.Context, report *models.ConsistencyReport, purchases []*models.Purchase, repair bool) (map[string]string, error) {
+	bySignature := make(map[string][]*models.Purchase)
+	var signatures []string
+	for _, p := range purchases {
+		s := p.Signature()
+		if len(bySignature[s]) == 0 {
+			signatures = append(signatures, s)
+		}
+		bySignature[s] = append(bySignature[s], p)
+	}
+
+	merged := make(map[string]string)
+	for _, s := range signatures {
+		group := bySignature[s]
+		if len(group) < 2 {
+			continue
+		}
+		if err := n.oldestFirst(ctx, group); err != nil {
+			return nil, err
+		}
+		// the oldest one stored with the signature is kept, the others stored with it are merged into it.
+		kept := group[0]
+		for _, p := range group {
+			if p.Deduplicate {
+				kept = p
+				break
+			}
+		}
+		for _, p := range group {
+			if p == kept {
+				continue
+			}
+			issue := &models.ConsistencyIssue{Kind: models.IssueDuplicateSignature, PurchaseId: p.Id, Detail: fmt.Sprintf("same signature as the purchase '%s'", kept.Id)}
+			switch {
+			case !p.Deduplicate:
+				issue.Detail += ", not merged as it was created with no signature to deduplicate"
+			case repair:
+				if err := n.sm.ExchangeService().DeletePurchase(services.WithPurchaseID(ctx, p.Id), p.Id); err != nil {
+					n.sm.LogsService().Error(ctx, err.Error(), services.PurchaseIDKey, p.Id)
+				} else {
+					issue.Repaired = true
+					merged[p.Id] = kept.Id
+				}
+			}
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+
+	return merged, nil
+}
+
+// without returns the purchases not in ids.
+func without(purchases []*models.Purchase, ids map[string]string) []*models.Purchase {
+	left := make([]*models.Purchase, 0, len(purchases))
+	for _, p := range purchases {
+		if _, ok := ids[p.Id]; !ok {
+			left = append(left, p)
+		}
+	}
+	return left
+}
+
+// oldestFirst sorts the purchases by when they were created, by id when created at the same second.
+func (n *consistencyCheckerFinal) oldestFirst(ctx context.Context, ps []*models.Purchase) error {
+	createdAt := make(map[string]int64, len(ps))
+	for _, p := range ps {
+		history, err := n.sm.PersistenceService().ListPurchaseHistory(ctx, p.Id)
+		if err != nil {
+			n.sm.LogsService().Error(ctx, err.Error(), services.PurchaseIDKey, p.Id)
+			return err
+		}
+		for _, h := range history {
+			if h.Action == models.PurchaseCreated {
+				createdAt[p.Id] = h.ChangedAt
+				break
+			}
+		}
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		if createdAt[ps[i].Id] != createdAt[ps[j].Id] {
+			return createdAt[ps[i].Id] < createdAt[ps[j].Id]
+		}
+		return ps[i].Id < ps[j].Id
+	})
+	return nil
+}
+
+// checkRates reports the purchases that cannot be converted to each currency. With repair the rates of their
+// dates are collected from the Treasury API, once for all the currencies, and the purchases checked again.
+func (n *consistencyCheckerFinal) checkRates(ctx context.Context, report *models.ConsistencyReport, purchases []*models.Purchase, repair bool) error {
+	missing := make(map[string][]*models.Purchase, len(report.Currencies))
+	var toCollect []*models.Purchase
+	collecting := make(map[string]bool)
+	for _, cc := range report.Currencies {
+		uncovered, err := n.uncovered(ctx, purchases, cc)
+		if err != nil {
+			return err
+		}
+		missing[cc] = uncovered
+		for _, p := range uncovered {
+			if !collecting[p.Date] {
+				collecting[p.Date] = true
+				toCollect = append(toCollect, p)
+			}
+		}
+	}
+
+	still := make(map[string]map[string]bool, len(missing))
+	if repair && len(toCollect) > 0 {
+		n.collect(ctx, toCollect)
+		for _, cc := range report.Currencies {
+			uncovered, err := n.uncovered(ctx, missing[cc], cc)
+			if err != nil {
+				return err
+			}
+			still[cc] = make(map[string]bool, len(uncovered))
+			for _, p := range uncovered {
+				still[cc][p.Id] = true
+			}
+		}
+	}
+
+	for _, cc := range report.Currencies {
+		for _, p := range missing[cc] {
+			report.Issues = append(report.Issues, &models.ConsistencyIssue{
+				Kind:                models.IssueMissingRate,
+				PurchaseId:          p.Id,
+				CountryCurrencyDesc: cc,
+				Detail:              fmt.Sprintf("no rate effective within the 6 months up to %s", p.Date),
+				Repaired:            repair && len(toCollect) > 0 && !still[cc][p.Id],
+			})
+		}
+	}
+	return nil
+}
+
+// uncovered returns the purchases with no stored rate of countrycurrency within their 6 months, leaving out the
+// ones locked in it and the ones a RateOverride in use converts.
+func (n *consistencyCheckerFinal) uncovered(ctx context.Context, purchases []*models.Purchase, countrycurrency string) ([]*models.Purchase, error) {
+	locks, err := n.sm.PersistenceService().ListPurchaseConversions(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	overrides, err := n.sm.PersistenceService().ListRateOverrides(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	dates := make([]string, 0, len(purchases))
+	for _, p := range purchases {
+		dates = append(dates, p.Date)
+	}
+	rates, err := n.sm.PersistenceService().GetExchangeRatesForCountryCurrencyAndDates(ctx, countrycurrency, dates)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+
+	var uncovered []*models.Purchase
+	for _, p := range purchases {
+		if _, ok := locks[p.Id]; ok || overridden(overrides, p.Date) {
+			continue
+		}
+		if rate, ok := rates[p.Date]; ok && rate != nil && models.WithinSixMonths(rate.Date, p.Date) {
+			continue
+		}
+		uncovered = append(uncovered, p)
+	}
+	return uncovered, nil
+}
+
+func overridden(overrides []*models.RateOverride, date string) bool {
+	for _, o := range overrides {
+		if o.RemovedAt == 0 && o.Covers(date) {
+			return true
+		}
+	}
+	return false
+}
+
+// collect stores the rates of the date of each purchase, like the async collect done when they were created. A
+// date failing does not stop the others, its purchases are just left unrepaired.
+func (n *consistencyCheckerFinal) collect(ctx context.Context, ps []*models.Purchase) {
+	timeout := n.sm.ConfigService().Config().Exchange.CollectTimeout
+	for _, p := range ps {
+		pctx, cancel := context.WithTimeout(services.WithPurchaseID(ctx, p.Id), timeout)
+		exchanges, err := n.sm.ExchangeService().CollectExchangeRatesForPurchase(pctx, p)
+		if err == nil {
+			err = n.sm.PersistenceService().BatchInsertExchanges(pctx, p, exchanges)
+		}
+		cancel()
+		if err != nil {
+			n.sm.LogsService().Error(ctx, err.Error(), "date", p.Date)
+		}
+	}
+}
+
+// checkConversions reports the conversions locked to each currency whose purchase is gone or changed since. The
+// conversion of a duplicate merged into an older purchase is not moved to it, the older one may have its own.
+func (n *consistencyCheckerFinal) checkConversions(ctx context.Context, report *models.ConsistencyReport, purchases []*models.Purchase, merged map[string]string) error {
+	byId := make(map[string]*models.Purchase, len(purchases))
+	for _, p := range purchases {
+		byId[p.Id] = p
+	}
+	for _, cc := range report.Currencies {
+		locks, err := n.sm.PersistenceService().ListPurchaseConversions(ctx, cc)
+		if err != nil {
+			n.sm.LogsService().Error(ctx, err.Error())
+			return err
+		}
+		ids := make([]string, 0, len(locks))
+		for id := range locks {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			lock := locks[id]
+			p, ok := byId[id]
+			switch {
+			case !ok && merged[id] != "":
+				report.Issues = append(report.Issues, &models.ConsistencyIssue{Kind: models.IssueOrphanedConversion, PurchaseId: id, CountryCurrencyDesc: cc,
+					Detail: fmt.Sprintf("the purchase was merged into the purchase '%s' as a duplicate", merged[id])})
+			case !ok:
+				report.Issues = append(report.Issues, &models.ConsistencyIssue{Kind: models.IssueOrphanedConversion, PurchaseId: id, CountryCurrencyDesc: cc, Detail: "the purchase was deleted or never created"})
+			case p.Amount != lock.OriginalAmount || p.Date != lock.PurchaseDate:
+				report.Issues = append(report.Issues, &models.ConsistencyIssue{
+					Kind:                models.IssueStaleConversion,
+					PurchaseId:          id,
+					CountryCurrencyDesc: cc,
+					Detail:              fmt.Sprintf("locked for %s on %s, the purchase is now %s on %s", lock.OriginalAmount, lock.PurchaseDate, p.Amount, p.Date),
+				})
+			}
+		}
+	}
+	return nil
+}
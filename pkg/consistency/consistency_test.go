@@ -0,0 +1,191 @@
+package consistency
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/exchangeservice"
+	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/persistence"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+// treasuryStub answers every date asked with rates, or fails with err.
+type treasuryStub struct {
+	services.TreasuryAccessService
+	rates []*models.ExchangeForDate
+	err   error
+}
+
+func (s *treasuryStub) WithServiceManager(sm services.ServiceManager) services.TreasuryAccessService {
+	return s
+}
+
+func (s *treasuryStub) GetExchangesForDate(ctx context.Context, date string) ([]*models.ExchangeForDate, error) {
+	return s.rates, s.err
+}
+
+func NewManagerForTests() (services.ServiceManager, context.Context) {
+	asyncWorkChannel := make(chan func() error)
+	stop := make(chan struct{})
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, logs.AppEnvKey, "TESTS")
+	ctx = context.WithValue(ctx, logs.AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.Version())
+	return services.NewManager(asyncWorkChannel, stop), ctx
+}
+
+type issue struct {
+	kind     string
+	id       string
+	repaired bool
+}
+
+func Test_consistencyCheckerFinal_Check(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	// p-2 got in with the signature of p-1, restored from a backup taken before the signature was unique.
+	snapshot := filepath.Join(t.TempDir(), "purchases.json")
+	if err := os.WriteFile(snapshot, []byte(`{"purchases": [
+		{"id": "p-1", "description": "Dinner", "amount": "20.13", "date": "2023-09-30", "signature": "20.13_2023-09-30_Dinner"},
+		{"id": "p-2", "description": "Dinner", "amount": "20.13", "date": "2023-09-30", "signature": "20.13_2023-09-30_Dinner"}
+	], "history": [
+		{"id": 1, "purchase_id": "p-1", "action": "created", "description": "Dinner", "amount": "20.13", "date": "2023-09-30", "changed_at": 1696000000},
+		{"id": 2, "purchase_id": "p-2", "action": "created", "description": "Dinner", "amount": "20.13", "date": "2023-09-30", "changed_at": 1696000060}
+	]}`), 0o600); err != nil {
+		t.Fatalf("an error '%s' was not expected when writing the snapshot", err)
+	}
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver, cfg.Database.Snapshot = models.DatabaseDriverMemory, snapshot
+	cfg.Exchange.DedupPolicy, cfg.Exchange.Currencies = models.DedupPolicySignature, "Brazil-Real"
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatalf("configService.Reconfigure() error = %v", err)
+	}
+	treasury := &treasuryStub{}
+	sm.WithDatabase(persistence.NewMemoryDatabase()).
+		WithPersistenceService(persistence.NewPersistenceService()).
+		WithTreasuryAccessService(treasury).
+		WithExchangeService(exchangeservice.NewExchangeService())
+	if err := sm.Database().Start(ctx); err != nil {
+		t.Fatalf("Database.Start() error = %v", err)
+	}
+
+	// p-3 has no rate collected, p-4 is converted by an override and p-8 and p-9 are two coffees created with no
+	// dedup policy, so they are never merged.
+	for _, p := range []*models.Purchase{
+		{Id: "p-3", Description: "Taxi", Amount: "10.00", Date: "2023-05-10"},
+		{Id: "p-4", Description: "Lunch", Amount: "15.00", Date: "2023-06-15"},
+		{Id: "p-5", Description: "Broken", Amount: "ten", Date: "2023-09-30"},
+		{Id: "p-6", Description: "Hotel", Amount: "300.00", Date: "2023-09-30"},
+		{Id: "p-7", Description: "Flight", Amount: "900.00", Date: "2023-09-30"},
+		{Id: "p-8", Description: "Coffee", Amount: "5.00", Date: "2023-09-30"},
+		{Id: "p-9", Description: "Coffee", Amount: "5.00", Date: "2023-09-30"},
+	} {
+		if _, _, err := sm.PersistenceService().InsertPurchase(ctx, p); err != nil {
+			t.Fatalf("InsertPurchase(%s) error = %v", p.Id, err)
+		}
+	}
+	rate := &models.ExchangeForDate{Date: "2023-09-30", CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "5.00"}
+	if err := sm.PersistenceService().InsertExchange(ctx, &models.Purchase{}, rate); err != nil {
+		t.Fatalf("InsertExchange() error = %v", err)
+	}
+	if _, err := sm.ExchangeService().CreateRateOverride(ctx, &models.RateOverride{CountryCurrencyDesc: "Brazil-Real", StartDate: "2023-06-01", EndDate: "2023-06-30",
+		ExchangeRate: "4.80", Reason: "missing quarter", CreatedBy: "finance"}); err != nil {
+		t.Fatalf("CreateRateOverride() error = %v", err)
+	}
+	// p-6 changes after its conversion is locked, p-7 is deleted and p-2 is merged into p-1 by the repair.
+	if _, err := sm.ExchangeService().LockConversions(ctx, []string{"p-2", "p-6", "p-7"}, "Brazil-Real"); err != nil {
+		t.Fatalf("LockConversions() error = %v", err)
+	}
+	if _, err := sm.PersistenceService().UpdatePurchase(ctx, "p-6", func(current *models.Purchase) (*models.Purchase, error) {
+		return &models.Purchase{Description: "Hotel", Amount: "320.00", Date: "2023-09-30"}, nil
+	}); err != nil {
+		t.Fatalf("UpdatePurchase() error = %v", err)
+	}
+	if err := sm.PersistenceService().DeletePurchase(ctx, "p-7"); err != nil {
+		t.Fatalf("DeletePurchase() error = %v", err)
+	}
+
+	checker := NewConsistencyChecker().WithServiceManager(sm)
+	tests := []struct {
+		name         string
+		repair       bool
+		treasuryErr  error
+		wantIssues   []issue
+		wantRepaired int
+	}{
+		{
+			name: "checkOnly",
+			wantIssues: []issue{
+				{kind: models.IssueUnparsableAmount, id: "p-5"},
+				{kind: models.IssueDuplicateSignature, id: "p-2"},
+				{kind: models.IssueDuplicateSignature, id: "p-9"},
+				{kind: models.IssueMissingRate, id: "p-3"},
+				{kind: models.IssueStaleConversion, id: "p-6"},
+				{kind: models.IssueOrphanedConversion, id: "p-7"},
+			},
+		},
+		{
+			name:        "repairWithTheTreasuryDown",
+			repair:      true,
+			treasuryErr: errors.New("treasury down"),
+			wantIssues: []issue{
+				{kind: models.IssueUnparsableAmount, id: "p-5"},
+				{kind: models.IssueDuplicateSignature, id: "p-2", repaired: true},
+				{kind: models.IssueDuplicateSignature, id: "p-9"},
+				{kind: models.IssueMissingRate, id: "p-3"},
+				{kind: models.IssueOrphanedConversion, id: "p-2"},
+				{kind: models.IssueStaleConversion, id: "p-6"},
+				{kind: models.IssueOrphanedConversion, id: "p-7"},
+			},
+			wantRepaired: 1,
+		},
+		{
+			name:   "repair",
+			repair: true,
+			wantIssues: []issue{
+				{kind: models.IssueUnparsableAmount, id: "p-5"},
+				{kind: models.IssueDuplicateSignature, id: "p-9"},
+				{kind: models.IssueMissingRate, id: "p-3", repaired: true},
+				{kind: models.IssueOrphanedConversion, id: "p-2"},
+				{kind: models.IssueStaleConversion, id: "p-6"},
+				{kind: models.IssueOrphanedConversion, id: "p-7"},
+			},
+			wantRepaired: 1,
+		},
+		{
+			name: "onlyTheUnrepairableLeft",
+			wantIssues: []issue{
+				{kind: models.IssueUnparsableAmount, id: "p-5"},
+				{kind: models.IssueDuplicateSignature, id: "p-9"},
+				{kind: models.IssueOrphanedConversion, id: "p-2"},
+				{kind: models.IssueStaleConversion, id: "p-6"},
+				{kind: models.IssueOrphanedConversion, id: "p-7"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			treasury.rates = []*models.ExchangeForDate{{Date: "2023-03-31", CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "4.90"}}
+			treasury.err = tt.treasuryErr
+			report, err := checker.Check(ctx, tt.repair)
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			got := make([]issue, len(report.Issues))
+			for i, is := range report.Issues {
+				got[i] = issue{kind: is.Kind, id: is.PurchaseId, repaired: is.Repaired}
+			}
+			if !reflect.DeepEqual(got, tt.wantIssues) {
+				t.Errorf("Check() issues = %v, want %v", got, tt.wantIssues)
+			}
+			if report.Repaired != tt.wantRepaired || report.Repair != tt.repair {
+				t.Errorf("Check() repaired = %d (repair %v), want %d (repair %v)", report.Repaired, report.Repair, tt.wantRepaired, tt.repair)
+			}
+		})
+	}
+}
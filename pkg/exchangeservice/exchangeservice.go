@@ -4,18 +4,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
 	"github.com/shopspring/decimal"
 )
 
+const (
+	importChunkSize = 500
+)
+
 type (
 	exchangeServiceFinal struct {
 		sm services.ServiceManager
 	}
+
+	// rateReader is where the exchange rates are read from, the RateCache or the PersistenceService.
+	rateReader interface {
+		GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error)
+		GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error)
+	}
 )
 
 func NewExchangeService() services.ExchangeService {
@@ -23,7 +35,7 @@ func NewExchangeService() services.ExchangeService {
 }
 
 func (n *exchangeServiceFinal) Start(ctx context.Context) error {
-	n.sm.LogsService().Info(ctx, "Exchange Service Started!")
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Exchange Service Started! Purchases dedup policy: '%s'", n.sm.ConfigService().Config().Exchange.DedupPolicy))
 	return nil
 }
 
@@ -35,6 +47,11 @@ func (n *exchangeServiceFinal) Healthy(ctx context.Context) error {
 	return nil
 }
 
+// Reconfigure accepts any settings, the dedup policy and the collect timeout are read when used.
+func (n *exchangeServiceFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
 func (n *exchangeServiceFinal) WithServiceManager(sm services.ServiceManager) services.ExchangeService {
 	n.sm = sm
 	return n
@@ -44,88 +61,494 @@ func (n *exchangeServiceFinal) ServiceManager() services.ServiceManager {
 	return n.sm
 }
 
-func (n *exchangeServiceFinal) HandleNewPurchase(ctx context.Context, p *models.Purchase) error {
-	if p == nil {
-		return errors.New("cannot insert nil Purchase")
+// rates returns the RateCache when one is registered, or else the PersistenceService.
+func (n *exchangeServiceFinal) rates() rateReader {
+	if cache, err := services.Get[services.RateCache](n.sm, services.RateCacheName); err == nil {
+		return cache
 	}
-	if exists, _ := n.sm.PersistenceService().ExistsBySignature(ctx, p.Signature()); exists {
-		return nil
+	return n.sm.PersistenceService()
+}
+
+// staleRates tells if a stale rate can be used while the Treasury API is unavailable, see models.StaleRatesNewest.
+func (n *exchangeServiceFinal) staleRates() bool {
+	return n.sm.ConfigService().Config().Exchange.StaleRates == models.StaleRatesNewest
+}
+
+// deduplicate tells if purchases with the same signature must be merged, see models.DedupPolicySignature.
+func (n *exchangeServiceFinal) deduplicate() bool {
+	return n.sm.ConfigService().Config().Exchange.DedupPolicy == models.DedupPolicySignature
+}
+
+func (n *exchangeServiceFinal) HandleNewPurchase(ctx context.Context, p *models.Purchase) (string, bool, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.HandleNewPurchase")
+	defer span.End()
+	if p == nil {
+		return "", false, errors.New("cannot insert nil Purchase")
 	}
 	if p.Id == "" {
 		p.Id = uuid.NewString()
 	}
+	ctx = services.WithPurchaseID(ctx, p.Id)
+	p.Deduplicate = n.deduplicate()
 
-	err := n.sm.PersistenceService().InsertPurchase(ctx, p)
+	id, created, err := n.sm.PersistenceService().InsertPurchase(ctx, p)
 	if err != nil {
-		return err
+		return "", false, err
+	}
+	if !created {
+		n.sm.MetricsService().PurchasesInserted(0, 1)
+		n.sm.LogsService().Info(ctx, "Purchase with the same signature already exists", "signature", p.Signature(), services.PurchaseIDKey, id)
+		return id, false, nil
 	}
 
-	asynContext, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	go func() {
-		n.sm.AsyncWorkChannel() <- func() error { //async collect and persist  ...
-			defer cancel()
-			n.sm.LogsService().Info(ctx, "starting async collect of exchanges..")
-			exchanges, err := n.CollectExchangeRatesForPurchase(ctx, p)
-			if err != nil {
-				n.sm.LogsService().Error(ctx, err.Error())
-				return err
+	n.sm.MetricsService().PurchasesInserted(1, 0)
+	n.collectExchangeRatesAsync(ctx, p)
+	return id, true, nil
+}
+
+// ImportPurchases reads every row of d and inserts the valid ones in chunks of importChunkSize purchases, one
+// transaction per chunk. The exchange rates for all the new purchases are collected once, when the import ends.
+func (n *exchangeServiceFinal) ImportPurchases(ctx context.Context, d services.PurchaseDecoder) (*models.ImportReport, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.ImportPurchases")
+	defer span.End()
+	report := models.NewImportReport()
+	var created, chunk []*models.Purchase
+	var lines []int
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		results, err := n.sm.PersistenceService().BatchInsertPurchases(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		for i, r := range results {
+			switch {
+			case r.Err != nil:
+				report.Rejected = append(report.Rejected, &models.ImportLine{Line: lines[i], Id: chunk[i].Id, Message: r.Err.Error()})
+			case r.Created:
+				report.Accepted = append(report.Accepted, &models.ImportLine{Line: lines[i], Id: r.Id})
+				created = append(created, chunk[i])
+			default:
+				report.Duplicated = append(report.Duplicated, &models.ImportLine{Line: lines[i], Id: r.Id})
 			}
+		}
+		chunk, lines = nil, nil
+		return nil
+	}
 
-			return n.sm.PersistenceService().BatchInsertExchanges(asynContext, p, exchanges)
+	var err error
+	for {
+		var row *models.ImportRow
+		if row, err = d.Next(); err != nil {
+			break
 		}
-	}()
+		if row.Err != nil {
+			report.Rejected = append(report.Rejected, &models.ImportLine{Line: row.Line, Message: row.Err.Error()})
+			continue
+		}
+		p := row.Purchase
+		if p.Id == "" {
+			p.Id = uuid.NewString()
+		}
+		p.Deduplicate = n.deduplicate()
+		if verr := p.Validate(); verr != nil {
+			report.Rejected = append(report.Rejected, &models.ImportLine{Line: row.Line, Id: p.Id, Message: verr.Error()})
+			continue
+		}
+		chunk = append(chunk, p)
+		lines = append(lines, row.Line)
+		if len(chunk) == importChunkSize {
+			if err = flush(); err != nil {
+				break
+			}
+		}
+	}
+	if err == io.EOF {
+		err = flush()
+	}
+
+	// even when the import stopped in the middle, the chunks already commited need their exchange rates.
+	if len(created) > 0 {
+		n.collectExchangeRatesAsync(ctx, created...)
+	}
+	n.sm.MetricsService().PurchasesInserted(len(report.Accepted), len(report.Duplicated))
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Import stopped: %s", err.Error()))
+		return report, err
+	}
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Import finished: %d accepted, %d duplicated, %d rejected", len(report.Accepted), len(report.Duplicated), len(report.Rejected)))
+	return report, nil
+}
+
+func (n *exchangeServiceFinal) UpdatePurchase(ctx context.Context, id string, patch *models.PurchasePatch) (*models.Purchase, error) {
+	ctx, span := n.sm.TracingService().StartSpan(services.WithPurchaseID(ctx, id), "ExchangeService.UpdatePurchase")
+	defer span.End()
+	if patch == nil || patch.IsEmpty() {
+		return nil, fmt.Errorf("%w: nothing to update", messages.ErrInvalidPurchase)
+	}
+	// the patch is applied to the purchase as it is in the transaction, so a concurrent update is never lost.
+	var currentDate string
+	updated, err := n.sm.PersistenceService().UpdatePurchase(ctx, id, func(current *models.Purchase) (*models.Purchase, error) {
+		currentDate = current.Date
+		updated := patch.Apply(current)
+		updated.Deduplicate = n.deduplicate()
+		return updated, updated.Validate()
+	})
+	if errors.Is(err, messages.ErrInvalidPurchase) {
+		return nil, err
+	}
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+
+	if updated.Date != currentDate {
+		n.collectExchangeRatesAsync(ctx, updated)
+	}
+	return updated, nil
+}
+
+func (n *exchangeServiceFinal) DeletePurchase(ctx context.Context, id string) error {
+	ctx, span := n.sm.TracingService().StartSpan(services.WithPurchaseID(ctx, id), "ExchangeService.DeletePurchase")
+	defer span.End()
+	if err := n.sm.PersistenceService().DeletePurchase(ctx, id); err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return err
+	}
 	return nil
 }
 
+func (n *exchangeServiceFinal) GetPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error) {
+	ctx, span := n.sm.TracingService().StartSpan(services.WithPurchaseID(ctx, id), "ExchangeService.GetPurchaseHistory")
+	defer span.End()
+	history, err := n.sm.PersistenceService().ListPurchaseHistory(ctx, id)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	return history, nil
+}
+
+func (n *exchangeServiceFinal) GetExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.GetExchangeRevisions")
+	defer span.End()
+	revisions, err := n.sm.PersistenceService().ListExchangeRevisions(ctx, countrycurrency, date)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// collectExchangeRatesAsync loads, in the background, the exchange rates that may be needed to convert the purchases.
+// The rates are collected only once for each distinct date, all of them in a single async work.
+func (n *exchangeServiceFinal) collectExchangeRatesAsync(ctx context.Context, ps ...*models.Purchase) {
+	seen := make(map[string]bool)
+	var toCollect []*models.Purchase
+	for _, p := range ps {
+		if !seen[p.Date] {
+			seen[p.Date] = true
+			toCollect = append(toCollect, p)
+		}
+	}
+	n.sm.SubmitAsyncWork(ctx, func(ctx context.Context) error { //async collect and persist  ...
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(len(toCollect))*n.sm.ConfigService().Config().Exchange.CollectTimeout)
+		defer cancel()
+		n.sm.LogsService().Info(ctx, "starting async collect of exchanges", "dates", len(toCollect))
+		var lastErr error
+		for _, p := range toCollect {
+			pctx := services.WithPurchaseID(ctx, p.Id)
+			exchanges, err := n.CollectExchangeRatesForPurchase(pctx, p)
+			if err == nil {
+				err = n.sm.PersistenceService().BatchInsertExchanges(pctx, p, exchanges)
+			}
+			if err != nil {
+				// one date failing must not stop the collect of the others.
+				n.sm.LogsService().Error(pctx, err.Error(), "date", p.Date)
+				lastErr = err
+			}
+		}
+		return lastErr
+	})
+}
+
 func (n *exchangeServiceFinal) GetAllPurchases(ctx context.Context, countrycurrency string) ([]*models.ConvertedAmount, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.GetAllPurchases")
+	defer span.End()
 	purchases, err := n.sm.PersistenceService().ListAllPurchases(ctx)
 	if err != nil {
 		n.sm.LogsService().Error(ctx, err.Error())
 		return services.EmptyConvertedPurchasesSlice, err
 	}
 
-	var converteds []*models.ConvertedAmount
+	locks, err := n.sm.PersistenceService().ListPurchaseConversions(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	overrides, err := n.overridesOf(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+
+	// the rates of all the dates are looked up at once, not one query for each purchase, the locked and
+	// overridden ones need none. A rate out of the window of its purchase is handled like in SearchPurchasesById.
+	dates := make([]string, 0, len(purchases))
 	for _, v := range purchases {
-		exchange, err := n.sm.PersistenceService().GetExchangeRateForCountryCurrencyAndDate(ctx, countrycurrency, v.Date)
-		if err != nil {
-			n.sm.LogsService().Error(ctx, err.Error())
-			return nil, err
+		if !lockUsable(ctx, locks[v.Id]) && overrideFor(overrides, v.Date) == nil {
+			dates = append(dates, v.Date)
 		}
+	}
+	rates, err := n.rates().GetExchangeRatesForCountryCurrencyAndDates(ctx, countrycurrency, dates)
+	if err != nil {
+		n.sm.MetricsService().ConversionFailed(countrycurrency)
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
 
-		c, err := n.convertPurchaseByExchangeRate(ctx, v, exchange.ExchangeRate)
+	var converteds []*models.ConvertedAmount
+	for _, v := range purchases {
+		if lock := locks[v.Id]; lockUsable(ctx, lock) {
+			converteds = append(converteds, lockedConversion(v, lock))
+			continue
+		}
+		if o := overrideFor(overrides, v.Date); o != nil {
+			c, err := n.convertByOverride(ctx, v, o)
+			if err != nil {
+				n.sm.MetricsService().ConversionFailed(countrycurrency)
+				n.sm.LogsService().Error(ctx, err.Error())
+				return services.EmptyConvertedPurchasesSlice, err
+			}
+			converteds = append(converteds, c)
+			continue
+		}
+		c, rateDate, err := n.convertByStoredRate(services.WithPurchaseID(ctx, v.Id), v, countrycurrency, rates[v.Date])
 		if err != nil {
-			n.sm.LogsService().Error(ctx, err.Error())
 			return services.EmptyConvertedPurchasesSlice, err
 		}
+		if !c.Degraded {
+			// the rate collected for the date, if it was, converts the next purchases of the date too.
+			rates[v.Date] = &models.ExchangeForDate{Date: rateDate, CountryCurrencyDesc: countrycurrency, ExchangeRate: c.ExchangeRate}
+		}
 		converteds = append(converteds, c)
 	}
 	return converteds, nil
 }
 
+// StreamAllPurchases converts the purchases one at a time, as they are read from the database, handing each one to fn.
+func (n *exchangeServiceFinal) StreamAllPurchases(ctx context.Context, countrycurrency string, fn func(c *models.ConvertedAmount) error) error {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.StreamAllPurchases")
+	defer span.End()
+	locks, err := n.sm.PersistenceService().ListPurchaseConversions(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return err
+	}
+	overrides, err := n.overridesOf(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return err
+	}
+	err = n.sm.PersistenceService().StreamAllPurchases(ctx, func(p *models.Purchase) error {
+		if lock := locks[p.Id]; lockUsable(ctx, lock) {
+			return fn(lockedConversion(p, lock))
+		}
+		if o := overrideFor(overrides, p.Date); o != nil {
+			c, err := n.convertByOverride(ctx, p, o)
+			if err != nil {
+				n.sm.MetricsService().ConversionFailed(countrycurrency)
+				return err
+			}
+			return fn(c)
+		}
+		pctx := services.WithPurchaseID(ctx, p.Id)
+		stored, err := n.storedRate(pctx, countrycurrency, p.Date)
+		if err != nil {
+			n.sm.MetricsService().ConversionFailed(countrycurrency)
+			return err
+		}
+		c, _, err := n.convertByStoredRate(pctx, p, countrycurrency, stored)
+		if err != nil {
+			return err
+		}
+		return fn(c)
+	})
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+	}
+	return err
+}
+
 func (n *exchangeServiceFinal) SearchPurchasesById(ctx context.Context, id string, countrycurrency string) (*models.ConvertedAmount, error) {
+	ctx, span := n.sm.TracingService().StartSpan(services.WithPurchaseID(ctx, id), "ExchangeService.SearchPurchasesById")
+	defer span.End()
 	purchase, err := n.sm.PersistenceService().GetPurchaseById(ctx, id)
 	if err != nil {
 		n.sm.LogsService().Error(ctx, err.Error())
 		return nil, err
 	}
 
-	exchange, err := n.sm.PersistenceService().GetExchangeRateForCountryCurrencyAndDate(ctx, countrycurrency, purchase.Date)
-	if err != nil {
+	lock, err := n.sm.PersistenceService().GetPurchaseConversion(ctx, id, countrycurrency)
+	if err != nil && !errors.Is(err, messages.ErrNoConversionFound) {
 		n.sm.LogsService().Error(ctx, err.Error())
 		return nil, err
 	}
-	if exchange == nil {
+	if lockUsable(ctx, lock) {
+		return lockedConversion(purchase, lock), nil
+	}
+	c, _, err := n.convertPurchase(ctx, purchase, countrycurrency)
+	return c, err
+}
+
+// convertPurchase converts the purchase by the rate override of its date, or else by the rate stored for its date,
+// collecting it from the Treasury API when none can convert it. It returns the date the rate is effective on too.
+func (n *exchangeServiceFinal) convertPurchase(ctx context.Context, purchase *models.Purchase, countrycurrency string) (*models.ConvertedAmount, string, error) {
+	overrides, err := n.overridesOf(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, "", err
+	}
+	if o := overrideFor(overrides, purchase.Date); o != nil {
+		c, err := n.convertByOverride(ctx, purchase, o)
+		if err != nil {
+			n.sm.MetricsService().ConversionFailed(countrycurrency)
+			return nil, "", err
+		}
+		return c, o.StartDate, nil
+	}
+
+	stored, err := n.storedRate(ctx, countrycurrency, purchase.Date)
+	if err != nil {
+		n.sm.MetricsService().ConversionFailed(countrycurrency)
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, "", err
+	}
+	return n.convertByStoredRate(ctx, purchase, countrycurrency, stored)
+}
+
+// storedRate returns the nearest rate stored on or before date, nil when there is none.
+func (n *exchangeServiceFinal) storedRate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
+	stored, err := n.rates().GetExchangeRateForCountryCurrencyAndDate(ctx, countrycurrency, date)
+	if errors.Is(err, messages.ErrNoExchangeFound) {
+		return nil, nil
+	}
+	return stored, err
+}
+
+// convertByStoredRate converts the purchase by stored, the nearest rate stored on or before its date, when it is
+// within its 6 months. Otherwise the rate is collected from the Treasury API, and while it is unavailable stored
+// is used anyway with exchange.staleRates, the conversion marked as degraded. It returns the date the rate is
+// effective on too. Every path converting by the stored rates goes through it, one purchase or all of them.
+func (n *exchangeServiceFinal) convertByStoredRate(ctx context.Context, purchase *models.Purchase, countrycurrency string, stored *models.ExchangeForDate) (*models.ConvertedAmount, string, error) {
+	var err error
+	exchange, degraded := stored, false
+	if _, ok := services.AsOf(ctx); ok && (exchange == nil || !models.WithinSixMonths(exchange.Date, purchase.Date)) {
+		// the conversion reported then, so no rate is collected now.
+		n.sm.MetricsService().ConversionFailed(countrycurrency)
+		return nil, "", fmt.Errorf("the purchase cannot be converted to %s: %w", countrycurrency, messages.ErrNoExchangeFound)
+	}
+	if exchange == nil || !models.WithinSixMonths(exchange.Date, purchase.Date) {
+		// no stored rate can convert it, the Treasury API may have one.
 		exchange, err = n.CollectSpecificExchangeRateForPurchase(ctx, purchase, countrycurrency)
+		if err != nil && stored != nil && errors.Is(err, messages.ErrSwApiUnavailableError) && n.staleRates() {
+			n.sm.MetricsService().ConversionDegraded(countrycurrency)
+			n.sm.LogsService().Warn(ctx, "converting by a stale rate, the Treasury API is unavailable", "rate_date", stored.Date)
+			exchange, degraded, err = stored, true, nil
+		}
 		if err != nil {
+			n.sm.MetricsService().ConversionFailed(countrycurrency)
 			n.sm.LogsService().Error(ctx, err.Error())
+			return nil, "", fmt.Errorf("the purchase cannot be converted to %s: %w", countrycurrency, err)
+		}
+	}
+
+	c, err := n.convertPurchaseByExchangeRate(ctx, purchase, exchange.ExchangeRate)
+	if err != nil {
+		n.sm.MetricsService().ConversionFailed(countrycurrency)
+		return nil, "", err
+	}
+	if degraded {
+		c.Degraded, c.RateDate = true, exchange.Date
+	}
+	return c, exchange.Date, nil
+}
+
+// LockConversions converts the purchases and locks the conversions, a purchase already locked keeps its lock. A
+// conversion by a stale rate is not locked, so the operation fails while the Treasury API is unavailable.
+func (n *exchangeServiceFinal) LockConversions(ctx context.Context, ids []string, countrycurrency string) ([]*models.ConvertedAmount, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.LockConversions")
+	defer span.End()
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: no purchase to lock", messages.ErrInvalidPurchase)
+	}
+
+	seen := make(map[string]bool)
+	purchases := make(map[string]*models.Purchase)
+	var conversions []*models.PurchaseConversion
+	lockedAt := time.Now().UnixMilli()
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		pctx := services.WithPurchaseID(ctx, id)
+		purchase, err := n.sm.PersistenceService().GetPurchaseById(pctx, id)
+		if err != nil {
+			n.sm.LogsService().Error(pctx, err.Error())
+			return nil, err
+		}
+		purchases[id] = purchase
+
+		// the conversion locked before is the one reported, the persistence keeps it.
+		if lock, err := n.sm.PersistenceService().GetPurchaseConversion(pctx, id, countrycurrency); err == nil {
+			conversions = append(conversions, lock)
+			continue
+		} else if !errors.Is(err, messages.ErrNoConversionFound) {
+			n.sm.LogsService().Error(pctx, err.Error())
+			return nil, err
+		}
+		c, rateDate, err := n.convertPurchase(pctx, purchase, countrycurrency)
+		if err != nil {
 			return nil, err
 		}
+		if c.Degraded {
+			return nil, fmt.Errorf("a conversion to %s by a stale rate cannot be locked: %w", countrycurrency, messages.ErrSwApiUnavailableError)
+		}
+		provider := models.ConversionProviderTreasury
+		if c.Provider != "" {
+			provider = c.Provider
+		}
+		conversions = append(conversions, &models.PurchaseConversion{
+			PurchaseId:          id,
+			CountryCurrencyDesc: countrycurrency,
+			OriginalAmount:      c.OriginalAmount,
+			PurchaseDate:        c.PurchaseDate,
+			ExchangeRate:        c.ExchangeRate,
+			RateDate:            rateDate,
+			Provider:            provider,
+			ConvertedAmount:     c.ConvertedAmount,
+			LockedAt:            lockedAt,
+		})
 	}
 
-	return n.convertPurchaseByExchangeRate(ctx, purchase, exchange.ExchangeRate)
+	locks, err := n.sm.PersistenceService().LockConversions(ctx, conversions)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	locked := make([]*models.ConvertedAmount, len(locks))
+	for i, lock := range locks {
+		locked[i] = lockedConversion(purchases[lock.PurchaseId], lock)
+	}
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Conversions locked to %s: %d", countrycurrency, len(locked)))
+	return locked, nil
 }
 
 func (n *exchangeServiceFinal) CollectExchangeRatesForPurchase(ctx context.Context, p *models.Purchase) ([]*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.CollectExchangeRatesForPurchase")
+	defer span.End()
 
 	exchanges, err := n.sm.TreasuryAccessService().GetExchangesForDate(ctx, p.Date)
 	if err != nil {
@@ -138,6 +561,8 @@ func (n *exchangeServiceFinal) CollectExchangeRatesForPurchase(ctx context.Conte
 }
 
 func (n *exchangeServiceFinal) CollectSpecificExchangeRateForPurchase(ctx context.Context, p *models.Purchase, countrycurrency string) (*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.CollectSpecificExchangeRateForPurchase")
+	defer span.End()
 
 	exchange, err := n.sm.TreasuryAccessService().GetSpecificExchangeForDateAndCurrency(ctx, p.Date, countrycurrency)
 	if err != nil {
@@ -148,8 +573,8 @@ func (n *exchangeServiceFinal) CollectSpecificExchangeRateForPurchase(ctx contex
 
 	err = n.sm.PersistenceService().InsertExchange(ctx, p, exchange)
 	if err != nil {
-		msg := fmt.Sprintf("Error Inserting specific exchange for signature '%s': %s", p.Signature(), err.Error())
-		n.sm.LogsService().Error(ctx, msg)
+		msg := fmt.Sprintf("Error Inserting specific exchange: %s", err.Error())
+		n.sm.LogsService().Error(ctx, msg, "signature", p.Signature())
 		return nil, err
 	}
 
@@ -164,7 +589,7 @@ func (n *exchangeServiceFinal) convertPurchaseByExchangeRate(ctx context.Context
 
 	originalAmount, err := decimal.NewFromString(p.Amount)
 	if err != nil {
-		return nil, fmt.Errorf("error converting the original Amount '%s' to decimal: %s ", p.Amount, err.Error())
+		return nil, fmt.Errorf("error converting the original Amount to decimal: %s ", err.Error())
 	}
 
 	convertedAmount := originalAmount.Mul(exchangeRate).Round(2)
@@ -178,3 +603,123 @@ func (n *exchangeServiceFinal) convertPurchaseByExchangeRate(ctx context.Context
 		ConvertedAmount: convertedAmount.String(),
 	}, nil
 }
+
+func (n *exchangeServiceFinal) CreateRateOverride(ctx context.Context, o *models.RateOverride) (*models.RateOverride, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.CreateRateOverride")
+	defer span.End()
+	if o == nil {
+		return nil, fmt.Errorf("%w: nothing to create", messages.ErrInvalidOverride)
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	o.CreatedAt = time.Now().UnixMilli()
+	created, err := n.sm.PersistenceService().CreateRateOverride(ctx, o)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	return created, nil
+}
+
+func (n *exchangeServiceFinal) RemoveRateOverride(ctx context.Context, id int64, actor string, reason string) (*models.RateOverride, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.RemoveRateOverride")
+	defer span.End()
+	if err := models.ValidateOverrideChange(actor, reason); err != nil {
+		return nil, err
+	}
+	removed, err := n.sm.PersistenceService().RemoveRateOverride(ctx, id, actor, reason)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (n *exchangeServiceFinal) ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.ListRateOverrides")
+	defer span.End()
+	overrides, err := n.sm.PersistenceService().ListRateOverrides(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	return overrides, nil
+}
+
+func (n *exchangeServiceFinal) GetRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "ExchangeService.GetRateOverrideAudit")
+	defer span.End()
+	audit, err := n.sm.PersistenceService().ListRateOverrideAudit(ctx, countrycurrency)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, err.Error())
+		return nil, err
+	}
+	return audit, nil
+}
+
+// overridesOf returns the rate overrides of countrycurrency in use, the oldest first: the ones not removed, or with
+// a context given by services.WithAsOf the ones in use then.
+func (n *exchangeServiceFinal) overridesOf(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	overrides, err := n.sm.PersistenceService().ListRateOverrides(ctx, countrycurrency)
+	if err != nil {
+		return nil, err
+	}
+	asOf, ok := services.AsOf(ctx)
+	inUse := overrides[:0]
+	for _, o := range overrides {
+		used := o.RemovedAt == 0
+		if ok {
+			used = o.CreatedAt <= asOf.UnixMilli() && (o.RemovedAt == 0 || o.RemovedAt > asOf.UnixMilli())
+		}
+		if used {
+			inUse = append(inUse, o)
+		}
+	}
+	return inUse, nil
+}
+
+// overrideFor returns the newest of the overrides converting a purchase made on date, nil when none does.
+func overrideFor(overrides []*models.RateOverride, date string) *models.RateOverride {
+	for i := len(overrides) - 1; i >= 0; i-- {
+		if overrides[i].Covers(date) {
+			return overrides[i]
+		}
+	}
+	return nil
+}
+
+// convertByOverride converts p by the rate of the override, saying so in the ConvertedAmount.
+func (n *exchangeServiceFinal) convertByOverride(ctx context.Context, p *models.Purchase, o *models.RateOverride) (*models.ConvertedAmount, error) {
+	c, err := n.convertPurchaseByExchangeRate(ctx, p, o.ExchangeRate)
+	if err != nil {
+		return nil, err
+	}
+	c.Provider, c.RateDate, c.OverrideId = models.ConversionProviderOverride, o.StartDate, o.Id
+	return c, nil
+}
+
+// lockUsable tells if the purchase conversion lock answers for the purchase: always, unless the context given by
+// services.WithAsOf asks for a time before the lock.
+func lockUsable(ctx context.Context, lock *models.PurchaseConversion) bool {
+	if lock == nil {
+		return false
+	}
+	asOf, ok := services.AsOf(ctx)
+	return !ok || lock.LockedAt <= asOf.UnixMilli()
+}
+
+// lockedConversion is the conversion of p as it was locked, only the description is the current one.
+func lockedConversion(p *models.Purchase, lock *models.PurchaseConversion) *models.ConvertedAmount {
+	return &models.ConvertedAmount{
+		Id:              p.Id,
+		Description:     p.Description,
+		PurchaseDate:    lock.PurchaseDate,
+		OriginalAmount:  lock.OriginalAmount,
+		ExchangeRate:    lock.ExchangeRate,
+		ConvertedAmount: lock.ConvertedAmount,
+		Locked:          true,
+		RateDate:        lock.RateDate,
+		Provider:        lock.Provider,
+	}
+}
@@ -2,11 +2,19 @@ package exchangeservice
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/persistence"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
 )
 
@@ -50,13 +58,49 @@ var (
 	}}
 )
 
+type sliceDecoder struct {
+	rows []*models.ImportRow
+	err  error
+}
+
+func (d *sliceDecoder) Next() (*models.ImportRow, error) {
+	if len(d.rows) == 0 {
+		if d.err != nil {
+			return nil, d.err
+		}
+		return nil, io.EOF
+	}
+	row := d.rows[0]
+	d.rows = d.rows[1:]
+	return row, nil
+}
+
+// treasuryStub answers every rate asked with rate, or fails with err.
+type treasuryStub struct {
+	services.TreasuryAccessService
+	rate *models.ExchangeForDate
+	err  error
+}
+
+func (s *treasuryStub) WithServiceManager(sm services.ServiceManager) services.TreasuryAccessService {
+	return s
+}
+
+func (s *treasuryStub) GetSpecificExchangeForDateAndCurrency(ctx context.Context, date string, countrycurrency string) (*models.ExchangeForDate, error) {
+	return s.rate, s.err
+}
+
+func importRow(line int, id string, amount string) *models.ImportRow {
+	return &models.ImportRow{Line: line, Purchase: &models.Purchase{Id: id, Description: "Some transaction", Amount: amount, Date: "2023-09-30"}}
+}
+
 func NewManagerForTests() (services.ServiceManager, context.Context) {
 	asyncWorkChannel := make(chan func() error)
 	stop := make(chan struct{})
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, logs.AppEnvKey, "TESTS")
-	ctx = context.WithValue(ctx, logs.AppNameKey, logs.AppName)
-	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.AppVersion)
+	ctx = context.WithValue(ctx, logs.AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.Version())
 	return services.NewManager(asyncWorkChannel, stop), ctx
 }
 
@@ -73,7 +117,7 @@ func Test_exchangeServiceFinal_Start(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name:    "success", //here is just the success case is needed because ExchangeService.Start(ctx) does nothing with the ctx yet
+			name:    "success",
 			args:    args{ctx: ctx},
 			n:       sm.WithExchangeService(NewExchangeService()).ExchangeService().(*exchangeServiceFinal),
 			wantErr: false,
@@ -203,6 +247,37 @@ func Test_exchangeServiceFinal_ServiceManager(t *testing.T) {
 	}
 }
 
+func Test_exchangeServiceFinal_rates(t *testing.T) {
+	withoutCache, _ := NewManagerForTests()
+	withCache, _ := NewManagerForTests()
+	cache := services.NewNoOpsRateCache().WithServiceManager(withCache)
+	withCache.Register(services.RateCacheName, cache, services.PersistenceServiceName)
+	tests := []struct {
+		name string
+		sm   services.ServiceManager
+		want rateReader
+	}{
+		{
+			name: "persistenceWithoutCache",
+			sm:   withoutCache,
+			want: withoutCache.PersistenceService(),
+		},
+		{
+			name: "registeredCache",
+			sm:   withCache,
+			want: cache,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewExchangeService().WithServiceManager(tt.sm).(*exchangeServiceFinal)
+			if got := n.rates(); got != tt.want {
+				t.Errorf("exchangeServiceFinal.rates() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
 func Test_exchangeServiceFinal_HandleNewPurchase(t *testing.T) {
 	type args struct {
 		ctx context.Context
@@ -211,17 +286,20 @@ func Test_exchangeServiceFinal_HandleNewPurchase(t *testing.T) {
 	sm, ctx := NewManagerForTests()
 	pf := NewExchangeService().WithServiceManager(sm)
 	tests := []struct {
-		name    string
-		n       *exchangeServiceFinal
-		args    args
-		want    *models.Purchase
-		wantErr bool
+		name        string
+		n           *exchangeServiceFinal
+		args        args
+		wantId      string
+		wantCreated bool
+		wantErr     bool
 	}{
 		{
-			name:    "success",
-			args:    args{ctx: ctx, p: basicPurchase},
-			n:       pf.(*exchangeServiceFinal),
-			wantErr: false,
+			name:        "success",
+			args:        args{ctx: ctx, p: basicPurchase},
+			n:           pf.(*exchangeServiceFinal),
+			wantId:      basicPurchase.Id,
+			wantCreated: true,
+			wantErr:     false,
 		},
 		{
 			name:    "returnNilCallingTreasuryAccessService",
@@ -232,11 +310,14 @@ func Test_exchangeServiceFinal_HandleNewPurchase(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := tt.n.HandleNewPurchase(tt.args.ctx, tt.args.p)
+			id, created, err := tt.n.HandleNewPurchase(tt.args.ctx, tt.args.p)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("%s: exchangeServiceFinal.HandleNewPurchase() error = %v", tt.name, err)
 				return
 			}
+			if id != tt.wantId || created != tt.wantCreated {
+				t.Errorf("%s: exchangeServiceFinal.HandleNewPurchase() = (%s, %v), want (%s, %v)", tt.name, id, created, tt.wantId, tt.wantCreated)
+			}
 		})
 	}
 }
@@ -286,6 +367,381 @@ func Test_exchangeServiceFinal_SearchPurchasesById(t *testing.T) {
 	}
 }
 
+// Test_exchangeServiceFinal_staleRates converts a purchase by each path, one purchase or all of them, which must
+// all apply the same 6 months window and degraded handling.
+func Test_exchangeServiceFinal_staleRates(t *testing.T) {
+	paths := []struct {
+		name    string
+		convert func(ctx context.Context, es services.ExchangeService, countrycurrency string) (*models.ConvertedAmount, error)
+	}{
+		{
+			name: "SearchPurchasesById",
+			convert: func(ctx context.Context, es services.ExchangeService, countrycurrency string) (*models.ConvertedAmount, error) {
+				return es.SearchPurchasesById(ctx, basicPurchase.Id, countrycurrency)
+			},
+		},
+		{
+			name: "GetAllPurchases",
+			convert: func(ctx context.Context, es services.ExchangeService, countrycurrency string) (*models.ConvertedAmount, error) {
+				all, err := es.GetAllPurchases(ctx, countrycurrency)
+				if err != nil {
+					return nil, err
+				}
+				return all[0], nil
+			},
+		},
+		{
+			name: "StreamAllPurchases",
+			convert: func(ctx context.Context, es services.ExchangeService, countrycurrency string) (*models.ConvertedAmount, error) {
+				var got *models.ConvertedAmount
+				err := es.StreamAllPurchases(ctx, countrycurrency, func(c *models.ConvertedAmount) error {
+					got = c
+					return nil
+				})
+				return got, err
+			},
+		},
+	}
+	unavailable := fmt.Errorf("%w: status 503", messages.ErrSwApiUnavailableError)
+	noRate := fmt.Errorf("%w: Brazil-Real", messages.ErrNoExchangeFound)
+	tests := []struct {
+		name         string
+		staleRates   string
+		storedDate   string
+		treasury     *treasuryStub
+		wantRate     string
+		wantDegraded bool
+		wantErr      error
+	}{
+		{
+			name:       "storedInsideTheWindow",
+			staleRates: models.StaleRatesNone,
+			storedDate: "2023-06-30",
+			treasury:   &treasuryStub{err: unavailable},
+			wantRate:   "4.90",
+		},
+		{
+			name:       "collectedFromTreasury",
+			staleRates: models.StaleRatesNewest,
+			storedDate: "2022-12-31",
+			treasury:   &treasuryStub{rate: basicExchange},
+			wantRate:   basicExchange.ExchangeRate,
+		},
+		{
+			name:       "treasuryUnavailable",
+			staleRates: models.StaleRatesNone,
+			storedDate: "2022-12-31",
+			treasury:   &treasuryStub{err: unavailable},
+			wantErr:    messages.ErrSwApiUnavailableError,
+		},
+		{
+			name:         "staleRateWhileTreasuryUnavailable",
+			staleRates:   models.StaleRatesNewest,
+			storedDate:   "2022-12-31",
+			treasury:     &treasuryStub{err: unavailable},
+			wantRate:     "4.90",
+			wantDegraded: true,
+		},
+		{
+			name:       "noRateInTheWindow",
+			staleRates: models.StaleRatesNewest,
+			storedDate: "2022-12-31",
+			treasury:   &treasuryStub{err: noRate},
+			wantErr:    messages.ErrNoExchangeFound,
+		},
+	}
+	for _, path := range paths {
+		for _, tt := range tests {
+			t.Run(path.name+"/"+tt.name, func(t *testing.T) {
+				sm, ctx := NewManagerForTests()
+				cfg := models.DefaultConfig()
+				cfg.Database.Driver, cfg.Exchange.StaleRates = models.DatabaseDriverMemory, tt.staleRates
+				if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+					t.Fatal(err)
+				}
+				sm.WithDatabase(persistence.NewMemoryDatabase()).
+					WithPersistenceService(persistence.NewPersistenceService()).
+					WithTreasuryAccessService(tt.treasury).
+					WithExchangeService(NewExchangeService())
+				if err := sm.Database().Start(ctx); err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := sm.PersistenceService().InsertPurchase(ctx, basicPurchase); err != nil {
+					t.Fatal(err)
+				}
+				stored := &models.ExchangeForDate{CountryCurrencyDesc: basicExchange.CountryCurrencyDesc, ExchangeRate: "4.90", Date: tt.storedDate}
+				if err := sm.PersistenceService().InsertExchange(ctx, basicPurchase, stored); err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := path.convert(ctx, sm.ExchangeService(), basicExchange.CountryCurrencyDesc)
+				if tt.wantErr != nil {
+					if !errors.Is(err, tt.wantErr) {
+						t.Errorf("%s() error = %v, want %v", path.name, err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s() error = %v", path.name, err)
+				}
+				if got.ExchangeRate != tt.wantRate || got.Degraded != tt.wantDegraded {
+					t.Errorf("%s() = %+v, want rate %s and degraded %v", path.name, got, tt.wantRate, tt.wantDegraded)
+				}
+				if tt.wantDegraded && got.RateDate != tt.storedDate {
+					t.Errorf("%s().RateDate = %s, want %s", path.name, got.RateDate, tt.storedDate)
+				}
+			})
+		}
+	}
+}
+
+func Test_exchangeServiceFinal_SearchPurchasesById_asOf(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver = models.DatabaseDriverMemory
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	sm.WithDatabase(persistence.NewMemoryDatabase()).
+		WithPersistenceService(persistence.NewPersistenceService()).
+		WithTreasuryAccessService(&treasuryStub{rate: basicExchange}).
+		WithExchangeService(NewExchangeService())
+	if err := sm.Database().Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.PersistenceService().InsertPurchase(ctx, basicPurchase); err != nil {
+		t.Fatal(err)
+	}
+	for _, rate := range []string{"4.90", "5.10"} {
+		revised := &models.ExchangeForDate{CountryCurrencyDesc: basicExchange.CountryCurrencyDesc, ExchangeRate: rate, Date: "2023-06-30"}
+		if err := sm.PersistenceService().InsertExchange(ctx, basicPurchase, revised); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	revisions, err := sm.ExchangeService().GetExchangeRevisions(ctx, basicExchange.CountryCurrencyDesc, "2023-06-30")
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("GetExchangeRevisions() = %v, %v, want 2 revisions", revisions, err)
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantRate string
+		wantErr  error
+	}{
+		{
+			name:     "current",
+			ctx:      ctx,
+			wantRate: "5.10",
+		},
+		{
+			name:     "asOfFirstRevision",
+			ctx:      services.WithAsOf(ctx, time.UnixMilli(revisions[0].RecordedAt)),
+			wantRate: "4.90",
+		},
+		{
+			// the Treasury is not asked, it would answer a rate recorded now.
+			name:    "asOfBeforeAnyRate",
+			ctx:     services.WithAsOf(ctx, time.UnixMilli(revisions[0].RecordedAt-1)),
+			wantErr: messages.ErrNoExchangeFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sm.ExchangeService().SearchPurchasesById(tt.ctx, basicPurchase.Id, basicExchange.CountryCurrencyDesc)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("SearchPurchasesById() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got.ExchangeRate != tt.wantRate {
+				t.Errorf("SearchPurchasesById() = %+v, %v, want rate %s", got, err, tt.wantRate)
+			}
+		})
+	}
+}
+
+func Test_exchangeServiceFinal_LockConversions(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver, cfg.Exchange.StaleRates = models.DatabaseDriverMemory, models.StaleRatesNewest
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	sm.WithDatabase(persistence.NewMemoryDatabase()).
+		WithPersistenceService(persistence.NewPersistenceService()).
+		WithTreasuryAccessService(&treasuryStub{err: messages.ErrSwApiUnavailableError}).
+		WithExchangeService(NewExchangeService())
+	if err := sm.Database().Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the rate of basicExchange is too old for the late purchase, only a stale conversion is possible.
+	late := &models.Purchase{Id: "late", Description: "Some transaction", Amount: "10.00", Date: "2024-06-30"}
+	for _, p := range []*models.Purchase{basicPurchase, late} {
+		if _, _, err := sm.PersistenceService().InsertPurchase(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sm.PersistenceService().InsertExchange(ctx, basicPurchase, basicExchange); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	beforeLock := time.Now()
+	time.Sleep(2 * time.Millisecond)
+
+	locked, err := sm.ExchangeService().LockConversions(ctx, []string{basicPurchase.Id, basicPurchase.Id}, basicExchange.CountryCurrencyDesc)
+	if err != nil || len(locked) != 1 {
+		t.Fatalf("LockConversions() = %v, %v, want one conversion", locked, err)
+	}
+	if !locked[0].Locked || locked[0].ConvertedAmount != "100.65" || locked[0].RateDate != basicExchange.Date || locked[0].Provider != models.ConversionProviderTreasury {
+		t.Errorf("LockConversions() = %+v, want the conversion by %s locked", locked[0], basicExchange.ExchangeRate)
+	}
+
+	// the rate is revised after the lock.
+	revised := &models.ExchangeForDate{CountryCurrencyDesc: basicExchange.CountryCurrencyDesc, ExchangeRate: "5.50", Date: basicExchange.Date}
+	if err := sm.PersistenceService().InsertExchange(ctx, basicPurchase, revised); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		wantAmount string
+		wantLocked bool
+	}{
+		{
+			name:       "locked",
+			ctx:        ctx,
+			wantAmount: "100.65",
+			wantLocked: true,
+		},
+		{
+			name:       "asOfBeforeTheLock",
+			ctx:        services.WithAsOf(ctx, beforeLock),
+			wantAmount: "100.65",
+			wantLocked: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sm.ExchangeService().SearchPurchasesById(tt.ctx, basicPurchase.Id, basicExchange.CountryCurrencyDesc)
+			if err != nil || got.ConvertedAmount != tt.wantAmount || got.Locked != tt.wantLocked {
+				t.Errorf("SearchPurchasesById() = %+v, %v, want %s locked %v", got, err, tt.wantAmount, tt.wantLocked)
+			}
+		})
+	}
+
+	t.Run("relockKeepsTheFirst", func(t *testing.T) {
+		got, err := sm.ExchangeService().LockConversions(ctx, []string{basicPurchase.Id}, basicExchange.CountryCurrencyDesc)
+		if err != nil || len(got) != 1 || got[0].ConvertedAmount != "100.65" {
+			t.Errorf("LockConversions() = %v, %v, want the first lock", got, err)
+		}
+	})
+	t.Run("staleRateNotLocked", func(t *testing.T) {
+		_, err := sm.ExchangeService().LockConversions(ctx, []string{late.Id}, basicExchange.CountryCurrencyDesc)
+		if !errors.Is(err, messages.ErrSwApiUnavailableError) {
+			t.Errorf("LockConversions() error = %v, want %v", err, messages.ErrSwApiUnavailableError)
+		}
+		if _, err := sm.PersistenceService().GetPurchaseConversion(ctx, late.Id, basicExchange.CountryCurrencyDesc); !errors.Is(err, messages.ErrNoConversionFound) {
+			t.Errorf("GetPurchaseConversion() error = %v, want %v", err, messages.ErrNoConversionFound)
+		}
+	})
+	t.Run("unknownPurchase", func(t *testing.T) {
+		if _, err := sm.ExchangeService().LockConversions(ctx, []string{"unknown"}, basicExchange.CountryCurrencyDesc); !errors.Is(err, messages.ErrNoPurchaseFound) {
+			t.Errorf("LockConversions() error = %v, want %v", err, messages.ErrNoPurchaseFound)
+		}
+	})
+	t.Run("listsPreferTheLock", func(t *testing.T) {
+		sm.WithTreasuryAccessService(&treasuryStub{rate: &models.ExchangeForDate{CountryCurrencyDesc: basicExchange.CountryCurrencyDesc, ExchangeRate: "5.00", Date: late.Date}})
+		if _, err := sm.ExchangeService().SearchPurchasesById(ctx, late.Id, basicExchange.CountryCurrencyDesc); err != nil {
+			t.Fatal(err)
+		}
+		all, err := sm.ExchangeService().GetAllPurchases(ctx, basicExchange.CountryCurrencyDesc)
+		if err != nil || len(all) != 2 || !all[0].Locked || all[0].ConvertedAmount != "100.65" || all[1].Locked {
+			t.Errorf("GetAllPurchases() = %v, %v, want only %s locked", all, err, basicPurchase.Id)
+		}
+		var streamed []*models.ConvertedAmount
+		err = sm.ExchangeService().StreamAllPurchases(ctx, basicExchange.CountryCurrencyDesc, func(c *models.ConvertedAmount) error {
+			streamed = append(streamed, c)
+			return nil
+		})
+		if err != nil || len(streamed) != 2 || !streamed[0].Locked || streamed[1].Locked {
+			t.Errorf("StreamAllPurchases() = %v, %v, want only %s locked", streamed, err, basicPurchase.Id)
+		}
+	})
+}
+
+func Test_exchangeServiceFinal_RateOverrides(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver = models.DatabaseDriverMemory
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatal(err)
+	}
+	sm.WithDatabase(persistence.NewMemoryDatabase()).
+		WithPersistenceService(persistence.NewPersistenceService()).
+		WithTreasuryAccessService(&treasuryStub{rate: basicExchange}).
+		WithExchangeService(NewExchangeService())
+	if err := sm.Database().Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.PersistenceService().InsertPurchase(ctx, basicPurchase); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.PersistenceService().InsertExchange(ctx, basicPurchase, basicExchange); err != nil {
+		t.Fatal(err)
+	}
+	currency := basicExchange.CountryCurrencyDesc
+	beforeCreation := time.Now()
+	time.Sleep(2 * time.Millisecond)
+
+	invalid := &models.RateOverride{CountryCurrencyDesc: currency, StartDate: "2023-09-30", EndDate: "2023-07-01", ExchangeRate: "6.00", Reason: "missing quarter", CreatedBy: "finance"}
+	if _, err := sm.ExchangeService().CreateRateOverride(ctx, invalid); !errors.Is(err, messages.ErrInvalidOverride) {
+		t.Errorf("CreateRateOverride() of an invalid override error = %v, want %v", err, messages.ErrInvalidOverride)
+	}
+	o, err := sm.ExchangeService().CreateRateOverride(ctx, &models.RateOverride{CountryCurrencyDesc: currency, StartDate: "2023-07-01", EndDate: "2023-09-30",
+		ExchangeRate: "6.00", Reason: "missing quarter", CreatedBy: "finance"})
+	if err != nil {
+		t.Fatalf("CreateRateOverride() error = %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	whileInUse := time.Now()
+	time.Sleep(2 * time.Millisecond)
+
+	check := func(t *testing.T, ctx context.Context, wantAmount string, wantOverride int64) {
+		t.Helper()
+		got, err := sm.ExchangeService().SearchPurchasesById(ctx, basicPurchase.Id, currency)
+		if err != nil || got.ConvertedAmount != wantAmount || got.OverrideId != wantOverride || (wantOverride != 0) != (got.Provider == models.ConversionProviderOverride) {
+			t.Errorf("SearchPurchasesById() = %+v, %v, want %s by the override %d", got, err, wantAmount, wantOverride)
+		}
+		all, err := sm.ExchangeService().GetAllPurchases(ctx, currency)
+		if err != nil || len(all) != 1 || all[0].ConvertedAmount != wantAmount || all[0].OverrideId != wantOverride {
+			t.Errorf("GetAllPurchases() = %v, %v, want %s by the override %d", all, err, wantAmount, wantOverride)
+		}
+	}
+	t.Run("overridden", func(t *testing.T) { check(t, ctx, "120.78", o.Id) })
+	t.Run("asOfBeforeTheOverride", func(t *testing.T) { check(t, services.WithAsOf(ctx, beforeCreation), "100.65", 0) })
+
+	if _, err := sm.ExchangeService().RemoveRateOverride(ctx, o.Id, "finance", ""); !errors.Is(err, messages.ErrInvalidOverride) {
+		t.Errorf("RemoveRateOverride() without a reason error = %v, want %v", err, messages.ErrInvalidOverride)
+	}
+	if _, err := sm.ExchangeService().RemoveRateOverride(ctx, o.Id, "finance", "Treasury published the quarter"); err != nil {
+		t.Fatalf("RemoveRateOverride() error = %v", err)
+	}
+	if _, err := sm.ExchangeService().RemoveRateOverride(ctx, o.Id, "finance", "again"); !errors.Is(err, messages.ErrNoOverrideFound) {
+		t.Errorf("RemoveRateOverride() of a removed override error = %v, want %v", err, messages.ErrNoOverrideFound)
+	}
+	t.Run("removed", func(t *testing.T) { check(t, ctx, "100.65", 0) })
+	t.Run("asOfWhileInUse", func(t *testing.T) { check(t, services.WithAsOf(ctx, whileInUse), "120.78", o.Id) })
+
+	audit, err := sm.ExchangeService().GetRateOverrideAudit(ctx, currency)
+	if err != nil || len(audit) != 2 || audit[0].Action != models.RateOverrideCreated || audit[1].Action != models.RateOverrideRemoved ||
+		audit[1].Reason != "Treasury published the quarter" {
+		t.Errorf("GetRateOverrideAudit() = %v, %v, want the creation and the removal", audit, err)
+	}
+}
+
 func Test_exchangeServiceFinal_convertPurchaseByExchangeRate(t *testing.T) {
 	type args struct {
 		ctx          context.Context
@@ -379,3 +835,296 @@ func Test_exchangeServiceFinal_GetAllPurchases(t *testing.T) {
 		})
 	}
 }
+
+func Test_exchangeServiceFinal_UpdatePurchase(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	pf := NewExchangeService().WithServiceManager(sm)
+	newAmount := "30.50"
+	invalidAmount := "30.505"
+	tests := []struct {
+		name       string
+		n          *exchangeServiceFinal
+		id         string
+		patch      *models.PurchasePatch
+		wantAmount string
+		wantErr    bool
+	}{
+		{
+			name:       "success",
+			n:          pf.(*exchangeServiceFinal),
+			id:         basicPurchase.Id,
+			patch:      &models.PurchasePatch{Amount: &newAmount},
+			wantAmount: newAmount,
+			wantErr:    false,
+		},
+		{
+			name:    "emptyPatch",
+			n:       pf.(*exchangeServiceFinal),
+			id:      basicPurchase.Id,
+			patch:   &models.PurchasePatch{},
+			wantErr: true,
+		},
+		{
+			name:    "invalidPatch",
+			n:       pf.(*exchangeServiceFinal),
+			id:      basicPurchase.Id,
+			patch:   &models.PurchasePatch{Amount: &invalidAmount},
+			wantErr: true,
+		},
+		{
+			name:    "persistenceError",
+			n:       pf.(*exchangeServiceFinal),
+			id:      "error",
+			patch:   &models.PurchasePatch{Amount: &newAmount},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.n.UpdatePurchase(ctx, tt.id, tt.patch)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: exchangeServiceFinal.UpdatePurchase() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				return
+			}
+			if got != nil && got.Amount != tt.wantAmount {
+				t.Errorf("%s: exchangeServiceFinal.UpdatePurchase() amount = %s, want %s", tt.name, got.Amount, tt.wantAmount)
+			}
+		})
+	}
+}
+
+func Test_exchangeServiceFinal_DeletePurchase(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	pf := NewExchangeService().WithServiceManager(sm)
+	tests := []struct {
+		name    string
+		n       *exchangeServiceFinal
+		id      string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			n:       pf.(*exchangeServiceFinal),
+			id:      basicPurchase.Id,
+			wantErr: false,
+		},
+		{
+			name:    "anyError",
+			n:       pf.(*exchangeServiceFinal),
+			id:      "error",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.n.DeletePurchase(ctx, tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("%s: exchangeServiceFinal.DeletePurchase() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_exchangeServiceFinal_GetPurchaseHistory(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	pf := NewExchangeService().WithServiceManager(sm)
+	tests := []struct {
+		name    string
+		n       *exchangeServiceFinal
+		id      string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			n:       pf.(*exchangeServiceFinal),
+			id:      basicPurchase.Id,
+			wantErr: false,
+		},
+		{
+			name:    "anyError",
+			n:       pf.(*exchangeServiceFinal),
+			id:      "error",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.n.GetPurchaseHistory(ctx, tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("%s: exchangeServiceFinal.GetPurchaseHistory() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_exchangeServiceFinal_ImportPurchases(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	pf := NewExchangeService().WithServiceManager(sm)
+	tests := []struct {
+		name           string
+		n              *exchangeServiceFinal
+		d              *sliceDecoder
+		wantAccepted   int
+		wantDuplicated int
+		wantRejected   int
+		wantErr        bool
+	}{
+		{
+			name: "success",
+			n:    pf.(*exchangeServiceFinal),
+			d: &sliceDecoder{rows: []*models.ImportRow{
+				importRow(2, "a", "10.00"),
+				importRow(3, "", "11.00"),
+				importRow(4, "duplicated", "12.00"),
+				importRow(5, "conflict", "13.00"),
+				importRow(6, "b", "-1.00"),
+				{Line: 7, Err: errors.New("unreadable row")},
+			}},
+			wantAccepted:   2,
+			wantDuplicated: 1,
+			wantRejected:   3,
+			wantErr:        false,
+		},
+		{
+			name:         "persistenceError",
+			n:            pf.(*exchangeServiceFinal),
+			d:            &sliceDecoder{rows: []*models.ImportRow{importRow(2, "error", "10.00")}},
+			wantAccepted: 0,
+			wantErr:      true,
+		},
+		{
+			name:         "decoderError",
+			n:            pf.(*exchangeServiceFinal),
+			d:            &sliceDecoder{rows: []*models.ImportRow{importRow(2, "a", "10.00")}, err: errors.New("broken stream")},
+			wantAccepted: 0,
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.n.ImportPurchases(ctx, tt.d)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: exchangeServiceFinal.ImportPurchases() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				return
+			}
+			if len(got.Accepted) != tt.wantAccepted || len(got.Duplicated) != tt.wantDuplicated || len(got.Rejected) != tt.wantRejected {
+				t.Errorf("%s: exchangeServiceFinal.ImportPurchases() = (%d, %d, %d), want (%d, %d, %d)", tt.name,
+					len(got.Accepted), len(got.Duplicated), len(got.Rejected), tt.wantAccepted, tt.wantDuplicated, tt.wantRejected)
+			}
+		})
+	}
+}
+
+func Test_exchangeServiceFinal_StreamAllPurchases(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	pf := NewExchangeService().WithServiceManager(sm)
+	tests := []struct {
+		name            string
+		n               *exchangeServiceFinal
+		countrycurrency string
+		want            []*models.ConvertedAmount
+		wantErr         bool
+	}{
+		{
+			name:            "success",
+			n:               pf.(*exchangeServiceFinal),
+			countrycurrency: basicExchange.CountryCurrencyDesc,
+			want:            basicConvertedAmounts,
+			wantErr:         false,
+		},
+		{
+			name:            "anyError",
+			n:               pf.(*exchangeServiceFinal),
+			countrycurrency: "error",
+			want:            nil,
+			wantErr:         true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []*models.ConvertedAmount
+			err := tt.n.StreamAllPurchases(ctx, tt.countrycurrency, func(c *models.ConvertedAmount) error {
+				got = append(got, c)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: exchangeServiceFinal.StreamAllPurchases() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: exchangeServiceFinal.StreamAllPurchases() = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkGetAllPurchases compares the conversion of every purchase looking up the rates one purchase at a time,
+// as GetAllPurchases used to, with the batched lookup it does now, on a SQLite database. Run it with
+// go test -run ^$ -bench GetAllPurchases -benchtime 3x ./pkg/exchangeservice/
+func BenchmarkGetAllPurchases(b *testing.B) {
+	for _, size := range []int{10_000, 100_000} {
+		sm, ctx := newBenchmarkManager(b, size)
+		n := sm.ExchangeService().(*exchangeServiceFinal)
+		b.Run(fmt.Sprintf("perPurchase/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				purchases, err := sm.PersistenceService().ListAllPurchases(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, p := range purchases {
+					exchange, err := sm.PersistenceService().GetExchangeRateForCountryCurrencyAndDate(ctx, basicExchange.CountryCurrencyDesc, p.Date)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := n.convertPurchaseByExchangeRate(ctx, p, exchange.ExchangeRate); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("batched/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := n.GetAllPurchases(ctx, basicExchange.CountryCurrencyDesc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// newBenchmarkManager starts a SQLite database with size purchases over 5 years and the quarterly rates of them.
+func newBenchmarkManager(b *testing.B, size int) (services.ServiceManager, context.Context) {
+	b.Helper()
+	sm, ctx := NewManagerForTests()
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver, cfg.Database.Path = models.DatabaseDriverSQLite, filepath.Join(b.TempDir(), "purchases.db")
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		b.Fatal(err)
+	}
+	sm.WithDatabase(persistence.NewDatabaseOfDriver()).
+		WithPersistenceService(persistence.NewPersistenceService()).
+		WithExchangeService(NewExchangeService())
+	if err := sm.Database().Start(ctx); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { sm.Database().Close(ctx) })
+
+	first, _ := time.Parse(time.DateOnly, "2019-01-01")
+	var exchanges []*models.ExchangeForDate
+	for d := first; d.Year() < 2024; d = d.AddDate(0, 3, 0) {
+		exchanges = append(exchanges, &models.ExchangeForDate{CountryCurrencyDesc: basicExchange.CountryCurrencyDesc, ExchangeRate: "5.00", Date: d.Format(time.DateOnly)})
+	}
+	if err := sm.PersistenceService().BatchInsertExchanges(ctx, basicPurchase, exchanges); err != nil {
+		b.Fatal(err)
+	}
+	batch := make([]*models.Purchase, 0, importChunkSize)
+	for i := 0; i < size; i++ {
+		date := first.AddDate(0, 0, i%(5*365)).Format(time.DateOnly)
+		batch = append(batch, &models.Purchase{Id: strconv.Itoa(i), Description: "Some transaction", Amount: "20.13", Date: date})
+		if len(batch) == cap(batch) || i == size-1 {
+			if _, err := sm.PersistenceService().BatchInsertPurchases(ctx, batch); err != nil {
+				b.Fatal(err)
+			}
+			batch = batch[:0]
+		}
+	}
+	return sm, ctx
+}
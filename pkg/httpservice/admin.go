@@ -0,0 +1,45 @@
+package httpservice
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+	actorKey            = "actor"
+)
+
+// authenticateAdmin lets through the requests with one of the http.adminTokens as bearer token, keeping the actor
+// it authenticates for the handlers. With no token configured every request is rejected, the /admin routes are
+// never open. The tokens are read on each request, so a reload adds or revokes them right away.
+func (n *httpServiceFinal) authenticateAdmin(c *gin.Context) {
+	actors, _ := n.sm.ConfigService().Config().Http.AdminActors() // validated when the settings are loaded
+	token, ok := strings.CutPrefix(c.GetHeader(authorizationHeader), bearerPrefix)
+	actor := ""
+	if ok && token != "" {
+		for t, a := range actors {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				actor = a
+			}
+		}
+	}
+	if actor == "" {
+		n.sm.LogsService().Warn(c.Request.Context(), "admin request rejected, no valid token")
+		c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "a valid admin token is required"})
+		return
+	}
+	n.sm.LogsService().Info(c.Request.Context(), "admin request authenticated", actorKey, actor)
+	c.Set(actorKey, actor)
+	c.Next()
+}
+
+// adminActor returns who made the admin request, the actor of its token.
+func adminActor(c *gin.Context) string {
+	return c.GetString(actorKey)
+}
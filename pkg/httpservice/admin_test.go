@@ -0,0 +1,106 @@
+package httpservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Test_httpServiceFinal_authenticateAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        string
+		authorization string
+		wantStatus    int
+		wantActor     string
+	}{
+		{
+			name:          "authenticated",
+			tokens:        "finance@example.com:s3cr3t,ops:t0k3n",
+			authorization: "Bearer s3cr3t",
+			wantStatus:    http.StatusOK,
+			wantActor:     "finance@example.com",
+		},
+		{
+			name:          "anotherActor",
+			tokens:        "finance@example.com:s3cr3t,ops:t0k3n",
+			authorization: "Bearer t0k3n",
+			wantStatus:    http.StatusOK,
+			wantActor:     "ops",
+		},
+		{
+			name:          "wrongToken",
+			tokens:        "finance@example.com:s3cr3t",
+			authorization: "Bearer guessed",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:          "notBearer",
+			tokens:        "finance@example.com:s3cr3t",
+			authorization: "Basic s3cr3t",
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:       "noToken",
+			tokens:     "finance@example.com:s3cr3t",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "noTokensConfigured",
+			authorization: "Bearer ",
+			wantStatus:    http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, _ := NewManagerForTestsWithArgs(t, "-admin-tokens", tt.tokens)
+			n := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+			actor := ""
+			router := SetUpRouter()
+			router.GET("/admin/log/level", n.authenticateAdmin, func(c *gin.Context) { actor = adminActor(c) })
+
+			req, _ := http.NewRequest(http.MethodGet, "/admin/log/level", nil)
+			if tt.authorization != "" {
+				req.Header.Set(authorizationHeader, tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus || actor != tt.wantActor {
+				t.Errorf("authenticateAdmin() status = %d and actor '%s', want %d and '%s'", w.Code, actor, tt.wantStatus, tt.wantActor)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("authenticateAdmin() answered no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_adminRoutesAuthenticated(t *testing.T) {
+	sm, ctx := NewManagerForTestsWithArgs(t, "-http-addr", "127.0.0.1:0", "-admin-tokens", "finance@example.com:s3cr3t")
+	n := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+	if err := n.Start(ctx); err != nil {
+		t.Fatalf("httpServiceFinal.Start() error = %v", err)
+	}
+	defer n.Close(ctx)
+
+	admin := 0
+	for _, route := range n.router.Routes() {
+		if !strings.HasPrefix(route.Path, "/admin/") {
+			continue
+		}
+		admin++
+		req, _ := http.NewRequest(route.Method, strings.Replace(route.Path, ":id", "1", 1), nil)
+		w := httptest.NewRecorder()
+		n.router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token status = %d, want %d", route.Method, route.Path, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if admin == 0 {
+		t.Errorf("httpServiceFinal.Start() registered no /admin route")
+	}
+}
@@ -0,0 +1,133 @@
+package httpservice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+const (
+	csvContentType    = "text/csv"
+	ndjsonContentType = "application/x-ndjson"
+	maxNDJSONLineSize = 1024 * 1024
+)
+
+var requiredCSVColumns = []string{"description", "amount", "date"}
+
+type (
+	csvPurchaseDecoder struct {
+		r       *csv.Reader
+		columns map[string]int
+	}
+
+	ndjsonPurchaseDecoder struct {
+		s    *bufio.Scanner
+		line int
+	}
+)
+
+// newPurchaseDecoder returns the decoder for the content type of an import, the body is read only as the rows are requested.
+func newPurchaseDecoder(contentType string, body io.Reader) (services.PurchaseDecoder, error) {
+	switch contentType {
+	case csvContentType:
+		return newCSVPurchaseDecoder(body)
+	case ndjsonContentType, "application/jsonl":
+		return newNDJSONPurchaseDecoder(body), nil
+	}
+	return nil, messages.ErrUnsupportedImport
+}
+
+// newCSVPurchaseDecoder reads the header of the CSV, that must name the description, amount and date columns.
+// The id column is optional.
+func newCSVPurchaseDecoder(body io.Reader) (*csvPurchaseDecoder, error) {
+	r := csv.NewReader(body)
+	r.TrimLeadingSpace = true
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%w: reading the csv header: %s", messages.ErrInvalidImport, err.Error())
+	}
+
+	d := &csvPurchaseDecoder{r: r, columns: make(map[string]int)}
+	for i, name := range header {
+		d.columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if err == nil {
+		for _, name := range requiredCSVColumns {
+			if _, ok := d.columns[name]; !ok {
+				return nil, fmt.Errorf("%w: the csv header must have the columns %s", messages.ErrInvalidImport, strings.Join(requiredCSVColumns, ", "))
+			}
+		}
+	}
+	return d, nil
+}
+
+func (d *csvPurchaseDecoder) Next() (*models.ImportRow, error) {
+	record, err := d.r.Read()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	// a malformed row, like one with a bare quote, is rejected and the rows after it are still read.
+	var perr *csv.ParseError
+	if errors.As(err, &perr) && errors.Is(perr.Err, csv.ErrFieldCount) {
+		return &models.ImportRow{Line: perr.StartLine, Err: fmt.Errorf("%w: expected %d fields", messages.ErrInvalidPurchase, len(d.columns))}, nil
+	}
+	if perr != nil {
+		return &models.ImportRow{Line: perr.StartLine, Err: fmt.Errorf("%w: %s", messages.ErrInvalidPurchase, perr.Err.Error())}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", messages.ErrInvalidImport, err.Error())
+	}
+
+	line, _ := d.r.FieldPos(0)
+	return &models.ImportRow{
+		Line: line,
+		Purchase: &models.Purchase{
+			Id:          d.field(record, "id"),
+			Description: d.field(record, "description"),
+			Amount:      d.field(record, "amount"),
+			Date:        d.field(record, "date"),
+		},
+	}, nil
+}
+
+func (d *csvPurchaseDecoder) field(record []string, name string) string {
+	if i, ok := d.columns[name]; ok {
+		return record[i]
+	}
+	return ""
+}
+
+func newNDJSONPurchaseDecoder(body io.Reader) *ndjsonPurchaseDecoder {
+	s := bufio.NewScanner(body)
+	s.Buffer(make([]byte, 0, 64*1024), maxNDJSONLineSize)
+	return &ndjsonPurchaseDecoder{s: s}
+}
+
+func (d *ndjsonPurchaseDecoder) Next() (*models.ImportRow, error) {
+	for d.s.Scan() {
+		d.line++
+		raw := bytes.TrimSpace(d.s.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var p models.Purchase
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return &models.ImportRow{Line: d.line, Err: fmt.Errorf("%w: %s", messages.ErrInvalidPurchase, err.Error())}, nil
+		}
+		return &models.ImportRow{Line: d.line, Purchase: &p}, nil
+	}
+	if err := d.s.Err(); err != nil {
+		return nil, fmt.Errorf("%w: line %d: %s", messages.ErrInvalidImport, d.line+1, err.Error())
+	}
+	return nil, io.EOF
+}
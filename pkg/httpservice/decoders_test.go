@@ -0,0 +1,121 @@
+package httpservice
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+func readAllRows(t *testing.T, d services.PurchaseDecoder) (lines []int, rejected []int, err error) {
+	t.Helper()
+	for {
+		row, err := d.Next()
+		if err == io.EOF {
+			return lines, rejected, nil
+		}
+		if err != nil {
+			return lines, rejected, err
+		}
+		if row.Err != nil {
+			rejected = append(rejected, row.Line)
+			continue
+		}
+		lines = append(lines, row.Line)
+	}
+}
+
+func Test_newPurchaseDecoder(t *testing.T) {
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		wantLines    []int
+		wantRejected []int
+		wantInitErr  error
+		wantReadErr  error
+	}{
+		{
+			name:        "csv",
+			contentType: csvContentType,
+			body:        "id,description,amount,date\na,Some transaction,20.13,2023-09-30\n\nb,Other transaction,10.00,2023-09-29\n",
+			wantLines:   []int{2, 4},
+		},
+		{
+			name:         "csvWithoutIdAndWrongFieldCount",
+			contentType:  csvContentType,
+			body:         "Description, Amount, Date\nSome transaction,20.13,2023-09-30\nmissing,20.13\n",
+			wantLines:    []int{2},
+			wantRejected: []int{3},
+		},
+		{
+			name:        "csvMissingColumns",
+			contentType: csvContentType,
+			body:        "id,description\na,Some transaction\n",
+			wantInitErr: messages.ErrInvalidImport,
+		},
+		{
+			name:         "csvBareQuote",
+			contentType:  csvContentType,
+			body:         "description,amount,date\nSome \"transaction,20.13,2023-09-30\nOther transaction,10.00,2023-09-29\n",
+			wantLines:    []int{3},
+			wantRejected: []int{2},
+		},
+		{
+			name:         "csvBrokenQuote",
+			contentType:  csvContentType,
+			body:         "description,amount,date\nOther transaction,10.00,2023-09-29\n\"Some transaction,20.13,2023-09-30\n",
+			wantLines:    []int{2},
+			wantRejected: []int{3},
+		},
+		{
+			name:         "ndjson",
+			contentType:  ndjsonContentType,
+			body:         "{\"id\": \"a\", \"description\": \"Some transaction\", \"amount\": \"20.13\", \"date\": \"2023-09-30\"}\n\n{'broken'}\n{\"description\": \"Other\", \"amount\": \"1.00\", \"date\": \"2023-09-30\"}",
+			wantLines:    []int{1, 4},
+			wantRejected: []int{3},
+		},
+		{
+			name:        "unsupported",
+			contentType: "application/xml",
+			body:        "<purchases/>",
+			wantInitErr: messages.ErrUnsupportedImport,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newPurchaseDecoder(tt.contentType, strings.NewReader(tt.body))
+			if !errors.Is(err, tt.wantInitErr) {
+				t.Fatalf("%s: newPurchaseDecoder() error = %v, want %v", tt.name, err, tt.wantInitErr)
+			}
+			if err != nil {
+				return
+			}
+			lines, rejected, err := readAllRows(t, d)
+			if !errors.Is(err, tt.wantReadErr) {
+				t.Fatalf("%s: Next() error = %v, want %v", tt.name, err, tt.wantReadErr)
+			}
+			if err != nil {
+				return
+			}
+			if !equalInts(lines, tt.wantLines) || !equalInts(rejected, tt.wantRejected) {
+				t.Errorf("%s: rows at lines %v and rejected %v, want %v and %v", tt.name, lines, rejected, tt.wantLines, tt.wantRejected)
+			}
+		})
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package httpservice
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+const (
+	exportJSON       = "json"
+	exportCSV        = "csv"
+	exportExcelCSV   = "xlsx"
+	exportNDJSON     = "ndjson"
+	excelContentType = "application/vnd.ms-excel"
+	utf8BOM          = "\xEF\xBB\xBF"
+	// exportErrorTrailer carries the error of an export that failed after the first rows were already sent.
+	exportErrorTrailer = "X-Export-Error"
+)
+
+// exportHeader ends with how each amount was converted, so a row converted by a stale rate is told apart in the
+// spreadsheet too.
+var exportHeader = []string{"id", "description", "purchase_date", "original_amount", "exchange_rate", "converted_amount", "degraded", "rate_date", "locked", "provider"}
+
+type (
+	convertedAmountEncoder interface {
+		Encode(c *models.ConvertedAmount) error
+		// Flush writes everything still buffered, including the CSV header when no row was encoded.
+		Flush() error
+	}
+
+	csvConvertedAmountEncoder struct {
+		w           *bufio.Writer
+		csv         *csv.Writer
+		excel       bool
+		wroteHeader bool
+	}
+
+	ndjsonConvertedAmountEncoder struct {
+		enc *json.Encoder
+	}
+)
+
+// negotiateExportFormat picks the export format from the format query parameter or, when it is absent, from the Accept header.
+func negotiateExportFormat(c *gin.Context) (string, error) {
+	if format := c.Query("format"); format != "" {
+		switch format {
+		case exportJSON, exportCSV, exportExcelCSV, exportNDJSON:
+			return format, nil
+		}
+		return "", messages.ErrUnsupportedExport
+	}
+	switch c.NegotiateFormat(gin.MIMEJSON, csvContentType, excelContentType, ndjsonContentType) {
+	case gin.MIMEJSON:
+		return exportJSON, nil
+	case csvContentType:
+		return exportCSV, nil
+	case excelContentType:
+		return exportExcelCSV, nil
+	case ndjsonContentType:
+		return exportNDJSON, nil
+	}
+	return "", messages.ErrUnsupportedExport
+}
+
+// newConvertedAmountEncoder returns the encoder for the format and sets the response headers it needs.
+func newConvertedAmountEncoder(format string, c *gin.Context) convertedAmountEncoder {
+	// the rows are sent as they are converted, so whether one was degraded is only known at the end.
+	c.Header("Trailer", exportErrorTrailer+", "+degradedHeader)
+	if format == exportNDJSON {
+		c.Header("Content-Type", ndjsonContentType)
+		return &ndjsonConvertedAmountEncoder{enc: json.NewEncoder(c.Writer)}
+	}
+	c.Header("Content-Type", csvContentType+"; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="purchases.csv"`)
+	w := bufio.NewWriter(c.Writer)
+	cw := csv.NewWriter(w)
+	// spreadsheets only detect the UTF-8 encoding with the BOM and expect CRLF line endings.
+	cw.UseCRLF = format == exportExcelCSV
+	return &csvConvertedAmountEncoder{w: w, csv: cw, excel: format == exportExcelCSV}
+}
+
+func (e *csvConvertedAmountEncoder) Encode(c *models.ConvertedAmount) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	return e.csv.Write([]string{c.Id, cell(c.Description), c.PurchaseDate, c.OriginalAmount, c.ExchangeRate, c.ConvertedAmount,
+		strconv.FormatBool(c.Degraded), c.RateDate, strconv.FormatBool(c.Locked), c.Provider})
+}
+
+func (e *csvConvertedAmountEncoder) Flush() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.csv.Flush()
+	if err := e.csv.Error(); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *csvConvertedAmountEncoder) writeHeader() error {
+	if e.wroteHeader {
+		return nil
+	}
+	e.wroteHeader = true
+	if e.excel {
+		if _, err := io.WriteString(e.w, utf8BOM); err != nil {
+			return err
+		}
+	}
+	return e.csv.Write(exportHeader)
+}
+
+// cell keeps spreadsheets from running a text that looks like a formula, a plain csv is opened by them as well.
+// A leading tab or carriage return is escaped too, some spreadsheets skip it before reading the formula.
+func cell(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+func (e *ndjsonConvertedAmountEncoder) Encode(c *models.ConvertedAmount) error {
+	return e.enc.Encode(c)
+}
+
+func (e *ndjsonConvertedAmountEncoder) Flush() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package httpservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+func newGinContextForExport(query string, accept string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	header := make(http.Header)
+	header.Add("Countrycurrency", "Brazil-Real")
+	if accept != "" {
+		header.Add("Accept", accept)
+	}
+	ctx.Request = &http.Request{
+		Header: header,
+		URL:    &url.URL{Path: "/purchases", RawQuery: query},
+	}
+	return ctx, w
+}
+
+func Test_negotiateExportFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: exportJSON},
+		{name: "anything", accept: "*/*", want: exportJSON},
+		{name: "acceptCSV", accept: "text/csv", want: exportCSV},
+		{name: "acceptExcel", accept: "application/vnd.ms-excel", want: exportExcelCSV},
+		{name: "acceptNDJSON", accept: "application/x-ndjson", want: exportNDJSON},
+		{name: "queryOverAccept", query: "format=ndjson", accept: "text/csv", want: exportNDJSON},
+		{name: "unknownQuery", query: "format=pdf", wantErr: true},
+		{name: "unknownAccept", accept: "application/pdf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newGinContextForExport(tt.query, tt.accept)
+			got, err := negotiateExportFormat(c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: negotiateExportFormat() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("%s: negotiateExportFormat() = %s, want %s", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_convertedAmountEncoder(t *testing.T) {
+	row := &models.ConvertedAmount{
+		Id:              "abcd-fghi",
+		Description:     "=Some transaction",
+		PurchaseDate:    "2023-09-30",
+		OriginalAmount:  "20.13",
+		ExchangeRate:    "5.00",
+		ConvertedAmount: "100.65",
+	}
+	degraded := &models.ConvertedAmount{
+		Id:              "abcd-fghi",
+		Description:     "Some transaction",
+		PurchaseDate:    "2023-09-30",
+		OriginalAmount:  "20.13",
+		ExchangeRate:    "4.90",
+		ConvertedAmount: "98.64",
+		Degraded:        true,
+		RateDate:        "2022-12-31",
+		Provider:        models.ConversionProviderTreasury,
+	}
+	tests := []struct {
+		name   string
+		format string
+		rows   []*models.ConvertedAmount
+		want   string
+	}{
+		{
+			name:   "csv",
+			format: exportCSV,
+			rows:   []*models.ConvertedAmount{row},
+			want:   "id,description,purchase_date,original_amount,exchange_rate,converted_amount,degraded,rate_date,locked,provider\nabcd-fghi,'=Some transaction,2023-09-30,20.13,5.00,100.65,false,,false,\n",
+		},
+		{
+			name:   "csvDegraded",
+			format: exportCSV,
+			rows:   []*models.ConvertedAmount{degraded},
+			want:   "id,description,purchase_date,original_amount,exchange_rate,converted_amount,degraded,rate_date,locked,provider\nabcd-fghi,Some transaction,2023-09-30,20.13,4.90,98.64,true,2022-12-31,false,treasury\n",
+		},
+		{
+			name:   "csvLeadingTab",
+			format: exportCSV,
+			rows:   []*models.ConvertedAmount{{Id: "abcd-fghi", Description: "\t=1+1", PurchaseDate: "2023-09-30", OriginalAmount: "20.13", ExchangeRate: "5.00", ConvertedAmount: "100.65"}},
+			want:   "id,description,purchase_date,original_amount,exchange_rate,converted_amount,degraded,rate_date,locked,provider\nabcd-fghi,'\t=1+1,2023-09-30,20.13,5.00,100.65,false,,false,\n",
+		},
+		{
+			name:   "csvWithoutRows",
+			format: exportCSV,
+			want:   "id,description,purchase_date,original_amount,exchange_rate,converted_amount,degraded,rate_date,locked,provider\n",
+		},
+		{
+			name:   "excel",
+			format: exportExcelCSV,
+			rows:   []*models.ConvertedAmount{row},
+			want:   utf8BOM + "id,description,purchase_date,original_amount,exchange_rate,converted_amount,degraded,rate_date,locked,provider\r\nabcd-fghi,'=Some transaction,2023-09-30,20.13,5.00,100.65,false,,false,\r\n",
+		},
+		{
+			name:   "ndjson",
+			format: exportNDJSON,
+			rows:   []*models.ConvertedAmount{row},
+			want:   `{"id":"abcd-fghi","description":"=Some transaction","purchase_date":"2023-09-30","original_amount":"20.13","exchange_rate":"5.00","converted_amount":"100.65"}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := newGinContextForExport("", "")
+			enc := newConvertedAmountEncoder(tt.format, c)
+			for _, r := range tt.rows {
+				if err := enc.Encode(r); err != nil {
+					t.Fatalf("%s: Encode() error = %v", tt.name, err)
+				}
+			}
+			if err := enc.Flush(); err != nil {
+				t.Fatalf("%s: Flush() error = %v", tt.name, err)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("%s: encoded = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
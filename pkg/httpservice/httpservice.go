@@ -2,15 +2,19 @@ package httpservice
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"os"
-	"os/signal"
 	"regexp"
-	"syscall"
+	"strconv"
+	"sync/atomic"
 	"time"
 
-	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
 
@@ -18,7 +22,13 @@ import (
 )
 
 const (
-	countrycurrencyKey = "Countrycurrency"
+	countrycurrencyKey       = "Countrycurrency"
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	degradedHeader           = "X-Degraded"
+	asOfParam                = "as_of"
+	jsonContentType          = "application/json; charset=utf-8"
+	exportFlushRows          = 100
 )
 
 type (
@@ -27,7 +37,7 @@ type (
 		router     *gin.Engine
 		srv        *http.Server
 		regexpRule *regexp.Regexp
-		quit       chan os.Signal
+		serving    atomic.Bool
 	}
 )
 
@@ -38,57 +48,80 @@ func NewHttpService() services.HttpService {
 func (n *httpServiceFinal) Start(ctx context.Context) error {
 	gin.SetMode(gin.ReleaseMode)
 	n.router = gin.Default()
+	n.router.Use(n.traceRequest, n.measureRequest, requestContext)
 
 	n.router.POST("/purchases", n.PostPurchase)
+	n.router.POST("/purchases/import", n.ImportPurchases)
+	n.router.POST("/purchases/lock", n.LockConversions)
 	n.router.GET("/purchases/:id", n.GetPurchaseById)
 	n.router.GET("/purchases", n.GetAllPurchases)
+	n.router.PUT("/purchases/:id", n.UpdatePurchase)
+	n.router.PATCH("/purchases/:id", n.PatchPurchase)
+	n.router.DELETE("/purchases/:id", n.DeletePurchase)
+	n.router.GET("/purchases/:id/history", n.GetPurchaseHistory)
+	n.router.GET("/exchanges/:date/revisions", n.GetExchangeRevisions)
+	n.router.GET("/healthz", n.Liveness)
+	n.router.GET("/readyz", n.Readiness)
+	n.router.GET("/metrics", n.Metrics)
+
+	admin := n.router.Group("/admin", n.authenticateAdmin)
+	admin.POST("/config/reload", n.ReloadConfig)
+	admin.GET("/log/level", n.GetLogLevel)
+	admin.PUT("/log/level", n.SetLogLevel)
+	admin.POST("/rates/overrides", n.CreateRateOverride)
+	admin.GET("/rates/overrides", n.ListRateOverrides)
+	admin.DELETE("/rates/overrides/:id", n.RemoveRateOverride)
+	admin.GET("/rates/overrides/audit", n.GetRateOverrideAudit)
+	admin.GET("/consistency", n.CheckConsistency)
+	admin.POST("/consistency/repair", n.RepairConsistency)
 
 	n.srv = &http.Server{
-		Addr:    ":8080",
+		Addr:    n.sm.ConfigService().Config().Http.Addr,
 		Handler: n.router,
 	}
-
-	n.quit = make(chan os.Signal, 1)
-	signal.Notify(n.quit, syscall.SIGINT, syscall.SIGTERM)
-
+	// listening here, and not inside the goroutine, makes a busy port fail the Start.
+	ln, err := net.Listen("tcp", n.srv.Addr)
+	if err != nil {
+		return fmt.Errorf("listen error: %w", err)
+	}
+	n.serving.Store(true)
 	go func() {
 		// http interface connection
-		if err := n.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			n.sm.LogsService().Error(ctx, fmt.Sprintf("listen error: %s\n", err.Error()))
-			n.quit <- syscall.SIGINT
-		}
-		n.sm.LogsService().Info(ctx, "Http Server Listening!")
-	}()
-
-	go func() {
-		if ctx.Value(logs.AppEnvKey) == "TESTS" {
-			time.Sleep(5 * time.Second)
-			n.Close(ctx)
+		defer n.serving.Store(false)
+		if err := n.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			n.sm.LogsService().Error(ctx, fmt.Sprintf("serve error: %s", err.Error()))
 		}
 	}()
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Http Server Listening on %s!", ln.Addr().String()))
+	return nil
+}
 
-	<-n.quit
+// Close stops accepting new connections and waits for the in-flight requests to finish, until ctx is done.
+func (n *httpServiceFinal) Close(ctx context.Context) error {
+	if n.srv == nil {
+		return nil
+	}
 	n.sm.LogsService().Info(ctx, "shuting down server ...")
-
-	ctxT, cancel := context.WithTimeout(ctx, 2*time.Second)
-	defer cancel()
-	if err := n.srv.Shutdown(ctxT); err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("Something went wrong executing server shutdown: %s\n", err.Error()))
+	if err := n.srv.Shutdown(ctx); err != nil {
+		return fmt.Errorf("something went wrong executing server shutdown: %w", err)
 	}
-	<-ctxT.Done()
-	n.sm.LogsService().Warn(ctx, "timed out after 2 seconds.")
-
-	n.sm.LogsService().Warn(ctx, "server exiting")
-
+	n.sm.LogsService().Info(ctx, "server exiting")
 	return nil
 }
 
-func (n *httpServiceFinal) Close(ctx context.Context) error {
-	n.quit <- syscall.SIGINT
+func (n *httpServiceFinal) Healthy(ctx context.Context) error {
+	if !n.serving.Load() {
+		return errors.New("http server is not serving")
+	}
 	return nil
 }
 
-func (n *httpServiceFinal) Healthy(ctx context.Context) error {
+// Reconfigure rejects a new address, the server would have to listen again. The other http settings are read
+// when used.
+func (n *httpServiceFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	if n.srv != nil && cfg.Http.Addr != n.srv.Addr {
+		return fmt.Errorf("the http address cannot change from '%s' to '%s' without a restart", n.srv.Addr, cfg.Http.Addr)
+	}
 	return nil
 }
 
@@ -103,52 +136,539 @@ func (n *httpServiceFinal) ServiceManager() services.ServiceManager {
 
 func (n *httpServiceFinal) PostPurchase(c *gin.Context) {
 	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	rawBody, err := c.GetRawData()
+	if err != nil {
+		n.sm.LogsService().Error(c.Request.Context(), fmt.Sprintf("Error reading the body received: %s", err.Error()))
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid purchase: %s", err.Error())})
+		return
+	}
+
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		status, response, _ := n.createPurchase(c.Request.Context(), rawBody)
+		c.IndentedJSON(status, response)
+		return
+	}
+
+	hash := sha256.Sum256(rawBody)
+	k := &models.IdempotencyKey{
+		Key:         key,
+		RequestHash: hex.EncodeToString(hash[:]),
+		ExpiresAt:   time.Now().Add(n.sm.ConfigService().Config().Http.IdempotencyKeyTTL).Unix(),
+	}
+	existing, err := n.sm.PersistenceService().ReserveIdempotencyKey(c.Request.Context(), k)
+	if err != nil {
+		n.sm.LogsService().Error(c.Request.Context(), err.Error(), "idempotency_key", key)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": fmt.Sprintf("Something went wrong: %s", err.Error())})
+		return
+	}
+	if existing != nil {
+		n.replayIdempotencyKey(c, k, existing)
+		return
+	}
+
+	status, response, retryable := n.createPurchase(c.Request.Context(), rawBody)
+	responseBody, _ := json.MarshalIndent(response, "", "    ")
+	if retryable {
+		// nothing was decided for this request, so the client can try again with the same key.
+		if err := n.sm.PersistenceService().ReleaseIdempotencyKey(c.Request.Context(), key); err != nil {
+			n.sm.LogsService().Error(c.Request.Context(), err.Error(), "idempotency_key", key)
+		}
+	} else {
+		k.StatusCode = status
+		k.ResponseBody = string(responseBody)
+		if err := n.sm.PersistenceService().CompleteIdempotencyKey(c.Request.Context(), k); err != nil {
+			n.sm.LogsService().Error(c.Request.Context(), err.Error(), "idempotency_key", key)
+		}
+	}
+	c.Data(status, jsonContentType, responseBody)
+}
+
+func (n *httpServiceFinal) replayIdempotencyKey(c *gin.Context, k *models.IdempotencyKey, existing *models.IdempotencyKey) {
+	if existing.RequestHash != k.RequestHash {
+		n.sm.LogsService().Warn(c.Request.Context(), "Idempotency-Key reused with a different request", "idempotency_key", k.Key)
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "Idempotency-Key already used with a different request"})
+		return
+	}
+	if existing.InProgress() {
+		c.IndentedJSON(http.StatusConflict, gin.H{"message": "a request with this Idempotency-Key is still being processed"})
+		return
+	}
+	n.sm.LogsService().Info(c.Request.Context(), "Replaying the stored response for Idempotency-Key", "idempotency_key", k.Key)
+	c.Header(idempotentReplayedHeader, "true")
+	c.Data(existing.StatusCode, jsonContentType, []byte(existing.ResponseBody))
+}
+
+// createPurchase returns the status and the response for the new purchase, and if the request
+// failed for a reason that may go away when trying again.
+func (n *httpServiceFinal) createPurchase(ctx context.Context, rawBody []byte) (int, gin.H, bool) {
 	var body models.Purchase
-	err := c.BindJSON(&body)
-	if body.Id == "" {
-		n.sm.LogsService().Error(c.Request.Context(), fmt.Sprintf("Error scanning the body received: %s", err.Error()))
+	if err := json.Unmarshal(rawBody, &body); err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error scanning the body received: %s", err.Error()))
+		return http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid purchase: %s", err.Error())}, false
+	}
+	if err := body.Validate(); err != nil {
+		return http.StatusBadRequest, gin.H{"message": err.Error()}, false
+	}
+
+	n.sm.LogsService().Info(ctx, "Delegating to ExchangeService to handle the new transaction")
+	id, created, err := n.sm.ExchangeService().HandleNewPurchase(ctx, &body)
+	if errors.Is(err, messages.ErrPurchaseIdConflict) {
+		return http.StatusConflict, gin.H{"message": err.Error()}, false
 	}
 	if err != nil {
-		n.sm.LogsService().Error(c.Request.Context(), fmt.Sprintf("Error scanning the body received: %s", err.Error()))
+		n.sm.LogsService().Error(ctx, err.Error())
+		// only a failure of the server, like the database being down, may go away when trying again.
+		status := errorStatus(err)
+		return status, gin.H{"message": fmt.Sprintf("Something went wrong: %s", err.Error())}, status >= http.StatusInternalServerError
 	}
+	if !created {
+		n.sm.LogsService().Info(ctx, "purchase already persisted, returning the existing one")
+		return http.StatusOK, gin.H{"id": id}, false
+	}
+	n.sm.LogsService().Info(ctx, "persisted the new purchase")
+	return http.StatusCreated, gin.H{"id": id}, false
+}
 
-	n.sm.LogsService().Info(c.Request.Context(), "Delegating to ExchangeService to handle the new transaction")
-	err = n.sm.ExchangeService().HandleNewPurchase(c.Request.Context(), &body)
+// ImportPurchases streams the body, a CSV or NDJSON file, into the ExchangeService and answers with the report
+// of every row imported.
+func (n *httpServiceFinal) ImportPurchases(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	d, err := newPurchaseDecoder(c.ContentType(), c.Request.Body)
 	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Something went wrong: %s", err.Error())})
+		n.sm.LogsService().Error(c.Request.Context(), err.Error())
+		c.IndentedJSON(errorStatus(err), gin.H{"message": err.Error()})
 		return
 	}
-	n.sm.LogsService().Info(c.Request.Context(), "persisted the new purchase")
-	c.IndentedJSON(http.StatusOK, nil)
+
+	n.sm.LogsService().Info(c.Request.Context(), "Delegating to ExchangeService to import the purchases")
+	report, err := n.sm.ExchangeService().ImportPurchases(c.Request.Context(), d)
+	if err != nil {
+		// the chunks imported before the error are kept, so the report tells what is already persisted.
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Import stopped: %s", err.Error()), "report": report})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, report)
 }
 
 func (n *httpServiceFinal) GetPurchaseById(c *gin.Context) {
 	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
 	id := c.Param("id")
 	countrycurrency := c.Request.Header[countrycurrencyKey][0]
-	fmt.Println("countrycurrency=" + countrycurrency)
+	n.sm.LogsService().Debug(c.Request.Context(), "Countrycurrency received", "countrycurrency", countrycurrency)
+	if err := withAsOf(c); err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": err.Error()})
+		return
+	}
 	n.sm.LogsService().Info(c.Request.Context(), "Delegating to ExchangeService to find the purchase")
 
 	p, err := n.sm.ExchangeService().SearchPurchasesById(c.Request.Context(), id, countrycurrency)
 	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Something went wrong: %s", err.Error())})
+		c.IndentedJSON(conversionStatus(err), gin.H{"message": fmt.Sprintf("Something went wrong: %s", err.Error())})
 		return
 	}
-	n.sm.LogsService().Info(c.Request.Context(), fmt.Sprintf("Got the correct purchase, returning it: %v", p))
+	if p.Degraded {
+		c.Header(degradedHeader, "stale-rate")
+		c.Header("Warning", fmt.Sprintf(`110 - "exchange rate effective on %s, the Treasury API is unavailable"`, p.RateDate))
+	}
+	n.sm.LogsService().Info(c.Request.Context(), "Got the correct purchase, returning it", "purchase", p)
 	c.IndentedJSON(http.StatusOK, p)
 }
 
 func (n *httpServiceFinal) GetAllPurchases(c *gin.Context) {
 	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
 	countrycurrency := c.Request.Header[countrycurrencyKey][0]
-	fmt.Println("countrycurrency=" + countrycurrency)
+	n.sm.LogsService().Debug(c.Request.Context(), "Countrycurrency received", "countrycurrency", countrycurrency)
+	if err := withAsOf(c); err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+
+	format, err := negotiateExportFormat(c)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+	if format != exportJSON {
+		n.exportAllPurchases(c, countrycurrency, format)
+		return
+	}
 
 	ps, err := n.sm.ExchangeService().GetAllPurchases(c.Request.Context(), countrycurrency)
 	if err != nil {
-		c.IndentedJSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Error getting all Purchases: %s", err.Error())})
+		c.IndentedJSON(conversionStatus(err), gin.H{"message": fmt.Sprintf("Error getting all Purchases: %s", err.Error())})
 		return
 	}
+	for _, p := range ps {
+		if p.Degraded {
+			c.Header(degradedHeader, "stale-rate")
+			c.Header("Warning", `110 - "some exchange rates are stale, the Treasury API is unavailable"`)
+			break
+		}
+	}
 
 	c.IndentedJSON(http.StatusOK, ps)
 
 }
+
+// exportAllPurchases streams every converted purchase in the format asked, row by row as they are read from the database.
+func (n *httpServiceFinal) exportAllPurchases(c *gin.Context, countrycurrency string, format string) {
+	var enc convertedAmountEncoder
+	rows, degraded := 0, false
+	err := n.sm.ExchangeService().StreamAllPurchases(c.Request.Context(), countrycurrency, func(ca *models.ConvertedAmount) error {
+		if enc == nil {
+			enc = newConvertedAmountEncoder(format, c)
+		}
+		if err := enc.Encode(ca); err != nil {
+			return err
+		}
+		rows++
+		degraded = degraded || ca.Degraded
+		if rows%exportFlushRows == 0 {
+			if err := enc.Flush(); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	if err != nil && !c.Writer.Written() {
+		c.Writer.Header().Del("Content-Disposition")
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Trailer")
+		c.IndentedJSON(conversionStatus(err), gin.H{"message": fmt.Sprintf("Error exporting all Purchases: %s", err.Error())})
+		return
+	}
+	if degraded {
+		c.Writer.Header().Set(degradedHeader, "stale-rate")
+	}
+	if err != nil {
+		// the status was sent with the first rows, so the trailer is the only way left to tell the export is incomplete.
+		n.sm.LogsService().Error(c.Request.Context(), fmt.Sprintf("Export stopped after %d rows: %s", rows, err.Error()))
+		c.Writer.Header().Set(exportErrorTrailer, err.Error())
+		return
+	}
+
+	if enc == nil {
+		enc = newConvertedAmountEncoder(format, c)
+	}
+	if err := enc.Flush(); err != nil {
+		n.sm.LogsService().Error(c.Request.Context(), fmt.Sprintf("Error flushing the export: %s", err.Error()))
+		return
+	}
+	c.Status(http.StatusOK)
+	n.sm.LogsService().Info(c.Request.Context(), fmt.Sprintf("Exported %d purchases as %s", rows, format))
+}
+
+func (n *httpServiceFinal) UpdatePurchase(c *gin.Context) {
+	n.updatePurchase(c, true)
+}
+
+func (n *httpServiceFinal) PatchPurchase(c *gin.Context) {
+	n.updatePurchase(c, false)
+}
+
+// updatePurchase handles both PUT, that must replace every field, and PATCH, that changes only the fields sent.
+func (n *httpServiceFinal) updatePurchase(c *gin.Context, replace bool) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	id := c.Param("id")
+	var patch models.PurchasePatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		n.sm.LogsService().Error(c.Request.Context(), fmt.Sprintf("Error scanning the body received: %s", err.Error()))
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid purchase: %s", err.Error())})
+		return
+	}
+	if replace && !patch.IsComplete() {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid purchase: description, amount and date are required"})
+		return
+	}
+
+	n.sm.LogsService().Info(c.Request.Context(), "Delegating to ExchangeService to update the purchase")
+	p, err := n.sm.ExchangeService().UpdatePurchase(c.Request.Context(), id, &patch)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error updating the Purchase: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, p)
+}
+
+func (n *httpServiceFinal) DeletePurchase(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	id := c.Param("id")
+	if err := n.sm.ExchangeService().DeletePurchase(c.Request.Context(), id); err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error deleting the Purchase: %s", err.Error())})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (n *httpServiceFinal) GetPurchaseHistory(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	id := c.Param("id")
+	history, err := n.sm.ExchangeService().GetPurchaseHistory(c.Request.Context(), id)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error getting the Purchase history: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, history)
+}
+
+// GetExchangeRevisions lists every rate of the Countrycurrency effective on the date that was ingested, the
+// oldest first.
+func (n *httpServiceFinal) GetExchangeRevisions(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	date := c.Param("date")
+	countrycurrency := c.GetHeader(countrycurrencyKey)
+	if countrycurrency == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "the Countrycurrency header is required"})
+		return
+	}
+	if _, err := time.Parse(models.DateLayout, date); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid date '%s', use a date like 2023-09-30", date)})
+		return
+	}
+	revisions, err := n.sm.ExchangeService().GetExchangeRevisions(c.Request.Context(), countrycurrency, date)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error getting the Exchange revisions: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, revisions)
+}
+
+// LockConversions locks the conversions of the purchases to the currency of the Countrycurrency header, so they are
+// answered the same way from then on.
+func (n *httpServiceFinal) LockConversions(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	countrycurrency := c.GetHeader(countrycurrencyKey)
+	if countrycurrency == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "the Countrycurrency header is required"})
+		return
+	}
+	var body models.ConversionLock
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Error reading the purchases to lock: %s", err.Error())})
+		return
+	}
+	if len(body.Ids) == 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "the ids of the purchases to lock are required"})
+		return
+	}
+	locked, err := n.sm.ExchangeService().LockConversions(c.Request.Context(), body.Ids, countrycurrency)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error locking the conversions: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, locked)
+}
+
+// CreateRateOverride sets a rate by hand for a currency and a range of purchase dates, on behalf of the actor
+// authenticated by the admin token.
+func (n *httpServiceFinal) CreateRateOverride(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	actor := adminActor(c)
+	if actor == "" {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": "a valid admin token is required"})
+		return
+	}
+	var o models.RateOverride
+	if err := c.ShouldBindJSON(&o); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Error reading the rate override: %s", err.Error())})
+		return
+	}
+	o.CreatedBy = actor
+	created, err := n.sm.ExchangeService().CreateRateOverride(c.Request.Context(), &o)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error creating the rate override: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusCreated, created)
+}
+
+// ListRateOverrides returns the rate overrides, the removed ones too, of the Countrycurrency header currency when
+// it is sent.
+func (n *httpServiceFinal) ListRateOverrides(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	overrides, err := n.sm.ExchangeService().ListRateOverrides(c.Request.Context(), c.GetHeader(countrycurrencyKey))
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error listing the rate overrides: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, overrides)
+}
+
+// RemoveRateOverride stops using a rate override, on behalf of the actor authenticated by the admin token. It is
+// kept for the conversions asked as of a time it was in use.
+func (n *httpServiceFinal) RemoveRateOverride(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	actor := adminActor(c)
+	if actor == "" {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"message": "a valid admin token is required"})
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid rate override id '%s'", c.Param("id"))})
+		return
+	}
+	var body models.RateOverrideRemoval
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Error reading why the rate override is removed: %s", err.Error())})
+		return
+	}
+	removed, err := n.sm.ExchangeService().RemoveRateOverride(c.Request.Context(), id, actor, body.Reason)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error removing the rate override: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, removed)
+}
+
+// GetRateOverrideAudit returns every change made to the rate overrides, of the Countrycurrency header currency when
+// it is sent.
+func (n *httpServiceFinal) GetRateOverrideAudit(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	audit, err := n.sm.ExchangeService().GetRateOverrideAudit(c.Request.Context(), c.GetHeader(countrycurrencyKey))
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error getting the rate override audit: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, audit)
+}
+
+// CheckConsistency reports the consistency issues found, without changing anything.
+func (n *httpServiceFinal) CheckConsistency(c *gin.Context) {
+	n.checkConsistency(c, false)
+}
+
+// RepairConsistency reports the consistency issues found, repairing the ones that can be.
+func (n *httpServiceFinal) RepairConsistency(c *gin.Context) {
+	n.checkConsistency(c, true)
+}
+
+// checkConsistency answers 501 when no ConsistencyChecker is registered. The issues found are in the report, the
+// check itself succeeded.
+func (n *httpServiceFinal) checkConsistency(c *gin.Context, repair bool) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	report, err := n.consistencyCheck(c.Request.Context(), repair)
+	if err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error checking the consistency: %s", err.Error())})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, report)
+}
+
+func (n *httpServiceFinal) consistencyCheck(ctx context.Context, repair bool) (*models.ConsistencyReport, error) {
+	checker, err := services.Get[services.ConsistencyChecker](n.sm, services.ConsistencyCheckerName)
+	if err != nil {
+		return nil, err
+	}
+	return checker.Check(ctx, repair)
+}
+
+// withAsOf makes the conversions of the request use the rates recorded until the as_of query parameter, when it
+// is set: a RFC 3339 time, or a date for the end of that day in UTC.
+func withAsOf(c *gin.Context) error {
+	v := c.Query(asOfParam)
+	if v == "" {
+		return nil
+	}
+	asOf, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		day, derr := time.Parse(models.DateLayout, v)
+		if derr != nil {
+			return fmt.Errorf("%w: '%s'", messages.ErrInvalidAsOf, v)
+		}
+		asOf = day.AddDate(0, 0, 1).Add(-time.Millisecond)
+	}
+	c.Request = c.Request.WithContext(services.WithAsOf(c.Request.Context(), asOf))
+	return nil
+}
+
+// Liveness answers if the process is alive, checking only what runs inside it, so a failing database does not
+// make the orchestrator restart a container that would not fix it.
+func (n *httpServiceFinal) Liveness(c *gin.Context) {
+	n.healthReport(c, false)
+}
+
+// Readiness answers if the service can handle requests, checking every dependency.
+func (n *httpServiceFinal) Readiness(c *gin.Context) {
+	n.healthReport(c, true)
+}
+
+// ReloadConfig reloads the settings like a SIGHUP, answering why when they are not applied.
+func (n *httpServiceFinal) ReloadConfig(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	if err := n.sm.Reload(c.Request.Context()); err != nil {
+		c.IndentedJSON(errorStatus(err), gin.H{"message": fmt.Sprintf("Error reloading the configuration: %s", err.Error())})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetLogLevel answers the lowest level logged, like {"level": "info"}.
+func (n *httpServiceFinal) GetLogLevel(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, models.LogLevel{Level: n.sm.LogsService().Level()})
+}
+
+// SetLogLevel changes the lowest level logged right away, until the next restart or the next change of
+// app.logLevel in the settings.
+func (n *httpServiceFinal) SetLogLevel(c *gin.Context) {
+	n.sm.LogsService().Info(c.Request.Context(), c.FullPath()+" Call received")
+	var body models.LogLevel
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Error reading the log level: %s", err.Error())})
+		return
+	}
+	if err := n.sm.LogsService().SetLevel(body.Level); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Error setting the log level: %s", err.Error())})
+		return
+	}
+	n.sm.LogsService().Warn(c.Request.Context(), "log level changed", "level", body.Level, actorKey, adminActor(c))
+	c.IndentedJSON(http.StatusOK, models.LogLevel{Level: n.sm.LogsService().Level()})
+}
+
+// Metrics serves the metrics of the MetricsService to the Prometheus scraper.
+func (n *httpServiceFinal) Metrics(c *gin.Context) {
+	n.sm.MetricsService().Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+func (n *httpServiceFinal) healthReport(c *gin.Context, readiness bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), n.sm.ConfigService().Config().Http.HealthCheckTimeout)
+	defer cancel()
+	report := n.sm.HealthReport(ctx, readiness)
+	status := http.StatusOK
+	if report.Status == models.HealthDown {
+		status = http.StatusServiceUnavailable
+	}
+	c.IndentedJSON(status, report)
+}
+
+// conversionStatus answers a failed conversion: no purchase or no rate to convert it is a 404, the Treasury API
+// being unavailable a 503 worth retrying.
+func conversionStatus(err error) int {
+	if errors.Is(err, messages.ErrSwApiUnavailableError) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusNotFound
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, messages.ErrNoPurchaseFound), errors.Is(err, messages.ErrNoExchangeFound), errors.Is(err, messages.ErrNoOverrideFound):
+		return http.StatusNotFound
+	case errors.Is(err, messages.ErrInvalidPurchase), errors.Is(err, messages.ErrInvalidImport), errors.Is(err, messages.ErrInvalidConfig),
+		errors.Is(err, messages.ErrInvalidAsOf), errors.Is(err, messages.ErrInvalidOverride):
+		return http.StatusBadRequest
+	case errors.Is(err, messages.ErrUnsupportedImport):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, messages.ErrUnsupportedExport):
+		return http.StatusNotAcceptable
+	case errors.Is(err, messages.ErrDuplicatedPurchase), errors.Is(err, messages.ErrPurchaseIdConflict), errors.Is(err, messages.ErrConfigRejected):
+		return http.StatusConflict
+	case errors.Is(err, messages.ErrSwApiUnavailableError):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, messages.ErrServiceNotRegistered):
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
@@ -2,7 +2,9 @@ package httpservice
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -10,7 +12,9 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/marcosArruda/purchases-multi-country/pkg/config"
 	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
 )
 
@@ -34,11 +38,20 @@ func NewManagerForTests() (services.ServiceManager, context.Context) {
 	stop := make(chan struct{})
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, logs.AppEnvKey, "TESTS")
-	ctx = context.WithValue(ctx, logs.AppNameKey, logs.AppName)
-	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.AppVersion)
+	ctx = context.WithValue(ctx, logs.AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.Version())
 	return services.NewManager(asyncWorkChannel, stop), ctx
 }
 
+// NewManagerForTestsWithArgs is NewManagerForTests with the settings loaded from the command line args.
+func NewManagerForTestsWithArgs(t *testing.T, args ...string) (services.ServiceManager, context.Context) {
+	sm, ctx := NewManagerForTests()
+	if err := sm.WithConfigService(config.NewConfigService(args)).ConfigService().Start(ctx); err != nil {
+		t.Fatalf("an error '%s' was not expected when loading the config", err)
+	}
+	return sm, ctx
+}
+
 func NewGinContextForTests(reqPath string, withError bool) *gin.Context {
 	gin.SetMode(gin.TestMode)
 	w := httptest.NewRecorder()
@@ -64,6 +77,10 @@ func NewGinContextForTests(reqPath string, withError bool) *gin.Context {
 }
 
 func NewGinContextForTestsPOST(reqPath string, withError bool) *gin.Context {
+	return NewGinContextForTestsWithBody(reqPath, "{'id': 'abcd-fghi', 'description': 'Some transaction', 'amount': '20.13', date: '2023-09-30'}", withError)
+}
+
+func NewGinContextForTestsWithBody(reqPath string, body string, withError bool) *gin.Context {
 	gin.SetMode(gin.TestMode)
 	w := httptest.NewRecorder()
 	ctx, _ := gin.CreateTestContext(w)
@@ -82,7 +99,7 @@ func NewGinContextForTestsPOST(reqPath string, withError bool) *gin.Context {
 	ctx.Request = &http.Request{
 		Header: header,
 		URL:    u,
-		Body:   io.NopCloser(strings.NewReader("{'id': 'abcd-fghi', 'description': 'Some transaction', 'amount': '20.13', date: '2023-09-30'}")),
+		Body:   io.NopCloser(strings.NewReader(body)),
 	}
 
 	ctx.Request.URL.RawQuery = v.Encode()
@@ -90,57 +107,63 @@ func NewGinContextForTestsPOST(reqPath string, withError bool) *gin.Context {
 }
 
 func Test_httpServiceFinal_Start(t *testing.T) {
-	type args struct {
-		ctx context.Context
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a listener", err)
 	}
-	sm, ctx := NewManagerForTests()
-	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	defer busy.Close()
 	tests := []struct {
 		name    string
-		n       *httpServiceFinal
-		args    args
+		addr    string
 		wantErr bool
 	}{
 		{
 			name:    "success",
-			n:       httpService.(*httpServiceFinal),
-			args:    args{ctx},
+			addr:    "127.0.0.1:0",
 			wantErr: false,
 		},
+		{
+			name:    "addressInUse",
+			addr:    busy.Addr().String(),
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := tt.n.Start(tt.args.ctx); (err != nil) != tt.wantErr {
+			sm, ctx := NewManagerForTestsWithArgs(t, "-http-addr", tt.addr)
+			n := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+			if err := n.Start(ctx); (err != nil) != tt.wantErr {
 				t.Errorf("httpServiceFinal.Start() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			n.Close(ctx)
 		})
 	}
 }
 
 func Test_httpServiceFinal_Close(t *testing.T) {
-	type args struct {
-		ctx context.Context
-	}
-	sm, ctx := NewManagerForTests()
-	httpService := sm.WithHttpService(NewHttpService()).HttpService()
-	httpService.Start(ctx)
+	sm, ctx := NewManagerForTestsWithArgs(t, "-http-addr", "127.0.0.1:0")
+	started := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+	started.Start(ctx)
 	tests := []struct {
 		name    string
 		n       *httpServiceFinal
-		args    args
 		wantErr bool
 	}{
 		{
 			name:    "success",
-			n:       httpService.(*httpServiceFinal),
-			args:    args{ctx},
+			n:       started,
+			wantErr: false,
+		},
+		{
+			name:    "notStarted",
+			n:       NewHttpService().WithServiceManager(sm).(*httpServiceFinal),
 			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := tt.n.Close(tt.args.ctx); (err != nil) != tt.wantErr {
+			if err := tt.n.Close(ctx); (err != nil) != tt.wantErr {
 				t.Errorf("httpServiceFinal.Close() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -148,52 +171,141 @@ func Test_httpServiceFinal_Close(t *testing.T) {
 }
 
 func Test_httpServiceFinal_GetPurchaseById(t *testing.T) {
-	type args struct {
-		c *gin.Context
-	}
-
 	sm, _ := NewManagerForTests()
 	httpService := sm.WithHttpService(NewHttpService()).HttpService()
-	ginCtx := NewGinContextForTests("/some-request-path/1/", false)
 	tests := []struct {
-		name string
-		n    *httpServiceFinal
-		args args
+		name            string
+		n               *httpServiceFinal
+		countrycurrency string
+		asOf            string
+		wantStatus      int
+		wantDegraded    bool
 	}{
 		{
-			name: "success",
-			n:    httpService.(*httpServiceFinal),
-			args: args{ginCtx},
+			name:            "success",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:            "noRate",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "error",
+			wantStatus:      http.StatusNotFound,
+		},
+		{
+			name:            "treasuryUnavailable",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "unavailable",
+			wantStatus:      http.StatusServiceUnavailable,
+		},
+		{
+			name:            "staleRate",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "stale",
+			wantStatus:      http.StatusOK,
+			wantDegraded:    true,
+		},
+		{
+			name:            "asOfDate",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			asOf:            "2023-10-05",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:            "asOfTime",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			asOf:            "2023-10-05T12:00:00Z",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:            "invalidAsOf",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			asOf:            "yesterday",
+			wantStatus:      http.StatusBadRequest,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.n.GetPurchaseById(tt.args.c)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/purchases/1?as_of="+tt.asOf, nil)
+			c.Request.Header.Set(countrycurrencyKey, tt.countrycurrency)
+			c.Params = gin.Params{{Key: "id", Value: "1"}}
+			tt.n.GetPurchaseById(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetPurchaseById() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get(degradedHeader) != ""; got != tt.wantDegraded {
+				t.Errorf("GetPurchaseById() %s header = %q, want it %v", degradedHeader, w.Header().Get(degradedHeader), tt.wantDegraded)
+			}
+			if got := strings.Contains(w.Body.String(), `"degraded": true`); got != tt.wantDegraded {
+				t.Errorf("GetPurchaseById() body = %s, want degraded %v", w.Body.String(), tt.wantDegraded)
+			}
 		})
 	}
 }
 
 func Test_httpServiceFinal_GetAllPurchases(t *testing.T) {
-	type args struct {
-		c *gin.Context
-	}
 	sm, _ := NewManagerForTests()
 	httpService := sm.WithHttpService(NewHttpService()).HttpService()
-	ginCtx := NewGinContextForTests("/some-request-path/1/", false)
 	tests := []struct {
-		name string
-		n    *httpServiceFinal
-		args args
+		name            string
+		n               *httpServiceFinal
+		countrycurrency string
+		query           string
+		wantStatus      int
+		wantDegraded    bool
 	}{
 		{
-			name: "success",
-			n:    httpService.(*httpServiceFinal),
-			args: args{ginCtx},
+			name:            "success",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:            "noRate",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "error",
+			wantStatus:      http.StatusNotFound,
+		},
+		{
+			name:            "treasuryUnavailable",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "unavailable",
+			wantStatus:      http.StatusServiceUnavailable,
+		},
+		{
+			name:            "staleRate",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "stale",
+			wantStatus:      http.StatusOK,
+			wantDegraded:    true,
+		},
+		{
+			name:            "exportWithTreasuryUnavailable",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "unavailable",
+			query:           "format=ndjson",
+			wantStatus:      http.StatusServiceUnavailable,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			tt.n.GetAllPurchases(tt.args.c)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/purchases?"+tt.query, nil)
+			c.Request.Header.Set(countrycurrencyKey, tt.countrycurrency)
+			tt.n.GetAllPurchases(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetAllPurchases() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get(degradedHeader) != ""; got != tt.wantDegraded {
+				t.Errorf("GetAllPurchases() %s header = %q, want it %v", degradedHeader, w.Header().Get(degradedHeader), tt.wantDegraded)
+			}
 		})
 	}
 }
@@ -204,21 +316,843 @@ func Test_httpServiceFinal_PostPurchase(t *testing.T) {
 	}
 	sm, _ := NewManagerForTests()
 	httpService := sm.WithHttpService(NewHttpService()).HttpService()
-	ginCtx := NewGinContextForTestsPOST("/some-request-path/1/", false)
+	validBody := `{"id": "abcd-fghi", "description": "Some transaction", "amount": "20.13", "date": "2023-09-30"}`
 	tests := []struct {
-		name string
-		n    *httpServiceFinal
-		args args
+		name           string
+		n              *httpServiceFinal
+		args           args
+		idempotencyKey string
+		wantStatus     int
 	}{
 		{
-			name: "success",
-			n:    httpService.(*httpServiceFinal),
-			args: args{ginCtx},
+			name:       "invalidBody",
+			n:          httpService.(*httpServiceFinal),
+			args:       args{NewGinContextForTestsPOST("/some-request-path/1/", false)},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalidPurchase",
+			n:          httpService.(*httpServiceFinal),
+			args:       args{NewGinContextForTestsWithBody("/some-request-path/1/", `{"description": "Some transaction", "amount": "-20.13", "date": "2023-09-30"}`, false)},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "serverError",
+			n:          httpService.(*httpServiceFinal),
+			args:       args{NewGinContextForTestsWithBody("/some-request-path/1/", `{"id": "error", "description": "Some transaction", "amount": "20.13", "date": "2023-09-30"}`, false)},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "created",
+			n:          httpService.(*httpServiceFinal),
+			args:       args{NewGinContextForTestsWithBody("/some-request-path/1/", validBody, false)},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:           "createdWithIdempotencyKey",
+			n:              httpService.(*httpServiceFinal),
+			args:           args{NewGinContextForTestsWithBody("/some-request-path/1/", validBody, false)},
+			idempotencyKey: "new-key",
+			wantStatus:     http.StatusCreated,
+		},
+		{
+			name:           "replayedIdempotencyKey",
+			n:              httpService.(*httpServiceFinal),
+			args:           args{NewGinContextForTestsWithBody("/some-request-path/1/", validBody, false)},
+			idempotencyKey: "replay",
+			wantStatus:     http.StatusCreated,
+		},
+		{
+			name:           "idempotencyKeyWithAnotherRequest",
+			n:              httpService.(*httpServiceFinal),
+			args:           args{NewGinContextForTestsWithBody("/some-request-path/1/", validBody, false)},
+			idempotencyKey: "conflict",
+			wantStatus:     http.StatusConflict,
+		},
+		{
+			name:           "idempotencyKeyInProgress",
+			n:              httpService.(*httpServiceFinal),
+			args:           args{NewGinContextForTestsWithBody("/some-request-path/1/", validBody, false)},
+			idempotencyKey: "inprogress",
+			wantStatus:     http.StatusConflict,
+		},
+		{
+			name:           "idempotencyKeyError",
+			n:              httpService.(*httpServiceFinal),
+			args:           args{NewGinContextForTestsWithBody("/some-request-path/1/", validBody, false)},
+			idempotencyKey: "error",
+			wantStatus:     http.StatusInternalServerError,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if tt.idempotencyKey != "" {
+				tt.args.c.Request.Header.Set(idempotencyKeyHeader, tt.idempotencyKey)
+			}
 			tt.n.PostPurchase(tt.args.c)
+			if got := tt.args.c.Writer.Status(); got != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal.PostPurchase() status = %d, want %d", tt.name, got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_UpdatePurchase(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name       string
+		n          *httpServiceFinal
+		id         string
+		body       string
+		replace    bool
+		wantStatus int
+	}{
+		{
+			name:       "putSuccess",
+			n:          httpService.(*httpServiceFinal),
+			id:         "abcd-fghi",
+			body:       `{"description": "Another transaction", "amount": "30.50", "date": "2023-10-01"}`,
+			replace:    true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "putIncomplete",
+			n:          httpService.(*httpServiceFinal),
+			id:         "abcd-fghi",
+			body:       `{"amount": "30.50"}`,
+			replace:    true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "patchSuccess",
+			n:          httpService.(*httpServiceFinal),
+			id:         "abcd-fghi",
+			body:       `{"amount": "30.50"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "patchInvalidBody",
+			n:          httpService.(*httpServiceFinal),
+			id:         "abcd-fghi",
+			body:       `{'amount': 30.50}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "patchError",
+			n:          httpService.(*httpServiceFinal),
+			id:         "error",
+			body:       `{"amount": "30.50"}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewGinContextForTestsWithBody("/purchases/"+tt.id, tt.body, false)
+			c.Params = gin.Params{{Key: "id", Value: tt.id}}
+			if tt.replace {
+				tt.n.UpdatePurchase(c)
+			} else {
+				tt.n.PatchPurchase(c)
+			}
+			if got := c.Writer.Status(); got != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal.updatePurchase() status = %d, want %d", tt.name, got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_DeletePurchase(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name       string
+		n          *httpServiceFinal
+		id         string
+		wantStatus int
+	}{
+		{
+			name:       "success",
+			n:          httpService.(*httpServiceFinal),
+			id:         "abcd-fghi",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "anyError",
+			n:          httpService.(*httpServiceFinal),
+			id:         "error",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewGinContextForTests("/purchases/"+tt.id, false)
+			c.Params = gin.Params{{Key: "id", Value: tt.id}}
+			tt.n.DeletePurchase(c)
+			if got := c.Writer.Status(); got != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal.DeletePurchase() status = %d, want %d", tt.name, got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_GetPurchaseHistory(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name       string
+		n          *httpServiceFinal
+		id         string
+		wantStatus int
+	}{
+		{
+			name:       "success",
+			n:          httpService.(*httpServiceFinal),
+			id:         "abcd-fghi",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "anyError",
+			n:          httpService.(*httpServiceFinal),
+			id:         "error",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewGinContextForTests("/purchases/"+tt.id+"/history", false)
+			c.Params = gin.Params{{Key: "id", Value: tt.id}}
+			tt.n.GetPurchaseHistory(c)
+			if got := c.Writer.Status(); got != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal.GetPurchaseHistory() status = %d, want %d", tt.name, got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_GetExchangeRevisions(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name            string
+		n               *httpServiceFinal
+		countrycurrency string
+		date            string
+		wantStatus      int
+	}{
+		{
+			name:            "success",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			date:            "2023-09-30",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:            "noRevisions",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "none",
+			date:            "2023-09-30",
+			wantStatus:      http.StatusNotFound,
+		},
+		{
+			name:            "anyError",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "error",
+			date:            "2023-09-30",
+			wantStatus:      http.StatusInternalServerError,
+		},
+		{
+			name:       "noCountrycurrency",
+			n:          httpService.(*httpServiceFinal),
+			date:       "2023-09-30",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:            "invalidDate",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			date:            "30/09/2023",
+			wantStatus:      http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/exchanges/"+url.PathEscape(tt.date)+"/revisions", nil)
+			if tt.countrycurrency != "" {
+				c.Request.Header.Set(countrycurrencyKey, tt.countrycurrency)
+			}
+			c.Params = gin.Params{{Key: "date", Value: tt.date}}
+			tt.n.GetExchangeRevisions(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("GetExchangeRevisions() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_LockConversions(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name            string
+		n               *httpServiceFinal
+		countrycurrency string
+		body            string
+		wantStatus      int
+		wantLocked      int
+	}{
+		{
+			name:            "success",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			body:            `{"ids": ["abcd-fghi", "jklm-nopq"]}`,
+			wantStatus:      http.StatusOK,
+			wantLocked:      2,
+		},
+		{
+			name:            "anyError",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "error",
+			body:            `{"ids": ["abcd-fghi"]}`,
+			wantStatus:      http.StatusInternalServerError,
+		},
+		{
+			name:       "noCountrycurrency",
+			n:          httpService.(*httpServiceFinal),
+			body:       `{"ids": ["abcd-fghi"]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:            "noIds",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			body:            `{"ids": []}`,
+			wantStatus:      http.StatusBadRequest,
+		},
+		{
+			name:            "invalidBody",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			body:            `{"ids": "abcd-fghi"}`,
+			wantStatus:      http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/purchases/lock", strings.NewReader(tt.body))
+			if tt.countrycurrency != "" {
+				c.Request.Header.Set(countrycurrencyKey, tt.countrycurrency)
+			}
+			tt.n.LockConversions(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("LockConversions() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got []*models.ConvertedAmount
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != tt.wantLocked || !got[0].Locked {
+				t.Errorf("LockConversions() = %s (%v), want %d locked conversions", w.Body.String(), err, tt.wantLocked)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_CreateRateOverride(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name       string
+		n          *httpServiceFinal
+		actor      string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "success",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			body:       `{"country_currency_desc": "Brazil-Real", "start_date": "2023-07-01", "end_date": "2023-09-30", "exchange_rate": "5.20", "reason": "missing quarter"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "invalidOverride",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			body:       `{"country_currency_desc": "invalid"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "anyError",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			body:       `{"country_currency_desc": "error"}`,
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "noActor",
+			n:          httpService.(*httpServiceFinal),
+			body:       `{"country_currency_desc": "Brazil-Real"}`,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalidBody",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			body:       `{"exchange_rate": 5.20}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/admin/rates/overrides", strings.NewReader(tt.body))
+			if tt.actor != "" {
+				c.Set(actorKey, tt.actor)
+			}
+			tt.n.CreateRateOverride(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("CreateRateOverride() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusCreated {
+				return
+			}
+			var got models.RateOverride
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.CreatedBy != tt.actor {
+				t.Errorf("CreateRateOverride() = %s (%v), want it created by %s", w.Body.String(), err, tt.actor)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_RemoveRateOverride(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name       string
+		n          *httpServiceFinal
+		actor      string
+		id         string
+		wantStatus int
+	}{
+		{
+			name:       "success",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			id:         "1",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "notFound",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			id:         "0",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "anyError",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			id:         "-1",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "invalidId",
+			n:          httpService.(*httpServiceFinal),
+			actor:      "finance",
+			id:         "first",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "noActor",
+			n:          httpService.(*httpServiceFinal),
+			id:         "1",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodDelete, "/admin/rates/overrides/"+tt.id, strings.NewReader(`{"reason": "Treasury published the quarter"}`))
+			if tt.actor != "" {
+				c.Set(actorKey, tt.actor)
+			}
+			c.Params = gin.Params{{Key: "id", Value: tt.id}}
+			tt.n.RemoveRateOverride(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("RemoveRateOverride() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_ListRateOverrides(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name            string
+		n               *httpServiceFinal
+		countrycurrency string
+		wantStatus      int
+	}{
+		{
+			name:       "everyCurrency",
+			n:          httpService.(*httpServiceFinal),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:            "oneCurrency",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "Brazil-Real",
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:            "anyError",
+			n:               httpService.(*httpServiceFinal),
+			countrycurrency: "error",
+			wantStatus:      http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, handler := range []func(c *gin.Context){tt.n.ListRateOverrides, tt.n.GetRateOverrideAudit} {
+				w := httptest.NewRecorder()
+				c, _ := gin.CreateTestContext(w)
+				c.Request = httptest.NewRequest(http.MethodGet, "/admin/rates/overrides", nil)
+				if tt.countrycurrency != "" {
+					c.Request.Header.Set(countrycurrencyKey, tt.countrycurrency)
+				}
+				handler(c)
+				if w.Code != tt.wantStatus {
+					t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_CheckConsistency(t *testing.T) {
+	tests := []struct {
+		name       string
+		registered bool
+		repair     bool
+		wantStatus int
+	}{
+		{
+			name:       "check",
+			registered: true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "repair",
+			registered: true,
+			repair:     true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "noChecker",
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, _ := NewManagerForTests()
+			n := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+			if tt.registered {
+				sm.Register(services.ConsistencyCheckerName, services.NewNoOpsConsistencyChecker().WithServiceManager(sm), services.ExchangeServiceName)
+			}
+			handler, method := n.CheckConsistency, http.MethodGet
+			if tt.repair {
+				handler, method = n.RepairConsistency, http.MethodPost
+			}
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(method, "/admin/consistency", nil)
+			handler(c)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var report models.ConsistencyReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatalf("an error '%s' was not expected when decoding the report", err)
+			}
+			if report.Repair != tt.repair || report.Consistent() != tt.repair {
+				t.Errorf("report = %+v, want repair %v", report, tt.repair)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_ImportPurchases(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name        string
+		n           *httpServiceFinal
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{
+			name:        "csv",
+			n:           httpService.(*httpServiceFinal),
+			contentType: "text/csv; charset=utf-8",
+			body:        "id,description,amount,date\na,Some transaction,20.13,2023-09-30\n",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "invalidCsvHeader",
+			n:           httpService.(*httpServiceFinal),
+			contentType: "text/csv",
+			body:        "id,amount\na,20.13\n",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "unsupportedContentType",
+			n:           httpService.(*httpServiceFinal),
+			contentType: "application/json",
+			body:        "[]",
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewGinContextForTestsWithBody("/purchases/import", tt.body, false)
+			c.Request.Header.Set("Content-Type", tt.contentType)
+			tt.n.ImportPurchases(c)
+			if got := c.Writer.Status(); got != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal.ImportPurchases() status = %d, want %d", tt.name, got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_GetAllPurchasesExport(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	httpService := sm.WithHttpService(NewHttpService()).HttpService()
+	tests := []struct {
+		name            string
+		n               *httpServiceFinal
+		query           string
+		countrycurrency string
+		wantStatus      int
+		wantContentType string
+		wantDegraded    bool
+	}{
+		{
+			name:            "csv",
+			n:               httpService.(*httpServiceFinal),
+			query:           "format=csv",
+			countrycurrency: "Brazil-Real",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/csv; charset=utf-8",
+		},
+		{
+			name:            "ndjson",
+			n:               httpService.(*httpServiceFinal),
+			query:           "format=ndjson",
+			countrycurrency: "Brazil-Real",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/x-ndjson",
+		},
+		{
+			name:            "staleRate",
+			n:               httpService.(*httpServiceFinal),
+			query:           "format=csv",
+			countrycurrency: "stale",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/csv; charset=utf-8",
+			wantDegraded:    true,
+		},
+		{
+			name:            "errorBeforeFirstRow",
+			n:               httpService.(*httpServiceFinal),
+			query:           "format=csv",
+			countrycurrency: "error",
+			wantStatus:      http.StatusNotFound,
+			wantContentType: "application/json; charset=utf-8",
+		},
+		{
+			name:            "unsupportedFormat",
+			n:               httpService.(*httpServiceFinal),
+			query:           "format=pdf",
+			countrycurrency: "Brazil-Real",
+			wantStatus:      http.StatusNotAcceptable,
+			wantContentType: "application/json; charset=utf-8",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := newGinContextForExport(tt.query, "")
+			c.Request.Header.Set(countrycurrencyKey, tt.countrycurrency)
+			tt.n.GetAllPurchases(c)
+			c.Writer.WriteHeaderNow()
+			if w.Code != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal.GetAllPurchases() status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("%s: httpServiceFinal.GetAllPurchases() Content-Type = %s, want %s", tt.name, got, tt.wantContentType)
+			}
+			if got := w.Result().Trailer.Get(degradedHeader) != ""; got != tt.wantDegraded {
+				t.Errorf("%s: httpServiceFinal.GetAllPurchases() %s trailer = %q, want it %v", tt.name, degradedHeader, w.Result().Trailer.Get(degradedHeader), tt.wantDegraded)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_Liveness_Readiness(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	notServing := sm.WithHttpService(NewHttpService()).HttpService()
+	smUp, _ := NewManagerForTests()
+	up := smUp.WithHttpService(NewHttpService()).HttpService()
+	smUp.WithHttpService(services.NewNoOpsHttpService())
+	tests := []struct {
+		name       string
+		n          *httpServiceFinal
+		readiness  bool
+		wantStatus int
+	}{
+		{
+			name:       "livenessUp",
+			n:          up.(*httpServiceFinal),
+			readiness:  false,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "readinessUp",
+			n:          up.(*httpServiceFinal),
+			readiness:  true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "livenessNotServing",
+			n:          notServing.(*httpServiceFinal),
+			readiness:  false,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "readinessNotServing",
+			n:          notServing.(*httpServiceFinal),
+			readiness:  true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewGinContextForTests("/healthz", false)
+			if tt.readiness {
+				tt.n.Readiness(c)
+			} else {
+				tt.n.Liveness(c)
+			}
+			if got := c.Writer.Status(); got != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal health status = %d, want %d", tt.name, got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_ReloadConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantStatus int
+	}{
+		{
+			name:       "success",
+			env:        map[string]string{"LOG_LEVEL": "debug"},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "invalid",
+			env:        map[string]string{"LOG_LEVEL": "loud"},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "rejected",
+			env:        map[string]string{"HTTP_ADDR": "127.0.0.1:1"},
+			wantStatus: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(config.ConfigFileEnv, "")
+			sm, ctx := NewManagerForTestsWithArgs(t)
+			n := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+			n.srv = &http.Server{Addr: sm.ConfigService().Config().Http.Addr}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c := NewGinContextForTests("/admin/config/reload", false)
+			c.Request = c.Request.WithContext(ctx)
+			n.ReloadConfig(c)
+			if got := c.Writer.Status(); got != tt.wantStatus {
+				t.Errorf("%s: httpServiceFinal.ReloadConfig() status = %d, want %d", tt.name, got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_httpServiceFinal_SetLogLevel(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	sm.WithLogsService(logs.NewLogsService())
+	n := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+	router := SetUpRouter()
+	router.GET("/admin/log/level", n.GetLogLevel)
+	router.PUT("/admin/log/level", n.SetLogLevel)
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantLevel  string
+	}{
+		{
+			name:       "debug",
+			body:       `{"level": "debug"}`,
+			wantStatus: http.StatusOK,
+			wantLevel:  "debug",
+		},
+		{
+			name:       "unknownLevel",
+			body:       `{"level": "loud"}`,
+			wantStatus: http.StatusBadRequest,
+			wantLevel:  "debug",
+		},
+		{
+			name:       "noLevel",
+			body:       `{}`,
+			wantStatus: http.StatusBadRequest,
+			wantLevel:  "debug",
+		},
+		{
+			name:       "warn",
+			body:       `{"level": "warn"}`,
+			wantStatus: http.StatusOK,
+			wantLevel:  "warn",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/log/level", strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("httpServiceFinal.SetLogLevel() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/log/level", nil))
+			var got models.LogLevel
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Level != tt.wantLevel {
+				t.Errorf("httpServiceFinal.GetLogLevel() = %s (%v), want %s", w.Body.String(), err, tt.wantLevel)
+			}
 		})
 	}
 }
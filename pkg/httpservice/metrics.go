@@ -0,0 +1,14 @@
+package httpservice
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// measureRequest counts the request and observes its latency, by route and status.
+func (n *httpServiceFinal) measureRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	n.sm.MetricsService().ObserveHttpRequest(c.Request.Method, routeOf(c), c.Writer.Status(), time.Since(start))
+}
@@ -0,0 +1,39 @@
+package httpservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/marcosArruda/purchases-multi-country/pkg/metrics"
+)
+
+func Test_httpServiceFinal_Metrics(t *testing.T) {
+	sm, _ := NewManagerForTests()
+	sm.WithMetricsService(metrics.NewMetricsService())
+	n := sm.WithHttpService(NewHttpService()).HttpService().(*httpServiceFinal)
+
+	router := SetUpRouter()
+	router.Use(n.measureRequest)
+	router.GET("/purchases/:id", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	router.GET("/metrics", n.Metrics)
+	for _, path := range []string{"/purchases/a", "/purchases/b", "/nowhere"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("httpServiceFinal.Metrics() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, want := range []string{
+		`purchases_http_requests_total{method="GET",route="/purchases/:id",status="404"} 2`,
+		`purchases_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("httpServiceFinal.Metrics() does not have %s", want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package httpservice
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// purchaseRoute prefixes the routes whose id parameter is a purchase ID, any other route with an id has ids
+	// of its own.
+	purchaseRoute = "/purchases/:id"
+)
+
+// validRequestID accepts the IDs sent by a proxy or a client as long as they are short and printable, so they
+// cannot break a log line.
+var validRequestID = regexp.MustCompile(`^[\x21-\x7e]{1,128}$`)
+
+// requestContext keeps the request ID, the route and the purchase ID of the path in the request context, so they
+// are in every line logged while handling it. The request ID sent in the X-Request-ID header is kept, a new one is
+// created otherwise, and it is always answered back in the same header.
+func requestContext(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = uuid.NewString()
+	}
+	c.Header(requestIDHeader, id)
+
+	ctx := services.WithRequestID(c.Request.Context(), id)
+	if route := c.FullPath(); route != "" {
+		ctx = services.WithRoute(ctx, c.Request.Method+" "+route)
+	}
+	if purchaseID := c.Param("id"); purchaseID != "" && strings.HasPrefix(c.FullPath(), purchaseRoute) {
+		ctx = services.WithPurchaseID(ctx, purchaseID)
+	}
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
@@ -0,0 +1,85 @@
+package httpservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+func Test_requestContext(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		requestID     string
+		wantRequestID string
+		wantRoute     string
+		wantPurchase  string
+	}{
+		{
+			name:          "propagated",
+			path:          "/purchases/abcd",
+			requestID:     "from-the-proxy-42",
+			wantRequestID: "from-the-proxy-42",
+			wantRoute:     "GET /purchases/:id",
+			wantPurchase:  "abcd",
+		},
+		{
+			name:         "purchaseHistory",
+			path:         "/purchases/abcd/history",
+			wantRoute:    "GET /purchases/:id/history",
+			wantPurchase: "abcd",
+		},
+		{
+			name:      "overrideIsNotAPurchase",
+			path:      "/admin/rates/overrides/42",
+			wantRoute: "GET /admin/rates/overrides/:id",
+		},
+		{
+			name:      "assigned",
+			path:      "/purchases",
+			wantRoute: "GET /purchases",
+		},
+		{
+			name:      "invalidReplaced",
+			path:      "/purchases",
+			requestID: "with spaces " + strings.Repeat("x", 200),
+			wantRoute: "GET /purchases",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got services.LogContext
+			router := SetUpRouter()
+			router.Use(requestContext)
+			handler := func(c *gin.Context) { got = services.LogContextFrom(c.Request.Context()) }
+			router.GET("/purchases", handler)
+			router.GET("/purchases/:id", handler)
+			router.GET("/purchases/:id/history", handler)
+			router.GET("/admin/rates/overrides/:id", handler)
+
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if tt.wantRequestID != "" && got.RequestID != tt.wantRequestID {
+				t.Errorf("requestContext() request ID = %s, want %s", got.RequestID, tt.wantRequestID)
+			}
+			if got.RequestID == "" || got.RequestID == tt.requestID && tt.wantRequestID == "" {
+				t.Errorf("requestContext() request ID = '%s', want a new one", got.RequestID)
+			}
+			if answered := w.Header().Get(requestIDHeader); answered != got.RequestID {
+				t.Errorf("requestContext() answered %s = %s, want %s", requestIDHeader, answered, got.RequestID)
+			}
+			if got.Route != tt.wantRoute || got.PurchaseID != tt.wantPurchase {
+				t.Errorf("requestContext() = %+v, want route %s and purchase %s", got, tt.wantRoute, tt.wantPurchase)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package httpservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingTracingService keeps every span ended, to check them once the request is answered.
+type recordingTracingService struct {
+	services.TracingService
+	tracer   trace.Tracer
+	recorder *tracetest.SpanRecorder
+}
+
+func newRecordingTracingService() *recordingTracingService {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return &recordingTracingService{services.NewNoOpsTracingService(), provider.Tracer("tests"), recorder}
+}
+
+func (r *recordingTracingService) WithServiceManager(sm services.ServiceManager) services.TracingService {
+	r.TracingService.WithServiceManager(sm)
+	return r
+}
+
+func (r *recordingTracingService) StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return r.tracer.Start(ctx, name, opts...)
+}
+
+func Test_httpServiceFinal_traceRequest(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name        string
+		path        string
+		traceparent string
+		status      int
+		wantName    string
+		wantTraceID string
+		wantError   bool
+	}{
+		{
+			name:        "continuesTheTrace",
+			path:        "/purchases/abcd",
+			traceparent: traceparent,
+			status:      http.StatusOK,
+			wantName:    "GET /purchases/:id",
+			wantTraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:      "newTraceWithError",
+			path:      "/purchases/abcd",
+			status:    http.StatusInternalServerError,
+			wantName:  "GET /purchases/:id",
+			wantError: true,
+		},
+		{
+			name:     "unmatched",
+			path:     "/nowhere",
+			status:   http.StatusNotFound,
+			wantName: "GET unmatched",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracing := newRecordingTracingService()
+			sm, _ := NewManagerForTests()
+			sm.WithTracingService(tracing)
+			n := NewHttpService().WithServiceManager(sm).(*httpServiceFinal)
+
+			router := SetUpRouter()
+			router.Use(n.traceRequest)
+			router.GET("/purchases/:id", func(c *gin.Context) {
+				_, child := sm.TracingService().StartSpan(c.Request.Context(), "child")
+				child.End()
+				c.Status(tt.status)
+			})
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			var server sdktrace.ReadOnlySpan
+			for _, s := range tracing.recorder.Ended() {
+				if s.SpanKind() == trace.SpanKindServer {
+					server = s
+				}
+			}
+			if server == nil || server.Name() != tt.wantName {
+				t.Fatalf("traceRequest() server span = %v, want one named %s", server, tt.wantName)
+			}
+			if tt.wantTraceID != "" && server.SpanContext().TraceID().String() != tt.wantTraceID {
+				t.Errorf("traceRequest() trace ID = %s, want %s", server.SpanContext().TraceID(), tt.wantTraceID)
+			}
+			if got := server.Status().Code == codes.Error; got != tt.wantError {
+				t.Errorf("traceRequest() error status = %v, want %v", got, tt.wantError)
+			}
+			for _, s := range tracing.recorder.Ended() {
+				if s.Name() == "child" && s.Parent().SpanID() != server.SpanContext().SpanID() {
+					t.Errorf("traceRequest() child span parent = %s, want %s", s.Parent().SpanID(), server.SpanContext().SpanID())
+				}
+			}
+		})
+	}
+}
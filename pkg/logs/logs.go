@@ -2,16 +2,28 @@ package logs
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"os"
+	"sync/atomic"
+	"time"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type (
 	logsServiceFinal struct {
 		sm              services.ServiceManager
 		logger          *zap.Logger
+		level           zap.AtomicLevel
+		app             *models.AppConfig
+		file            *lumberjack.Logger
+		redactor        atomic.Pointer[redactor]
 		AppNameField    zap.Field
 		AppVersionField zap.Field
 		AppEnvField     zap.Field
@@ -20,31 +32,138 @@ type (
 )
 
 var (
-	AppNameKey    key    = "service"
-	AppVersionKey key    = "version"
-	AppEnvKey     key    = "env"
-	AppName       string = "purchases-multi-country-app"
-	AppVersion    string = "1.0"
-	AppEnv        string = "PROD"
+	AppNameKey    key = "service"
+	AppVersionKey key = "version"
+	AppEnvKey     key = "env"
 )
 
+const (
+	traceIDKey = "trace_id"
+	spanIDKey  = "span_id"
+)
+
+// NewLogsService builds a LogsService writing JSON lines to stderr, so the services can log before it is started.
+// Start replaces the logger by the one of the app settings.
 func NewLogsService() services.LogsService {
-	logger, err := zap.NewProduction(zap.AddCallerSkip(1))
+	config := zap.NewProductionConfig()
+	logger, err := config.Build(zap.AddCallerSkip(1))
 	if err != nil {
 		log.Fatalf("can't initialize zap logger: %v", err)
 	}
 	defer logger.Sync()
-	return &logsServiceFinal{logger: logger}
+	f := &logsServiceFinal{logger: logger, level: config.Level}
+	f.setAppFields(&models.DefaultConfig().App)
+	if err := f.setRedaction(&models.DefaultConfig().App); err != nil {
+		log.Fatalf("can't parse the default log redaction: %v", err)
+	}
+	return f
 }
 
 func (f *logsServiceFinal) Start(ctx context.Context) error {
-	f.AppNameField = zap.String(string(AppNameKey), AppName)
-	f.AppVersionField = zap.String(string(AppVersionKey), AppVersion)
-	f.AppEnvField = zap.String(string(AppEnvKey), AppEnv)
+	app := f.sm.ConfigService().Config().App
+	if err := f.SetLevel(app.LogLevel); err != nil {
+		return err
+	}
+	if err := f.setRedaction(&app); err != nil {
+		return err
+	}
+	f.logger = f.build(&app)
+	f.app = &app
+	f.setAppFields(&app)
 	f.Info(ctx, "Staring LogsService")
 	return nil
 }
+
+func (f *logsServiceFinal) setAppFields(app *models.AppConfig) {
+	f.AppNameField = zap.String(string(AppNameKey), app.Name)
+	f.AppVersionField = zap.String(string(AppVersionKey), Version())
+	f.AppEnvField = zap.String(string(AppEnvKey), app.Env)
+}
+
+// build creates the logger of the app settings. It shares f.level, so the level changes without building it again.
+func (f *logsServiceFinal) build(app *models.AppConfig) *zap.Logger {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoder := zapcore.NewJSONEncoder(encoderConfig)
+	if app.LogEncoding == models.LogEncodingConsole {
+		encoderConfig = zap.NewDevelopmentEncoderConfig()
+		encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+	output := zapcore.Lock(os.Stderr)
+	if app.LogFile != "" {
+		f.file = &lumberjack.Logger{
+			Filename:   app.LogFile,
+			MaxSize:    app.LogFileMaxSizeMB,
+			MaxBackups: app.LogFileMaxBackups,
+			MaxAge:     app.LogFileMaxAgeDays,
+		}
+		output = zapcore.AddSync(f.file)
+	}
+	core := zapcore.NewCore(encoder, output, f.level)
+	if app.LogSamplingInitial > 0 {
+		core = zapcore.NewSamplerWithOptions(core, time.Second, app.LogSamplingInitial, app.LogSamplingThereafter)
+	}
+	return zap.New(core, zap.AddCaller(), zap.AddCallerSkip(1), zap.AddStacktrace(zapcore.ErrorLevel))
+}
+
+// Reconfigure changes the redaction right away and the log level when the level in the settings changes, a level
+// set with SetLevel is kept otherwise. The other app settings are in every log line or build the logger, they only
+// change with a restart.
+func (f *logsServiceFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	if f.app == nil {
+		if err := f.setRedaction(&cfg.App); err != nil {
+			return err
+		}
+		return f.SetLevel(cfg.App.LogLevel)
+	}
+	next := cfg.App
+	next.LogLevel, next.LogRedact, next.ShutdownTimeout = f.app.LogLevel, f.app.LogRedact, f.app.ShutdownTimeout
+	if next != *f.app {
+		return fmt.Errorf("the app settings other than logLevel, logRedact and shutdownTimeout cannot change without a restart")
+	}
+	if err := f.setRedaction(&cfg.App); err != nil {
+		return err
+	}
+	f.app.LogRedact = cfg.App.LogRedact
+	if cfg.App.LogLevel != f.app.LogLevel {
+		if err := f.SetLevel(cfg.App.LogLevel); err != nil {
+			return err
+		}
+		f.app.LogLevel = cfg.App.LogLevel
+	}
+	return nil
+}
+
+func (f *logsServiceFinal) setRedaction(app *models.AppConfig) error {
+	policies, err := app.Redaction()
+	if err != nil {
+		return err
+	}
+	r := redactor(policies)
+	f.redactor.Store(&r)
+	return nil
+}
+
+func (f *logsServiceFinal) Level() string {
+	return f.level.Level().String()
+}
+
+func (f *logsServiceFinal) SetLevel(level string) error {
+	l, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	f.level.SetLevel(l)
+	return nil
+}
+
+// Close flushes the buffered lines and closes the log file, if any.
 func (f *logsServiceFinal) Close(ctx context.Context) error {
+	// syncing stderr fails on some terminals, only the file matters.
+	_ = f.logger.Sync()
+	if f.file != nil {
+		return f.file.Close()
+	}
 	return nil
 }
 func (f *logsServiceFinal) Healthy(ctx context.Context) error {
@@ -57,15 +176,51 @@ func (f *logsServiceFinal) WithServiceManager(sm services.ServiceManager) servic
 func (f *logsServiceFinal) ServiceManager() services.ServiceManager {
 	return f.sm
 }
-func (f *logsServiceFinal) Info(ctx context.Context, s string) {
-	f.logger.Info(s, f.AppEnvField, f.AppNameField, f.AppVersionField)
+func (f *logsServiceFinal) Info(ctx context.Context, s string, kv ...any) {
+	f.logger.Info(s, f.fields(ctx, kv)...)
+}
+func (f *logsServiceFinal) Warn(ctx context.Context, s string, kv ...any) {
+	f.logger.Warn(s, f.fields(ctx, kv)...)
+}
+func (f *logsServiceFinal) Error(ctx context.Context, s string, kv ...any) {
+	f.logger.Error(s, f.fields(ctx, kv)...)
 }
-func (f *logsServiceFinal) Warn(ctx context.Context, s string) {
-	f.logger.Warn(s, f.AppEnvField, f.AppNameField, f.AppVersionField)
+func (f *logsServiceFinal) Debug(ctx context.Context, s string, kv ...any) {
+	f.logger.Debug(s, f.fields(ctx, kv)...)
 }
-func (f *logsServiceFinal) Error(ctx context.Context, s string) {
-	f.logger.Error(s, f.AppEnvField, f.AppNameField, f.AppVersionField)
+
+// fields builds the fields of a line: the app ones, the trace of the span in ctx, the identifiers kept in ctx
+// (see services.LogContext) and
+// the key/value pairs given, a key without a value is logged under the "ignored" key. The identifiers and the
+// pairs are redacted by the app.logRedact policies.
+func (f *logsServiceFinal) fields(ctx context.Context, kv []any) []zap.Field {
+	var r redactor
+	if p := f.redactor.Load(); p != nil {
+		r = *p
+	}
+	kv = append(services.LogContextFrom(ctx).Fields(), kv...)
+	fields := make([]zap.Field, 0, 3+len(kv)/2)
+	fields = append(fields, f.AppEnvField, f.AppNameField, f.AppVersionField)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields = append(fields, zap.String(traceIDKey, sc.TraceID().String()), zap.String(spanIDKey, sc.SpanID().String()))
+	}
+	for i := 0; i < len(kv); {
+		switch {
+		case isField(kv[i]):
+			fields = append(fields, r.redactField(kv[i].(zap.Field)))
+			i++
+		case i+1 == len(kv):
+			fields = append(fields, r.field("ignored", kv[i]))
+			i++
+		default:
+			fields = append(fields, r.field(fmt.Sprint(kv[i]), kv[i+1]))
+			i += 2
+		}
+	}
+	return fields
 }
-func (f *logsServiceFinal) Debug(ctx context.Context, s string) {
-	f.logger.Debug(s, f.AppEnvField, f.AppNameField, f.AppVersionField)
+
+func isField(v any) bool {
+	_, ok := v.(zap.Field)
+	return ok
 }
@@ -2,10 +2,18 @@ package logs
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func NewManagerForTests() (services.ServiceManager, context.Context) {
@@ -13,8 +21,8 @@ func NewManagerForTests() (services.ServiceManager, context.Context) {
 	stop := make(chan struct{})
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, AppEnvKey, "TESTS")
-	ctx = context.WithValue(ctx, AppNameKey, AppName)
-	ctx = context.WithValue(ctx, AppVersionKey, AppVersion)
+	ctx = context.WithValue(ctx, AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, AppVersionKey, Version())
 	return services.NewManager(asyncWorkChannel, stop), ctx
 }
 
@@ -39,8 +47,8 @@ func Test_logsServiceFinal_Start(t *testing.T) {
 	type args struct {
 		ctx context.Context
 	}
-	_, ctx := NewManagerForTests()
-	s := NewLogsService()
+	sm, ctx := NewManagerForTests()
+	s := NewLogsService().WithServiceManager(sm)
 	tests := []struct {
 		name    string
 		f       *logsServiceFinal
@@ -175,3 +183,247 @@ func Test_logsServiceFinal_ServiceManager(t *testing.T) {
 		})
 	}
 }
+
+func Test_logsServiceFinal_Reconfigure(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	s := NewLogsService().WithServiceManager(sm).(*logsServiceFinal)
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("logsServiceFinal.Start() error = %v", err)
+	}
+	tests := []struct {
+		name      string
+		env       string
+		encoding  string
+		setLevel  string
+		level     string
+		wantLevel zapcore.Level
+		wantErr   bool
+	}{
+		{
+			name:      "levelChanged",
+			env:       "PROD",
+			level:     "debug",
+			wantLevel: zapcore.DebugLevel,
+			wantErr:   false,
+		},
+		{
+			name:      "envChanged",
+			env:       "STAGING",
+			level:     "warn",
+			wantLevel: zapcore.DebugLevel,
+			wantErr:   true,
+		},
+		{
+			name:      "encodingChanged",
+			env:       "PROD",
+			encoding:  models.LogEncodingConsole,
+			level:     "warn",
+			wantLevel: zapcore.DebugLevel,
+			wantErr:   true,
+		},
+		{
+			name:      "levelSetAtRuntimeKept",
+			env:       "PROD",
+			setLevel:  "error",
+			level:     "debug",
+			wantLevel: zapcore.ErrorLevel,
+			wantErr:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setLevel != "" {
+				if err := s.SetLevel(tt.setLevel); err != nil {
+					t.Fatalf("logsServiceFinal.SetLevel() error = %v", err)
+				}
+			}
+			cfg := models.DefaultConfig()
+			cfg.App.Env = tt.env
+			cfg.App.LogLevel = tt.level
+			if tt.encoding != "" {
+				cfg.App.LogEncoding = tt.encoding
+			}
+			if err := s.Reconfigure(ctx, cfg); (err != nil) != tt.wantErr {
+				t.Errorf("logsServiceFinal.Reconfigure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := s.level.Level(); got != tt.wantLevel {
+				t.Errorf("logsServiceFinal.Reconfigure() level = %s, want %s", got, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func Test_logsServiceFinal_fields(t *testing.T) {
+	core, logged := observer.New(zapcore.DebugLevel)
+	s := &logsServiceFinal{
+		logger:          zap.New(core),
+		AppNameField:    zap.String(string(AppNameKey), "purchases-multi-country-app"),
+		AppVersionField: zap.String(string(AppVersionKey), Version()),
+		AppEnvField:     zap.String(string(AppEnvKey), "TESTS"),
+	}
+	ctx := services.WithJobID(services.WithRequestID(context.Background(), "req-1"), "job-1")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		kv   []any
+		want map[string]any
+	}{
+		{
+			name: "withoutContext",
+			ctx:  context.Background(),
+			want: map[string]any{},
+		},
+		{
+			name: "fromContext",
+			ctx:  ctx,
+			want: map[string]any{services.RequestIDKey: "req-1", services.JobIDKey: "job-1"},
+		},
+		{
+			name: "keyValues",
+			ctx:  ctx,
+			kv:   []any{"dates", 3, zap.String("country", "Brazil"), "dangling"},
+			want: map[string]any{services.RequestIDKey: "req-1", services.JobIDKey: "job-1", "dates": int64(3), "country": "Brazil", "ignored": "dangling"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Info(tt.ctx, tt.name, tt.kv...)
+			entries := logged.TakeAll()
+			if len(entries) != 1 {
+				t.Fatalf("logsServiceFinal.Info() logged %d lines, want 1", len(entries))
+			}
+			got := entries[0].ContextMap()
+			for _, k := range []string{string(AppEnvKey), string(AppNameKey), string(AppVersionKey)} {
+				delete(got, k)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("logsServiceFinal.Info() fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_logsServiceFinal_build(t *testing.T) {
+	tests := []struct {
+		name      string
+		encoding  string
+		sampling  int
+		wantLines int
+		wantJSON  bool
+	}{
+		{
+			name:      "json",
+			encoding:  models.LogEncodingJSON,
+			wantLines: 6,
+			wantJSON:  true,
+		},
+		{
+			name:      "console",
+			encoding:  models.LogEncodingConsole,
+			wantLines: 6,
+			wantJSON:  false,
+		},
+		{
+			name:      "sampled",
+			encoding:  models.LogEncodingJSON,
+			sampling:  2,
+			wantLines: 3,
+			wantJSON:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTests()
+			cfg := models.DefaultConfig()
+			cfg.App.LogEncoding = tt.encoding
+			cfg.App.LogSamplingInitial, cfg.App.LogSamplingThereafter = tt.sampling, 0
+			cfg.App.LogFile = filepath.Join(t.TempDir(), "app.log")
+			if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+				t.Fatalf("configService.Reconfigure() error = %v", err)
+			}
+			s := NewLogsService().WithServiceManager(sm)
+			if err := s.Start(ctx); err != nil {
+				t.Fatalf("logsServiceFinal.Start() error = %v", err)
+			}
+			for i := 0; i < 5; i++ {
+				s.Info(ctx, "noisy line")
+			}
+			if err := s.Close(ctx); err != nil {
+				t.Fatalf("logsServiceFinal.Close() error = %v", err)
+			}
+			b, err := os.ReadFile(cfg.App.LogFile)
+			if err != nil {
+				t.Fatalf("reading the log file: %v", err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) != tt.wantLines {
+				t.Errorf("logsServiceFinal logged %d lines, want %d:\n%s", len(lines), tt.wantLines, b)
+			}
+			if got := strings.HasPrefix(lines[0], "{"); got != tt.wantJSON {
+				t.Errorf("logsServiceFinal logged JSON = %v, want %v: %s", got, tt.wantJSON, lines[0])
+			}
+		})
+	}
+}
+
+func Test_logsServiceFinal_redaction(t *testing.T) {
+	core, logged := observer.New(zapcore.DebugLevel)
+	s := &logsServiceFinal{logger: zap.New(core)}
+	s.setAppFields(&models.DefaultConfig().App)
+	if err := s.setRedaction(&models.AppConfig{LogRedact: "description:mask,amount:mask,purchase_id:hash,id:hash"}); err != nil {
+		t.Fatalf("logsServiceFinal.setRedaction() error = %v", err)
+	}
+	hashed := redact(models.RedactHash, "abcd")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		kv   []any
+		want map[string]any
+	}{
+		{
+			name: "keyValues",
+			ctx:  context.Background(),
+			kv:   []any{"description", "Dinner at Joe's", "dates", 3},
+			want: map[string]any{"description": models.RedactedValue, "dates": int64(3)},
+		},
+		{
+			name: "field",
+			ctx:  context.Background(),
+			kv:   []any{zap.String("amount", "20.13"), zap.String("country", "Brazil")},
+			want: map[string]any{"amount": models.RedactedValue, "country": "Brazil"},
+		},
+		{
+			name: "fromContext",
+			ctx:  services.WithPurchaseID(context.Background(), "abcd"),
+			want: map[string]any{services.PurchaseIDKey: hashed},
+		},
+		{
+			name: "nested",
+			ctx:  context.Background(),
+			kv:   []any{"purchase", &models.Purchase{Id: "abcd", Description: "Dinner at Joe's", Amount: "20.13", Date: "2023-09-30"}},
+			want: map[string]any{"purchase": map[string]any{"id": hashed, "description": models.RedactedValue, "amount": models.RedactedValue, "date": "2023-09-30"}},
+		},
+		{
+			name: "error",
+			ctx:  context.Background(),
+			kv:   []any{"cause", errors.New("timeout")},
+			want: map[string]any{"cause": "timeout"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Info(tt.ctx, tt.name, tt.kv...)
+			entries := logged.TakeAll()
+			if len(entries) != 1 {
+				t.Fatalf("logsServiceFinal.Info() logged %d lines, want 1", len(entries))
+			}
+			got := entries[0].ContextMap()
+			for _, k := range []string{string(AppEnvKey), string(AppNameKey), string(AppVersionKey)} {
+				delete(got, k)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("logsServiceFinal.Info() fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
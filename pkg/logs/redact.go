@@ -0,0 +1,82 @@
+package logs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redactor holds the policy of each redacted field, by key, see models.AppConfig.Redaction.
+type redactor map[string]string
+
+// field builds the field of a key/value pair, redacting the value when the key is redacted, or the redacted keys
+// inside it when it is a struct, a map or a slice.
+func (r redactor) field(key string, value any) zap.Field {
+	return zap.Any(key, r.value(key, value))
+}
+
+// redactField redacts a field given as is, like zap.String("description", d).
+func (r redactor) redactField(f zap.Field) zap.Field {
+	if _, ok := r[f.Key]; ok {
+		enc := zapcore.NewMapObjectEncoder()
+		f.AddTo(enc)
+		return r.field(f.Key, enc.Fields[f.Key])
+	}
+	if f.Type == zapcore.ReflectType {
+		return r.field(f.Key, f.Interface)
+	}
+	return f
+}
+
+func (r redactor) value(key string, value any) any {
+	if policy, ok := r[key]; ok {
+		return redact(policy, value)
+	}
+	if len(r) == 0 || value == nil {
+		return value
+	}
+	if _, ok := value.(error); ok {
+		return value
+	}
+	switch reflect.Indirect(reflect.ValueOf(value)).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		// the JSON form is the one logged, so its keys are the ones matched.
+		var generic any
+		if b, err := json.Marshal(value); err == nil && json.Unmarshal(b, &generic) == nil {
+			return r.walk(generic)
+		}
+	}
+	return value
+}
+
+func (r redactor) walk(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, e := range t {
+			if policy, ok := r[k]; ok {
+				t[k] = redact(policy, e)
+			} else {
+				t[k] = r.walk(e)
+			}
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = r.walk(e)
+		}
+	}
+	return v
+}
+
+func redact(policy string, value any) string {
+	if policy == models.RedactHash {
+		sum := sha256.Sum256([]byte(fmt.Sprint(value)))
+		return "sha256:" + hex.EncodeToString(sum[:])[:12]
+	}
+	return models.RedactedValue
+}
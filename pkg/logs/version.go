@@ -0,0 +1,52 @@
+package logs
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// version is set at build time with -ldflags "-X github.com/marcosArruda/purchases-multi-country/pkg/logs.version=1.4.0",
+// when it is not Version falls back to the build info.
+var version string
+
+var versionOnce sync.Once
+
+// Version returns the version of the running binary: the one given at build time, the module version when it was
+// installed with go install, or the vcs revision it was built from.
+func Version() string {
+	versionOnce.Do(func() {
+		if version == "" {
+			version = buildVersion()
+		}
+	})
+	return version
+}
+
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -5,9 +5,26 @@ import (
 )
 
 var (
-	ErrSwApiUnavailableError = errors.New("something went wrong accessing treasury data")
-	ErrNoPurchaseFound       = errors.New("no Purchase found")
-	ErrNoExchangeFound       = errors.New("no Exchange found")
+	ErrSwApiUnavailableError  = errors.New("something went wrong accessing treasury data")
+	ErrNoPurchaseFound        = errors.New("no Purchase found")
+	ErrNoExchangeFound        = errors.New("no Exchange found")
+	ErrPurchaseIdConflict     = errors.New("a different Purchase with the same id already exists")
+	ErrNoIdempotencyKeyFound  = errors.New("no Idempotency-Key found")
+	ErrInvalidPurchase        = errors.New("invalid Purchase")
+	ErrDuplicatedPurchase     = errors.New("the same Purchase already exists")
+	ErrInvalidImport          = errors.New("invalid import file")
+	ErrUnsupportedImport      = errors.New("unsupported import format, use text/csv or application/x-ndjson")
+	ErrUnsupportedExport      = errors.New("unsupported export format, use json, csv, xlsx or ndjson")
+	ErrInvalidConfig          = errors.New("invalid configuration")
+	ErrConfigRejected         = errors.New("configuration rejected")
+	ErrServiceNotRegistered   = errors.New("service not registered")
+	ErrServiceType            = errors.New("service of another type")
+	ErrServiceDependencyCycle = errors.New("services depending on each other")
+	ErrTxDone                 = errors.New("the transaction has already been committed or rolled back")
+	ErrInvalidAsOf            = errors.New("invalid as_of, use a date like 2023-09-30 or a RFC 3339 time")
+	ErrNoConversionFound      = errors.New("no locked conversion found")
+	ErrInvalidOverride        = errors.New("invalid rate override")
+	ErrNoOverrideFound        = errors.New("no rate override found")
 )
 
 type (
@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "purchases"
+
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+
+	// maxCurrencies bounds the currencies labeled one by one, the Countrycurrency header is sent by the clients.
+	maxCurrencies = 200
+	otherCurrency = "other"
+)
+
+type (
+	metricsServiceFinal struct {
+		sm       services.ServiceManager
+		registry *prometheus.Registry
+
+		httpRequests        *prometheus.CounterVec
+		httpDuration        *prometheus.HistogramVec
+		treasuryCalls       *prometheus.CounterVec
+		treasuryDuration    prometheus.Histogram
+		databaseDuration    *prometheus.HistogramVec
+		asyncWorks          *prometheus.CounterVec
+		conversionFailures  *prometheus.CounterVec
+		conversionsDegraded *prometheus.CounterVec
+		purchasesCreated    prometheus.Counter
+		purchasesMerged     prometheus.Counter
+
+		currenciesMu sync.Mutex
+		currencies   map[string]bool
+	}
+)
+
+// NewMetricsService builds a MetricsService with its own registry, so the tests can build as many as they need.
+// The metrics can be observed before it is started.
+func NewMetricsService() services.MetricsService {
+	n := &metricsServiceFinal{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "http", Name: "requests_total",
+			Help: "Http requests answered, by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+			Help: "Latency of the http requests, by method and route.", Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		treasuryCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "treasury", Name: "calls_total",
+			Help: "Calls to the Treasury API, by outcome.",
+		}, []string{"outcome"}),
+		treasuryDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "treasury", Name: "call_duration_seconds",
+			Help: "Latency of the calls to the Treasury API.", Buckets: prometheus.DefBuckets,
+		}),
+		databaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "db", Name: "query_duration_seconds",
+			Help: "Latency of the Database methods, by method.", Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+		asyncWorks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "async", Name: "works_total",
+			Help: "Async works done, by outcome.",
+		}, []string{"outcome"}),
+		conversionFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "conversion_failures_total",
+			Help: "Purchases that could not be converted, by country currency.",
+		}, []string{"countrycurrency"}),
+		conversionsDegraded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "conversions_degraded_total",
+			Help: "Purchases converted by a stale rate while the Treasury API was unavailable, by country currency.",
+		}, []string{"countrycurrency"}),
+		purchasesCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "created_total",
+			Help: "Purchases created.",
+		}),
+		purchasesMerged: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "deduplicated_total",
+			Help: "Purchases not created because an equal one already exists.",
+		}),
+		currencies: make(map[string]bool),
+	}
+	n.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		n.httpRequests, n.httpDuration, n.treasuryCalls, n.treasuryDuration, n.databaseDuration, n.asyncWorks,
+		n.conversionFailures, n.conversionsDegraded, n.purchasesCreated, n.purchasesMerged,
+	)
+	return n
+}
+
+// Start registers the metrics read from the other services when scraped: the async queue depth, the database
+// pool statistics and the RateCache stats.
+func (n *metricsServiceFinal) Start(ctx context.Context) error {
+	gauge := func(subsystem string, name string, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, value)
+	}
+	counter := func(subsystem string, name string, help string, value func() float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, value)
+	}
+	stats := func() sql.DBStats { return n.sm.Database().Stats() }
+	cacheStats := func() models.RateCacheStats {
+		cache, err := services.Get[services.RateCache](n.sm, services.RateCacheName)
+		if err != nil {
+			return models.RateCacheStats{}
+		}
+		return cache.Stats()
+	}
+	for _, c := range []prometheus.Collector{
+		gauge("async", "queue_depth", "Async works submitted and not finished yet.", func() float64 { return float64(n.sm.AsyncQueueDepth()) }),
+		gauge("db", "connections_open", "Connections open, in use or idle.", func() float64 { return float64(stats().OpenConnections) }),
+		gauge("db", "connections_in_use", "Connections in use.", func() float64 { return float64(stats().InUse) }),
+		gauge("db", "connections_idle", "Idle connections.", func() float64 { return float64(stats().Idle) }),
+		gauge("db", "connections_max_open", "Maximum connections open.", func() float64 { return float64(stats().MaxOpenConnections) }),
+		counter("db", "connections_wait_total", "Connections waited for.", func() float64 { return float64(stats().WaitCount) }),
+		counter("db", "connections_wait_seconds_total", "Time waited for a connection.", func() float64 { return stats().WaitDuration.Seconds() }),
+		counter("ratecache", "hits_total", "Exchange rates found in the RateCache.", func() float64 { return float64(cacheStats().Hits) }),
+		counter("ratecache", "misses_total", "Exchange rates read from the database by the RateCache.", func() float64 { return float64(cacheStats().Misses) }),
+		counter("ratecache", "evictions_total", "Exchange rates dropped from the RateCache to make room or expired.", func() float64 { return float64(cacheStats().Evictions) }),
+		counter("ratecache", "invalidations_total", "Exchange rates dropped from the RateCache because a new rate was written.", func() float64 { return float64(cacheStats().Invalidations) }),
+		gauge("ratecache", "size", "Exchange rates kept in the RateCache.", func() float64 { return float64(cacheStats().Size) }),
+	} {
+		if err := n.registry.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	n.sm.LogsService().Info(ctx, "Metrics Service Started!")
+	return nil
+}
+
+func (n *metricsServiceFinal) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *metricsServiceFinal) Healthy(ctx context.Context) error {
+	return nil
+}
+
+func (n *metricsServiceFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func (n *metricsServiceFinal) WithServiceManager(sm services.ServiceManager) services.MetricsService {
+	n.sm = sm
+	return n
+}
+
+func (n *metricsServiceFinal) ServiceManager() services.ServiceManager {
+	return n.sm
+}
+
+func (n *metricsServiceFinal) Handler() http.Handler {
+	return promhttp.HandlerFor(n.registry, promhttp.HandlerOpts{Registry: n.registry})
+}
+
+func (n *metricsServiceFinal) ObserveHttpRequest(method string, route string, status int, d time.Duration) {
+	n.httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	n.httpDuration.WithLabelValues(method, route).Observe(d.Seconds())
+}
+
+func (n *metricsServiceFinal) ObserveTreasuryCall(d time.Duration, err error) {
+	n.treasuryCalls.WithLabelValues(outcome(err)).Inc()
+	n.treasuryDuration.Observe(d.Seconds())
+}
+
+func (n *metricsServiceFinal) ObserveDatabaseQuery(method string, d time.Duration) {
+	n.databaseDuration.WithLabelValues(method).Observe(d.Seconds())
+}
+
+func (n *metricsServiceFinal) ObserveAsyncWork(err error) {
+	n.asyncWorks.WithLabelValues(outcome(err)).Inc()
+}
+
+func (n *metricsServiceFinal) ConversionFailed(countrycurrency string) {
+	n.conversionFailures.WithLabelValues(n.currencyLabel(countrycurrency)).Inc()
+}
+
+func (n *metricsServiceFinal) ConversionDegraded(countrycurrency string) {
+	n.conversionsDegraded.WithLabelValues(n.currencyLabel(countrycurrency)).Inc()
+}
+
+func (n *metricsServiceFinal) PurchasesInserted(created int, deduplicated int) {
+	n.purchasesCreated.Add(float64(created))
+	n.purchasesMerged.Add(float64(deduplicated))
+}
+
+// currencyLabel returns countrycurrency until maxCurrencies different ones were seen, and otherCurrency after.
+func (n *metricsServiceFinal) currencyLabel(countrycurrency string) string {
+	n.currenciesMu.Lock()
+	defer n.currenciesMu.Unlock()
+	if !n.currencies[countrycurrency] {
+		if len(n.currencies) >= maxCurrencies {
+			return otherCurrency
+		}
+		n.currencies[countrycurrency] = true
+	}
+	return countrycurrency
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+func NewManagerForTests() (services.ServiceManager, context.Context) {
+	return services.NewManager(nil, nil), context.Background()
+}
+
+func scrape(t *testing.T, ms services.MetricsService) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	ms.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metricsServiceFinal.Handler() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	return w.Body.String()
+}
+
+func Test_metricsServiceFinal_Handler(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	ms := NewMetricsService()
+	sm.WithMetricsService(ms)
+	if err := ms.Start(ctx); err != nil {
+		t.Fatalf("metricsServiceFinal.Start() error = %v", err)
+	}
+	ms.ObserveHttpRequest(http.MethodGet, "/purchases/:id", http.StatusOK, 20*time.Millisecond)
+	ms.ObserveTreasuryCall(time.Second, errors.New("timeout"))
+	ms.ObserveTreasuryCall(time.Second, nil)
+	ms.ObserveDatabaseQuery("GetPurchaseById", time.Millisecond)
+	ms.ObserveAsyncWork(nil)
+	ms.ConversionFailed("Brazil-Real")
+	ms.PurchasesInserted(3, 1)
+
+	got := scrape(t, ms)
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "httpRequests", want: `purchases_http_requests_total{method="GET",route="/purchases/:id",status="200"} 1`},
+		{name: "httpDuration", want: `purchases_http_request_duration_seconds_count{method="GET",route="/purchases/:id"} 1`},
+		{name: "treasuryErrors", want: `purchases_treasury_calls_total{outcome="error"} 1`},
+		{name: "treasuryDuration", want: `purchases_treasury_call_duration_seconds_count 2`},
+		{name: "databaseDuration", want: `purchases_db_query_duration_seconds_count{method="GetPurchaseById"} 1`},
+		{name: "databasePool", want: `purchases_db_connections_open 0`},
+		{name: "asyncQueueDepth", want: `purchases_async_queue_depth 0`},
+		{name: "asyncWorks", want: `purchases_async_works_total{outcome="success"} 1`},
+		{name: "conversionFailures", want: `purchases_conversion_failures_total{countrycurrency="Brazil-Real"} 1`},
+		{name: "created", want: `purchases_created_total 3`},
+		{name: "deduplicated", want: `purchases_deduplicated_total 1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(got, tt.want+"\n") {
+				t.Errorf("metricsServiceFinal.Handler() does not have %s", tt.want)
+			}
+		})
+	}
+}
+
+func Test_metricsServiceFinal_ConversionFailed(t *testing.T) {
+	ms := NewMetricsService()
+	for i := 0; i < maxCurrencies+10; i++ {
+		ms.ConversionFailed(fmt.Sprintf("Country%d-Currency", i))
+	}
+	got := scrape(t, ms)
+	if n := strings.Count(got, "purchases_conversion_failures_total{"); n != maxCurrencies+1 {
+		t.Errorf("metricsServiceFinal.ConversionFailed() labeled %d currencies, want %d", n, maxCurrencies+1)
+	}
+	if want := `purchases_conversion_failures_total{countrycurrency="other"} 10`; !strings.Contains(got, want) {
+		t.Errorf("metricsServiceFinal.ConversionFailed() does not have %s", want)
+	}
+}
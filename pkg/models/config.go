@@ -0,0 +1,295 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DedupPolicyNone only deduplicates purchases sent with the same Idempotency-Key.
+	DedupPolicyNone = "none"
+	// DedupPolicySignature also merges purchases with the same amount, date and description beginning.
+	DedupPolicySignature = "signature"
+
+	// StaleRatesNone fails the conversions the Treasury API is needed for while it is unavailable.
+	StaleRatesNone = "none"
+	// StaleRatesNewest converts by the newest rate stored when the Treasury API is unavailable, even if it is older
+	// than 6 months, marking the answer as degraded.
+	StaleRatesNewest = "newest"
+
+	// DatabaseDriverMySQL connects to the MySQL server of database.hostPort.
+	DatabaseDriverMySQL = "mysql"
+	// DatabaseDriverSQLite keeps the data in the SQLite file of database.path, no database server is needed.
+	DatabaseDriverSQLite = "sqlite"
+	// DatabaseDriverMemory keeps the data in memory, for demos and tests, saving it to database.snapshot if set.
+	DatabaseDriverMemory = "memory"
+
+	// LogEncodingJSON writes one JSON object for each line, for the log collectors.
+	LogEncodingJSON = "json"
+	// LogEncodingConsole writes colored plain text lines, for local development.
+	LogEncodingConsole = "console"
+
+	// RedactMask replaces the value of a log field by RedactedValue.
+	RedactMask = "mask"
+	// RedactHash replaces the value of a log field by the beginning of its SHA-256, equal values still match.
+	RedactHash = "hash"
+	// RedactedValue is logged in place of the masked values.
+	RedactedValue = "[REDACTED]"
+
+	// TracingExporterNone keeps the spans in the process only, they are not exported.
+	TracingExporterNone = "none"
+	// TracingExporterStdout writes the spans to the standard output, for local debugging.
+	TracingExporterStdout = "stdout"
+	// TracingExporterOTLP sends the spans to an OpenTelemetry collector over OTLP/HTTP.
+	TracingExporterOTLP = "otlp"
+)
+
+type (
+	Config struct {
+		/*
+			Every setting of the application, one section for each service.
+			Each setting can be given in the config file (yaml tag), by an environment variable (env tag) or by a
+			command line flag (flag tag), from the lowest to the highest precedence.
+			The settings marked as reloadable can change with a SIGHUP or POST /admin/config/reload, the others
+			need a restart.
+		*/
+		App       AppConfig       `yaml:"app"`
+		Http      HttpConfig      `yaml:"http"`
+		Database  DatabaseConfig  `yaml:"database"`
+		Treasury  TreasuryConfig  `yaml:"treasury"`
+		Exchange  ExchangeConfig  `yaml:"exchange"`
+		RateCache RateCacheConfig `yaml:"rateCache"`
+		Tracing   TracingConfig   `yaml:"tracing"`
+	}
+
+	AppConfig struct {
+		/*
+			Name: the service name in the logs and in the spans
+			LogLevel: debug, info, warn or error, reloadable
+			LogEncoding: LogEncodingJSON or LogEncodingConsole
+			LogSamplingInitial, LogSamplingThereafter: each second, after the first LogSamplingInitial lines with the
+			same level and message only one of every LogSamplingThereafter is logged, 0 initial turns it off
+			LogFile: the file the logs are written to instead of stderr, rotated when it gets LogFileMaxSizeMB
+			big. LogFileMaxBackups rotated files are kept, for up to LogFileMaxAgeDays days (0 keeps them all)
+			LogRedact: the log fields redacted and how, like "description:mask,purchase_id:hash" (see Redaction), reloadable
+			ShutdownTimeout: how long the in-flight requests and the async work have to finish on shutdown, reloadable
+		*/
+		Env                   string        `yaml:"env" env:"APP_ENV" flag:"env"`
+		Name                  string        `yaml:"name" env:"APP_NAME" flag:"app-name"`
+		LogLevel              string        `yaml:"logLevel" env:"LOG_LEVEL" flag:"log-level"`
+		LogEncoding           string        `yaml:"logEncoding" env:"LOG_ENCODING" flag:"log-encoding"`
+		LogSamplingInitial    int           `yaml:"logSamplingInitial" env:"LOG_SAMPLING_INITIAL" flag:"log-sampling-initial"`
+		LogSamplingThereafter int           `yaml:"logSamplingThereafter" env:"LOG_SAMPLING_THEREAFTER" flag:"log-sampling-thereafter"`
+		LogFile               string        `yaml:"logFile" env:"LOG_FILE" flag:"log-file"`
+		LogFileMaxSizeMB      int           `yaml:"logFileMaxSizeMB" env:"LOG_FILE_MAX_SIZE_MB" flag:"log-file-max-size-mb"`
+		LogFileMaxBackups     int           `yaml:"logFileMaxBackups" env:"LOG_FILE_MAX_BACKUPS" flag:"log-file-max-backups"`
+		LogFileMaxAgeDays     int           `yaml:"logFileMaxAgeDays" env:"LOG_FILE_MAX_AGE_DAYS" flag:"log-file-max-age-days"`
+		LogRedact             string        `yaml:"logRedact" env:"LOG_REDACT" flag:"log-redact"`
+		ShutdownTimeout       time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout"`
+	}
+
+	HttpConfig struct {
+		/*
+			IdempotencyKeyTTL: how long an Idempotency-Key is kept before it can be reused, reloadable
+			HealthCheckTimeout: how long /healthz and /readyz wait for the services to answer, reloadable
+			AdminTokens: the bearer tokens of the /admin routes and the actor each one authenticates, like
+			"finance@example.com:s3cr3t,ops:t0k3n", none rejects every admin request, reloadable (see AdminActors)
+		*/
+		Addr               string        `yaml:"addr" env:"HTTP_ADDR" flag:"http-addr"`
+		IdempotencyKeyTTL  time.Duration `yaml:"idempotencyKeyTTL" env:"IDEMPOTENCY_KEY_TTL" flag:"idempotency-key-ttl"`
+		HealthCheckTimeout time.Duration `yaml:"healthCheckTimeout" env:"HEALTH_CHECK_TIMEOUT" flag:"health-check-timeout"`
+		AdminTokens        string        `yaml:"adminTokens" env:"ADMIN_TOKENS" flag:"admin-tokens"`
+	}
+
+	DatabaseConfig struct {
+		/*
+			Only the pool settings (MaxOpenConns, MaxIdleConns and ConnMaxLifetime) are reloadable.
+				Driver: DatabaseDriverMySQL, DatabaseDriverSQLite or DatabaseDriverMemory
+				Path: the SQLite database file, only used by DatabaseDriverSQLite
+				Snapshot: the JSON file loaded on start and saved on shutdown, only used by DatabaseDriverMemory
+				User, Password and HostPort are only used by DatabaseDriverMySQL
+		*/
+		Driver          string        `yaml:"driver" env:"DB_DRIVER" flag:"db-driver"`
+		Path            string        `yaml:"path" env:"DB_PATH" flag:"db-path"`
+		Snapshot        string        `yaml:"snapshot" env:"DB_SNAPSHOT" flag:"db-snapshot"`
+		Name            string        `yaml:"name" env:"DB_NAME" flag:"db-name"`
+		User            string        `yaml:"user" env:"DB_USER" flag:"db-user"`
+		Password        string        `yaml:"password" env:"DB_PASSWORD" flag:"db-password"`
+		HostPort        string        `yaml:"hostPort" env:"DB_HOSTPORT" flag:"db-hostport"`
+		MaxOpenConns    int           `yaml:"maxOpenConns" env:"DB_MAX_OPEN_CONNS" flag:"db-max-open-conns"`
+		MaxIdleConns    int           `yaml:"maxIdleConns" env:"DB_MAX_IDLE_CONNS" flag:"db-max-idle-conns"`
+		ConnMaxLifetime time.Duration `yaml:"connMaxLifetime" env:"DB_CONN_MAX_LIFETIME" flag:"db-conn-max-lifetime"`
+	}
+
+	TreasuryConfig struct {
+		/*
+			All of them reloadable.
+				BaseURL: the rates of exchange endpoint, the query is added to it
+				Timeout: how long each call to the API can take
+				MaxRetries: how many times a failed call is retried, 0 for none
+				RetryBackoff: the wait before the first retry, it grows linearly with each retry
+				FailureThreshold: failed calls in a row that open the circuit breaker
+				OpenCooldown: how long the circuit stays open before a trial call
+		*/
+		BaseURL          string        `yaml:"baseURL" env:"TREASURY_BASE_URL" flag:"treasury-base-url"`
+		Timeout          time.Duration `yaml:"timeout" env:"TREASURY_TIMEOUT" flag:"treasury-timeout"`
+		MaxRetries       int           `yaml:"maxRetries" env:"TREASURY_MAX_RETRIES" flag:"treasury-max-retries"`
+		RetryBackoff     time.Duration `yaml:"retryBackoff" env:"TREASURY_RETRY_BACKOFF" flag:"treasury-retry-backoff"`
+		FailureThreshold int           `yaml:"failureThreshold" env:"TREASURY_FAILURE_THRESHOLD" flag:"treasury-failure-threshold"`
+		OpenCooldown     time.Duration `yaml:"openCooldown" env:"TREASURY_OPEN_COOLDOWN" flag:"treasury-open-cooldown"`
+	}
+
+	ExchangeConfig struct {
+		/*
+			DedupPolicy: DedupPolicyNone or DedupPolicySignature, reloadable
+			CollectTimeout: how long the async collect of the exchange rates has for each date, reloadable
+			StaleRates: StaleRatesNone or StaleRatesNewest, the opt-in degraded mode, reloadable
+			Currencies: the currencies every purchase must be convertible to, comma separated, checked by the
+			ConsistencyChecker, reloadable
+		*/
+		DedupPolicy    string        `yaml:"dedupPolicy" env:"PURCHASE_DEDUP_POLICY" flag:"dedup-policy"`
+		CollectTimeout time.Duration `yaml:"collectTimeout" env:"EXCHANGE_COLLECT_TIMEOUT" flag:"exchange-collect-timeout"`
+		StaleRates     string        `yaml:"staleRates" env:"EXCHANGE_STALE_RATES" flag:"exchange-stale-rates"`
+		Currencies     string        `yaml:"currencies" env:"EXCHANGE_CURRENCIES" flag:"exchange-currencies"`
+	}
+
+	RateCacheConfig struct {
+		/*
+			Size: how many rates are kept, the least recently used ones are dropped first, reloadable
+			TTL: how long a rate is kept before it is read again from the database, reloadable
+			WarmupQuarters: the rates of the current quarter and of the WarmupQuarters-1 before it are loaded on
+			start, 0 starts empty
+		*/
+		Size           int           `yaml:"size" env:"RATE_CACHE_SIZE" flag:"rate-cache-size"`
+		TTL            time.Duration `yaml:"ttl" env:"RATE_CACHE_TTL" flag:"rate-cache-ttl"`
+		WarmupQuarters int           `yaml:"warmupQuarters" env:"RATE_CACHE_WARMUP_QUARTERS" flag:"rate-cache-warmup-quarters"`
+	}
+
+	TracingConfig struct {
+		/*
+			None of them reloadable.
+				Exporter: TracingExporterNone, TracingExporterStdout or TracingExporterOTLP
+				Endpoint: the url of the OTLP/HTTP collector, only used by TracingExporterOTLP
+		*/
+		Exporter string `yaml:"exporter" env:"TRACING_EXPORTER" flag:"tracing-exporter"`
+		Endpoint string `yaml:"endpoint" env:"TRACING_ENDPOINT" flag:"tracing-endpoint"`
+	}
+
+	LogLevel struct {
+		/*
+			The body of GET and PUT /admin/log/level: debug, info, warn or error.
+		*/
+		Level string `json:"level" binding:"required"`
+	}
+)
+
+// DefaultConfig returns the settings used when nothing else is given.
+func DefaultConfig() *Config {
+	return &Config{
+		App: AppConfig{
+			Env:                   "PROD",
+			Name:                  "purchases-multi-country-app",
+			LogLevel:              "info",
+			LogEncoding:           LogEncodingJSON,
+			LogSamplingInitial:    100,
+			LogSamplingThereafter: 100,
+			LogFileMaxSizeMB:      100,
+			LogFileMaxBackups:     5,
+			LogFileMaxAgeDays:     30,
+			LogRedact:             "description:mask,amount:mask,original_amount:mask,converted_amount:mask,signature:hash,id:hash,purchase_id:hash,idempotency_key:hash",
+			ShutdownTimeout:       15 * time.Second,
+		},
+		Http: HttpConfig{
+			Addr:               ":8080",
+			IdempotencyKeyTTL:  24 * time.Hour,
+			HealthCheckTimeout: 2 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Driver:          DatabaseDriverMySQL,
+			Path:            "purchases-multi-country.db",
+			Name:            "purchases-multi-country-db",
+			HostPort:        "localhost:3306",
+			MaxOpenConns:    5,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 5 * time.Minute,
+		},
+		Treasury: TreasuryConfig{
+			BaseURL:          "https://api.fiscaldata.treasury.gov/services/api/fiscal_service/v1/accounting/od/rates_of_exchange",
+			Timeout:          10 * time.Second,
+			MaxRetries:       0,
+			RetryBackoff:     500 * time.Millisecond,
+			FailureThreshold: 5,
+			OpenCooldown:     30 * time.Second,
+		},
+		Exchange: ExchangeConfig{
+			DedupPolicy:    DedupPolicyNone,
+			CollectTimeout: 10 * time.Second,
+			StaleRates:     StaleRatesNone,
+		},
+		RateCache: RateCacheConfig{
+			Size:           10000,
+			TTL:            24 * time.Hour,
+			WarmupQuarters: 4,
+		},
+		Tracing: TracingConfig{
+			Exporter: TracingExporterNone,
+			Endpoint: "http://localhost:4318",
+		},
+	}
+}
+
+// Redaction parses LogRedact into the policy of each field: RedactMask or RedactHash. The fields are matched by
+// key at any depth, so "description" also redacts the description of a purchase logged as a whole.
+func (a *AppConfig) Redaction() (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, rule := range strings.Split(a.LogRedact, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		field, policy, _ := strings.Cut(rule, ":")
+		field, policy = strings.TrimSpace(field), strings.TrimSpace(policy)
+		if field == "" || (policy != RedactMask && policy != RedactHash) {
+			return nil, fmt.Errorf("'%s' must be field:%s or field:%s", rule, RedactMask, RedactHash)
+		}
+		policies[field] = policy
+	}
+	return policies, nil
+}
+
+// AdminActors parses AdminTokens into the actor authenticated by each token. The actor is everything before the
+// last ':', so it can be an e-mail address. The errors never show a token, they end up in the logs.
+func (h *HttpConfig) AdminActors() (map[string]string, error) {
+	actors := make(map[string]string)
+	for i, entry := range strings.Split(h.AdminTokens, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		sep := strings.LastIndex(entry, ":")
+		if sep < 0 {
+			return nil, fmt.Errorf("entry %d must be actor:token", i+1)
+		}
+		actor, token := strings.TrimSpace(entry[:sep]), strings.TrimSpace(entry[sep+1:])
+		if actor == "" || token == "" {
+			return nil, fmt.Errorf("entry %d must be actor:token", i+1)
+		}
+		if _, ok := actors[token]; ok {
+			return nil, fmt.Errorf("entry %d repeats the token of another actor", i+1)
+		}
+		actors[token] = actor
+	}
+	return actors, nil
+}
+
+// CurrencyList parses Currencies into the currencies listed, once each and in the order given.
+func (e *ExchangeConfig) CurrencyList() []string {
+	var currencies []string
+	seen := make(map[string]bool)
+	for _, c := range strings.Split(e.Currencies, ",") {
+		if c = strings.TrimSpace(c); c != "" && !seen[c] {
+			seen[c] = true
+			currencies = append(currencies, c)
+		}
+	}
+	return currencies
+}
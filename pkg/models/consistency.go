@@ -0,0 +1,54 @@
+package models
+
+const (
+	// IssueMissingRate is a purchase that cannot be converted to a configured currency: no rate within the 6
+	// months before it is stored, and it is neither locked nor covered by a RateOverride.
+	IssueMissingRate = "missing_rate"
+	// IssueDuplicateSignature is a purchase with the signature of an older one, kept when the signature dedup
+	// policy is used.
+	IssueDuplicateSignature = "duplicate_signature"
+	IssueUnparsableAmount   = "unparsable_amount"
+	IssueUnparsableDate     = "unparsable_date"
+	// IssueOrphanedConversion is a locked conversion of a purchase that was deleted or never existed.
+	IssueOrphanedConversion = "orphaned_conversion"
+	// IssueStaleConversion is a locked conversion of a purchase whose amount or date changed after the lock.
+	IssueStaleConversion = "stale_conversion"
+)
+
+type (
+	ConsistencyIssue struct {
+		/*
+			One problem found in the data.
+				Kind: one of the Issue constants
+				CountryCurrencyDesc: the currency involved, for the rates and the conversions
+				Repaired: true when the repair fixed it
+		*/
+		Kind                string `json:"kind"`
+		PurchaseId          string `json:"purchase_id"`
+		CountryCurrencyDesc string `json:"country_currency_desc,omitempty"`
+		Detail              string `json:"detail"`
+		Repaired            bool   `json:"repaired,omitempty"`
+	}
+
+	ConsistencyReport struct {
+		/*
+			What a consistency check found.
+				CheckedAt: unix timestamp (milliseconds) of the check
+				Purchases: how many live purchases were checked
+				Currencies: the currencies the purchases were checked to be convertible to
+				Repair: true when the issues that can be were repaired
+				Repaired: how many of the Issues were repaired
+		*/
+		CheckedAt  int64               `json:"checked_at"`
+		Purchases  int                 `json:"purchases"`
+		Currencies []string            `json:"currencies"`
+		Repair     bool                `json:"repair"`
+		Issues     []*ConsistencyIssue `json:"issues"`
+		Repaired   int                 `json:"repaired"`
+	}
+)
+
+// Consistent tells if nothing is left to fix, every issue found was repaired.
+func (r *ConsistencyReport) Consistent() bool {
+	return r.Repaired == len(r.Issues)
+}
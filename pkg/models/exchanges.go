@@ -1,6 +1,14 @@
 package models
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// ConversionProviderTreasury is the provider of the rates of the Treasury Reporting Rates of Exchange.
+	ConversionProviderTreasury = "treasury"
+)
 
 /*
 FILTERED REQUEST: https://api.fiscaldata.treasury.gov/services/api/fiscal_service/v1/accounting/od/rates_of_exchange?fields=country_currency_desc,exchange_rate,record_date&filter=country_currency_desc:in:(Canada-Dollar,Mexico-Peso),record_date:gte:2020-01-01
@@ -35,6 +43,7 @@ type (
 		Description string `json:"description"`
 		Amount      string `json:"amount"`
 		Date        string `json:"date"`
+		Deduplicate bool   `json:"-"` // when true the signature is persisted and duplicated purchases are merged
 		signature   string `json:"-"`
 	}
 
@@ -59,6 +68,12 @@ type (
 				● If no currency conversion rate is available within 6 months equal to or before the purchase date, an error should
 					be returned stating the purchase cannot be converted to the target currency.
 				● The converted purchase amount to the target currency should be rounded to two decimal places (i.e., cent).
+
+			Degraded: the Treasury API was unavailable and no rate from within the last 6 months was stored, so the
+			newest rate stored, effective on RateDate, was used instead (see ExchangeConfig.StaleRates)
+			Locked: the conversion locked when it was reported, by the rate of the Provider effective on RateDate,
+			and the amount and date the purchase had then (see PurchaseConversion)
+			OverrideId: the RateOverride used, the Provider is then ConversionProviderOverride and RateDate its start
 		*/
 		Id              string `json:"id"`
 		Description     string `json:"description"`
@@ -66,6 +81,36 @@ type (
 		OriginalAmount  string `json:"original_amount"`
 		ExchangeRate    string `json:"exchange_rate"`
 		ConvertedAmount string `json:"converted_amount"`
+		Degraded        bool   `json:"degraded,omitempty"`
+		Locked          bool   `json:"locked,omitempty"`
+		RateDate        string `json:"rate_date,omitempty"`
+		Provider        string `json:"provider,omitempty"`
+		OverrideId      int64  `json:"override_id,omitempty"`
+	}
+
+	PurchaseConversion struct {
+		/*
+			The conversion of a purchase to a currency, locked so it never changes once reported, even when the rates
+			are revised or the purchase is changed later.
+				Provider: where the rate came from, see ConversionProviderTreasury
+				LockedAt: unix timestamp (milliseconds) of the lock
+		*/
+		PurchaseId          string `json:"purchase_id"`
+		CountryCurrencyDesc string `json:"country_currency_desc"`
+		OriginalAmount      string `json:"original_amount"`
+		PurchaseDate        string `json:"purchase_date"`
+		ExchangeRate        string `json:"exchange_rate"`
+		RateDate            string `json:"rate_date"`
+		Provider            string `json:"provider"`
+		ConvertedAmount     string `json:"converted_amount"`
+		LockedAt            int64  `json:"locked_at"`
+	}
+
+	ConversionLock struct {
+		/*
+			The purchases to lock the conversion of, to the currency of the Countrycurrency header.
+		*/
+		Ids []string `json:"ids"`
 	}
 
 	DataVal struct {
@@ -119,12 +164,39 @@ type (
 		Links *LinksVal  `json:"links"`
 	}
 
+	RateCacheStats struct {
+		/*
+			Hits and Misses: the rates asked to the RateCache found in it, and the ones read from the database
+			Evictions: the rates dropped to make room or because they expired
+			Invalidations: the rates dropped because a new rate was written
+			Size: how many rates are kept now
+		*/
+		Hits          int64 `json:"hits"`
+		Misses        int64 `json:"misses"`
+		Evictions     int64 `json:"evictions"`
+		Invalidations int64 `json:"invalidations"`
+		Size          int   `json:"size"`
+	}
+
 	ExchangeForDate struct {
 		//ID                  string `json:"id"`
 		Date                string `json:"date"`
 		CountryCurrencyDesc string `json:"country_currency_desc"`
 		ExchangeRate        string `json:"exchange_rate"`
 	}
+
+	ExchangeRevision struct {
+		/*
+			One rate of a currency and date as it was ingested, kept when the Treasury revises it.
+				RecordedAt: unix timestamp (milliseconds) of the ingestion, 0 for the rates ingested before
+				the revisions were kept
+		*/
+		Id                  int64  `json:"id"`
+		Date                string `json:"date"`
+		CountryCurrencyDesc string `json:"country_currency_desc"`
+		ExchangeRate        string `json:"exchange_rate"`
+		RecordedAt          int64  `json:"recorded_at"`
+	}
 )
 
 func (p *Purchase) Signature() string {
@@ -141,3 +213,12 @@ func firstN(s string, n int) string {
 	}
 	return s
 }
+
+// WithinSixMonths tells if a rate effective on rateDate can convert a purchase made on purchaseDate.
+func WithinSixMonths(rateDate string, purchaseDate string) bool {
+	d, err := time.Parse(DateLayout, purchaseDate)
+	if err != nil {
+		return true
+	}
+	return rateDate >= d.AddDate(0, -6, 0).Format(DateLayout)
+}
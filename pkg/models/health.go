@@ -0,0 +1,56 @@
+package models
+
+import "time"
+
+const (
+	HealthUp       = "up"
+	HealthDegraded = "degraded" // working, but with a dependency failing, like the Treasury API
+	HealthDown     = "down"
+)
+
+type (
+	ComponentHealth struct {
+		/*
+			The health of one service.
+				Latency: how long the check took, e.g. the database ping
+				Details: anything else the service reports, like the circuit state or the queue depth
+		*/
+		Name    string         `json:"name"`
+		Status  string         `json:"status"`
+		Latency string         `json:"latency"`
+		Error   string         `json:"error,omitempty"`
+		Details map[string]any `json:"details,omitempty"`
+	}
+
+	HealthReport struct {
+		/*
+			Status: the worst status among the components
+		*/
+		Status     string             `json:"status"`
+		Components []*ComponentHealth `json:"components"`
+	}
+)
+
+// NewComponentHealth builds the health of a check that took latency and failed with err, if err is not nil.
+func NewComponentHealth(name string, latency time.Duration, err error) *ComponentHealth {
+	h := &ComponentHealth{Name: name, Status: HealthUp, Latency: latency.String()}
+	if err != nil {
+		h.Status = HealthDown
+		h.Error = err.Error()
+	}
+	return h
+}
+
+// NewHealthReport combines the components health, the report is as healthy as its worst component.
+func NewHealthReport(components []*ComponentHealth) *HealthReport {
+	r := &HealthReport{Status: HealthUp, Components: components}
+	for _, c := range components {
+		switch {
+		case c.Status == HealthDown:
+			r.Status = HealthDown
+		case c.Status == HealthDegraded && r.Status == HealthUp:
+			r.Status = HealthDegraded
+		}
+	}
+	return r
+}
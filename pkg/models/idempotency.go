@@ -0,0 +1,21 @@
+package models
+
+type (
+	IdempotencyKey struct {
+		/*
+			Stores the outcome of a request sent with an "Idempotency-Key" header so retries of the same request
+			get the very same response back instead of being processed again.
+				StatusCode: 0 while the first request is still being processed
+				ExpiresAt: unix timestamp (seconds) after which the key can be reused
+		*/
+		Key          string `json:"key"`
+		RequestHash  string `json:"request_hash"`
+		StatusCode   int    `json:"status_code"`
+		ResponseBody string `json:"response_body"`
+		ExpiresAt    int64  `json:"expires_at"`
+	}
+)
+
+func (k *IdempotencyKey) InProgress() bool {
+	return k.StatusCode == 0
+}
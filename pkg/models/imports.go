@@ -0,0 +1,46 @@
+package models
+
+type (
+	ImportRow struct {
+		/*
+			One row read from an import file.
+				Line: line number of the row in the file, starting at 1
+				Err: why the row could not be read, Purchase is nil when it is set
+		*/
+		Line     int
+		Purchase *Purchase
+		Err      error
+	}
+
+	ImportLine struct {
+		/*
+			The outcome of one row of an import.
+				Id: the purchase id, for duplicated rows it is the id of the purchase that already exists
+				Message: why the row was rejected
+		*/
+		Line    int    `json:"line"`
+		Id      string `json:"id,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+
+	ImportReport struct {
+		Accepted   []*ImportLine `json:"accepted"`
+		Duplicated []*ImportLine `json:"duplicated"`
+		Rejected   []*ImportLine `json:"rejected"`
+	}
+
+	PurchaseInsertResult struct {
+		/*
+			The outcome of inserting one Purchase of a batch.
+				Id: the id of the new purchase, or of the existing one when Created is false
+				Err: set when this purchase could not be inserted, the rest of the batch is not affected
+		*/
+		Id      string
+		Created bool
+		Err     error
+	}
+)
+
+func NewImportReport() *ImportReport {
+	return &ImportReport{Accepted: []*ImportLine{}, Duplicated: []*ImportLine{}, Rejected: []*ImportLine{}}
+}
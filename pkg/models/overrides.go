@@ -0,0 +1,119 @@
+package models
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// ConversionProviderOverride is the provider of the rates set by hand, see RateOverride.
+	ConversionProviderOverride = "override"
+
+	RateOverrideCreated = "created"
+	RateOverrideRemoved = "removed"
+
+	MaxOverrideChangeLength = 255
+)
+
+type (
+	RateOverride struct {
+		/*
+			A rate set by hand for a currency, used instead of the Treasury ones to convert the purchases made from
+			StartDate to EndDate (both included). When overrides overlap the newest one is used.
+				CreatedBy and Reason: who set it and why
+				CreatedAt and RemovedAt: unix timestamps (milliseconds), RemovedAt is 0 while it is in use
+		*/
+		Id                  int64  `json:"id"`
+		CountryCurrencyDesc string `json:"country_currency_desc"`
+		StartDate           string `json:"start_date"`
+		EndDate             string `json:"end_date"`
+		ExchangeRate        string `json:"exchange_rate"`
+		Reason              string `json:"reason"`
+		CreatedBy           string `json:"created_by"`
+		CreatedAt           int64  `json:"created_at"`
+		RemovedAt           int64  `json:"removed_at,omitempty"`
+	}
+
+	RateOverrideAudit struct {
+		/*
+			One change made to the RateOverrides, with the values of the override changed.
+				Action: created or removed
+				Actor and Reason: who made the change and why
+				ChangedAt: unix timestamp (milliseconds) of the change
+		*/
+		Id                  int64  `json:"id"`
+		OverrideId          int64  `json:"override_id"`
+		Action              string `json:"action"`
+		CountryCurrencyDesc string `json:"country_currency_desc"`
+		StartDate           string `json:"start_date"`
+		EndDate             string `json:"end_date"`
+		ExchangeRate        string `json:"exchange_rate"`
+		Actor               string `json:"actor"`
+		Reason              string `json:"reason"`
+		ChangedAt           int64  `json:"changed_at"`
+	}
+
+	RateOverrideRemoval struct {
+		/*
+			Why a RateOverride is removed.
+		*/
+		Reason string `json:"reason"`
+	}
+)
+
+// Validate checks the RateOverride sent to be created: the dates, a positive rate and who set it and why.
+func (o *RateOverride) Validate() error {
+	if o.CountryCurrencyDesc == "" {
+		return fmt.Errorf("%w: country_currency_desc is required", messages.ErrInvalidOverride)
+	}
+	start, err := time.Parse(DateLayout, o.StartDate)
+	if err != nil {
+		return fmt.Errorf("%w: start_date '%s' must be in the YYYY-MM-DD format", messages.ErrInvalidOverride, o.StartDate)
+	}
+	end, err := time.Parse(DateLayout, o.EndDate)
+	if err != nil {
+		return fmt.Errorf("%w: end_date '%s' must be in the YYYY-MM-DD format", messages.ErrInvalidOverride, o.EndDate)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("%w: end_date '%s' is before start_date '%s'", messages.ErrInvalidOverride, o.EndDate, o.StartDate)
+	}
+	if rate, err := decimal.NewFromString(o.ExchangeRate); err != nil || !rate.IsPositive() {
+		return fmt.Errorf("%w: exchange_rate '%s' must be a positive value", messages.ErrInvalidOverride, o.ExchangeRate)
+	}
+	return ValidateOverrideChange(o.CreatedBy, o.Reason)
+}
+
+// ValidateOverrideChange checks who changes a RateOverride and why, both are recorded in the audit.
+func ValidateOverrideChange(actor string, reason string) error {
+	if actor == "" || reason == "" {
+		return fmt.Errorf("%w: who changes the override and why are required", messages.ErrInvalidOverride)
+	}
+	if utf8.RuneCountInString(actor) > MaxOverrideChangeLength || utf8.RuneCountInString(reason) > MaxOverrideChangeLength {
+		return fmt.Errorf("%w: who changes the override and why must have up to %d characters", messages.ErrInvalidOverride, MaxOverrideChangeLength)
+	}
+	return nil
+}
+
+// Covers tells if the override converts a purchase made on date.
+func (o *RateOverride) Covers(date string) bool {
+	return o.StartDate <= date && date <= o.EndDate
+}
+
+// AuditOf returns the audit entry of the action made to o by actor.
+func (o *RateOverride) AuditOf(action string, actor string, reason string, changedAt int64) *RateOverrideAudit {
+	return &RateOverrideAudit{
+		OverrideId:          o.Id,
+		Action:              action,
+		CountryCurrencyDesc: o.CountryCurrencyDesc,
+		StartDate:           o.StartDate,
+		EndDate:             o.EndDate,
+		ExchangeRate:        o.ExchangeRate,
+		Actor:               actor,
+		Reason:              reason,
+		ChangedAt:           changedAt,
+	}
+}
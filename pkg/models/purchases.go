@@ -0,0 +1,91 @@
+package models
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	DateLayout           = "2006-01-02"
+	MaxDescriptionLength = 50
+
+	PurchaseCreated = "created"
+	PurchaseUpdated = "updated"
+	PurchaseDeleted = "deleted"
+)
+
+type (
+	PurchasePatch struct {
+		/*
+			The fields to change in an existing Purchase, nil fields are kept as they are.
+		*/
+		Description *string `json:"description"`
+		Amount      *string `json:"amount"`
+		Date        *string `json:"date"`
+	}
+
+	PurchaseHistory struct {
+		/*
+			One change made to a Purchase, with the values the purchase had right after the change.
+				Action: created, updated or deleted
+				ChangedAt: unix timestamp (seconds) of the change
+		*/
+		Id          int64  `json:"id"`
+		PurchaseId  string `json:"purchase_id"`
+		Action      string `json:"action"`
+		Description string `json:"description"`
+		Amount      string `json:"amount"`
+		Date        string `json:"date"`
+		ChangedAt   int64  `json:"changed_at"`
+	}
+)
+
+// Validate checks the Purchase against the rules described in the Purchase struct.
+func (p *Purchase) Validate() error {
+	if p.Description == "" || utf8.RuneCountInString(p.Description) > MaxDescriptionLength {
+		return fmt.Errorf("%w: description must have between 1 and %d characters", messages.ErrInvalidPurchase, MaxDescriptionLength)
+	}
+	if _, err := time.Parse(DateLayout, p.Date); err != nil {
+		return fmt.Errorf("%w: date '%s' must be in the YYYY-MM-DD format", messages.ErrInvalidPurchase, p.Date)
+	}
+	amount, err := decimal.NewFromString(p.Amount)
+	if err != nil || !amount.IsPositive() || !amount.Equal(amount.Round(2)) {
+		return fmt.Errorf("%w: amount '%s' must be a positive value rounded to the nearest cent", messages.ErrInvalidPurchase, p.Amount)
+	}
+	return nil
+}
+
+// IsEmpty tells if the patch has nothing to change.
+func (pp *PurchasePatch) IsEmpty() bool {
+	return pp.Description == nil && pp.Amount == nil && pp.Date == nil
+}
+
+// IsComplete tells if the patch replaces every field of the Purchase, as a PUT must do.
+func (pp *PurchasePatch) IsComplete() bool {
+	return pp.Description != nil && pp.Amount != nil && pp.Date != nil
+}
+
+// Apply returns a new Purchase with the patch applied over p, its signature is computed again.
+func (pp *PurchasePatch) Apply(p *Purchase) *Purchase {
+	patched := &Purchase{
+		Id:          p.Id,
+		Description: p.Description,
+		Amount:      p.Amount,
+		Date:        p.Date,
+		Deduplicate: p.Deduplicate,
+	}
+	if pp.Description != nil {
+		patched.Description = *pp.Description
+	}
+	if pp.Amount != nil {
+		patched.Amount = *pp.Amount
+	}
+	if pp.Date != nil {
+		patched.Date = *pp.Date
+	}
+	return patched
+}
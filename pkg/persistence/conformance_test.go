@@ -0,0 +1,598 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+// The conformance suite runs the same cases against every backend, so they keep the same semantics. The in-memory
+// database and SQLite always run; MySQL runs when TEST_MYSQL_HOSTPORT is set, like TEST_MYSQL_HOSTPORT=localhost:3306 with the
+// TEST_MYSQL_USER, TEST_MYSQL_PASSWORD and TEST_MYSQL_DB of a database the tests can write to. The rows are not
+// removed, every case uses its own ids and currencies.
+
+type conformanceCase struct {
+	name string
+	run  func(t *testing.T, ctx context.Context, db services.Database, suffix string)
+}
+
+func Test_Database_conformance(t *testing.T) {
+	backends := map[string]func(t *testing.T) models.DatabaseConfig{
+		models.DatabaseDriverMemory: func(t *testing.T) models.DatabaseConfig {
+			cfg := models.DefaultConfig().Database
+			cfg.Driver = models.DatabaseDriverMemory
+			return cfg
+		},
+		models.DatabaseDriverSQLite: func(t *testing.T) models.DatabaseConfig {
+			cfg := models.DefaultConfig().Database
+			cfg.Driver, cfg.Path = models.DatabaseDriverSQLite, filepath.Join(t.TempDir(), "purchases.db")
+			return cfg
+		},
+		models.DatabaseDriverMySQL: func(t *testing.T) models.DatabaseConfig {
+			hostPort := os.Getenv("TEST_MYSQL_HOSTPORT")
+			if hostPort == "" {
+				t.Skip("TEST_MYSQL_HOSTPORT not set")
+			}
+			cfg := models.DefaultConfig().Database
+			cfg.HostPort, cfg.User, cfg.Password = hostPort, os.Getenv("TEST_MYSQL_USER"), os.Getenv("TEST_MYSQL_PASSWORD")
+			if name := os.Getenv("TEST_MYSQL_DB"); name != "" {
+				cfg.Name = name
+			}
+			return cfg
+		},
+	}
+	for driver, config := range backends {
+		t.Run(driver, func(t *testing.T) {
+			cfg := models.DefaultConfig()
+			cfg.Database = config(t)
+			sm, ctx := NewManagerForTestsDatabase()
+			if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+				t.Fatalf("configService.Reconfigure() error = %v", err)
+			}
+			db := sm.WithDatabase(NewDatabaseOfDriver()).Database()
+			if err := db.Start(ctx); err != nil {
+				t.Fatalf("Database.Start() error = %v", err)
+			}
+			defer db.Close(ctx)
+			if err := db.Healthy(ctx); err != nil {
+				t.Fatalf("Database.Healthy() error = %v", err)
+			}
+			for _, c := range conformanceCases {
+				t.Run(c.name, func(t *testing.T) {
+					c.run(t, ctx, db, uuid.NewString()[:8])
+				})
+			}
+		})
+	}
+}
+
+var conformanceCases = []conformanceCase{
+	{
+		name: "insertPurchase",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			p := &models.Purchase{Id: "p-" + suffix, Description: "Dinner " + suffix, Amount: "20.13", Date: "2023-09-30"}
+			if id, created, err := insertInTx(ctx, db, p); err != nil || !created || id != p.Id {
+				t.Fatalf("InsertPurchase() = %s, %v, %v, want %s, true, nil", id, created, err, p.Id)
+			}
+			got, err := db.GetPurchaseById(ctx, p.Id)
+			if err != nil || !reflect.DeepEqual(got, &models.Purchase{Id: p.Id, Description: p.Description, Amount: p.Amount, Date: p.Date}) {
+				t.Errorf("GetPurchaseById() = %v, %v, want %v", got, err, p)
+			}
+			other := &models.Purchase{Id: p.Id, Description: "Lunch", Amount: "1.00", Date: "2023-09-30"}
+			if _, _, err := insertInTx(ctx, db, other); !errors.Is(err, messages.ErrPurchaseIdConflict) {
+				t.Errorf("InsertPurchase() of the same id error = %v, want %v", err, messages.ErrPurchaseIdConflict)
+			}
+			if _, err := db.GetPurchaseById(ctx, "missing-"+suffix); !errors.Is(err, messages.ErrNoPurchaseFound) {
+				t.Errorf("GetPurchaseById() of a missing id error = %v, want %v", err, messages.ErrNoPurchaseFound)
+			}
+		},
+	},
+	{
+		name: "deduplicatedPurchase",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			first := &models.Purchase{Id: "first-" + suffix, Description: "Taxi " + suffix, Amount: "7.50", Date: "2023-09-30", Deduplicate: true}
+			second := &models.Purchase{Id: "second-" + suffix, Description: first.Description, Amount: first.Amount, Date: first.Date, Deduplicate: true}
+			if _, created, err := insertInTx(ctx, db, first); err != nil || !created {
+				t.Fatalf("InsertPurchase() = %v, %v, want true, nil", created, err)
+			}
+			if exists, err := db.ExistsBySignature(ctx, first.Signature()); err != nil || !exists {
+				t.Errorf("ExistsBySignature() = %v, %v, want true, nil", exists, err)
+			}
+			if id, created, err := insertInTx(ctx, db, second); err != nil || created || id != first.Id {
+				t.Errorf("InsertPurchase() of a duplicate = %s, %v, %v, want %s, false, nil", id, created, err, first.Id)
+			}
+			// not deduplicated, the same id is another purchase even with the signature of first.
+			taken := &models.Purchase{Id: "taken-" + suffix, Description: "Bus " + suffix, Amount: "2.00", Date: "2023-09-30"}
+			if _, created, err := insertInTx(ctx, db, taken); err != nil || !created {
+				t.Fatalf("InsertPurchase() = %v, %v, want true, nil", created, err)
+			}
+			sameId := &models.Purchase{Id: taken.Id, Description: first.Description, Amount: first.Amount, Date: first.Date}
+			if id, _, err := insertInTx(ctx, db, sameId); !errors.Is(err, messages.ErrPurchaseIdConflict) {
+				t.Errorf("InsertPurchase() of a taken id = %s, %v, want %v", id, err, messages.ErrPurchaseIdConflict)
+			}
+			all, err := db.ListAllPurchases(ctx)
+			if err != nil {
+				t.Fatalf("ListAllPurchases() error = %v", err)
+			}
+			for _, p := range all {
+				if want := p.Id == first.Id; (p.Id == first.Id || p.Id == taken.Id) && p.Deduplicate != want {
+					t.Errorf("ListAllPurchases() %s deduplicate = %v, want %v", p.Id, p.Deduplicate, want)
+				}
+			}
+		},
+	},
+	{
+		name: "batchInsertPurchases",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			p := &models.Purchase{Id: "batch-" + suffix, Description: "Hotel", Amount: "300.00", Date: "2023-09-30"}
+			conflict := &models.Purchase{Id: p.Id, Description: "Another hotel", Amount: "150.00", Date: "2023-09-30"}
+			results, err := batchInsertInTx(ctx, db, []*models.Purchase{p, conflict})
+			if err != nil || len(results) != 2 {
+				t.Fatalf("BatchInsertPurchases() = %v, %v, want 2 results", results, err)
+			}
+			if !results[0].Created || !errors.Is(results[1].Err, messages.ErrPurchaseIdConflict) {
+				t.Errorf("BatchInsertPurchases() = %+v, %+v, want created and a conflict", results[0], results[1])
+			}
+			if _, err := db.GetPurchaseById(ctx, p.Id); err != nil {
+				t.Errorf("GetPurchaseById() after the batch error = %v", err)
+			}
+		},
+	},
+	{
+		name: "updateDeleteAndHistory",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			p := &models.Purchase{Id: "h-" + suffix, Description: "Books", Amount: "12.00", Date: "2023-09-30"}
+			if _, _, err := insertInTx(ctx, db, p); err != nil {
+				t.Fatalf("InsertPurchase() error = %v", err)
+			}
+			p.Amount = "15.00"
+			if err := db.WithTx(ctx, func(tx services.Tx) error { return db.UpdatePurchase(tx.Context(), tx, p) }); err != nil {
+				t.Fatalf("UpdatePurchase() error = %v", err)
+			}
+			if got, _ := db.GetPurchaseById(ctx, p.Id); got == nil || got.Amount != "15.00" {
+				t.Errorf("GetPurchaseById() after the update = %v, want the amount 15.00", got)
+			}
+			if err := db.WithTx(ctx, func(tx services.Tx) error { return db.DeletePurchase(tx.Context(), tx, p.Id) }); err != nil {
+				t.Fatalf("DeletePurchase() error = %v", err)
+			}
+			if err := db.WithTx(ctx, func(tx services.Tx) error { return db.DeletePurchase(tx.Context(), tx, p.Id) }); !errors.Is(err, messages.ErrNoPurchaseFound) {
+				t.Errorf("DeletePurchase() twice error = %v, want %v", err, messages.ErrNoPurchaseFound)
+			}
+			if _, err := db.GetPurchaseById(ctx, p.Id); !errors.Is(err, messages.ErrNoPurchaseFound) {
+				t.Errorf("GetPurchaseById() after the delete error = %v, want %v", err, messages.ErrNoPurchaseFound)
+			}
+			// neither changed nor given another history entry once deleted.
+			if err := db.WithTx(ctx, func(tx services.Tx) error { return db.UpdatePurchase(tx.Context(), tx, p) }); !errors.Is(err, messages.ErrNoPurchaseFound) {
+				t.Errorf("UpdatePurchase() after the delete error = %v, want %v", err, messages.ErrNoPurchaseFound)
+			}
+			if err := db.WithTx(ctx, func(tx services.Tx) error {
+				_, err := db.GetPurchaseForUpdate(tx.Context(), tx, p.Id)
+				return err
+			}); !errors.Is(err, messages.ErrNoPurchaseFound) {
+				t.Errorf("GetPurchaseForUpdate() after the delete error = %v, want %v", err, messages.ErrNoPurchaseFound)
+			}
+			history, err := db.ListPurchaseHistory(ctx, p.Id)
+			if err != nil {
+				t.Fatalf("ListPurchaseHistory() error = %v", err)
+			}
+			var actions []string
+			for _, h := range history {
+				actions = append(actions, h.Action+" "+h.Amount)
+			}
+			if want := []string{"created 12.00", "updated 15.00", "deleted 15.00"}; !reflect.DeepEqual(actions, want) {
+				t.Errorf("ListPurchaseHistory() = %v, want %v", actions, want)
+			}
+		},
+	},
+	{
+		name: "concurrentUpdates",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			p := &models.Purchase{Id: "cu-" + suffix, Description: "Counter", Amount: "0", Date: "2023-09-30"}
+			if _, _, err := insertInTx(ctx, db, p); err != nil {
+				t.Fatalf("InsertPurchase() error = %v", err)
+			}
+			// every update reads the amount left by the one before, none of them is lost.
+			const updates = 8
+			var wg sync.WaitGroup
+			errs := make(chan error, updates)
+			for i := 0; i < updates; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- db.WithTx(ctx, func(tx services.Tx) error {
+						current, err := db.GetPurchaseForUpdate(tx.Context(), tx, p.Id)
+						if err != nil {
+							return err
+						}
+						amount, _ := strconv.Atoi(current.Amount)
+						current.Amount = strconv.Itoa(amount + 1)
+						return db.UpdatePurchase(tx.Context(), tx, current)
+					})
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("UpdatePurchase() error = %v", err)
+				}
+			}
+			if got, err := db.GetPurchaseById(ctx, p.Id); err != nil || got.Amount != strconv.Itoa(updates) {
+				t.Errorf("GetPurchaseById() after the updates = %v, %v, want the amount %d", got, err, updates)
+			}
+		},
+	},
+	{
+		name: "exchangeUpsert",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			currency := "Country" + suffix + "-Currency"
+			for _, rate := range []string{"5.00", "5.10"} {
+				ex := &models.ExchangeForDate{CountryCurrencyDesc: currency, ExchangeRate: rate, Date: "2023-09-30"}
+				if err := db.WithTx(ctx, func(tx services.Tx) error { return db.InsertExchange(tx.Context(), tx, ex) }); err != nil {
+					t.Fatalf("InsertExchange() error = %v", err)
+				}
+			}
+			if got, err := db.GetExchangeRateForCountryCurrencyAndDate(ctx, currency, "2023-09-30"); err != nil || got.ExchangeRate != "5.10" {
+				t.Errorf("GetExchangeRateForCountryCurrencyAndDate() = %v, %v, want the rate 5.10", got, err)
+			}
+			batch := []*models.ExchangeForDate{
+				{CountryCurrencyDesc: currency, ExchangeRate: "5.20", Date: "2023-09-30"},
+				{CountryCurrencyDesc: currency, ExchangeRate: "4.90", Date: "2023-06-30"},
+			}
+			if err := db.WithTx(ctx, func(tx services.Tx) error { return db.BatchInsertExchanges(tx.Context(), tx, batch) }); err != nil {
+				t.Fatalf("BatchInsertExchanges() error = %v", err)
+			}
+			if got, err := db.GetExchangeRateForCountryCurrencyAndDate(ctx, currency, "2023-09-30"); err != nil || got.ExchangeRate != "5.20" {
+				t.Errorf("GetExchangeRateForCountryCurrencyAndDate() after the batch = %v, %v, want the rate 5.20", got, err)
+			}
+		},
+	},
+	{
+		name: "exchangeLookup",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			currency := "Country" + suffix + "-Currency"
+			batch := []*models.ExchangeForDate{
+				{CountryCurrencyDesc: currency, ExchangeRate: "4.80", Date: "2023-03-31"},
+				{CountryCurrencyDesc: currency, ExchangeRate: "4.90", Date: "2023-06-30"},
+				{CountryCurrencyDesc: currency, ExchangeRate: "5.00", Date: "2023-09-30"},
+			}
+			if err := db.WithTx(ctx, func(tx services.Tx) error { return db.BatchInsertExchanges(tx.Context(), tx, batch) }); err != nil {
+				t.Fatalf("BatchInsertExchanges() error = %v", err)
+			}
+			tests := []struct {
+				date     string
+				wantDate string
+				wantErr  error
+			}{
+				{date: "2023-09-30", wantDate: "2023-09-30"},
+				{date: "2023-08-15", wantDate: "2023-06-30"},
+				{date: "2024-01-01", wantDate: "2023-09-30"},
+				{date: "2023-01-01", wantErr: messages.ErrNoExchangeFound},
+			}
+			for _, tt := range tests {
+				got, err := db.GetExchangeRateForCountryCurrencyAndDate(ctx, currency, tt.date)
+				if tt.wantErr != nil {
+					if !errors.Is(err, tt.wantErr) {
+						t.Errorf("GetExchangeRateForCountryCurrencyAndDate(%s) error = %v, want %v", tt.date, err, tt.wantErr)
+					}
+					continue
+				}
+				if err != nil || got.Date != tt.wantDate {
+					t.Errorf("GetExchangeRateForCountryCurrencyAndDate(%s) = %v, %v, want the rate of %s", tt.date, got, err, tt.wantDate)
+				}
+			}
+
+			// the batched lookup finds the same rates, over more dates than one query takes.
+			dates := []string{"2023-09-30", "2023-08-15", "2023-08-15", "2023-01-01"}
+			day, _ := time.Parse(time.DateOnly, "2024-01-01")
+			for i := 0; i < 2500; i++ {
+				dates = append(dates, day.AddDate(0, 0, i).Format(time.DateOnly))
+			}
+			rates, err := db.GetExchangeRatesForCountryCurrencyAndDates(ctx, currency, dates)
+			if err != nil {
+				t.Fatalf("GetExchangeRatesForCountryCurrencyAndDates() error = %v", err)
+			}
+			for _, tt := range tests {
+				got, ok := rates[tt.date]
+				if tt.wantErr != nil {
+					if ok {
+						t.Errorf("GetExchangeRatesForCountryCurrencyAndDates()[%s] = %v, want none", tt.date, got)
+					}
+					continue
+				}
+				if !ok || got.Date != tt.wantDate || got.CountryCurrencyDesc != currency {
+					t.Errorf("GetExchangeRatesForCountryCurrencyAndDates()[%s] = %v, want the rate of %s", tt.date, got, tt.wantDate)
+				}
+			}
+			if len(rates) != 2502 {
+				t.Errorf("GetExchangeRatesForCountryCurrencyAndDates() = %d rates, want 2502", len(rates))
+			}
+
+			since, err := db.ListExchangesSince(ctx, "2023-06-30")
+			if err != nil {
+				t.Fatalf("ListExchangesSince() error = %v", err)
+			}
+			var sinceDates []string
+			for _, ex := range since {
+				if ex.CountryCurrencyDesc == currency {
+					sinceDates = append(sinceDates, ex.Date)
+				}
+			}
+			if want := []string{"2023-06-30", "2023-09-30"}; !reflect.DeepEqual(sinceDates, want) {
+				t.Errorf("ListExchangesSince() dates = %v, want %v", sinceDates, want)
+			}
+		},
+	},
+	{
+		name: "exchangeRevisions",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			currency := "Country" + suffix + "-Currency"
+			for _, rate := range []string{"5.00", "5.00", "5.10"} {
+				ex := &models.ExchangeForDate{CountryCurrencyDesc: currency, ExchangeRate: rate, Date: "2023-09-30"}
+				if err := db.WithTx(ctx, func(tx services.Tx) error {
+					return db.BatchInsertExchanges(tx.Context(), tx, []*models.ExchangeForDate{ex})
+				}); err != nil {
+					t.Fatalf("BatchInsertExchanges() error = %v", err)
+				}
+				// the revisions are recorded in milliseconds.
+				time.Sleep(2 * time.Millisecond)
+			}
+			revisions, err := db.ListExchangeRevisions(ctx, currency, "2023-09-30")
+			if err != nil || len(revisions) != 2 {
+				t.Fatalf("ListExchangeRevisions() = %d revisions, %v, want 2", len(revisions), err)
+			}
+			if revisions[0].ExchangeRate != "5.00" || revisions[1].ExchangeRate != "5.10" || revisions[0].RecordedAt >= revisions[1].RecordedAt {
+				t.Errorf("ListExchangeRevisions() = %+v, %+v, want 5.00 and then 5.10", revisions[0], revisions[1])
+			}
+			if _, err := db.ListExchangeRevisions(ctx, currency, "2023-06-30"); !errors.Is(err, messages.ErrNoExchangeFound) {
+				t.Errorf("ListExchangeRevisions() of a date without rates error = %v, want %v", err, messages.ErrNoExchangeFound)
+			}
+
+			tests := []struct {
+				name string
+				ctx  context.Context
+				want string // the rate found, empty for none
+			}{
+				{name: "current", ctx: ctx, want: "5.10"},
+				{name: "asOfFirstRevision", ctx: services.WithAsOf(ctx, time.UnixMilli(revisions[0].RecordedAt)), want: "5.00"},
+				{name: "asOfBeforeAnyRevision", ctx: services.WithAsOf(ctx, time.UnixMilli(revisions[0].RecordedAt-1))},
+			}
+			for _, tt := range tests {
+				got, err := db.GetExchangeRateForCountryCurrencyAndDate(tt.ctx, currency, "2023-10-15")
+				if tt.want == "" && !errors.Is(err, messages.ErrNoExchangeFound) {
+					t.Errorf("%s: GetExchangeRateForCountryCurrencyAndDate() = %v, %v, want %v", tt.name, got, err, messages.ErrNoExchangeFound)
+				}
+				if tt.want != "" && (err != nil || got.ExchangeRate != tt.want) {
+					t.Errorf("%s: GetExchangeRateForCountryCurrencyAndDate() = %v, %v, want the rate %s", tt.name, got, err, tt.want)
+				}
+				rates, err := db.GetExchangeRatesForCountryCurrencyAndDates(tt.ctx, currency, []string{"2023-10-15"})
+				if err != nil || (tt.want == "") != (rates["2023-10-15"] == nil) || (tt.want != "" && rates["2023-10-15"].ExchangeRate != tt.want) {
+					t.Errorf("%s: GetExchangeRatesForCountryCurrencyAndDates() = %v, %v, want the rate '%s'", tt.name, rates, err, tt.want)
+				}
+			}
+		},
+	},
+	{
+		name: "purchaseConversions",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			currency := "Country" + suffix + "-Currency"
+			lock := func(c *models.PurchaseConversion) (inserted bool, err error) {
+				err = db.WithTx(ctx, func(tx services.Tx) error {
+					inserted, err = db.InsertPurchaseConversion(tx.Context(), tx, c)
+					return err
+				})
+				return inserted, err
+			}
+			first := &models.PurchaseConversion{PurchaseId: "lock" + suffix, CountryCurrencyDesc: currency, OriginalAmount: "10.00", PurchaseDate: "2023-09-30",
+				ExchangeRate: "5.00", RateDate: "2023-09-30", Provider: models.ConversionProviderTreasury, ConvertedAmount: "50.00", LockedAt: 1}
+			if inserted, err := lock(first); err != nil || !inserted {
+				t.Fatalf("InsertPurchaseConversion() = %v, %v, want true", inserted, err)
+			}
+			// the first lock is kept.
+			second := *first
+			second.ExchangeRate, second.ConvertedAmount, second.LockedAt = "5.10", "51.00", 2
+			if inserted, err := lock(&second); err != nil || inserted {
+				t.Fatalf("InsertPurchaseConversion() of a locked purchase = %v, %v, want false", inserted, err)
+			}
+			if got, err := db.GetPurchaseConversion(ctx, first.PurchaseId, currency); err != nil || !reflect.DeepEqual(got, first) {
+				t.Errorf("GetPurchaseConversion() = %+v, %v, want %+v", got, err, first)
+			}
+			if _, err := db.GetPurchaseConversion(ctx, first.PurchaseId, "Other"+suffix+"-Currency"); !errors.Is(err, messages.ErrNoConversionFound) {
+				t.Errorf("GetPurchaseConversion() in another currency error = %v, want %v", err, messages.ErrNoConversionFound)
+			}
+			if got, err := db.ListPurchaseConversions(ctx, currency); err != nil || len(got) != 1 || !reflect.DeepEqual(got[first.PurchaseId], first) {
+				t.Errorf("ListPurchaseConversions() = %v, %v, want only %+v", got, err, first)
+			}
+		},
+	},
+	{
+		name: "rateOverrides",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			currency := "Country" + suffix + "-Currency"
+			o := &models.RateOverride{CountryCurrencyDesc: currency, StartDate: "2023-07-01", EndDate: "2023-09-30", ExchangeRate: "5.20",
+				Reason: "missing quarter", CreatedBy: "finance", CreatedAt: 1}
+			var id int64
+			err := db.WithTx(ctx, func(tx services.Tx) error {
+				var err error
+				if id, err = db.InsertRateOverride(tx.Context(), tx, o); err != nil {
+					return err
+				}
+				o.Id = id
+				return db.InsertRateOverrideAudit(tx.Context(), tx, o.AuditOf(models.RateOverrideCreated, o.CreatedBy, o.Reason, o.CreatedAt))
+			})
+			if err != nil || id == 0 {
+				t.Fatalf("InsertRateOverride() = %d, %v, want an id", id, err)
+			}
+			if got, err := db.GetRateOverride(ctx, id); err != nil || got.ExchangeRate != o.ExchangeRate || got.RemovedAt != 0 {
+				t.Errorf("GetRateOverride() = %+v, %v, want %+v in use", got, err, o)
+			}
+
+			remove := func(id int64) error {
+				return db.WithTx(ctx, func(tx services.Tx) error { return db.RemoveRateOverride(tx.Context(), tx, id, 2) })
+			}
+			if err := remove(id); err != nil {
+				t.Fatalf("RemoveRateOverride() error = %v", err)
+			}
+			if err := remove(id); !errors.Is(err, messages.ErrNoOverrideFound) {
+				t.Errorf("RemoveRateOverride() of a removed override error = %v, want %v", err, messages.ErrNoOverrideFound)
+			}
+			if _, err := db.GetRateOverride(ctx, id+1000); !errors.Is(err, messages.ErrNoOverrideFound) {
+				t.Errorf("GetRateOverride() of an unknown override error = %v, want %v", err, messages.ErrNoOverrideFound)
+			}
+			overrides, err := db.ListRateOverrides(ctx, currency)
+			if err != nil || len(overrides) != 1 || overrides[0].Id != id || overrides[0].RemovedAt != 2 {
+				t.Errorf("ListRateOverrides() = %v, %v, want the override removed", overrides, err)
+			}
+			if all, err := db.ListRateOverrides(ctx, ""); err != nil || len(all) == 0 {
+				t.Errorf("ListRateOverrides() of every currency = %v, %v, want the override", all, err)
+			}
+			audit, err := db.ListRateOverrideAudit(ctx, currency)
+			if err != nil || len(audit) != 1 || audit[0].OverrideId != id || audit[0].Action != models.RateOverrideCreated || audit[0].Actor != "finance" {
+				t.Errorf("ListRateOverrideAudit() = %v, %v, want the creation", audit, err)
+			}
+		},
+	},
+	{
+		name: "unitOfWork",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			p := &models.Purchase{Id: "uow-" + suffix, Description: "Gift " + suffix, Amount: "9.99", Date: "2023-09-30", Deduplicate: true}
+			fail := errors.New("fail")
+			var leaked services.Tx
+			err := db.WithTx(ctx, func(tx services.Tx) error {
+				leaked = tx
+				if _, _, err := db.InsertPurchase(tx.Context(), tx, p); err != nil {
+					return err
+				}
+				// the nested WithTx joins the transaction, so it is rolled back with it.
+				return db.WithTx(tx.Context(), func(inner services.Tx) error {
+					if err := db.InsertExchange(inner.Context(), inner, &models.ExchangeForDate{Date: "2023-09-30", CountryCurrencyDesc: "Uow" + suffix, ExchangeRate: "1.0"}); err != nil {
+						return err
+					}
+					return fail
+				})
+			})
+			if !errors.Is(err, fail) {
+				t.Fatalf("WithTx() error = %v, want %v", err, fail)
+			}
+			if _, err := db.GetPurchaseById(ctx, p.Id); !errors.Is(err, messages.ErrNoPurchaseFound) {
+				t.Errorf("GetPurchaseById() after the rollback error = %v, want %v", err, messages.ErrNoPurchaseFound)
+			}
+			if _, err := db.GetExchangeRateForCountryCurrencyAndDate(ctx, "Uow"+suffix, "2023-09-30"); !errors.Is(err, messages.ErrNoExchangeFound) {
+				t.Errorf("GetExchangeRateForCountryCurrencyAndDate() after the rollback error = %v, want %v", err, messages.ErrNoExchangeFound)
+			}
+			if _, _, err := db.InsertPurchase(ctx, leaked, p); !errors.Is(err, messages.ErrTxDone) {
+				t.Errorf("InsertPurchase() with a finished transaction error = %v, want %v", err, messages.ErrTxDone)
+			}
+
+			func() {
+				defer func() {
+					if r := recover(); r == nil {
+						t.Errorf("WithTx() did not panic again")
+					}
+				}()
+				db.WithTx(ctx, func(tx services.Tx) error {
+					db.InsertPurchase(tx.Context(), tx, p)
+					panic("fail")
+				})
+			}()
+			if _, err := db.GetPurchaseById(ctx, p.Id); !errors.Is(err, messages.ErrNoPurchaseFound) {
+				t.Errorf("GetPurchaseById() after the panic error = %v, want %v", err, messages.ErrNoPurchaseFound)
+			}
+
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			if err := db.WithTx(canceled, func(tx services.Tx) error { return nil }); !errors.Is(err, context.Canceled) {
+				t.Errorf("WithTx() with a canceled context error = %v, want %v", err, context.Canceled)
+			}
+
+			// reads with the context of the transaction see its writes.
+			err = db.WithTx(ctx, func(tx services.Tx) error {
+				if _, _, err := db.InsertPurchase(tx.Context(), tx, p); err != nil {
+					return err
+				}
+				_, err := db.GetPurchaseById(tx.Context(), p.Id)
+				return err
+			})
+			if err != nil {
+				t.Fatalf("WithTx() error = %v", err)
+			}
+
+			// an update breaking the signature uniqueness changes neither the purchase nor its history.
+			other := &models.Purchase{Id: "rb-other-" + suffix, Description: "Book " + suffix, Amount: "5.00", Date: "2023-09-30", Deduplicate: true}
+			if _, _, err := insertInTx(ctx, db, other); err != nil {
+				t.Fatalf("InsertPurchase() error = %v", err)
+			}
+			update := &models.Purchase{Id: other.Id, Description: p.Description, Amount: p.Amount, Date: p.Date, Deduplicate: true}
+			if err := db.WithTx(ctx, func(tx services.Tx) error { return db.UpdatePurchase(tx.Context(), tx, update) }); !errors.Is(err, messages.ErrDuplicatedPurchase) {
+				t.Fatalf("UpdatePurchase() error = %v, want %v", err, messages.ErrDuplicatedPurchase)
+			}
+			if got, err := db.GetPurchaseById(ctx, other.Id); err != nil || got.Description != other.Description {
+				t.Errorf("GetPurchaseById() after the failed update = %v, %v, want %s", got, err, other.Description)
+			}
+			if history, err := db.ListPurchaseHistory(ctx, other.Id); err != nil || len(history) != 1 {
+				t.Errorf("ListPurchaseHistory() after the failed update = %d entries, %v, want 1", len(history), err)
+			}
+		},
+	},
+	{
+		name: "idempotencyKeys",
+		run: func(t *testing.T, ctx context.Context, db services.Database, suffix string) {
+			k := &models.IdempotencyKey{Key: "key-" + suffix, RequestHash: "hash", StatusCode: 0, ResponseBody: "", ExpiresAt: 4102444800}
+			if inserted, err := db.InsertIdempotencyKey(ctx, k); err != nil || !inserted {
+				t.Fatalf("InsertIdempotencyKey() = %v, %v, want true, nil", inserted, err)
+			}
+			if inserted, err := db.InsertIdempotencyKey(ctx, k); err != nil || inserted {
+				t.Errorf("InsertIdempotencyKey() twice = %v, %v, want false, nil", inserted, err)
+			}
+			k.StatusCode, k.ResponseBody = 201, `{"id": "abcd"}`
+			if err := db.UpdateIdempotencyKey(ctx, k); err != nil {
+				t.Fatalf("UpdateIdempotencyKey() error = %v", err)
+			}
+			if got, err := db.GetIdempotencyKey(ctx, k.Key); err != nil || !reflect.DeepEqual(got, k) {
+				t.Errorf("GetIdempotencyKey() = %v, %v, want %v", got, err, k)
+			}
+			expired := &models.IdempotencyKey{Key: "expired-" + suffix, RequestHash: "hash", ExpiresAt: 1}
+			if _, err := db.InsertIdempotencyKey(ctx, expired); err != nil {
+				t.Fatalf("InsertIdempotencyKey() error = %v", err)
+			}
+			if purged, err := db.DeleteExpiredIdempotencyKeys(ctx, 2); err != nil || purged < 1 {
+				t.Errorf("DeleteExpiredIdempotencyKeys() = %d, %v, want at least 1", purged, err)
+			}
+			if _, err := db.GetIdempotencyKey(ctx, expired.Key); !errors.Is(err, messages.ErrNoIdempotencyKeyFound) {
+				t.Errorf("GetIdempotencyKey() of an expired key error = %v, want %v", err, messages.ErrNoIdempotencyKeyFound)
+			}
+			if err := db.DeleteIdempotencyKey(ctx, k.Key); err != nil {
+				t.Errorf("DeleteIdempotencyKey() error = %v", err)
+			}
+		},
+	},
+}
+
+// insertInTx inserts p in a transaction of its own.
+func insertInTx(ctx context.Context, db services.Database, p *models.Purchase) (id string, created bool, err error) {
+	err = db.WithTx(ctx, func(tx services.Tx) error {
+		id, created, err = db.InsertPurchase(tx.Context(), tx, p)
+		return err
+	})
+	return id, created, err
+}
+
+// batchInsertInTx inserts ps in a transaction of their own.
+func batchInsertInTx(ctx context.Context, db services.Database, ps []*models.Purchase) (results []*models.PurchaseInsertResult, err error) {
+	err = db.WithTx(ctx, func(tx services.Tx) error {
+		results, err = db.BatchInsertPurchases(tx.Context(), tx, ps)
+		return err
+	})
+	return results, err
+}
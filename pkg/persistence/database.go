@@ -3,8 +3,9 @@ package persistence
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -12,27 +13,48 @@ import (
 	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
 )
 
 type (
-	mysqlDatabaseFinal struct {
-		sm services.ServiceManager
-		db *sql.DB
+	sqlDatabaseFinal struct {
+		sm         services.ServiceManager
+		db         *sql.DB
+		dialect    dialect
+		connection models.DatabaseConfig // the settings the connection was opened with
 		//mockDb bool
 	}
+
+	// sqlTx is the services.Tx of sqlDatabaseFinal.
+	sqlTx struct {
+		tx   *sql.Tx
+		ctx  context.Context
+		db   *sqlDatabaseFinal
+		done bool
+	}
+	// querier is what a *sql.DB and a *sql.Tx have in common.
+	querier interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	}
 	Key string
 )
 
 var (
-	version             string
 	MockDbKey           Key = "mockDb"
+	txKey               Key = "tx"
 	purchaseCreateTable     = `CREATE TABLE IF NOT EXISTS purchase (
 		id VARCHAR(255) PRIMARY KEY,
 		description VARCHAR(255) NOT NULL,
 		amount VARCHAR(50) NOT NULL,
 		date VARCHAR(40),
 		signature VARCHAR(255),
-		INDEX (date)
+		deleted_at BIGINT NULL,
+		INDEX (date),
+		UNIQUE INDEX ` + purchaseSignatureIndex + ` (signature)
 	)`
 
 	exchangeCreateTable = `CREATE TABLE IF NOT EXISTS exchange (
@@ -41,28 +63,123 @@ var (
 		exchange_rate VARCHAR(50) NOT NULL,
 		PRIMARY KEY (country_currency_desc,date)
 	)`
+
+	idempotencyKeyCreateTable = `CREATE TABLE IF NOT EXISTS idempotency_key (
+		idempotency_key VARCHAR(255) PRIMARY KEY,
+		request_hash VARCHAR(64) NOT NULL,
+		status_code INT NOT NULL,
+		response_body TEXT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		INDEX (expires_at)
+	)`
+
+	purchaseHistoryCreateTable = `CREATE TABLE IF NOT EXISTS purchase_history (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		purchase_id VARCHAR(255) NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		amount VARCHAR(50) NOT NULL,
+		date VARCHAR(40),
+		changed_at BIGINT NOT NULL,
+		INDEX (purchase_id)
+	)`
+
+	// exchangeRevisionCreateTable keeps every rate ingested, the exchange table only the current one.
+	exchangeRevisionCreateTable = `CREATE TABLE IF NOT EXISTS exchange_revision (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		date VARCHAR(40),
+		country_currency_desc VARCHAR(255) NOT NULL,
+		exchange_rate VARCHAR(50) NOT NULL,
+		recorded_at BIGINT NOT NULL,
+		INDEX (country_currency_desc, date)
+	)`
+
+	purchaseConversionCreateTable = `CREATE TABLE IF NOT EXISTS purchase_conversion (
+		purchase_id VARCHAR(255) NOT NULL,
+		country_currency_desc VARCHAR(255) NOT NULL,
+		original_amount VARCHAR(50) NOT NULL,
+		purchase_date VARCHAR(40) NOT NULL,
+		exchange_rate VARCHAR(50) NOT NULL,
+		rate_date VARCHAR(40) NOT NULL,
+		provider VARCHAR(50) NOT NULL,
+		converted_amount VARCHAR(50) NOT NULL,
+		locked_at BIGINT NOT NULL,
+		PRIMARY KEY (purchase_id, country_currency_desc)
+	)`
+
+	rateOverrideCreateTable = `CREATE TABLE IF NOT EXISTS rate_override (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		country_currency_desc VARCHAR(255) NOT NULL,
+		start_date VARCHAR(40) NOT NULL,
+		end_date VARCHAR(40) NOT NULL,
+		exchange_rate VARCHAR(50) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		created_by VARCHAR(255) NOT NULL,
+		created_at BIGINT NOT NULL,
+		removed_at BIGINT NOT NULL DEFAULT 0,
+		INDEX (country_currency_desc)
+	)`
+
+	rateOverrideAuditCreateTable = `CREATE TABLE IF NOT EXISTS rate_override_audit (
+		id BIGINT AUTO_INCREMENT PRIMARY KEY,
+		override_id BIGINT NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		country_currency_desc VARCHAR(255) NOT NULL,
+		start_date VARCHAR(40) NOT NULL,
+		end_date VARCHAR(40) NOT NULL,
+		exchange_rate VARCHAR(50) NOT NULL,
+		actor VARCHAR(255) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		changed_at BIGINT NOT NULL,
+		INDEX (country_currency_desc)
+	)`
+
+	createTables = []string{purchaseCreateTable, exchangeCreateTable, idempotencyKeyCreateTable, purchaseHistoryCreateTable, exchangeRevisionCreateTable, purchaseConversionCreateTable,
+		rateOverrideCreateTable, rateOverrideAuditCreateTable}
+
+	// backfillExchangeRevisions gives the rates ingested before the revisions were kept their first revision,
+	// recorded at 0. It does nothing once they all have one.
+	backfillExchangeRevisions = `INSERT INTO exchange_revision(date, country_currency_desc, exchange_rate, recorded_at)
+		SELECT e.date, e.country_currency_desc, e.exchange_rate, 0 FROM exchange e
+		WHERE NOT EXISTS (SELECT 1 FROM exchange_revision r WHERE r.country_currency_desc = e.country_currency_desc AND r.date = e.date)`
+
+	// clearDuplicatedSignatures keeps the signature of the first purchase, by id, of each one and clears it from
+	// the others, so the unique index can be added to a database created before it. The purchases themselves are
+	// kept, the ConsistencyChecker reports them as duplicated.
+	clearDuplicatedSignatures = `UPDATE purchase SET signature = NULL
+		WHERE signature IS NOT NULL AND id NOT IN (
+			SELECT keep_id FROM (SELECT MIN(id) AS keep_id FROM purchase WHERE signature IS NOT NULL GROUP BY signature) k)`
 )
 
+const purchaseSignatureIndex = "purchase_signature_uk"
+
+// streamPageSize is how many purchases StreamAllPurchases reads from the database at a time.
+var streamPageSize = 500
+
+// NewDatabase builds the Database of the database.driver setting: MySQL, or an embedded SQLite file for a
+// single binary deployment. The queries are the same, only the dialect changes.
 func NewDatabase() services.Database {
-	return &mysqlDatabaseFinal{}
-	// refer https://github.com/go-sql-driver/mysql#dsn-data-source-name for details
+	return &sqlDatabaseFinal{dialect: mysqlDialect{}}
 	//https://gorm.io/docs/connecting_to_the_database.html
 }
 
-func (n *mysqlDatabaseFinal) buildConnection(ctx context.Context, mockDb *sql.DB) error {
+func (n *sqlDatabaseFinal) buildConnection(ctx context.Context, mockDb *sql.DB) error {
+	cfg := n.sm.ConfigService().Config().Database
+	d, err := dialectOf(cfg.Driver)
+	if err != nil {
+		return err
+	}
+	n.dialect = d
+	n.connection = cfg
 	if mockDb == nil {
-		dbName := os.Getenv("DB_NAME")
-		dbUser := os.Getenv("DB_USER")
-		dbPass := os.Getenv("DB_PASSWORD")
-		dbHostPort := os.Getenv("DB_HOSTPORT")
-		db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s", dbUser, dbPass, dbHostPort, dbName))
+		db, err := sql.Open(d.driverName(), d.dsn(cfg))
 		if err != nil {
 			n.sm.LogsService().Error(ctx, err.Error())
 			return err
 		}
-		db.SetMaxOpenConns(5)
-		db.SetMaxIdleConns(5)
-		db.SetConnMaxLifetime(time.Minute * 5)
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 		n.db = db
 	} else {
 		n.db = mockDb
@@ -70,7 +187,7 @@ func (n *mysqlDatabaseFinal) buildConnection(ctx context.Context, mockDb *sql.DB
 	return nil
 }
 
-func (n *mysqlDatabaseFinal) Start(ctx context.Context) error {
+func (n *sqlDatabaseFinal) Start(ctx context.Context) error {
 	sm := n.ServiceManager()
 	mdb := ctx.Value(MockDbKey)
 	var err error
@@ -93,83 +210,369 @@ func (n *mysqlDatabaseFinal) Start(ctx context.Context) error {
 	return nil
 }
 
-func (n *mysqlDatabaseFinal) createTablesIfNotExists(ctx context.Context) error {
-	_, err := n.db.ExecContext(ctx, purchaseCreateTable)
-	if err != nil {
+// Reconfigure resizes the connection pool, the other settings need a new connection and so a restart.
+func (n *sqlDatabaseFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	if n.db == nil {
+		return nil
+	}
+	c := cfg.Database
+	if c.Driver != n.connection.Driver || c.Path != n.connection.Path ||
+		c.Name != n.connection.Name || c.User != n.connection.User || c.Password != n.connection.Password || c.HostPort != n.connection.HostPort {
+		return errors.New("the database connection settings cannot change without a restart")
+	}
+	n.db.SetMaxOpenConns(c.MaxOpenConns)
+	n.db.SetMaxIdleConns(c.MaxIdleConns)
+	n.db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	return nil
+}
+
+func (n *sqlDatabaseFinal) createTablesIfNotExists(ctx context.Context) error {
+	for _, createTable := range n.dialect.createTables() {
+		if _, err := n.db.ExecContext(ctx, createTable); err != nil {
+			return err
+		}
+	}
+	if _, err := n.db.ExecContext(ctx, backfillExchangeRevisions); err != nil {
 		return err
 	}
+	return n.migrate(ctx)
+}
+
+// migrate brings a database created by an older version, whose tables CREATE TABLE IF NOT EXISTS left as they
+// were, up to the current schema. Every step checks first, so nothing is done on an up to date database.
+func (n *sqlDatabaseFinal) migrate(ctx context.Context) error {
+	if err := n.addDeletedAt(ctx); err != nil {
+		return err
+	}
+	return n.addSignatureIndex(ctx)
+}
+
+// addDeletedAt adds the column of the soft deletes, every purchase query filters on it.
+func (n *sqlDatabaseFinal) addDeletedAt(ctx context.Context) error {
+	if exists, err := n.schemaHas(ctx, n.dialect.columnExists(), "purchase", "deleted_at"); err != nil || exists {
+		return err
+	}
+	if _, err := n.db.ExecContext(ctx, "ALTER TABLE purchase ADD COLUMN deleted_at BIGINT NULL"); err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, "Purchase deleted_at column added")
+	return nil
+}
 
-	_, err = n.db.ExecContext(ctx, exchangeCreateTable)
+// addSignatureIndex adds the unique index on the purchase signature, what makes the purchase creation idempotent.
+func (n *sqlDatabaseFinal) addSignatureIndex(ctx context.Context) error {
+	if exists, err := n.schemaHas(ctx, n.dialect.indexExists(), "purchase", purchaseSignatureIndex); err != nil || exists {
+		return err
+	}
+	res, err := n.db.ExecContext(ctx, clearDuplicatedSignatures)
 	if err != nil {
 		return err
 	}
+	if cleared, _ := res.RowsAffected(); cleared > 0 {
+		n.sm.LogsService().Warn(ctx, "Duplicated purchase signatures cleared to add their unique index", "purchases", cleared)
+	}
+	if _, err = n.db.ExecContext(ctx, n.dialect.addUniqueIndex("purchase", purchaseSignatureIndex, "signature")); err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, "Purchase signature unique index added")
 	return nil
 }
 
-func (n *mysqlDatabaseFinal) Close(ctx context.Context) error {
+// schemaHas runs the count query of the dialect given, like indexExists, and tells if it found anything.
+func (n *sqlDatabaseFinal) schemaHas(ctx context.Context, query string, args ...any) (bool, error) {
+	var count int
+	if err := n.db.QueryRowContext(ctx, query, args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (n *sqlDatabaseFinal) Close(ctx context.Context) error {
+	if n.db == nil {
+		return nil
+	}
 	return n.db.Close()
 }
 
-func (n *mysqlDatabaseFinal) Healthy(ctx context.Context) error {
-	return n.db.QueryRow("SELECT VERSION()").Scan(&version)
+func (n *sqlDatabaseFinal) Healthy(ctx context.Context) error {
+	if n.db == nil {
+		return errors.New("database not connected")
+	}
+	return n.db.PingContext(ctx)
 }
 
-func (n *mysqlDatabaseFinal) WithServiceManager(sm services.ServiceManager) services.Database {
+func (n *sqlDatabaseFinal) WithServiceManager(sm services.ServiceManager) services.Database {
 	n.sm = sm
 	return n
 }
 
-func (n *mysqlDatabaseFinal) ServiceManager() services.ServiceManager {
+func (n *sqlDatabaseFinal) ServiceManager() services.ServiceManager {
 	return n.sm
 }
 
-func (n *mysqlDatabaseFinal) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
-	//txCtx, _ := context.WithTimeout(ctx, 10*time.Second)
-	//defer cancel()
+// Stats returns the statistics of the connection pool, empty before the connection is opened.
+func (n *sqlDatabaseFinal) Stats() sql.DBStats {
+	if n.db == nil {
+		return sql.DBStats{}
+	}
+	return n.db.Stats()
+}
+
+// instrument starts the span of a Database method, a client span of the database. The returned end must
+// be called when the method returns, it ends the span and observes the latency of the method.
+func (n *sqlDatabaseFinal) instrument(ctx context.Context, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "Database."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(n.dialect.system(), semconv.DBName(n.connection.Name)))
+	return ctx, func() {
+		span.End()
+		n.sm.MetricsService().ObserveDatabaseQuery(method, time.Since(start))
+	}
+}
 
-	tx, err := n.db.Begin()
+// WithTx runs fn in a transaction begun with ctx, so canceling ctx rolls it back. Given the context of one of its
+// own transactions, fn joins it.
+func (n *sqlDatabaseFinal) WithTx(ctx context.Context, fn func(tx services.Tx) error) (err error) {
+	if outer, ok := ctx.Value(txKey).(*sqlTx); ok && outer.db == n && !outer.done {
+		return fn(outer)
+	}
+	ctx, end := n.instrument(ctx, "WithTx")
+	defer end()
+	if n.db == nil {
+		return errors.New("database not connected")
+	}
+	t, err := n.db.BeginTx(ctx, nil)
 	if err != nil {
 		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error creating transaction: %s", err.Error()))
+		return err
+	}
+	tx := &sqlTx{tx: t, db: n}
+	tx.ctx = context.WithValue(ctx, txKey, tx)
+	defer func() {
+		tx.done = true
+		if r := recover(); r != nil {
+			t.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		if rbErr := t.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			n.sm.LogsService().Error(ctx, fmt.Sprintf("Error rolling back transaction: %s", rbErr.Error()))
+		}
+		return err
+	}
+	if err = t.Commit(); err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error commiting transaction: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (t *sqlTx) Context() context.Context {
+	return t.ctx
+}
+
+// query returns the transaction of ctx when it is one of n not finished yet, so the reads inside a WithTx see its
+// writes, or the connection pool.
+func (n *sqlDatabaseFinal) query(ctx context.Context) querier {
+	if t, ok := ctx.Value(txKey).(*sqlTx); ok && t.db == n && !t.done {
+		return t.tx
+	}
+	return n.db
+}
+
+// txOf returns the *sql.Tx of a transaction begun by n and not finished yet.
+func (n *sqlDatabaseFinal) txOf(tx services.Tx) (*sql.Tx, error) {
+	t, ok := tx.(*sqlTx)
+	if !ok || t.db != n || t.done {
+		return nil, messages.ErrTxDone
+	}
+	return t.tx, nil
+}
+
+func (n *sqlDatabaseFinal) InsertPurchase(ctx context.Context, tx services.Tx, p *models.Purchase) (string, bool, error) {
+	ctx, end := n.instrument(ctx, "InsertPurchase")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return "", false, err
+	}
+
+	id, created, err := n.insertPurchase(ctx, t, p)
+	if err != nil || !created {
+		return id, created, err
+	}
+	n.sm.LogsService().Info(ctx, "Purchase Inserted!", "signature", p.Signature())
+	return p.Id, true, nil
+}
+
+func (n *sqlDatabaseFinal) BatchInsertPurchases(ctx context.Context, tx services.Tx, ps []*models.Purchase) ([]*models.PurchaseInsertResult, error) {
+	ctx, end := n.instrument(ctx, "BatchInsertPurchases")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
 		return nil, err
 	}
-	return tx, nil
+
+	results := make([]*models.PurchaseInsertResult, 0, len(ps))
+	for _, p := range ps {
+		id, created, err := n.insertPurchase(ctx, t, p)
+		if err != nil && !errors.Is(err, messages.ErrPurchaseIdConflict) {
+			return nil, err
+		}
+		// a failed statement does not abort the transaction, so a conflicting purchase is reported and the batch goes on.
+		results = append(results, &models.PurchaseInsertResult{Id: id, Created: created, Err: err})
+	}
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Purchases Batch Inserted! purchases num: %d", len(ps)))
+	return results, nil
 }
 
-func (n *mysqlDatabaseFinal) CommitTransaction(tx *sql.Tx) error {
-	return tx.Commit()
+// insertPurchase inserts p and its history inside tx. When p is a duplicate the id of the
+// purchase that already exists is returned.
+func (n *sqlDatabaseFinal) insertPurchase(ctx context.Context, tx *sql.Tx, p *models.Purchase) (string, bool, error) {
+	_, err := tx.ExecContext(ctx, "INSERT INTO purchase(id, description, amount, date, signature) VALUES (?, ?, ?, ?, ?)",
+		p.Id, p.Description, p.Amount, p.Date, nullableSignature(p))
+	if n.dialect.isDuplicateEntry(err) {
+		if !p.Deduplicate {
+			// no signature was inserted, the duplicated key is the id: it is another purchase.
+			return "", false, messages.ErrPurchaseIdConflict
+		}
+		// The unique index on signature is what makes the insert idempotent: concurrent inserts of the same
+		// purchase wait on each other and only the first one wins, the others get the winner's id back.
+		existingId, err := n.purchaseIdBySignature(ctx, tx, p)
+		if err != nil {
+			return "", false, err
+		}
+		n.sm.LogsService().Info(ctx, "Purchase already exists!", "signature", p.Signature(), services.PurchaseIDKey, existingId)
+		return existingId, false, nil
+	}
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting row into purchase table: %s", err.Error()))
+		return "", false, err
+	}
+	if err := n.insertPurchaseHistory(ctx, tx, p.Id, models.PurchaseCreated); err != nil {
+		return "", false, err
+	}
+	return p.Id, true, nil
 }
 
-func (n *mysqlDatabaseFinal) RollbackTransaction(tx *sql.Tx) error {
-	return tx.Rollback()
+func (n *sqlDatabaseFinal) purchaseIdBySignature(ctx context.Context, tx *sql.Tx, p *models.Purchase) (string, error) {
+	var id string
+	err := tx.QueryRowContext(ctx, "SELECT id FROM purchase WHERE signature = ? AND deleted_at IS NULL", p.Signature()).Scan(&id)
+	if err == sql.ErrNoRows {
+		// the duplicated key was the id, not the signature: it is another purchase.
+		return "", messages.ErrPurchaseIdConflict
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Something went wrong searching the Purchase by its signature: %s", err.Error())
+		return "", &messages.PurchaseError{Msg: msg, PurchaseId: p.Id}
+	}
+	return id, nil
 }
 
-func (n *mysqlDatabaseFinal) InsertPurchase(ctx context.Context, tx *sql.Tx, p *models.Purchase) error {
-	defer tx.Rollback()
+func (n *sqlDatabaseFinal) UpdatePurchase(ctx context.Context, tx services.Tx, p *models.Purchase) error {
+	ctx, end := n.instrument(ctx, "UpdatePurchase")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return err
+	}
 
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO purchase(id, description, amount, date, signature) VALUES (?, ?, ?, ?, ?)")
+	res, err := t.ExecContext(ctx, "UPDATE purchase SET description = ?, amount = ?, date = ?, signature = ? WHERE id = ? AND deleted_at IS NULL",
+		p.Description, p.Amount, p.Date, nullableSignature(p), p.Id)
+	if n.dialect.isDuplicateEntry(err) {
+		return messages.ErrDuplicatedPurchase
+	}
 	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when preparing SQL statement: %s", err.Error()))
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when updating row of purchase table: %s", err.Error()))
 		return err
 	}
-	defer stmt.Close()
-	_, err = stmt.ExecContext(ctx, p.Id, p.Description, p.Amount, p.Date, p.Signature())
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return messages.ErrNoPurchaseFound
+	}
+	if err := n.insertPurchaseHistory(ctx, t, p.Id, models.PurchaseUpdated); err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, "Purchase Updated!", services.PurchaseIDKey, p.Id)
+	return nil
+}
+
+func (n *sqlDatabaseFinal) DeletePurchase(ctx context.Context, tx services.Tx, id string) error {
+	ctx, end := n.instrument(ctx, "DeletePurchase")
+	defer end()
+	t, err := n.txOf(tx)
 	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting row into purchase table: %s", err.Error()))
 		return err
 	}
 
-	if err := tx.Commit(); err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error commiting purchase insert transaction: %s", err.Error()))
+	// the signature is released so the same purchase can be created again later.
+	res, err := t.ExecContext(ctx, "UPDATE purchase SET deleted_at = ?, signature = NULL WHERE id = ? AND deleted_at IS NULL", time.Now().Unix(), id)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when deleting row of purchase table: %s", err.Error()))
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return messages.ErrNoPurchaseFound
+	}
+	if err := n.insertPurchaseHistory(ctx, t, id, models.PurchaseDeleted); err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, "Purchase Deleted!", services.PurchaseIDKey, id)
+	return nil
+}
+
+// insertPurchaseHistory copies the current values of the purchase to its history.
+func (n *sqlDatabaseFinal) insertPurchaseHistory(ctx context.Context, tx *sql.Tx, id string, action string) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO purchase_history(purchase_id, action, description, amount, date, changed_at) SELECT id, ?, description, amount, date, ? FROM purchase WHERE id = ?",
+		action, time.Now().Unix(), id)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting row into purchase_history table: %s", err.Error()))
 		return err
 	}
-	n.sm.LogsService().Info(ctx, fmt.Sprintf("Purchase Inserted! Purchase Signature: '%s'", p.Signature()))
 	return nil
 }
 
-func (n *mysqlDatabaseFinal) InsertExchange(ctx context.Context, tx *sql.Tx, ex *models.ExchangeForDate) error {
-	defer tx.Rollback()
+func (n *sqlDatabaseFinal) ListPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error) {
+	ctx, end := n.instrument(ctx, "ListPurchaseHistory")
+	defer end()
+	rows, err := n.query(ctx).QueryContext(ctx, "SELECT id, purchase_id, action, description, amount, date, changed_at FROM purchase_history WHERE purchase_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, n.historyError(id, err)
+	}
+	defer rows.Close()
+	var history []*models.PurchaseHistory
+	for rows.Next() {
+		var h models.PurchaseHistory
+		if err := rows.Scan(&h.Id, &h.PurchaseId, &h.Action, &h.Description, &h.Amount, &h.Date, &h.ChangedAt); err != nil {
+			return nil, n.historyError(id, err)
+		}
+		history = append(history, &h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, n.historyError(id, err)
+	}
+	if len(history) == 0 {
+		return nil, messages.ErrNoPurchaseFound
+	}
+	return history, nil
+}
+
+func (n *sqlDatabaseFinal) historyError(id string, err error) error {
+	msg := fmt.Sprintf("Something went wrong searching the history of the Purchase: %s", err.Error())
+	return &messages.PurchaseError{Msg: msg, PurchaseId: id}
+}
 
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO exchange(date, country_currency_desc, exchange_rate) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE exchange_rate = VALUES(exchange_rate)")
+func (n *sqlDatabaseFinal) InsertExchange(ctx context.Context, tx services.Tx, ex *models.ExchangeForDate) error {
+	ctx, end := n.instrument(ctx, "InsertExchange")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := t.PrepareContext(ctx, n.dialect.upsertExchanges("(?, ?, ?)"))
 	if err != nil {
 		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when preparing SQL statement: %s", err.Error()))
 		return err
@@ -180,16 +583,20 @@ func (n *mysqlDatabaseFinal) InsertExchange(ctx context.Context, tx *sql.Tx, ex
 		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting row into exchange table: %s", err.Error()))
 		return err
 	}
-
-	if err := tx.Commit(); err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error commiting exchange insert transaction: %s", err.Error()))
+	if err := n.insertExchangeRevisions(ctx, t, []*models.ExchangeForDate{ex}); err != nil {
 		return err
 	}
 	n.sm.LogsService().Info(ctx, fmt.Sprintf("Exchange Inserted! For countrycurrency: '%s' and date: '%s'", ex.CountryCurrencyDesc, ex.Date))
 	return nil
 }
 
-func (n *mysqlDatabaseFinal) BatchInsertExchanges(ctx context.Context, tx *sql.Tx, exchanges []*models.ExchangeForDate) error {
+func (n *sqlDatabaseFinal) BatchInsertExchanges(ctx context.Context, tx services.Tx, exchanges []*models.ExchangeForDate) error {
+	ctx, end := n.instrument(ctx, "BatchInsertExchanges")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return err
+	}
 	valueStrings := []string{}
 	valueArgs := []interface{}{}
 	for _, ex := range exchanges {
@@ -198,38 +605,86 @@ func (n *mysqlDatabaseFinal) BatchInsertExchanges(ctx context.Context, tx *sql.T
 		valueArgs = append(valueArgs, ex.CountryCurrencyDesc)
 		valueArgs = append(valueArgs, ex.ExchangeRate)
 	}
-	smt := `INSERT INTO exchange(date, country_currency_desc, exchange_rate) VALUES %s ON DUPLICATE KEY UPDATE exchange_rate = VALUES(exchange_rate)`
-	smt = fmt.Sprintf(smt, strings.Join(valueStrings, ","))
-	fmt.Println("smttt:", smt)
-	_, err := tx.Exec(smt, valueArgs...)
-	if err != nil {
-		tx.Rollback()
+	smt := n.dialect.upsertExchanges(strings.Join(valueStrings, ","))
+	n.sm.LogsService().Debug(ctx, "Batch inserting exchanges", "statement", smt, "exchanges", len(exchanges))
+	if _, err = t.ExecContext(ctx, smt, valueArgs...); err != nil {
 		return err
 	}
-	return tx.Commit()
+	return n.insertExchangeRevisions(ctx, t, exchanges)
 }
 
-func (n *mysqlDatabaseFinal) ExistsBySignature(ctx context.Context, signature string) (bool, error) {
+// insertExchangeRevisions appends a revision, recorded now, for each of the exchanges just upserted whose rate
+// differs from its last revision. The rates are read back from the exchange table, so a rate given twice is
+// recorded once.
+func (n *sqlDatabaseFinal) insertExchangeRevisions(ctx context.Context, tx *sql.Tx, exchanges []*models.ExchangeForDate) error {
+	keys := make([]string, 0, len(exchanges))
+	args := []any{time.Now().UnixMilli()}
+	for _, ex := range exchanges {
+		keys = append(keys, "(?, ?)")
+		args = append(args, ex.CountryCurrencyDesc, ex.Date)
+	}
+	query := fmt.Sprintf(`INSERT INTO exchange_revision(date, country_currency_desc, exchange_rate, recorded_at)
+		SELECT e.date, e.country_currency_desc, e.exchange_rate, ? FROM exchange e
+		WHERE (e.country_currency_desc, e.date) IN (%s) AND e.exchange_rate <> COALESCE((
+			SELECT r.exchange_rate FROM exchange_revision r WHERE r.country_currency_desc = e.country_currency_desc AND r.date = e.date
+			ORDER BY r.id DESC LIMIT 1), '')`, strings.Join(keys, ","))
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting rows into exchange_revision table: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (n *sqlDatabaseFinal) ExistsBySignature(ctx context.Context, signature string) (bool, error) {
+	ctx, end := n.instrument(ctx, "ExistsBySignature")
+	defer end()
 	count := 0
-	n.db.QueryRow("SELECT count(1) FROM purchase WHERE signature = ?", signature).Scan(count)
+	if err := n.query(ctx).QueryRowContext(ctx, "SELECT count(1) FROM purchase WHERE signature = ? AND deleted_at IS NULL", signature).Scan(&count); err != nil {
+		msg := fmt.Sprintf("Something went wrong searching the Purchase by its signature: %s", err.Error())
+		return false, &messages.PurchaseError{Msg: msg}
+	}
 	return count > 0, nil
 }
 
-func (n *mysqlDatabaseFinal) GetPurchaseById(ctx context.Context, id string) (*models.Purchase, error) {
+func (n *sqlDatabaseFinal) GetPurchaseById(ctx context.Context, id string) (*models.Purchase, error) {
+	ctx, end := n.instrument(ctx, "GetPurchaseById")
+	defer end()
+	p := &models.Purchase{}
+	err := n.query(ctx).QueryRowContext(ctx, "SELECT id, description, amount, date FROM purchase WHERE id = ? AND deleted_at IS NULL", id).Scan(&p.Id, &p.Description, &p.Amount, &p.Date)
+	if err == sql.ErrNoRows {
+		return nil, messages.ErrNoPurchaseFound
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Something went wrong searching the Purchase: %s", err.Error())
+		return nil, &messages.PurchaseError{Msg: msg, PurchaseId: id}
+	}
+	return p, nil
+}
+
+// GetPurchaseForUpdate reads the purchase inside tx, locking its row until tx ends.
+func (n *sqlDatabaseFinal) GetPurchaseForUpdate(ctx context.Context, tx services.Tx, id string) (*models.Purchase, error) {
+	ctx, end := n.instrument(ctx, "GetPurchaseForUpdate")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return nil, err
+	}
 	p := &models.Purchase{}
-	err := n.db.QueryRow("SELECT id, description, amount, date FROM purchase WHERE id = ?", id).Scan(&p.Id, &p.Description, &p.Amount, &p.Date)
+	err = t.QueryRowContext(ctx, "SELECT id, description, amount, date FROM purchase WHERE id = ? AND deleted_at IS NULL"+n.dialect.lockRows(), id).Scan(&p.Id, &p.Description, &p.Amount, &p.Date)
 	if err == sql.ErrNoRows {
 		return nil, messages.ErrNoPurchaseFound
 	}
 	if err != nil {
-		msg := fmt.Sprintf("Something went wrong searching by the Purchase with ID %s: %s", id, err.Error())
+		msg := fmt.Sprintf("Something went wrong searching the Purchase: %s", err.Error())
 		return nil, &messages.PurchaseError{Msg: msg, PurchaseId: id}
 	}
 	return p, nil
 }
 
-func (n *mysqlDatabaseFinal) ListAllPurchases(ctx context.Context) ([]*models.Purchase, error) {
-	pRows, err := n.db.Query("SELECT id, description, amount, date FROM purchase")
+func (n *sqlDatabaseFinal) ListAllPurchases(ctx context.Context) ([]*models.Purchase, error) {
+	ctx, end := n.instrument(ctx, "ListAllPurchases")
+	defer end()
+	pRows, err := n.query(ctx).QueryContext(ctx, "SELECT id, description, amount, date, signature IS NOT NULL FROM purchase WHERE deleted_at IS NULL")
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return services.EmptyPurchasesSlice, messages.ErrNoPurchaseFound
@@ -240,7 +695,7 @@ func (n *mysqlDatabaseFinal) ListAllPurchases(ctx context.Context) ([]*models.Pu
 	var purchases []*models.Purchase
 	for pRows.Next() {
 		var p models.Purchase
-		if err := pRows.Scan(&p.Id, &p.Description, &p.Amount, &p.Date); err != nil {
+		if err := pRows.Scan(&p.Id, &p.Description, &p.Amount, &p.Date, &p.Deduplicate); err != nil {
 			return n.emptyAndGenericError(err)
 		}
 		purchases = append(purchases, &p)
@@ -251,9 +706,70 @@ func (n *mysqlDatabaseFinal) ListAllPurchases(ctx context.Context) ([]*models.Pu
 	return purchases, nil
 }
 
-func (n *mysqlDatabaseFinal) GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
+// StreamAllPurchases calls fn for every purchase, ordered by date and id, so they are never all in memory. They
+// are read streamPageSize at a time, each page after the last purchase of the one before, and the rows of a page
+// are closed before fn is called: fn can use the database even when the pool has a single connection. It stops at
+// the first error returned by fn.
+func (n *sqlDatabaseFinal) StreamAllPurchases(ctx context.Context, fn func(p *models.Purchase) error) error {
+	ctx, end := n.instrument(ctx, "StreamAllPurchases")
+	defer end()
+	var after *models.Purchase
+	for {
+		page, err := n.purchasesPage(ctx, after, streamPageSize)
+		if err != nil {
+			_, err = n.emptyAndGenericError(err)
+			return err
+		}
+		if len(page) > 0 {
+			last := page[len(page)-1]
+			after = &models.Purchase{Id: last.Id, Date: last.Date}
+		}
+		for _, p := range page {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		if len(page) < streamPageSize {
+			return nil
+		}
+	}
+}
+
+// purchasesPage reads the first limit purchases ordered by date and id after the one given, from the first one
+// when it is nil.
+func (n *sqlDatabaseFinal) purchasesPage(ctx context.Context, after *models.Purchase, limit int) ([]*models.Purchase, error) {
+	query, args := "SELECT id, description, amount, date FROM purchase WHERE deleted_at IS NULL", []any{}
+	if after != nil {
+		query += " AND (date > ? OR (date = ? AND id > ?))"
+		args = append(args, after.Date, after.Date, after.Id)
+	}
+	pRows, err := n.query(ctx).QueryContext(ctx, query+" ORDER BY date, id LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer pRows.Close()
+	page := make([]*models.Purchase, 0, limit)
+	for pRows.Next() {
+		var p models.Purchase
+		if err := pRows.Scan(&p.Id, &p.Description, &p.Amount, &p.Date); err != nil {
+			return nil, err
+		}
+		page = append(page, &p)
+	}
+	return page, pRows.Err()
+}
+
+func (n *sqlDatabaseFinal) GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
+	ctx, end := n.instrument(ctx, "GetExchangeRateForCountryCurrencyAndDate")
+	defer end()
 	p := &models.ExchangeForDate{}
-	err := n.db.QueryRow("SELECT date, country_currency_desc, exchange_rate from exchange WHERE DATE(date) <= DATE(?) AND country_currency_desc = ? ORDER BY DATE(date) DESC", date, countrycurrency).Scan(&p.Date, &p.CountryCurrencyDesc, &p.ExchangeRate)
+	query, args := "SELECT date, country_currency_desc, exchange_rate from exchange WHERE DATE(date) <= DATE(?) AND country_currency_desc = ? ORDER BY DATE(date) DESC", []any{date, countrycurrency}
+	if asOf, ok := services.AsOf(ctx); ok {
+		// the last revision recorded until asOf of the nearest date.
+		query = "SELECT date, country_currency_desc, exchange_rate FROM exchange_revision WHERE DATE(date) <= DATE(?) AND country_currency_desc = ? AND recorded_at <= ? ORDER BY DATE(date) DESC, id DESC LIMIT 1"
+		args = append(args, asOf.UnixMilli())
+	}
+	err := n.query(ctx).QueryRowContext(ctx, query, args...).Scan(&p.Date, &p.CountryCurrencyDesc, &p.ExchangeRate)
 	if err == sql.ErrNoRows {
 		return nil, messages.ErrNoExchangeFound
 	}
@@ -264,7 +780,391 @@ func (n *mysqlDatabaseFinal) GetExchangeRateForCountryCurrencyAndDate(ctx contex
 	return p, nil
 }
 
-func (n *mysqlDatabaseFinal) emptyAndGenericError(err error) ([]*models.Purchase, error) {
+// GetExchangeRatesForCountryCurrencyAndDates joins the dates with their earlier rates in a single query, a window
+// function keeping the nearest one of each date. The dates are sent as one JSON array, so there is no limit on
+// how many.
+func (n *sqlDatabaseFinal) GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	ctx, end := n.instrument(ctx, "GetExchangeRatesForCountryCurrencyAndDates")
+	defer end()
+	rates, err := n.lookupRates(ctx, countrycurrency, distinct(dates))
+	if err != nil {
+		msg := fmt.Sprintf("Something went wrong searching the Exchanges of contrycurrency %s for %d dates: %s", countrycurrency, len(dates), err.Error())
+		return nil, &messages.ExchangeError{Msg: msg, ExchangeCurrency: countrycurrency}
+	}
+	return rates, nil
+}
+
+func (n *sqlDatabaseFinal) lookupRates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	rates := make(map[string]*models.ExchangeForDate, len(dates))
+	if len(dates) == 0 {
+		return rates, nil
+	}
+	datesJSON, err := json.Marshal(dates)
+	if err != nil {
+		return nil, err
+	}
+	source, order, args := "exchange", "DATE(e.date) DESC", []any{string(datesJSON)}
+	if asOf, ok := services.AsOf(ctx); ok {
+		// the revisions recorded until asOf, the last one of the nearest date first.
+		source, order = "(SELECT id, date, country_currency_desc, exchange_rate FROM exchange_revision WHERE recorded_at <= ?)", "DATE(e.date) DESC, e.id DESC"
+		args = append(args, asOf.UnixMilli())
+	}
+	query := fmt.Sprintf(`SELECT date, rate_date, exchange_rate FROM (
+		SELECT d.date, e.date AS rate_date, e.exchange_rate, ROW_NUMBER() OVER (PARTITION BY d.date ORDER BY %s) AS nearest
+		FROM (%s) d JOIN %s e ON e.country_currency_desc = ? AND DATE(e.date) <= DATE(d.date)
+	) r WHERE nearest = 1`, order, n.dialect.datesTable(), source)
+	rows, err := n.query(ctx).QueryContext(ctx, query, append(args, countrycurrency)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var date string
+		ex := &models.ExchangeForDate{CountryCurrencyDesc: countrycurrency}
+		if err := rows.Scan(&date, &ex.Date, &ex.ExchangeRate); err != nil {
+			return nil, err
+		}
+		rates[date] = ex
+	}
+	return rates, rows.Err()
+}
+
+func (n *sqlDatabaseFinal) ListExchangesSince(ctx context.Context, date string) ([]*models.ExchangeForDate, error) {
+	ctx, end := n.instrument(ctx, "ListExchangesSince")
+	defer end()
+	rows, err := n.query(ctx).QueryContext(ctx, "SELECT date, country_currency_desc, exchange_rate FROM exchange WHERE DATE(date) >= DATE(?) ORDER BY country_currency_desc, DATE(date)", date)
+	if err != nil {
+		msg := fmt.Sprintf("Something went wrong listing the Exchanges since %s: %s", date, err.Error())
+		return nil, &messages.ExchangeError{Msg: msg, ExchangeDate: date}
+	}
+	defer rows.Close()
+	exchanges := []*models.ExchangeForDate{}
+	for rows.Next() {
+		ex := &models.ExchangeForDate{}
+		if err := rows.Scan(&ex.Date, &ex.CountryCurrencyDesc, &ex.ExchangeRate); err != nil {
+			msg := fmt.Sprintf("Something went wrong listing the Exchanges since %s: %s", date, err.Error())
+			return nil, &messages.ExchangeError{Msg: msg, ExchangeDate: date}
+		}
+		exchanges = append(exchanges, ex)
+	}
+	if err := rows.Err(); err != nil {
+		msg := fmt.Sprintf("Something went wrong listing the Exchanges since %s: %s", date, err.Error())
+		return nil, &messages.ExchangeError{Msg: msg, ExchangeDate: date}
+	}
+	return exchanges, nil
+}
+
+func (n *sqlDatabaseFinal) ListExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error) {
+	ctx, end := n.instrument(ctx, "ListExchangeRevisions")
+	defer end()
+	rows, err := n.query(ctx).QueryContext(ctx, "SELECT id, date, country_currency_desc, exchange_rate, recorded_at FROM exchange_revision WHERE country_currency_desc = ? AND date = ? ORDER BY id", countrycurrency, date)
+	if err != nil {
+		return nil, n.revisionsError(countrycurrency, date, err)
+	}
+	defer rows.Close()
+	var revisions []*models.ExchangeRevision
+	for rows.Next() {
+		var r models.ExchangeRevision
+		if err := rows.Scan(&r.Id, &r.Date, &r.CountryCurrencyDesc, &r.ExchangeRate, &r.RecordedAt); err != nil {
+			return nil, n.revisionsError(countrycurrency, date, err)
+		}
+		revisions = append(revisions, &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, n.revisionsError(countrycurrency, date, err)
+	}
+	if len(revisions) == 0 {
+		return nil, messages.ErrNoExchangeFound
+	}
+	return revisions, nil
+}
+
+func (n *sqlDatabaseFinal) revisionsError(countrycurrency string, date string, err error) error {
+	msg := fmt.Sprintf("Something went wrong searching the revisions of the Exchange {contrycurrency: %s, date: %s}: %s", countrycurrency, date, err.Error())
+	return &messages.ExchangeError{Msg: msg, ExchangeDate: date, ExchangeCurrency: countrycurrency}
+}
+
+func (n *sqlDatabaseFinal) InsertPurchaseConversion(ctx context.Context, tx services.Tx, c *models.PurchaseConversion) (bool, error) {
+	ctx, end := n.instrument(ctx, "InsertPurchaseConversion")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return false, err
+	}
+	_, err = t.ExecContext(ctx, "INSERT INTO purchase_conversion(purchase_id, country_currency_desc, original_amount, purchase_date, exchange_rate, rate_date, provider, converted_amount, locked_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		c.PurchaseId, c.CountryCurrencyDesc, c.OriginalAmount, c.PurchaseDate, c.ExchangeRate, c.RateDate, c.Provider, c.ConvertedAmount, c.LockedAt)
+	if n.dialect.isDuplicateEntry(err) {
+		return false, nil
+	}
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting row into purchase_conversion table: %s", err.Error()))
+		return false, err
+	}
+	return true, nil
+}
+
+func (n *sqlDatabaseFinal) GetPurchaseConversion(ctx context.Context, id string, countrycurrency string) (*models.PurchaseConversion, error) {
+	ctx, end := n.instrument(ctx, "GetPurchaseConversion")
+	defer end()
+	c := &models.PurchaseConversion{}
+	err := n.query(ctx).QueryRowContext(ctx, "SELECT purchase_id, country_currency_desc, original_amount, purchase_date, exchange_rate, rate_date, provider, converted_amount, locked_at FROM purchase_conversion WHERE purchase_id = ? AND country_currency_desc = ?", id, countrycurrency).
+		Scan(&c.PurchaseId, &c.CountryCurrencyDesc, &c.OriginalAmount, &c.PurchaseDate, &c.ExchangeRate, &c.RateDate, &c.Provider, &c.ConvertedAmount, &c.LockedAt)
+	if err == sql.ErrNoRows {
+		return nil, messages.ErrNoConversionFound
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Something went wrong searching the conversion of the Purchase to %s: %s", countrycurrency, err.Error())
+		return nil, &messages.PurchaseError{Msg: msg, PurchaseId: id}
+	}
+	return c, nil
+}
+
+func (n *sqlDatabaseFinal) ListPurchaseConversions(ctx context.Context, countrycurrency string) (map[string]*models.PurchaseConversion, error) {
+	ctx, end := n.instrument(ctx, "ListPurchaseConversions")
+	defer end()
+	conversions := make(map[string]*models.PurchaseConversion)
+	rows, err := n.query(ctx).QueryContext(ctx, "SELECT purchase_id, country_currency_desc, original_amount, purchase_date, exchange_rate, rate_date, provider, converted_amount, locked_at FROM purchase_conversion WHERE country_currency_desc = ?", countrycurrency)
+	if err != nil {
+		return nil, n.conversionsError(countrycurrency, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &models.PurchaseConversion{}
+		if err := rows.Scan(&c.PurchaseId, &c.CountryCurrencyDesc, &c.OriginalAmount, &c.PurchaseDate, &c.ExchangeRate, &c.RateDate, &c.Provider, &c.ConvertedAmount, &c.LockedAt); err != nil {
+			return nil, n.conversionsError(countrycurrency, err)
+		}
+		conversions[c.PurchaseId] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, n.conversionsError(countrycurrency, err)
+	}
+	return conversions, nil
+}
+
+func (n *sqlDatabaseFinal) conversionsError(countrycurrency string, err error) error {
+	msg := fmt.Sprintf("Something went wrong listing the Purchase conversions to %s: %s", countrycurrency, err.Error())
+	return &messages.PurchaseError{Msg: msg}
+}
+
+const (
+	rateOverrideColumns      = "id, country_currency_desc, start_date, end_date, exchange_rate, reason, created_by, created_at, removed_at"
+	rateOverrideAuditColumns = "id, override_id, action, country_currency_desc, start_date, end_date, exchange_rate, actor, reason, changed_at"
+)
+
+func (n *sqlDatabaseFinal) InsertRateOverride(ctx context.Context, tx services.Tx, o *models.RateOverride) (int64, error) {
+	ctx, end := n.instrument(ctx, "InsertRateOverride")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return 0, err
+	}
+	res, err := t.ExecContext(ctx, "INSERT INTO rate_override(country_currency_desc, start_date, end_date, exchange_rate, reason, created_by, created_at, removed_at) VALUES (?, ?, ?, ?, ?, ?, ?, 0)",
+		o.CountryCurrencyDesc, o.StartDate, o.EndDate, o.ExchangeRate, o.Reason, o.CreatedBy, o.CreatedAt)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting row into rate_override table: %s", err.Error()))
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (n *sqlDatabaseFinal) RemoveRateOverride(ctx context.Context, tx services.Tx, id int64, removedAt int64) error {
+	ctx, end := n.instrument(ctx, "RemoveRateOverride")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return err
+	}
+	res, err := t.ExecContext(ctx, "UPDATE rate_override SET removed_at = ? WHERE id = ? AND removed_at = 0", removedAt, id)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when removing the rate override %d: %s", id, err.Error()))
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return messages.ErrNoOverrideFound
+	}
+	return nil
+}
+
+func (n *sqlDatabaseFinal) GetRateOverride(ctx context.Context, id int64) (*models.RateOverride, error) {
+	ctx, end := n.instrument(ctx, "GetRateOverride")
+	defer end()
+	o := &models.RateOverride{}
+	err := n.query(ctx).QueryRowContext(ctx, "SELECT "+rateOverrideColumns+" FROM rate_override WHERE id = ?", id).
+		Scan(&o.Id, &o.CountryCurrencyDesc, &o.StartDate, &o.EndDate, &o.ExchangeRate, &o.Reason, &o.CreatedBy, &o.CreatedAt, &o.RemovedAt)
+	if err == sql.ErrNoRows {
+		return nil, messages.ErrNoOverrideFound
+	}
+	if err != nil {
+		return nil, n.overridesError(err)
+	}
+	return o, nil
+}
+
+func (n *sqlDatabaseFinal) ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	ctx, end := n.instrument(ctx, "ListRateOverrides")
+	defer end()
+	query, args := byCurrency("SELECT "+rateOverrideColumns+" FROM rate_override", countrycurrency)
+	rows, err := n.query(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, n.overridesError(err)
+	}
+	defer rows.Close()
+	overrides := make([]*models.RateOverride, 0)
+	for rows.Next() {
+		o := &models.RateOverride{}
+		if err := rows.Scan(&o.Id, &o.CountryCurrencyDesc, &o.StartDate, &o.EndDate, &o.ExchangeRate, &o.Reason, &o.CreatedBy, &o.CreatedAt, &o.RemovedAt); err != nil {
+			return nil, n.overridesError(err)
+		}
+		overrides = append(overrides, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, n.overridesError(err)
+	}
+	return overrides, nil
+}
+
+func (n *sqlDatabaseFinal) InsertRateOverrideAudit(ctx context.Context, tx services.Tx, a *models.RateOverrideAudit) error {
+	ctx, end := n.instrument(ctx, "InsertRateOverrideAudit")
+	defer end()
+	t, err := n.txOf(tx)
+	if err != nil {
+		return err
+	}
+	_, err = t.ExecContext(ctx, "INSERT INTO rate_override_audit(override_id, action, country_currency_desc, start_date, end_date, exchange_rate, actor, reason, changed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		a.OverrideId, a.Action, a.CountryCurrencyDesc, a.StartDate, a.EndDate, a.ExchangeRate, a.Actor, a.Reason, a.ChangedAt)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("Error when inserting row into rate_override_audit table: %s", err.Error()))
+		return err
+	}
+	return nil
+}
+
+func (n *sqlDatabaseFinal) ListRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error) {
+	ctx, end := n.instrument(ctx, "ListRateOverrideAudit")
+	defer end()
+	query, args := byCurrency("SELECT "+rateOverrideAuditColumns+" FROM rate_override_audit", countrycurrency)
+	rows, err := n.query(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, n.overridesError(err)
+	}
+	defer rows.Close()
+	audit := make([]*models.RateOverrideAudit, 0)
+	for rows.Next() {
+		a := &models.RateOverrideAudit{}
+		if err := rows.Scan(&a.Id, &a.OverrideId, &a.Action, &a.CountryCurrencyDesc, &a.StartDate, &a.EndDate, &a.ExchangeRate, &a.Actor, &a.Reason, &a.ChangedAt); err != nil {
+			return nil, n.overridesError(err)
+		}
+		audit = append(audit, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, n.overridesError(err)
+	}
+	return audit, nil
+}
+
+func (n *sqlDatabaseFinal) overridesError(err error) error {
+	msg := fmt.Sprintf("Something went wrong reading the rate overrides: %s", err.Error())
+	return &messages.ExchangeError{Msg: msg}
+}
+
+// byCurrency filters the rows of query by countrycurrency, unless it is empty, ordering them by id.
+func byCurrency(query string, countrycurrency string) (string, []any) {
+	if countrycurrency == "" {
+		return query + " ORDER BY id", nil
+	}
+	return query + " WHERE country_currency_desc = ? ORDER BY id", []any{countrycurrency}
+}
+
+// distinct returns the values without the repeated ones, in the order they first appear.
+func distinct(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+func (n *sqlDatabaseFinal) InsertIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (bool, error) {
+	ctx, end := n.instrument(ctx, "InsertIdempotencyKey")
+	defer end()
+	// an expired key is free to be used again.
+	if _, err := n.query(ctx).ExecContext(ctx, "DELETE FROM idempotency_key WHERE idempotency_key = ? AND expires_at <= ?", k.Key, time.Now().Unix()); err != nil {
+		return false, n.idempotencyKeyError(err)
+	}
+	_, err := n.query(ctx).ExecContext(ctx, "INSERT INTO idempotency_key(idempotency_key, request_hash, status_code, response_body, expires_at) VALUES (?, ?, ?, ?, ?)",
+		k.Key, k.RequestHash, k.StatusCode, k.ResponseBody, k.ExpiresAt)
+	if n.dialect.isDuplicateEntry(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, n.idempotencyKeyError(err)
+	}
+	return true, nil
+}
+
+func (n *sqlDatabaseFinal) GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyKey, error) {
+	ctx, end := n.instrument(ctx, "GetIdempotencyKey")
+	defer end()
+	k := &models.IdempotencyKey{}
+	err := n.query(ctx).QueryRowContext(ctx, "SELECT idempotency_key, request_hash, status_code, response_body, expires_at FROM idempotency_key WHERE idempotency_key = ?", key).
+		Scan(&k.Key, &k.RequestHash, &k.StatusCode, &k.ResponseBody, &k.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, messages.ErrNoIdempotencyKeyFound
+	}
+	if err != nil {
+		return nil, n.idempotencyKeyError(err)
+	}
+	return k, nil
+}
+
+func (n *sqlDatabaseFinal) UpdateIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	ctx, end := n.instrument(ctx, "UpdateIdempotencyKey")
+	defer end()
+	_, err := n.query(ctx).ExecContext(ctx, "UPDATE idempotency_key SET status_code = ?, response_body = ? WHERE idempotency_key = ?", k.StatusCode, k.ResponseBody, k.Key)
+	if err != nil {
+		return n.idempotencyKeyError(err)
+	}
+	return nil
+}
+
+func (n *sqlDatabaseFinal) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	ctx, end := n.instrument(ctx, "DeleteIdempotencyKey")
+	defer end()
+	_, err := n.query(ctx).ExecContext(ctx, "DELETE FROM idempotency_key WHERE idempotency_key = ?", key)
+	if err != nil {
+		return n.idempotencyKeyError(err)
+	}
+	return nil
+}
+
+func (n *sqlDatabaseFinal) DeleteExpiredIdempotencyKeys(ctx context.Context, now int64) (int64, error) {
+	ctx, end := n.instrument(ctx, "DeleteExpiredIdempotencyKeys")
+	defer end()
+	res, err := n.query(ctx).ExecContext(ctx, "DELETE FROM idempotency_key WHERE expires_at <= ?", now)
+	if err != nil {
+		return 0, fmt.Errorf("something went wrong deleting the expired Idempotency-Keys: %s", err.Error())
+	}
+	return res.RowsAffected()
+}
+
+// idempotencyKeyError leaves the key out, the error is logged and answered to the client.
+func (n *sqlDatabaseFinal) idempotencyKeyError(err error) error {
+	return fmt.Errorf("something went wrong with the Idempotency-Key: %s", err.Error())
+}
+
+// nullableSignature only persists the signature of purchases that must be deduplicated, the NULLs
+// are ignored by the unique index.
+func nullableSignature(p *models.Purchase) sql.NullString {
+	return sql.NullString{String: p.Signature(), Valid: p.Deduplicate}
+}
+
+func (n *sqlDatabaseFinal) emptyAndGenericError(err error) ([]*models.Purchase, error) {
 	baseMsg := "Something went wrong searching by All purchases: "
 	msg := fmt.Sprintf("%s%s", baseMsg, err.Error())
 	return services.EmptyPurchasesSlice, &messages.PurchaseError{Msg: msg}
@@ -4,13 +4,17 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
 )
@@ -23,6 +27,22 @@ var (
 		Date:        "2023-09-30",
 	}
 
+	dedupPurchase = &models.Purchase{
+		Id:          "abcd-fghi",
+		Description: "Some transaction",
+		Amount:      "20.13",
+		Date:        "2023-09-30",
+		Deduplicate: true,
+	}
+
+	basicIdempotencyKey = &models.IdempotencyKey{
+		Key:          "some-key",
+		RequestHash:  "some-hash",
+		StatusCode:   201,
+		ResponseBody: `{"id": "abcd-fghi"}`,
+		ExpiresAt:    1700000000,
+	}
+
 	basicExchange = &models.ExchangeForDate{
 		CountryCurrencyDesc: "Brazil-Real",
 		ExchangeRate:        "5.00",
@@ -34,15 +54,10 @@ func NewManagerForTestsDatabase() (services.ServiceManager, context.Context) {
 	asyncWorkChannel := make(chan func() error)
 	stop := make(chan struct{})
 
-	os.Setenv("DB_NAME", "dummyName")
-	os.Setenv("DB_USER", "dummyUser")
-	os.Setenv("DB_PASSWORD", "dummyPassword")
-	os.Setenv("DB_HOSTPORT", "dummyHostPort")
-
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, logs.AppEnvKey, "TESTS")
-	ctx = context.WithValue(ctx, logs.AppNameKey, logs.AppName)
-	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.AppVersion)
+	ctx = context.WithValue(ctx, logs.AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.Version())
 	return services.NewManager(asyncWorkChannel, stop), ctx
 }
 
@@ -55,11 +70,7 @@ func buildMock(t *testing.T, errorIn int) *sql.DB {
 		mock.ExpectClose()
 	}
 
-	expect := []*sqlmock.ExpectedExec{}
-	expect = append(expect, mock.ExpectExec("CREATE TABLE IF NOT EXISTS purchase").WillReturnResult(sqlmock.NewResult(1, 1)))
-	expect = append(expect, mock.ExpectExec("CREATE TABLE IF NOT EXISTS exchange").WillReturnResult(sqlmock.NewResult(1, 1)))
-
-	mock.ExpectQuery("SELECT VERSION").WillReturnRows(mock.NewRows([]string{"version"}).AddRow("1.0"))
+	expect := expectCreateTables(mock)
 
 	if errorIn >= 0 {
 		expect[errorIn].WillReturnError(errors.New("some error"))
@@ -67,6 +78,17 @@ func buildMock(t *testing.T, errorIn int) *sql.DB {
 	return db
 }
 
+func expectCreateTables(mock sqlmock.Sqlmock) []*sqlmock.ExpectedExec {
+	expect := []*sqlmock.ExpectedExec{}
+	for _, table := range []string{"purchase", "exchange", "idempotency_key", "purchase_history", "exchange_revision", "purchase_conversion", "rate_override", "rate_override_audit"} {
+		expect = append(expect, mock.ExpectExec("CREATE TABLE IF NOT EXISTS "+table).WillReturnResult(sqlmock.NewResult(1, 1)))
+	}
+	expect = append(expect, mock.ExpectExec("INSERT INTO exchange_revision").WillReturnResult(sqlmock.NewResult(0, 0)))
+	mock.ExpectQuery("information_schema.COLUMNS").WithArgs("purchase", "deleted_at").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("information_schema.STATISTICS").WithArgs("purchase", "purchase_signature_uk").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	return expect
+}
+
 func buildTransactionsMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -76,7 +98,7 @@ func buildTransactionsMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
 	return db, mock
 }
 
-func Test_mysqlDatabaseFinal_buildConnection(t *testing.T) {
+func Test_sqlDatabaseFinal_buildConnection(t *testing.T) {
 	type args struct {
 		ctx context.Context
 		db  *sql.DB
@@ -90,19 +112,19 @@ func Test_mysqlDatabaseFinal_buildConnection(t *testing.T) {
 	defer db.Close()
 	tests := []struct {
 		name    string
-		n       *mysqlDatabaseFinal
+		n       *sqlDatabaseFinal
 		args    args
 		wantErr bool
 	}{
 		{
 			name:    "successMocked",
-			n:       dbService.(*mysqlDatabaseFinal),
+			n:       dbService.(*sqlDatabaseFinal),
 			args:    args{ctx: ctx, db: db},
 			wantErr: false,
 		},
 		{
 			name:    "successPROD",
-			n:       dbService.(*mysqlDatabaseFinal),
+			n:       dbService.(*sqlDatabaseFinal),
 			args:    args{ctx: ctx, db: nil},
 			wantErr: false,
 		},
@@ -110,13 +132,13 @@ func Test_mysqlDatabaseFinal_buildConnection(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if err := tt.n.buildConnection(tt.args.ctx, tt.args.db); (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.Start() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("sqlDatabaseFinal.Start() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_Start(t *testing.T) {
+func Test_sqlDatabaseFinal_Start(t *testing.T) {
 	type args struct {
 		ctx context.Context
 	}
@@ -125,25 +147,25 @@ func Test_mysqlDatabaseFinal_Start(t *testing.T) {
 
 	tests := []struct {
 		name    string
-		n       *mysqlDatabaseFinal
+		n       *sqlDatabaseFinal
 		args    args
 		wantErr bool
 	}{
 		{
 			name:    "success",
-			n:       dbService.(*mysqlDatabaseFinal),
+			n:       dbService.(*sqlDatabaseFinal),
 			args:    args{ctx: context.WithValue(ctx, MockDbKey, buildMock(t, -1))},
 			wantErr: false,
 		},
 		{
 			name:    "errorPurchase",
-			n:       dbService.(*mysqlDatabaseFinal),
+			n:       dbService.(*sqlDatabaseFinal),
 			args:    args{ctx: context.WithValue(ctx, MockDbKey, buildMock(t, 0))},
 			wantErr: true,
 		},
 		{
 			name:    "errorExchange",
-			n:       dbService.(*mysqlDatabaseFinal),
+			n:       dbService.(*sqlDatabaseFinal),
 			args:    args{ctx: context.WithValue(ctx, MockDbKey, buildMock(t, 1))},
 			wantErr: true,
 		},
@@ -151,14 +173,14 @@ func Test_mysqlDatabaseFinal_Start(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if err := tt.n.Start(tt.args.ctx); (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.Start() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("sqlDatabaseFinal.Start() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			defer tt.args.ctx.Value(MockDbKey).(*sql.DB).Close()
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_Close(t *testing.T) {
+func Test_sqlDatabaseFinal_Close(t *testing.T) {
 	type args struct {
 		ctx context.Context
 	}
@@ -167,14 +189,14 @@ func Test_mysqlDatabaseFinal_Close(t *testing.T) {
 	dbService.Start(context.WithValue(ctx, MockDbKey, buildMock(t, -2)))
 	tests := []struct {
 		name    string
-		n       *mysqlDatabaseFinal
+		n       *sqlDatabaseFinal
 		args    args
 		wantErr bool
 	}{
 		{
 			name: "success", //just success because Database.Close() just closes the connection
 			// and is intermitent if the connection was not yet created.
-			n:       dbService.(*mysqlDatabaseFinal),
+			n:       dbService.(*sqlDatabaseFinal),
 			args:    args{ctx: ctx},
 			wantErr: false,
 		},
@@ -182,13 +204,13 @@ func Test_mysqlDatabaseFinal_Close(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if err := tt.n.Close(tt.args.ctx); (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.Close() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("sqlDatabaseFinal.Close() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_Healthy(t *testing.T) {
+func Test_sqlDatabaseFinal_Healthy(t *testing.T) {
 	type args struct {
 		ctx context.Context
 	}
@@ -197,27 +219,33 @@ func Test_mysqlDatabaseFinal_Healthy(t *testing.T) {
 	dbService.Start(context.WithValue(ctx, MockDbKey, buildMock(t, -1)))
 	tests := []struct {
 		name    string
-		n       *mysqlDatabaseFinal
+		n       *sqlDatabaseFinal
 		args    args
 		wantErr bool
 	}{
 		{
 			name:    "success",
-			n:       dbService.(*mysqlDatabaseFinal),
+			n:       dbService.(*sqlDatabaseFinal),
 			args:    args{ctx},
 			wantErr: false,
 		},
+		{
+			name:    "notConnected",
+			n:       NewDatabase().(*sqlDatabaseFinal),
+			args:    args{ctx},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if err := tt.n.Healthy(tt.args.ctx); (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.Healthy() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("sqlDatabaseFinal.Healthy() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_WithServiceManager(t *testing.T) {
+func Test_sqlDatabaseFinal_WithServiceManager(t *testing.T) {
 	type args struct {
 		sm services.ServiceManager
 	}
@@ -225,19 +253,19 @@ func Test_mysqlDatabaseFinal_WithServiceManager(t *testing.T) {
 	dbService := sm.WithDatabase(NewDatabase()).Database()
 	tests := []struct {
 		name string
-		n    *mysqlDatabaseFinal
+		n    *sqlDatabaseFinal
 		args args
 		want services.Database
 	}{
 		{
 			name: "success",
-			n:    dbService.(*mysqlDatabaseFinal),
+			n:    dbService.(*sqlDatabaseFinal),
 			args: args{sm: sm},
 			want: dbService,
 		},
 		{
 			name: "successNil",
-			n:    dbService.(*mysqlDatabaseFinal),
+			n:    dbService.(*sqlDatabaseFinal),
 			args: args{sm: nil},
 			want: dbService,
 		},
@@ -245,153 +273,242 @@ func Test_mysqlDatabaseFinal_WithServiceManager(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if got := tt.n.WithServiceManager(tt.args.sm); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("mysqlDatabaseFinal.WithServiceManager() = %v, want %v", got, tt.want)
+				t.Errorf("sqlDatabaseFinal.WithServiceManager() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_ServiceManager(t *testing.T) {
+func Test_sqlDatabaseFinal_ServiceManager(t *testing.T) {
 	sm, _ := NewManagerForTestsDatabase()
 	tests := []struct {
 		name string
-		n    *mysqlDatabaseFinal
+		n    *sqlDatabaseFinal
 		want services.ServiceManager
 	}{
 		{
 			name: "success",
-			n:    sm.WithDatabase(NewDatabase()).Database().(*mysqlDatabaseFinal),
+			n:    sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal),
 			want: sm,
 		},
 		{
 			name: "successNil",
-			n:    NewDatabase().(*mysqlDatabaseFinal),
+			n:    NewDatabase().(*sqlDatabaseFinal),
 			want: nil,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			if got := tt.n.ServiceManager(); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("mysqlDatabaseFinal.ServiceManager() = %v, want %v", got, tt.want)
+				t.Errorf("sqlDatabaseFinal.ServiceManager() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_BeginTransaction(t *testing.T) {
-	type args struct {
-		ctx context.Context
-	}
-	sm, ctx := NewManagerForTestsDatabase()
-	dbService := sm.WithDatabase(NewDatabase()).Database()
-	db, mock := buildTransactionsMock(t)
-	mock.ExpectBegin()
-	ctx = context.WithValue(ctx, MockDbKey, db)
-	dbService.Start(ctx)
+func Test_sqlDatabaseFinal_WithTx(t *testing.T) {
+	fail := errors.New("fail")
 	tests := []struct {
 		name    string
-		n       *mysqlDatabaseFinal
-		args    args
-		wantErr bool
+		expect  func(mock sqlmock.Sqlmock)
+		fn      func(n *sqlDatabaseFinal) func(tx services.Tx) error
+		wantErr error
 	}{
 		{
-			name:    "success",
-			n:       dbService.(*mysqlDatabaseFinal),
-			args:    args{ctx: ctx},
-			wantErr: true,
+			name: "commit",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectCommit()
+			},
+			fn:      func(n *sqlDatabaseFinal) func(tx services.Tx) error { return func(tx services.Tx) error { return nil } },
+			wantErr: nil,
+		},
+		{
+			name: "rollback",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			fn: func(n *sqlDatabaseFinal) func(tx services.Tx) error {
+				return func(tx services.Tx) error { return fail }
+			},
+			wantErr: fail,
+		},
+		{
+			name: "beginError",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin().WillReturnError(fail)
+			},
+			fn:      func(n *sqlDatabaseFinal) func(tx services.Tx) error { return func(tx services.Tx) error { return nil } },
+			wantErr: fail,
+		},
+		{
+			name: "nestedJoinsTheOuterTransaction",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			fn: func(n *sqlDatabaseFinal) func(tx services.Tx) error {
+				return func(tx services.Tx) error {
+					return n.WithTx(tx.Context(), func(inner services.Tx) error {
+						if inner != tx {
+							t.Errorf("sqlDatabaseFinal.WithTx() nested = %v, want the outer %v", inner, tx)
+						}
+						return fail
+					})
+				}
+			},
+			wantErr: fail,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := tt.n.BeginTransaction(tt.args.ctx)
-			if (err == nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.BeginTransaction() error = %v, wantErr %v", err, tt.wantErr)
-				return
+			sm, ctx := NewManagerForTestsDatabase()
+			db, mock := buildTransactionsMock(t)
+			expectCreateTables(mock)
+			tt.expect(mock)
+			ctx = context.WithValue(ctx, MockDbKey, db)
+			n := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			n.Start(ctx)
+			if err := n.WithTx(ctx, tt.fn(n)); !errors.Is(err, tt.wantErr) {
+				t.Errorf("sqlDatabaseFinal.WithTx() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			if err := mock.ExpectationsWereMet(); err != nil {
 				t.Errorf("there were unfulfilled expectations: %s", err)
-				return
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_CommitTransaction(t *testing.T) {
-	type args struct {
-		tx *sql.Tx
-	}
-	sm, _ := NewManagerForTestsDatabase()
-	dbService := sm.WithDatabase(NewDatabase()).Database()
-	db, mock := buildTransactionsMock(t)
-	mock.ExpectBegin()
-	mock.ExpectCommit()
-	tx, _ := db.Begin()
-
+func Test_sqlDatabaseFinal_migrate(t *testing.T) {
 	tests := []struct {
 		name    string
-		n       *mysqlDatabaseFinal
-		args    args
+		expect  func(mock sqlmock.Sqlmock)
 		wantErr bool
 	}{
 		{
-			name:    "success",
-			n:       dbService.(*mysqlDatabaseFinal),
-			args:    args{tx: tx},
-			wantErr: false,
+			name: "upToDate",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("information_schema.COLUMNS").WithArgs("purchase", "deleted_at").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery("information_schema.STATISTICS").WithArgs("purchase", "purchase_signature_uk").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			},
+		},
+		{
+			name: "withoutDeletedAt",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("information_schema.COLUMNS").WithArgs("purchase", "deleted_at").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE purchase ADD COLUMN deleted_at BIGINT NULL")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectQuery("information_schema.STATISTICS").WithArgs("purchase", "purchase_signature_uk").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			},
+		},
+		{
+			name: "withoutTheSignatureIndex",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("information_schema.COLUMNS").WithArgs("purchase", "deleted_at").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery("information_schema.STATISTICS").WithArgs("purchase", "purchase_signature_uk").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec("UPDATE purchase SET signature = NULL").WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE purchase ADD UNIQUE INDEX purchase_signature_uk (signature)")).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+		},
+		{
+			name: "columnNotAdded",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("information_schema.COLUMNS").WithArgs("purchase", "deleted_at").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec("ALTER TABLE purchase ADD COLUMN").WillReturnError(errors.New("some error"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "indexNotAdded",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("information_schema.COLUMNS").WithArgs("purchase", "deleted_at").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectQuery("information_schema.STATISTICS").WithArgs("purchase", "purchase_signature_uk").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec("UPDATE purchase SET signature = NULL").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("ALTER TABLE purchase ADD UNIQUE INDEX").WillReturnError(errors.New("some error"))
+			},
+			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := tt.n.CommitTransaction(tt.args.tx); (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.CommitTransaction() error = %v, wantErr %v", err, tt.wantErr)
-				return
+			sm, ctx := NewManagerForTestsDatabase()
+			db, mock := buildTransactionsMock(t)
+			tt.expect(mock)
+			n := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			n.db = db
+			if err := n.migrate(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.migrate() error = %v, wantErr %v", err, tt.wantErr)
 			}
 			if err := mock.ExpectationsWereMet(); err != nil {
 				t.Errorf("there were unfulfilled expectations: %s", err)
-				return
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_RollbackTransaction(t *testing.T) {
-	type args struct {
-		tx *sql.Tx
+// Test_sqlDatabaseFinal_migrateOldSchema starts over a purchase table created before the signature was unique and
+// the purchases soft deleted, with the same purchase inserted twice.
+func Test_sqlDatabaseFinal_migrateOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "purchases.db")
+	old, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening the old database", err)
 	}
-	sm, _ := NewManagerForTestsDatabase()
-	dbService := sm.WithDatabase(NewDatabase()).Database()
-	db, mock := buildTransactionsMock(t)
-	mock.ExpectBegin()
-	mock.ExpectRollback()
-	tx, _ := db.Begin()
-	tests := []struct {
-		name    string
-		n       *mysqlDatabaseFinal
-		args    args
-		wantErr bool
-	}{
-		{
-			name:    "success",
-			n:       dbService.(*mysqlDatabaseFinal),
-			args:    args{tx: tx},
-			wantErr: false,
-		},
+	for _, stmt := range []string{
+		`CREATE TABLE purchase (
+			id VARCHAR(255) PRIMARY KEY,
+			description VARCHAR(255) NOT NULL,
+			amount VARCHAR(50) NOT NULL,
+			date VARCHAR(40),
+			signature VARCHAR(255)
+		)`,
+		"INSERT INTO purchase(id, description, amount, date, signature) VALUES ('p-1', 'Dinner', '20.13', '2023-09-30', '20.13_2023-09-30_Dinner')",
+		"INSERT INTO purchase(id, description, amount, date, signature) VALUES ('p-2', 'Dinner', '20.13', '2023-09-30', '20.13_2023-09-30_Dinner')",
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatalf("an error '%s' was not expected when creating the old schema", err)
+		}
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if err := tt.n.RollbackTransaction(tt.args.tx); (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.RollbackTransaction() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if err := mock.ExpectationsWereMet(); err != nil {
-				t.Errorf("there were unfulfilled expectations: %s", err)
-				return
+	old.Close()
+
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver, cfg.Database.Path = models.DatabaseDriverSQLite, path
+	sm, ctx := NewManagerForTestsDatabase()
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatalf("configService.Reconfigure() error = %v", err)
+	}
+	// the second start finds the schema up to date.
+	for i := 0; i < 2; i++ {
+		db := sm.WithDatabase(NewDatabaseOfDriver()).Database()
+		if err := db.Start(ctx); err != nil {
+			t.Fatalf("Database.Start() error = %v", err)
+		}
+		for _, id := range []string{"p-1", "p-2"} {
+			if _, err := db.GetPurchaseById(ctx, id); err != nil {
+				t.Errorf("GetPurchaseById(%s) error = %v", id, err)
 			}
-		})
+		}
+		p := &models.Purchase{Id: "p-3", Description: "Dinner", Amount: "20.13", Date: "2023-09-30", Deduplicate: true}
+		if id, created, err := insertInTx(ctx, db, p); err != nil || created || id != "p-1" {
+			t.Errorf("InsertPurchase() of the same purchase = %s, %v, %v, want p-1 not created", id, created, err)
+		}
+		db.Close(ctx)
+	}
+
+	db := sm.WithDatabase(NewDatabaseOfDriver()).Database()
+	if err := db.Start(ctx); err != nil {
+		t.Fatalf("Database.Start() error = %v", err)
+	}
+	defer db.Close(ctx)
+	if err := db.WithTx(ctx, func(tx services.Tx) error { return db.DeletePurchase(tx.Context(), tx, "p-2") }); err != nil {
+		t.Errorf("DeletePurchase() error = %v", err)
+	}
+	if purchases, err := db.ListAllPurchases(ctx); err != nil || len(purchases) != 1 {
+		t.Errorf("ListAllPurchases() = %d purchases, %v, want 1", len(purchases), err)
 	}
 }
 
-func Test_mysqlDatabaseFinal_GetPurchaseById(t *testing.T) {
+func Test_sqlDatabaseFinal_GetPurchaseById(t *testing.T) {
 	type args struct {
 		id string
 	}
@@ -410,8 +527,7 @@ func Test_mysqlDatabaseFinal_GetPurchaseById(t *testing.T) {
 				if err != nil {
 					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 				}
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS purchase").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS exchange").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectCreateTables(mock)
 				mock.ExpectQuery("FROM purchase").WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"id", "description", "amount", "date"}).
 					FromCSVString("abcd-fghi,Some transaction,20.13,2023-09-30"))
 				mock.ExpectQuery("FROM exchange").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"date", "countrycurrency", "exchangerate"}).
@@ -429,8 +545,7 @@ func Test_mysqlDatabaseFinal_GetPurchaseById(t *testing.T) {
 				if err != nil {
 					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 				}
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS purchase").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS exchange").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectCreateTables(mock)
 				mock.ExpectQuery("FROM purchase").WithArgs("2").WillReturnError(sql.ErrNoRows)
 				return db
 			},
@@ -439,15 +554,14 @@ func Test_mysqlDatabaseFinal_GetPurchaseById(t *testing.T) {
 		},
 		{
 			name: "purchaseErrAny",
-			args: args{id: "3"},
+			args: args{id: "purchase-3"},
 			dbFunc: func() *sql.DB {
 				db, mock, err := sqlmock.New()
 				if err != nil {
 					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 				}
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS purchase").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS exchange").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectQuery("FROM purchase").WithArgs("3").WillReturnError(errors.New("some error"))
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase").WithArgs("purchase-3").WillReturnError(errors.New("some error"))
 
 				return db
 			},
@@ -456,17 +570,16 @@ func Test_mysqlDatabaseFinal_GetPurchaseById(t *testing.T) {
 		},
 		{
 			name: "purchaseErrNoRows",
-			args: args{id: "4"},
+			args: args{id: "purchase-4"},
 			dbFunc: func() *sql.DB {
 				db, mock, err := sqlmock.New()
 				if err != nil {
 					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 				}
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS purchase").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS exchange").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectQuery("FROM purchase").WithArgs("4").WillReturnRows(sqlmock.NewRows([]string{"id", "description", "amount", "date", "signature"}).
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase").WithArgs("purchase-4").WillReturnRows(sqlmock.NewRows([]string{"id", "description", "amount", "date", "signature"}).
 					FromCSVString("abcd-fghi,Some transaction,20.13,2023-09-30,20.13_2023-09-30_Sometransaction"))
-				mock.ExpectQuery("FROM exchange").WithArgs("4").
+				mock.ExpectQuery("FROM exchange").WithArgs("purchase-4").
 					WillReturnError(sql.ErrNoRows)
 				return db
 			},
@@ -475,17 +588,16 @@ func Test_mysqlDatabaseFinal_GetPurchaseById(t *testing.T) {
 		},
 		{
 			name: "exchangeErrAny",
-			args: args{id: "5"},
+			args: args{id: "purchase-5"},
 			dbFunc: func() *sql.DB {
 				db, mock, err := sqlmock.New()
 				if err != nil {
 					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 				}
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS purchase").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS exchange").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectQuery("FROM purchase").WithArgs("5").WillReturnRows(sqlmock.NewRows([]string{"id", "description", "amount", "date", "signature"}).
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase").WithArgs("purchase-5").WillReturnRows(sqlmock.NewRows([]string{"id", "description", "amount", "date", "signature"}).
 					FromCSVString("abcd-fghi,Some transaction,20.13,2023-09-30,20.13_2023-09-30_Sometransaction"))
-				mock.ExpectQuery("FROM exchange").WithArgs("5").
+				mock.ExpectQuery("FROM exchange").WithArgs("purchase-5").
 					WillReturnError(errors.New("some error"))
 				return db
 			},
@@ -497,29 +609,36 @@ func Test_mysqlDatabaseFinal_GetPurchaseById(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			sm, ctx := NewManagerForTestsDatabase()
 			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
-			dbService := sm.WithDatabase(NewDatabase()).Database().(*mysqlDatabaseFinal)
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
 			sm.Start(ctxTmp)
 			got, err := dbService.GetPurchaseById(ctxTmp, tt.args.id)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("%s: mysqlDatabaseFinal.GetPurchaseById() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				t.Errorf("%s: sqlDatabaseFinal.GetPurchaseById() error = %v, wantErr %v", tt.name, err, tt.wantErr)
 				return
 			}
+			// the id is logged as a field of the error, never in its message.
+			var pe *messages.PurchaseError
+			if errors.As(err, &pe) && (pe.PurchaseId != tt.args.id || strings.Contains(pe.Error(), tt.args.id)) {
+				t.Errorf("%s: sqlDatabaseFinal.GetPurchaseById() error = %q of the purchase %q, want the purchase %q out of the message", tt.name, pe.Error(), pe.PurchaseId, tt.args.id)
+			}
 			if !tt.wantErr && !purchaseSuperficialDeepEqual(got, tt.want) {
-				t.Errorf("%s: mysqlDatabaseFinal.GetPurchaseById() = %v, want %v", tt.name, got, tt.want)
+				t.Errorf("%s: sqlDatabaseFinal.GetPurchaseById() = %v, want %v", tt.name, got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_InsertPurchase(t *testing.T) {
+func Test_sqlDatabaseFinal_InsertPurchase(t *testing.T) {
 	type args struct {
 		newPurchase *models.Purchase
 	}
 	tests := []struct {
-		name    string
-		args    args
-		dbFunc  func() *sql.DB
-		wantErr bool
+		name        string
+		args        args
+		dbFunc      func() *sql.DB
+		wantId      string
+		wantCreated bool
+		wantErr     bool
 	}{
 		{
 			name: "success", //just manual work to make other cases. For now, I will pass, but I KNOW that in production apps we need to cover ALL..
@@ -529,39 +648,160 @@ func Test_mysqlDatabaseFinal_InsertPurchase(t *testing.T) {
 				if err != nil {
 					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 				}
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS purchase").WillReturnResult(sqlmock.NewResult(1, 1))
-				mock.ExpectExec("CREATE TABLE IF NOT EXISTS exchange").WillReturnResult(sqlmock.NewResult(1, 1))
+				expectCreateTables(mock)
 				mock.ExpectBegin()
-				mock.ExpectPrepare("INSERT INTO purchase").
-					ExpectExec().WithArgs(basicPurchase.Id, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date, basicPurchase.Signature()).
+				mock.ExpectExec("INSERT INTO purchase\\(").WithArgs(basicPurchase.Id, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date, nullableSignature(basicPurchase)).
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO purchase_history").WithArgs(models.PurchaseCreated, sqlmock.AnyArg(), basicPurchase.Id).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				return db
+			},
+			wantId:      basicPurchase.Id,
+			wantCreated: true,
+			wantErr:     false,
+		},
+		{
+			name: "duplicatedSignature",
+			args: args{newPurchase: dedupPurchase},
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO purchase\\(").WithArgs(dedupPurchase.Id, dedupPurchase.Description, dedupPurchase.Amount, dedupPurchase.Date, nullableSignature(dedupPurchase)).
+					WillReturnError(&mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"})
+				mock.ExpectQuery("SELECT id FROM purchase WHERE signature").WithArgs(dedupPurchase.Signature()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("existing-id"))
 				mock.ExpectCommit()
 				return db
 			},
+			wantId:      "existing-id",
+			wantCreated: false,
+			wantErr:     false,
+		},
+		{
+			name: "duplicatedId",
+			args: args{newPurchase: basicPurchase},
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO purchase\\(").WithArgs(basicPurchase.Id, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date, nullableSignature(basicPurchase)).
+					WillReturnError(&mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"})
+				mock.ExpectRollback()
+				return db
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			var id string
+			var created bool
+			err := dbService.WithTx(ctxTmp, func(tx services.Tx) error {
+				var err error
+				id, created, err = dbService.InsertPurchase(tx.Context(), tx, tt.args.newPurchase)
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.InsertPurchase() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if id != tt.wantId || created != tt.wantCreated {
+				t.Errorf("sqlDatabaseFinal.InsertPurchase() = (%s, %v), want (%s, %v)", id, created, tt.wantId, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_ExistsBySignature(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "exists",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase WHERE signature").WithArgs(basicPurchase.Signature()).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				return db
+			},
+			want:    true,
 			wantErr: false,
 		},
+		{
+			name: "notExists",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase WHERE signature").WithArgs(basicPurchase.Signature()).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				return db
+			},
+			want:    false,
+			wantErr: false,
+		},
+		{
+			name: "error",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase WHERE signature").WithArgs(basicPurchase.Signature()).
+					WillReturnError(errors.New("some error"))
+				return db
+			},
+			want:    false,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			sm, ctx := NewManagerForTestsDatabase()
 			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
-			dbService := sm.WithDatabase(NewDatabase()).Database().(*mysqlDatabaseFinal)
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
 			sm.Start(ctxTmp)
-			tx, _ := sm.Database().BeginTransaction(ctxTmp)
-			if err := dbService.InsertPurchase(ctxTmp, tx, tt.args.newPurchase); (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.InsertPurchase() error = %v, wantErr %v", err, tt.wantErr)
+			got, err := dbService.ExistsBySignature(ctxTmp, basicPurchase.Signature())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.ExistsBySignature() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("sqlDatabaseFinal.ExistsBySignature() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_mysqlDatabaseFinal_ListAllPurchases(t *testing.T) {
+func Test_sqlDatabaseFinal_ListAllPurchases(t *testing.T) {
 	type args struct {
 		ctx context.Context
 	}
 	tests := []struct {
 		name    string
-		n       *mysqlDatabaseFinal
+		n       *sqlDatabaseFinal
 		args    args
 		want    []*models.Purchase
 		wantErr bool
@@ -572,11 +812,11 @@ func Test_mysqlDatabaseFinal_ListAllPurchases(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			got, err := tt.n.ListAllPurchases(tt.args.ctx)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("mysqlDatabaseFinal.ListAllPurchases() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("sqlDatabaseFinal.ListAllPurchases() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("mysqlDatabaseFinal.ListAllPurchases() = %v, want %v", got, tt.want)
+				t.Errorf("sqlDatabaseFinal.ListAllPurchases() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -585,3 +825,776 @@ func Test_mysqlDatabaseFinal_ListAllPurchases(t *testing.T) {
 func purchaseSuperficialDeepEqual(p1 *models.Purchase, p2 *models.Purchase) bool {
 	return p1.Id == p2.Id && p1.Description == p2.Description && p1.Date == p2.Date && p1.Amount == p2.Amount
 }
+
+func Test_sqlDatabaseFinal_InsertIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		want    bool
+		wantErr bool
+	}{
+		{
+			name: "reserved",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectExec("DELETE FROM idempotency_key").WithArgs(basicIdempotencyKey.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO idempotency_key").WillReturnResult(sqlmock.NewResult(1, 1))
+				return db
+			},
+			want:    true,
+			wantErr: false,
+		},
+		{
+			name: "alreadyUsed",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectExec("DELETE FROM idempotency_key").WithArgs(basicIdempotencyKey.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO idempotency_key").WillReturnError(&mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"})
+				return db
+			},
+			want:    false,
+			wantErr: false,
+		},
+		{
+			name: "error",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectExec("DELETE FROM idempotency_key").WithArgs(basicIdempotencyKey.Key, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO idempotency_key").WillReturnError(errors.New("some error"))
+				return db
+			},
+			want:    false,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			got, err := dbService.InsertIdempotencyKey(ctxTmp, basicIdempotencyKey)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.InsertIdempotencyKey() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			// the error is logged and answered to the client, so it must not give the key away.
+			if err != nil && strings.Contains(err.Error(), basicIdempotencyKey.Key) {
+				t.Errorf("sqlDatabaseFinal.InsertIdempotencyKey() error = %v, must not contain the key", err)
+			}
+			if got != tt.want {
+				t.Errorf("sqlDatabaseFinal.InsertIdempotencyKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_GetIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		want    *models.IdempotencyKey
+		wantErr error
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM idempotency_key").WithArgs(basicIdempotencyKey.Key).
+					WillReturnRows(sqlmock.NewRows([]string{"idempotency_key", "request_hash", "status_code", "response_body", "expires_at"}).
+						AddRow(basicIdempotencyKey.Key, basicIdempotencyKey.RequestHash, basicIdempotencyKey.StatusCode, basicIdempotencyKey.ResponseBody, basicIdempotencyKey.ExpiresAt))
+				return db
+			},
+			want:    basicIdempotencyKey,
+			wantErr: nil,
+		},
+		{
+			name: "notFound",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM idempotency_key").WithArgs(basicIdempotencyKey.Key).WillReturnError(sql.ErrNoRows)
+				return db
+			},
+			want:    nil,
+			wantErr: messages.ErrNoIdempotencyKeyFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			got, err := dbService.GetIdempotencyKey(ctxTmp, basicIdempotencyKey.Key)
+			if err != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.GetIdempotencyKey() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sqlDatabaseFinal.GetIdempotencyKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_UpdatePurchase(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		wantErr error
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE purchase SET description").
+					WithArgs(basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date, nullableSignature(basicPurchase), basicPurchase.Id).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO purchase_history").WithArgs(models.PurchaseUpdated, sqlmock.AnyArg(), basicPurchase.Id).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				return db
+			},
+			wantErr: nil,
+		},
+		{
+			name: "duplicated",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE purchase SET description").
+					WillReturnError(&mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"})
+				mock.ExpectRollback()
+				return db
+			},
+			wantErr: messages.ErrDuplicatedPurchase,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			err := dbService.WithTx(ctxTmp, func(tx services.Tx) error {
+				return dbService.UpdatePurchase(tx.Context(), tx, basicPurchase)
+			})
+			if err != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.UpdatePurchase() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_DeletePurchase(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		wantErr error
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE purchase SET deleted_at").WithArgs(sqlmock.AnyArg(), basicPurchase.Id).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec("INSERT INTO purchase_history").WithArgs(models.PurchaseDeleted, sqlmock.AnyArg(), basicPurchase.Id).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				return db
+			},
+			wantErr: nil,
+		},
+		{
+			name: "notFound",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE purchase SET deleted_at").WithArgs(sqlmock.AnyArg(), basicPurchase.Id).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+				return db
+			},
+			wantErr: messages.ErrNoPurchaseFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			err := dbService.WithTx(ctxTmp, func(tx services.Tx) error {
+				return dbService.DeletePurchase(tx.Context(), tx, basicPurchase.Id)
+			})
+			if err != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.DeletePurchase() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_RemoveRateOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		wantErr error
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE rate_override SET removed_at").WithArgs(int64(1700000000000), int64(1)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				return db
+			},
+			wantErr: nil,
+		},
+		{
+			name: "notInUse",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("UPDATE rate_override SET removed_at").WithArgs(int64(1700000000000), int64(1)).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+				return db
+			},
+			wantErr: messages.ErrNoOverrideFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			err := dbService.WithTx(ctxTmp, func(tx services.Tx) error {
+				return dbService.RemoveRateOverride(tx.Context(), tx, 1, 1700000000000)
+			})
+			if err != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.RemoveRateOverride() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_ListPurchaseHistory(t *testing.T) {
+	columns := []string{"id", "purchase_id", "action", "description", "amount", "date", "changed_at"}
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase_history").WithArgs(basicPurchase.Id).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, basicPurchase.Id, models.PurchaseCreated, basicPurchase.Description, "20.31", basicPurchase.Date, 1700000000).
+						AddRow(2, basicPurchase.Id, models.PurchaseUpdated, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date, 1700000100))
+				return db
+			},
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name: "notFound",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase_history").WithArgs(basicPurchase.Id).WillReturnRows(sqlmock.NewRows(columns))
+				return db
+			},
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			got, err := dbService.ListPurchaseHistory(ctxTmp, basicPurchase.Id)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.ListPurchaseHistory() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("sqlDatabaseFinal.ListPurchaseHistory() = %v, want %d rows", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_ListExchangeRevisions(t *testing.T) {
+	columns := []string{"id", "date", "country_currency_desc", "exchange_rate", "recorded_at"}
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM exchange_revision").WithArgs(basicExchange.CountryCurrencyDesc, basicExchange.Date).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(1, basicExchange.Date, basicExchange.CountryCurrencyDesc, "5.00", 0).
+						AddRow(2, basicExchange.Date, basicExchange.CountryCurrencyDesc, "5.10", 1700000000000))
+				return db
+			},
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name: "notFound",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM exchange_revision").WithArgs(basicExchange.CountryCurrencyDesc, basicExchange.Date).WillReturnRows(sqlmock.NewRows(columns))
+				return db
+			},
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			got, err := dbService.ListExchangeRevisions(ctxTmp, basicExchange.CountryCurrencyDesc, basicExchange.Date)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.ListExchangeRevisions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("sqlDatabaseFinal.ListExchangeRevisions() = %v, want %d rows", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_GetPurchaseConversion(t *testing.T) {
+	columns := []string{"purchase_id", "country_currency_desc", "original_amount", "purchase_date", "exchange_rate", "rate_date", "provider", "converted_amount", "locked_at"}
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		wantErr error
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase_conversion").WithArgs(basicPurchase.Id, basicExchange.CountryCurrencyDesc).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(basicPurchase.Id, basicExchange.CountryCurrencyDesc, "10.00", "2023-09-30", "5.00", "2023-09-30", models.ConversionProviderTreasury, "50.00", 1700000000000))
+				return db
+			},
+			wantErr: nil,
+		},
+		{
+			name: "notLocked",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("FROM purchase_conversion").WithArgs(basicPurchase.Id, basicExchange.CountryCurrencyDesc).WillReturnRows(sqlmock.NewRows(columns))
+				return db
+			},
+			wantErr: messages.ErrNoConversionFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			got, err := dbService.GetPurchaseConversion(ctxTmp, basicPurchase.Id, basicExchange.CountryCurrencyDesc)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("sqlDatabaseFinal.GetPurchaseConversion() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr == nil && (got.ConvertedAmount != "50.00" || got.LockedAt != 1700000000000) {
+				t.Errorf("sqlDatabaseFinal.GetPurchaseConversion() = %+v, unexpected conversion", got)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_GetExchangeRatesForCountryCurrencyAndDates(t *testing.T) {
+	columns := []string{"date", "date", "exchange_rate"}
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				// a single query, with the repeated date sent once.
+				mock.ExpectQuery("JSON_TABLE").WithArgs(`["2023-09-30","2023-08-15"]`, basicExchange.CountryCurrencyDesc).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow("2023-09-30", "2023-09-30", "5.00").
+						AddRow("2023-08-15", "2023-06-30", "4.90"))
+				return db
+			},
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name: "anyError",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("JSON_TABLE").WillReturnError(sql.ErrConnDone)
+				return db
+			},
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			got, err := dbService.GetExchangeRatesForCountryCurrencyAndDates(ctxTmp, basicExchange.CountryCurrencyDesc, []string{"2023-09-30", "2023-08-15", "2023-09-30"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.GetExchangeRatesForCountryCurrencyAndDates() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("sqlDatabaseFinal.GetExchangeRatesForCountryCurrencyAndDates() = %v, want %d rates", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_BatchInsertPurchases(t *testing.T) {
+	tests := []struct {
+		name        string
+		dbFunc      func() *sql.DB
+		wantCreated []bool
+		wantErr     bool
+	}{
+		{
+			name: "successWithConflict",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO purchase\\(").WithArgs(basicPurchase.Id, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date, nullableSignature(basicPurchase)).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO purchase_history").WithArgs(models.PurchaseCreated, sqlmock.AnyArg(), basicPurchase.Id).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("INSERT INTO purchase\\(").WithArgs(basicPurchase.Id, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date, nullableSignature(basicPurchase)).
+					WillReturnError(&mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"})
+				mock.ExpectCommit()
+				return db
+			},
+			wantCreated: []bool{true, false},
+			wantErr:     false,
+		},
+		{
+			name: "anyError",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectBegin()
+				mock.ExpectExec("INSERT INTO purchase\\(").WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
+				return db
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			var got []*models.PurchaseInsertResult
+			err := dbService.WithTx(ctxTmp, func(tx services.Tx) error {
+				var err error
+				got, err = dbService.BatchInsertPurchases(tx.Context(), tx, []*models.Purchase{basicPurchase, basicPurchase})
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.BatchInsertPurchases() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != len(tt.wantCreated) {
+				t.Fatalf("sqlDatabaseFinal.BatchInsertPurchases() = %d results, want %d", len(got), len(tt.wantCreated))
+			}
+			for i, r := range got {
+				if r.Created != tt.wantCreated[i] {
+					t.Errorf("sqlDatabaseFinal.BatchInsertPurchases() result %d created = %v, want %v", i, r.Created, tt.wantCreated[i])
+				}
+			}
+			if len(got) > 1 && !errors.Is(got[1].Err, messages.ErrPurchaseIdConflict) {
+				t.Errorf("sqlDatabaseFinal.BatchInsertPurchases() result 1 error = %v, want %v", got[1].Err, messages.ErrPurchaseIdConflict)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_StreamAllPurchases(t *testing.T) {
+	columns := []string{"id", "description", "amount", "date"}
+	tests := []struct {
+		name    string
+		dbFunc  func() *sql.DB
+		fnErr   error
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "success",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("SELECT id, description, amount, date FROM purchase").
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(basicPurchase.Id, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date).
+						AddRow("other-id", basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date))
+				return db
+			},
+			want:    2,
+			wantErr: false,
+		},
+		{
+			name: "stopsOnCallbackError",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("SELECT id, description, amount, date FROM purchase").
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(basicPurchase.Id, basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date).
+						AddRow("other-id", basicPurchase.Description, basicPurchase.Amount, basicPurchase.Date))
+				return db
+			},
+			fnErr:   messages.ErrNoExchangeFound,
+			want:    1,
+			wantErr: true,
+		},
+		{
+			name: "queryError",
+			dbFunc: func() *sql.DB {
+				db, mock, err := sqlmock.New()
+				if err != nil {
+					t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+				}
+				expectCreateTables(mock)
+				mock.ExpectQuery("SELECT id, description, amount, date FROM purchase").WillReturnError(sql.ErrConnDone)
+				return db
+			},
+			want:    0,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTestsDatabase()
+			ctxTmp := context.WithValue(ctx, MockDbKey, tt.dbFunc())
+			dbService := sm.WithDatabase(NewDatabase()).Database().(*sqlDatabaseFinal)
+			sm.Start(ctxTmp)
+			got := 0
+			err := dbService.StreamAllPurchases(ctxTmp, func(p *models.Purchase) error {
+				got++
+				return tt.fnErr
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.StreamAllPurchases() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("sqlDatabaseFinal.StreamAllPurchases() streamed %d purchases, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sqlDatabaseFinal_StreamAllPurchasesSingleConnection(t *testing.T) {
+	pageSize := streamPageSize
+	streamPageSize = 2
+	defer func() { streamPageSize = pageSize }()
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver, cfg.Database.Path, cfg.Database.MaxOpenConns = models.DatabaseDriverSQLite, filepath.Join(t.TempDir(), "purchases.db"), 1
+	sm, ctx := NewManagerForTestsDatabase()
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatalf("configService.Reconfigure() error = %v", err)
+	}
+	db := sm.WithDatabase(NewDatabaseOfDriver()).Database()
+	if err := db.Start(ctx); err != nil {
+		t.Fatalf("Database.Start() error = %v", err)
+	}
+	defer db.Close(ctx)
+	for _, p := range []*models.Purchase{
+		{Id: "p-3", Description: "Taxi", Amount: "10.00", Date: "2023-09-30"},
+		{Id: "p-1", Description: "Dinner", Amount: "20.13", Date: "2023-09-30"},
+		{Id: "p-2", Description: "Hotel", Amount: "300.00", Date: "2023-09-29"},
+		{Id: "p-4", Description: "Lunch", Amount: "15.00", Date: "2023-10-01"},
+		{Id: "p-5", Description: "Flight", Amount: "900.00", Date: "2023-09-30"},
+	} {
+		if _, _, err := insertInTx(ctx, db, p); err != nil {
+			t.Fatalf("InsertPurchase(%s) error = %v", p.Id, err)
+		}
+	}
+
+	// fn reads the database like the export does, so it needs the only connection of the pool.
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	var got []string
+	err := db.StreamAllPurchases(ctx, func(p *models.Purchase) error {
+		if _, err := db.GetPurchaseById(ctx, p.Id); err != nil {
+			return err
+		}
+		got = append(got, p.Id)
+		return nil
+	})
+	if want := []string{"p-2", "p-1", "p-3", "p-5", "p-4"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("sqlDatabaseFinal.StreamAllPurchases() = %v, %v, want %v", got, err, want)
+	}
+}
+
+func Test_sqlDatabaseFinal_Reconfigure(t *testing.T) {
+	sm, ctx := NewManagerForTestsDatabase()
+	dbService := sm.WithDatabase(NewDatabase()).Database()
+	dbService.Start(context.WithValue(ctx, MockDbKey, buildMock(t, -1)))
+	pool := models.DefaultConfig()
+	pool.Database.MaxOpenConns = 20
+	moved := models.DefaultConfig()
+	moved.Database.HostPort = "otherdb:3306"
+	tests := []struct {
+		name    string
+		n       *sqlDatabaseFinal
+		cfg     *models.Config
+		wantErr bool
+	}{
+		{
+			name:    "poolResized",
+			n:       dbService.(*sqlDatabaseFinal),
+			cfg:     pool,
+			wantErr: false,
+		},
+		{
+			name:    "connectionChanged",
+			n:       dbService.(*sqlDatabaseFinal),
+			cfg:     moved,
+			wantErr: true,
+		},
+		{
+			name:    "notConnected",
+			n:       NewDatabase().(*sqlDatabaseFinal),
+			cfg:     moved,
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.n.Reconfigure(ctx, tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("sqlDatabaseFinal.Reconfigure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if got := dbService.(*sqlDatabaseFinal).db.Stats().MaxOpenConnections; got != 20 {
+		t.Errorf("sqlDatabaseFinal.Reconfigure() max open connections = %d, want 20", got)
+	}
+}
@@ -0,0 +1,235 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type (
+	// dialect holds what changes from one database to the other, the queries of sqlDatabaseFinal are the same.
+	dialect interface {
+		driverName() string
+		dsn(cfg models.DatabaseConfig) string
+		system() attribute.KeyValue
+		createTables() []string
+		// upsertExchanges is the insert of n exchange rows that replaces the rate of the rows already there.
+		upsertExchanges(values string) string
+		// datesTable is a table of one date column, with the dates of the JSON array given as its only argument.
+		datesTable() string
+		isDuplicateEntry(err error) bool
+		// columnExists counts the columns of the table given as the first argument named as the second one.
+		columnExists() string
+		// indexExists counts the indexes of the table given as the first argument named as the second one.
+		indexExists() string
+		// addUniqueIndex adds a unique index on column to a table already created.
+		addUniqueIndex(table string, index string, column string) string
+		// lockRows is appended to a SELECT made in a transaction to lock the rows read until it ends.
+		lockRows() string
+	}
+
+	mysqlDialect  struct{}
+	sqliteDialect struct{}
+)
+
+const (
+	mysqlDuplicateEntry = 1062
+)
+
+var (
+	sqlitePurchaseCreateTable = `CREATE TABLE IF NOT EXISTS purchase (
+		id VARCHAR(255) PRIMARY KEY,
+		description VARCHAR(255) NOT NULL,
+		amount VARCHAR(50) NOT NULL,
+		date VARCHAR(40),
+		signature VARCHAR(255),
+		deleted_at BIGINT NULL
+	)`
+
+	sqlitePurchaseHistoryCreateTable = `CREATE TABLE IF NOT EXISTS purchase_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		purchase_id VARCHAR(255) NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		amount VARCHAR(50) NOT NULL,
+		date VARCHAR(40),
+		changed_at BIGINT NOT NULL
+	)`
+
+	sqliteExchangeRevisionCreateTable = `CREATE TABLE IF NOT EXISTS exchange_revision (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		date VARCHAR(40),
+		country_currency_desc VARCHAR(255) NOT NULL,
+		exchange_rate VARCHAR(50) NOT NULL,
+		recorded_at BIGINT NOT NULL
+	)`
+
+	sqliteRateOverrideCreateTable = `CREATE TABLE IF NOT EXISTS rate_override (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		country_currency_desc VARCHAR(255) NOT NULL,
+		start_date VARCHAR(40) NOT NULL,
+		end_date VARCHAR(40) NOT NULL,
+		exchange_rate VARCHAR(50) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		created_by VARCHAR(255) NOT NULL,
+		created_at BIGINT NOT NULL,
+		removed_at BIGINT NOT NULL DEFAULT 0
+	)`
+
+	sqliteRateOverrideAuditCreateTable = `CREATE TABLE IF NOT EXISTS rate_override_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		override_id BIGINT NOT NULL,
+		action VARCHAR(20) NOT NULL,
+		country_currency_desc VARCHAR(255) NOT NULL,
+		start_date VARCHAR(40) NOT NULL,
+		end_date VARCHAR(40) NOT NULL,
+		exchange_rate VARCHAR(50) NOT NULL,
+		actor VARCHAR(255) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		changed_at BIGINT NOT NULL
+	)`
+
+	// SQLite has no INDEX inside CREATE TABLE, they are created on their own, the purchase signature one by the
+	// migration. The exchange and purchase_conversion tables are the same.
+	sqliteCreateTables = []string{
+		sqlitePurchaseCreateTable,
+		"CREATE INDEX IF NOT EXISTS purchase_date_idx ON purchase (date)",
+		exchangeCreateTable,
+		`CREATE TABLE IF NOT EXISTS idempotency_key (
+		idempotency_key VARCHAR(255) PRIMARY KEY,
+		request_hash VARCHAR(64) NOT NULL,
+		status_code INT NOT NULL,
+		response_body TEXT NOT NULL,
+		expires_at BIGINT NOT NULL
+	)`,
+		"CREATE INDEX IF NOT EXISTS idempotency_key_expires_at_idx ON idempotency_key (expires_at)",
+		sqlitePurchaseHistoryCreateTable,
+		"CREATE INDEX IF NOT EXISTS purchase_history_purchase_id_idx ON purchase_history (purchase_id)",
+		sqliteExchangeRevisionCreateTable,
+		"CREATE INDEX IF NOT EXISTS exchange_revision_currency_date_idx ON exchange_revision (country_currency_desc, date)",
+		purchaseConversionCreateTable,
+		sqliteRateOverrideCreateTable,
+		"CREATE INDEX IF NOT EXISTS rate_override_currency_idx ON rate_override (country_currency_desc)",
+		sqliteRateOverrideAuditCreateTable,
+		"CREATE INDEX IF NOT EXISTS rate_override_audit_currency_idx ON rate_override_audit (country_currency_desc)",
+	}
+)
+
+// dialectOf returns the dialect of the database.driver setting.
+func dialectOf(driver string) (dialect, error) {
+	switch driver {
+	case models.DatabaseDriverMySQL:
+		return mysqlDialect{}, nil
+	case models.DatabaseDriverSQLite:
+		return sqliteDialect{}, nil
+	}
+	return nil, fmt.Errorf("unknown database driver '%s'", driver)
+}
+
+func (mysqlDialect) driverName() string {
+	return "mysql"
+}
+
+// refer https://github.com/go-sql-driver/mysql#dsn-data-source-name for details
+// dsn asks for the rows matched as the rows affected, as SQLite answers, so an update writing the values a row
+// already has still finds it.
+func (mysqlDialect) dsn(cfg models.DatabaseConfig) string {
+	return fmt.Sprintf("%s:%s@tcp(%s)/%s?clientFoundRows=true", cfg.User, cfg.Password, cfg.HostPort, cfg.Name)
+}
+
+func (mysqlDialect) system() attribute.KeyValue {
+	return semconv.DBSystemMySQL
+}
+
+func (mysqlDialect) createTables() []string {
+	return createTables
+}
+
+func (mysqlDialect) upsertExchanges(values string) string {
+	return fmt.Sprintf("INSERT INTO exchange(date, country_currency_desc, exchange_rate) VALUES %s ON DUPLICATE KEY UPDATE exchange_rate = VALUES(exchange_rate)", values)
+}
+
+func (mysqlDialect) datesTable() string {
+	return "SELECT j.date FROM JSON_TABLE(?, '$[*]' COLUMNS (date VARCHAR(40) PATH '$')) j"
+}
+
+func (mysqlDialect) isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+func (mysqlDialect) columnExists() string {
+	return "SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?"
+}
+
+func (mysqlDialect) indexExists() string {
+	return "SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?"
+}
+
+func (mysqlDialect) addUniqueIndex(table string, index string, column string) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD UNIQUE INDEX %s (%s)", table, index, column)
+}
+
+func (mysqlDialect) lockRows() string {
+	return " FOR UPDATE"
+}
+
+func (sqliteDialect) driverName() string {
+	return "sqlite"
+}
+
+// dsn opens the database file in WAL mode, so the reads do not wait for the writes, and begins every transaction
+// taking the write lock, so two transactions never deadlock upgrading their read locks. A writer waits up to 5s
+// for another one to finish.
+func (sqliteDialect) dsn(cfg models.DatabaseConfig) string {
+	q := url.Values{}
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Set("_txlock", "immediate")
+	return "file:" + cfg.Path + "?" + q.Encode()
+}
+
+func (sqliteDialect) system() attribute.KeyValue {
+	return semconv.DBSystemSqlite
+}
+
+func (sqliteDialect) createTables() []string {
+	return sqliteCreateTables
+}
+
+func (sqliteDialect) upsertExchanges(values string) string {
+	return fmt.Sprintf("INSERT INTO exchange(date, country_currency_desc, exchange_rate) VALUES %s ON CONFLICT (country_currency_desc, date) DO UPDATE SET exchange_rate = excluded.exchange_rate", values)
+}
+
+func (sqliteDialect) datesTable() string {
+	return "SELECT value AS date FROM json_each(?)"
+}
+
+func (sqliteDialect) isDuplicateEntry(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
+
+func (sqliteDialect) columnExists() string {
+	return "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+}
+
+func (sqliteDialect) indexExists() string {
+	return "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?"
+}
+
+func (sqliteDialect) addUniqueIndex(table string, index string, column string) string {
+	return fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", index, table, column)
+}
+
+// lockRows is empty, the transactions begin immediate so they already write one at a time.
+func (sqliteDialect) lockRows() string {
+	return ""
+}
@@ -0,0 +1,33 @@
+package persistence
+
+import (
+	"context"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+// driverDatabase is the Database of the database.driver setting. The setting is only known once the config is
+// loaded, so the choice is made on Start.
+type driverDatabase struct {
+	services.Database
+}
+
+// NewDatabaseOfDriver builds the Database chosen on Start by the database.driver setting: the in-memory one for
+// models.DatabaseDriverMemory, the SQL one of NewDatabase for the others.
+func NewDatabaseOfDriver() services.Database {
+	return &driverDatabase{Database: NewDatabase()}
+}
+
+func (d *driverDatabase) Start(ctx context.Context) error {
+	sm := d.ServiceManager()
+	if sm.ConfigService().Config().Database.Driver == models.DatabaseDriverMemory {
+		d.Database = NewMemoryDatabase().WithServiceManager(sm)
+	}
+	return d.Database.Start(ctx)
+}
+
+func (d *driverDatabase) WithServiceManager(sm services.ServiceManager) services.Database {
+	d.Database = d.Database.WithServiceManager(sm)
+	return d
+}
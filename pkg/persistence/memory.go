@@ -0,0 +1,929 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	memoryDatabaseFinal struct {
+		sm         services.ServiceManager
+		connection models.DatabaseConfig // the settings it was started with
+
+		mu              sync.RWMutex
+		purchases       map[string]*memoryPurchase // by id, the deleted ones too
+		signatures      map[string]string          // the id of the purchase with each signature, as the unique index
+		history         []*models.PurchaseHistory
+		exchanges       map[string]map[string]string                     // the rate by country currency and date
+		revisions       []*models.ExchangeRevision                       // every rate ingested, the exchanges are the last ones
+		conversions     map[string]map[string]*models.PurchaseConversion // the locked conversion by country currency and purchase id
+		overrides       []*models.RateOverride                           // by id - 1, the removed ones too
+		overrideAudit   []*models.RateOverrideAudit
+		idempotencyKeys map[string]*models.IdempotencyKey
+	}
+
+	// memoryTx is the services.Tx of memoryDatabaseFinal, its journal undoes its changes on rollback.
+	memoryTx struct {
+		ctx     context.Context
+		db      *memoryDatabaseFinal
+		journal journal
+		done    bool
+	}
+
+	// memoryPurchase is a row of the purchase table.
+	memoryPurchase struct {
+		Id          string `json:"id"`
+		Description string `json:"description"`
+		Amount      string `json:"amount"`
+		Date        string `json:"date"`
+		Signature   string `json:"signature,omitempty"`
+		DeletedAt   int64  `json:"deleted_at,omitempty"`
+	}
+
+	// memorySnapshot is the content of the database.snapshot file.
+	memorySnapshot struct {
+		Purchases       []*memoryPurchase            `json:"purchases"`
+		History         []*models.PurchaseHistory    `json:"history"`
+		Exchanges       []*models.ExchangeForDate    `json:"exchanges"`
+		Revisions       []*models.ExchangeRevision   `json:"revisions,omitempty"`
+		Conversions     []*models.PurchaseConversion `json:"conversions,omitempty"`
+		Overrides       []*models.RateOverride       `json:"overrides,omitempty"`
+		OverrideAudit   []*models.RateOverrideAudit  `json:"override_audit,omitempty"`
+		IdempotencyKeys []*models.IdempotencyKey     `json:"idempotency_keys"`
+	}
+
+	// journal undoes the changes of a transaction that failed, in the reverse order.
+	journal []func()
+)
+
+// NewMemoryDatabase builds a Database kept in memory, with the semantics of the SQL ones: the signature is unique,
+// the exchanges are upserted by currency and date and a transaction that fails changes nothing. The transactions
+// run one at a time. With
+// database.snapshot set it is loaded from that JSON file on Start and saved to it on Close.
+func NewMemoryDatabase() services.Database {
+	return &memoryDatabaseFinal{}
+}
+
+func (n *memoryDatabaseFinal) Start(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.connection = n.sm.ConfigService().Config().Database
+	n.purchases = make(map[string]*memoryPurchase)
+	n.signatures = make(map[string]string)
+	n.history = nil
+	n.exchanges = make(map[string]map[string]string)
+	n.revisions = nil
+	n.conversions = make(map[string]map[string]*models.PurchaseConversion)
+	n.overrides = nil
+	n.overrideAudit = nil
+	n.idempotencyKeys = make(map[string]*models.IdempotencyKey)
+	if err := n.load(n.connection.Snapshot); err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, "Memory Database Started!", "purchases", len(n.purchases), "snapshot", n.connection.Snapshot)
+	return nil
+}
+
+// Close saves the snapshot, when there is one.
+func (n *memoryDatabaseFinal) Close(ctx context.Context) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.purchases == nil || n.connection.Snapshot == "" {
+		return nil
+	}
+	return n.save(n.connection.Snapshot)
+}
+
+func (n *memoryDatabaseFinal) Healthy(ctx context.Context) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.purchases == nil {
+		return errors.New("database not started")
+	}
+	return nil
+}
+
+// Reconfigure rejects a new driver or snapshot, there are no other settings to apply.
+func (n *memoryDatabaseFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	if n.purchases == nil {
+		return nil
+	}
+	if cfg.Database.Driver != n.connection.Driver || cfg.Database.Snapshot != n.connection.Snapshot {
+		return errors.New("the database driver and snapshot cannot change without a restart")
+	}
+	return nil
+}
+
+func (n *memoryDatabaseFinal) WithServiceManager(sm services.ServiceManager) services.Database {
+	n.sm = sm
+	return n
+}
+
+func (n *memoryDatabaseFinal) ServiceManager() services.ServiceManager {
+	return n.sm
+}
+
+// Stats is always empty, there is no connection pool.
+func (n *memoryDatabaseFinal) Stats() sql.DBStats {
+	return sql.DBStats{}
+}
+
+func (n *memoryDatabaseFinal) instrument(ctx context.Context, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "Database."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemKey.String(models.DatabaseDriverMemory), semconv.DBName(n.connection.Name)))
+	return ctx, func() {
+		span.End()
+		n.sm.MetricsService().ObserveDatabaseQuery(method, time.Since(start))
+	}
+}
+
+// WithTx runs fn holding the write lock, so the transactions are serializable, undoing everything fn changed when
+// it fails. Given the context of one of its own transactions, fn joins it.
+func (n *memoryDatabaseFinal) WithTx(ctx context.Context, fn func(tx services.Tx) error) error {
+	if n.inTx(ctx) {
+		return fn(ctx.Value(txKey).(*memoryTx))
+	}
+	ctx, end := n.instrument(ctx, "WithTx")
+	defer end()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.purchases == nil {
+		return errors.New("database not started")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx := &memoryTx{db: n}
+	tx.ctx = context.WithValue(ctx, txKey, tx)
+	defer func() {
+		tx.done = true
+		if r := recover(); r != nil {
+			tx.journal.undo()
+			panic(r)
+		}
+	}()
+
+	err := fn(tx)
+	if err == nil {
+		// like the SQL ones, a transaction whose context is canceled is rolled back.
+		err = ctx.Err()
+	}
+	if err != nil {
+		tx.journal.undo()
+		return err
+	}
+	return nil
+}
+
+func (t *memoryTx) Context() context.Context {
+	return t.ctx
+}
+
+// inTx tells if ctx is the one of a transaction of n, not finished yet. The write lock is held by it.
+func (n *memoryDatabaseFinal) inTx(ctx context.Context) bool {
+	t, ok := ctx.Value(txKey).(*memoryTx)
+	return ok && t.db == n && !t.done
+}
+
+// journalOf returns the journal of a transaction begun by n and not finished yet.
+func (n *memoryDatabaseFinal) journalOf(tx services.Tx) (*journal, error) {
+	t, ok := tx.(*memoryTx)
+	if !ok || t.db != n || t.done {
+		return nil, messages.ErrTxDone
+	}
+	return &t.journal, nil
+}
+
+// rlock takes the read lock, unless ctx is the one of a transaction of n that already holds the write lock.
+func (n *memoryDatabaseFinal) rlock(ctx context.Context) func() {
+	if n.inTx(ctx) {
+		return func() {}
+	}
+	n.mu.RLock()
+	return n.mu.RUnlock
+}
+
+// lock takes the write lock, unless ctx is the one of a transaction of n that already holds it.
+func (n *memoryDatabaseFinal) lock(ctx context.Context) func() {
+	if n.inTx(ctx) {
+		return func() {}
+	}
+	n.mu.Lock()
+	return n.mu.Unlock
+}
+
+// inTransaction runs change inside tx, the write lock is held by its WithTx. When change fails only its own changes
+// are undone, like a failed statement of a SQL transaction.
+func (n *memoryDatabaseFinal) inTransaction(tx services.Tx, change func(j *journal) error) error {
+	j, err := n.journalOf(tx)
+	if err != nil {
+		return err
+	}
+	mark := len(*j)
+	if err := change(j); err != nil {
+		(*j)[mark:].undo()
+		*j = (*j)[:mark]
+		return err
+	}
+	return nil
+}
+
+func (j *journal) add(undo func()) {
+	*j = append(*j, undo)
+}
+
+func (j journal) undo() {
+	for i := len(j) - 1; i >= 0; i-- {
+		j[i]()
+	}
+}
+
+func (n *memoryDatabaseFinal) InsertPurchase(ctx context.Context, tx services.Tx, p *models.Purchase) (string, bool, error) {
+	ctx, end := n.instrument(ctx, "InsertPurchase")
+	defer end()
+	var id string
+	var created bool
+	err := n.inTransaction(tx, func(j *journal) error {
+		var err error
+		id, created, err = n.insertPurchase(j, p)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	if created {
+		n.sm.LogsService().Info(ctx, "Purchase Inserted!", "signature", p.Signature())
+	}
+	return id, created, nil
+}
+
+func (n *memoryDatabaseFinal) BatchInsertPurchases(ctx context.Context, tx services.Tx, ps []*models.Purchase) ([]*models.PurchaseInsertResult, error) {
+	ctx, end := n.instrument(ctx, "BatchInsertPurchases")
+	defer end()
+	results := make([]*models.PurchaseInsertResult, 0, len(ps))
+	err := n.inTransaction(tx, func(j *journal) error {
+		for _, p := range ps {
+			id, created, err := n.insertPurchase(j, p)
+			if err != nil && !errors.Is(err, messages.ErrPurchaseIdConflict) {
+				return err
+			}
+			results = append(results, &models.PurchaseInsertResult{Id: id, Created: created, Err: err})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Purchases Batch Inserted! purchases num: %d", len(ps)))
+	return results, nil
+}
+
+// insertPurchase inserts p and its history. When p is a duplicate the id of the purchase that already exists is
+// returned, as the SQL databases do when the insert breaks the primary key or the signature unique index.
+func (n *memoryDatabaseFinal) insertPurchase(j *journal, p *models.Purchase) (string, bool, error) {
+	_, idTaken := n.purchases[p.Id]
+	_, signatureTaken := n.signatures[p.Signature()]
+	if p.Deduplicate && signatureTaken {
+		return n.signatures[p.Signature()], false, nil
+	}
+	if idTaken {
+		return "", false, messages.ErrPurchaseIdConflict
+	}
+	row := &memoryPurchase{Id: p.Id, Description: p.Description, Amount: p.Amount, Date: p.Date}
+	if p.Deduplicate {
+		row.Signature = p.Signature()
+	}
+	n.setPurchase(j, row)
+	n.appendHistory(j, row, models.PurchaseCreated)
+	return p.Id, true, nil
+}
+
+func (n *memoryDatabaseFinal) UpdatePurchase(ctx context.Context, tx services.Tx, p *models.Purchase) error {
+	ctx, end := n.instrument(ctx, "UpdatePurchase")
+	defer end()
+	err := n.inTransaction(tx, func(j *journal) error {
+		current, ok := n.purchases[p.Id]
+		if !ok || current.DeletedAt != 0 {
+			return messages.ErrNoPurchaseFound
+		}
+		row := &memoryPurchase{Id: p.Id, Description: p.Description, Amount: p.Amount, Date: p.Date}
+		if p.Deduplicate {
+			if id, taken := n.signatures[p.Signature()]; taken && id != p.Id {
+				return messages.ErrDuplicatedPurchase
+			}
+			row.Signature = p.Signature()
+		}
+		n.setPurchase(j, row)
+		n.appendHistory(j, row, models.PurchaseUpdated)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, "Purchase Updated!", services.PurchaseIDKey, p.Id)
+	return nil
+}
+
+func (n *memoryDatabaseFinal) DeletePurchase(ctx context.Context, tx services.Tx, id string) error {
+	ctx, end := n.instrument(ctx, "DeletePurchase")
+	defer end()
+	err := n.inTransaction(tx, func(j *journal) error {
+		current, ok := n.purchases[id]
+		if !ok || current.DeletedAt != 0 {
+			return messages.ErrNoPurchaseFound
+		}
+		// the signature is released so the same purchase can be created again later.
+		row := *current
+		row.Signature, row.DeletedAt = "", time.Now().Unix()
+		n.setPurchase(j, &row)
+		n.appendHistory(j, &row, models.PurchaseDeleted)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, "Purchase Deleted!", services.PurchaseIDKey, id)
+	return nil
+}
+
+// setPurchase stores row, keeping the signatures index in line with it.
+func (n *memoryDatabaseFinal) setPurchase(j *journal, row *memoryPurchase) {
+	previous, existed := n.purchases[row.Id]
+	if existed && previous.Signature != "" {
+		delete(n.signatures, previous.Signature)
+	}
+	n.purchases[row.Id] = row
+	if row.Signature != "" {
+		n.signatures[row.Signature] = row.Id
+	}
+	j.add(func() {
+		if row.Signature != "" {
+			delete(n.signatures, row.Signature)
+		}
+		if !existed {
+			delete(n.purchases, row.Id)
+			return
+		}
+		n.purchases[row.Id] = previous
+		if previous.Signature != "" {
+			n.signatures[previous.Signature] = previous.Id
+		}
+	})
+}
+
+// appendHistory copies the current values of the purchase to its history.
+func (n *memoryDatabaseFinal) appendHistory(j *journal, row *memoryPurchase, action string) {
+	var id int64 = 1
+	if len(n.history) > 0 {
+		id = n.history[len(n.history)-1].Id + 1
+	}
+	n.history = append(n.history, &models.PurchaseHistory{
+		Id: id, PurchaseId: row.Id, Action: action, Description: row.Description, Amount: row.Amount, Date: row.Date, ChangedAt: time.Now().Unix(),
+	})
+	j.add(func() { n.history = n.history[:len(n.history)-1] })
+}
+
+func (n *memoryDatabaseFinal) ListPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error) {
+	_, end := n.instrument(ctx, "ListPurchaseHistory")
+	defer end()
+	defer n.rlock(ctx)()
+	var history []*models.PurchaseHistory
+	for _, h := range n.history {
+		if h.PurchaseId == id {
+			c := *h
+			history = append(history, &c)
+		}
+	}
+	if len(history) == 0 {
+		return nil, messages.ErrNoPurchaseFound
+	}
+	return history, nil
+}
+
+func (n *memoryDatabaseFinal) InsertExchange(ctx context.Context, tx services.Tx, ex *models.ExchangeForDate) error {
+	ctx, end := n.instrument(ctx, "InsertExchange")
+	defer end()
+	err := n.inTransaction(tx, func(j *journal) error {
+		n.upsertExchange(j, ex, time.Now().UnixMilli())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Exchange Inserted! For countrycurrency: '%s' and date: '%s'", ex.CountryCurrencyDesc, ex.Date))
+	return nil
+}
+
+func (n *memoryDatabaseFinal) BatchInsertExchanges(ctx context.Context, tx services.Tx, exchanges []*models.ExchangeForDate) error {
+	_, end := n.instrument(ctx, "BatchInsertExchanges")
+	defer end()
+	recordedAt := time.Now().UnixMilli()
+	return n.inTransaction(tx, func(j *journal) error {
+		for _, ex := range exchanges {
+			n.upsertExchange(j, ex, recordedAt)
+		}
+		return nil
+	})
+}
+
+// upsertExchange replaces the rate of the currency and date, appending a revision recorded at recordedAt when
+// the rate changed.
+func (n *memoryDatabaseFinal) upsertExchange(j *journal, ex *models.ExchangeForDate, recordedAt int64) {
+	rates, ok := n.exchanges[ex.CountryCurrencyDesc]
+	if !ok {
+		rates = make(map[string]string)
+		n.exchanges[ex.CountryCurrencyDesc] = rates
+	}
+	previous, existed := rates[ex.Date]
+	if existed && previous == ex.ExchangeRate {
+		return
+	}
+	rates[ex.Date] = ex.ExchangeRate
+	n.revisions = append(n.revisions, &models.ExchangeRevision{
+		Id: int64(len(n.revisions) + 1), Date: ex.Date, CountryCurrencyDesc: ex.CountryCurrencyDesc, ExchangeRate: ex.ExchangeRate, RecordedAt: recordedAt,
+	})
+	j.add(func() {
+		n.revisions = n.revisions[:len(n.revisions)-1]
+		if existed {
+			rates[ex.Date] = previous
+		} else {
+			delete(rates, ex.Date)
+		}
+	})
+}
+
+// ratesOf returns the rate by date of countrycurrency: the current ones, or with a context given by WithAsOf the
+// last revision of each date recorded until then.
+func (n *memoryDatabaseFinal) ratesOf(ctx context.Context, countrycurrency string) map[string]string {
+	asOf, ok := services.AsOf(ctx)
+	if !ok {
+		return n.exchanges[countrycurrency]
+	}
+	rates := make(map[string]string)
+	for _, r := range n.revisions {
+		if r.CountryCurrencyDesc == countrycurrency && r.RecordedAt <= asOf.UnixMilli() {
+			rates[r.Date] = r.ExchangeRate
+		}
+	}
+	return rates
+}
+
+// GetExchangeRateForCountryCurrencyAndDate returns the rate of the date, or the nearest earlier one.
+func (n *memoryDatabaseFinal) GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
+	_, end := n.instrument(ctx, "GetExchangeRateForCountryCurrencyAndDate")
+	defer end()
+	defer n.rlock(ctx)()
+	// the dates are YYYY-MM-DD, in the chronological order as strings too.
+	rates := n.ratesOf(ctx, countrycurrency)
+	nearest := ""
+	for d := range rates {
+		if d <= date && d > nearest {
+			nearest = d
+		}
+	}
+	if nearest == "" {
+		return nil, messages.ErrNoExchangeFound
+	}
+	return &models.ExchangeForDate{Date: nearest, CountryCurrencyDesc: countrycurrency, ExchangeRate: rates[nearest]}, nil
+}
+
+// GetExchangeRatesForCountryCurrencyAndDates looks up every date in the rates of countrycurrency, sorted once.
+func (n *memoryDatabaseFinal) GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	_, end := n.instrument(ctx, "GetExchangeRatesForCountryCurrencyAndDates")
+	defer end()
+	defer n.rlock(ctx)()
+	rates := n.ratesOf(ctx, countrycurrency)
+	sorted := make([]string, 0, len(rates))
+	for d := range rates {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+	found := make(map[string]*models.ExchangeForDate, len(dates))
+	for _, date := range dates {
+		// the index of the first rate after date, the one before it is the nearest earlier.
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i] > date })
+		if i > 0 {
+			found[date] = &models.ExchangeForDate{Date: sorted[i-1], CountryCurrencyDesc: countrycurrency, ExchangeRate: rates[sorted[i-1]]}
+		}
+	}
+	return found, nil
+}
+
+func (n *memoryDatabaseFinal) ListExchangesSince(ctx context.Context, date string) ([]*models.ExchangeForDate, error) {
+	_, end := n.instrument(ctx, "ListExchangesSince")
+	defer end()
+	defer n.rlock(ctx)()
+	exchanges := []*models.ExchangeForDate{}
+	for currency, rates := range n.exchanges {
+		for d, rate := range rates {
+			if d >= date {
+				exchanges = append(exchanges, &models.ExchangeForDate{Date: d, CountryCurrencyDesc: currency, ExchangeRate: rate})
+			}
+		}
+	}
+	sort.Slice(exchanges, func(i, j int) bool {
+		if exchanges[i].CountryCurrencyDesc != exchanges[j].CountryCurrencyDesc {
+			return exchanges[i].CountryCurrencyDesc < exchanges[j].CountryCurrencyDesc
+		}
+		return exchanges[i].Date < exchanges[j].Date
+	})
+	return exchanges, nil
+}
+
+func (n *memoryDatabaseFinal) ListExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error) {
+	_, end := n.instrument(ctx, "ListExchangeRevisions")
+	defer end()
+	defer n.rlock(ctx)()
+	var revisions []*models.ExchangeRevision
+	for _, r := range n.revisions {
+		if r.CountryCurrencyDesc == countrycurrency && r.Date == date {
+			c := *r
+			revisions = append(revisions, &c)
+		}
+	}
+	if len(revisions) == 0 {
+		return nil, messages.ErrNoExchangeFound
+	}
+	return revisions, nil
+}
+
+func (n *memoryDatabaseFinal) InsertPurchaseConversion(ctx context.Context, tx services.Tx, c *models.PurchaseConversion) (bool, error) {
+	_, end := n.instrument(ctx, "InsertPurchaseConversion")
+	defer end()
+	inserted := false
+	err := n.inTransaction(tx, func(j *journal) error {
+		inserted = n.insertConversion(j, c)
+		return nil
+	})
+	return inserted, err
+}
+
+// insertConversion keeps the conversion unless the purchase has one to the currency already, the first lock is kept.
+func (n *memoryDatabaseFinal) insertConversion(j *journal, c *models.PurchaseConversion) bool {
+	conversions, ok := n.conversions[c.CountryCurrencyDesc]
+	if !ok {
+		conversions = make(map[string]*models.PurchaseConversion)
+		n.conversions[c.CountryCurrencyDesc] = conversions
+	}
+	if _, exists := conversions[c.PurchaseId]; exists {
+		return false
+	}
+	cp := *c
+	conversions[c.PurchaseId] = &cp
+	j.add(func() { delete(conversions, c.PurchaseId) })
+	return true
+}
+
+func (n *memoryDatabaseFinal) GetPurchaseConversion(ctx context.Context, id string, countrycurrency string) (*models.PurchaseConversion, error) {
+	_, end := n.instrument(ctx, "GetPurchaseConversion")
+	defer end()
+	defer n.rlock(ctx)()
+	c, ok := n.conversions[countrycurrency][id]
+	if !ok {
+		return nil, messages.ErrNoConversionFound
+	}
+	cp := *c
+	return &cp, nil
+}
+
+func (n *memoryDatabaseFinal) ListPurchaseConversions(ctx context.Context, countrycurrency string) (map[string]*models.PurchaseConversion, error) {
+	_, end := n.instrument(ctx, "ListPurchaseConversions")
+	defer end()
+	defer n.rlock(ctx)()
+	conversions := make(map[string]*models.PurchaseConversion, len(n.conversions[countrycurrency]))
+	for id, c := range n.conversions[countrycurrency] {
+		cp := *c
+		conversions[id] = &cp
+	}
+	return conversions, nil
+}
+
+func (n *memoryDatabaseFinal) InsertRateOverride(ctx context.Context, tx services.Tx, o *models.RateOverride) (int64, error) {
+	_, end := n.instrument(ctx, "InsertRateOverride")
+	defer end()
+	var id int64
+	err := n.inTransaction(tx, func(j *journal) error {
+		c := *o
+		c.Id, c.RemovedAt = int64(len(n.overrides)+1), 0
+		n.overrides = append(n.overrides, &c)
+		j.add(func() { n.overrides = n.overrides[:len(n.overrides)-1] })
+		id = c.Id
+		return nil
+	})
+	return id, err
+}
+
+func (n *memoryDatabaseFinal) RemoveRateOverride(ctx context.Context, tx services.Tx, id int64, removedAt int64) error {
+	_, end := n.instrument(ctx, "RemoveRateOverride")
+	defer end()
+	return n.inTransaction(tx, func(j *journal) error {
+		if id < 1 || id > int64(len(n.overrides)) || n.overrides[id-1].RemovedAt != 0 {
+			return messages.ErrNoOverrideFound
+		}
+		o := n.overrides[id-1]
+		o.RemovedAt = removedAt
+		j.add(func() { o.RemovedAt = 0 })
+		return nil
+	})
+}
+
+func (n *memoryDatabaseFinal) GetRateOverride(ctx context.Context, id int64) (*models.RateOverride, error) {
+	_, end := n.instrument(ctx, "GetRateOverride")
+	defer end()
+	defer n.rlock(ctx)()
+	if id < 1 || id > int64(len(n.overrides)) {
+		return nil, messages.ErrNoOverrideFound
+	}
+	c := *n.overrides[id-1]
+	return &c, nil
+}
+
+func (n *memoryDatabaseFinal) ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	_, end := n.instrument(ctx, "ListRateOverrides")
+	defer end()
+	defer n.rlock(ctx)()
+	overrides := make([]*models.RateOverride, 0)
+	for _, o := range n.overrides {
+		if countrycurrency == "" || o.CountryCurrencyDesc == countrycurrency {
+			c := *o
+			overrides = append(overrides, &c)
+		}
+	}
+	return overrides, nil
+}
+
+func (n *memoryDatabaseFinal) InsertRateOverrideAudit(ctx context.Context, tx services.Tx, a *models.RateOverrideAudit) error {
+	_, end := n.instrument(ctx, "InsertRateOverrideAudit")
+	defer end()
+	return n.inTransaction(tx, func(j *journal) error {
+		c := *a
+		c.Id = int64(len(n.overrideAudit) + 1)
+		n.overrideAudit = append(n.overrideAudit, &c)
+		j.add(func() { n.overrideAudit = n.overrideAudit[:len(n.overrideAudit)-1] })
+		return nil
+	})
+}
+
+func (n *memoryDatabaseFinal) ListRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error) {
+	_, end := n.instrument(ctx, "ListRateOverrideAudit")
+	defer end()
+	defer n.rlock(ctx)()
+	audit := make([]*models.RateOverrideAudit, 0)
+	for _, a := range n.overrideAudit {
+		if countrycurrency == "" || a.CountryCurrencyDesc == countrycurrency {
+			c := *a
+			audit = append(audit, &c)
+		}
+	}
+	return audit, nil
+}
+
+func (n *memoryDatabaseFinal) ExistsBySignature(ctx context.Context, signature string) (bool, error) {
+	_, end := n.instrument(ctx, "ExistsBySignature")
+	defer end()
+	defer n.rlock(ctx)()
+	_, ok := n.signatures[signature]
+	return ok, nil
+}
+
+func (n *memoryDatabaseFinal) GetPurchaseById(ctx context.Context, id string) (*models.Purchase, error) {
+	_, end := n.instrument(ctx, "GetPurchaseById")
+	defer end()
+	defer n.rlock(ctx)()
+	row, ok := n.purchases[id]
+	if !ok || row.DeletedAt != 0 {
+		return nil, messages.ErrNoPurchaseFound
+	}
+	return row.purchase(), nil
+}
+
+// GetPurchaseForUpdate reads the purchase inside tx, the write lock held by its WithTx keeps it as it is.
+func (n *memoryDatabaseFinal) GetPurchaseForUpdate(ctx context.Context, tx services.Tx, id string) (*models.Purchase, error) {
+	_, end := n.instrument(ctx, "GetPurchaseForUpdate")
+	defer end()
+	if _, err := n.journalOf(tx); err != nil {
+		return nil, err
+	}
+	row, ok := n.purchases[id]
+	if !ok || row.DeletedAt != 0 {
+		return nil, messages.ErrNoPurchaseFound
+	}
+	return row.purchase(), nil
+}
+
+func (n *memoryDatabaseFinal) ListAllPurchases(ctx context.Context) ([]*models.Purchase, error) {
+	_, end := n.instrument(ctx, "ListAllPurchases")
+	defer end()
+	defer n.rlock(ctx)()
+	return n.livePurchases(), nil
+}
+
+// StreamAllPurchases calls fn for every purchase, ordered by date and id. The purchases are copied before, so fn
+// can use the database.
+func (n *memoryDatabaseFinal) StreamAllPurchases(ctx context.Context, fn func(p *models.Purchase) error) error {
+	_, end := n.instrument(ctx, "StreamAllPurchases")
+	defer end()
+	unlock := n.rlock(ctx)
+	purchases := n.livePurchases()
+	unlock()
+	for _, p := range purchases {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *memoryDatabaseFinal) livePurchases() []*models.Purchase {
+	var purchases []*models.Purchase
+	for _, row := range n.purchases {
+		if row.DeletedAt == 0 {
+			p := row.purchase()
+			p.Deduplicate = row.Signature != ""
+			purchases = append(purchases, p)
+		}
+	}
+	sort.Slice(purchases, func(i, j int) bool {
+		if purchases[i].Date != purchases[j].Date {
+			return purchases[i].Date < purchases[j].Date
+		}
+		return purchases[i].Id < purchases[j].Id
+	})
+	return purchases
+}
+
+func (row *memoryPurchase) purchase() *models.Purchase {
+	return &models.Purchase{Id: row.Id, Description: row.Description, Amount: row.Amount, Date: row.Date}
+}
+
+func (n *memoryDatabaseFinal) InsertIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (bool, error) {
+	_, end := n.instrument(ctx, "InsertIdempotencyKey")
+	defer end()
+	defer n.lock(ctx)()
+	// an expired key is free to be used again.
+	if existing, ok := n.idempotencyKeys[k.Key]; ok && existing.ExpiresAt > time.Now().Unix() {
+		return false, nil
+	}
+	c := *k
+	n.idempotencyKeys[k.Key] = &c
+	return true, nil
+}
+
+func (n *memoryDatabaseFinal) GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyKey, error) {
+	_, end := n.instrument(ctx, "GetIdempotencyKey")
+	defer end()
+	defer n.rlock(ctx)()
+	k, ok := n.idempotencyKeys[key]
+	if !ok {
+		return nil, messages.ErrNoIdempotencyKeyFound
+	}
+	c := *k
+	return &c, nil
+}
+
+func (n *memoryDatabaseFinal) UpdateIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	_, end := n.instrument(ctx, "UpdateIdempotencyKey")
+	defer end()
+	defer n.lock(ctx)()
+	if existing, ok := n.idempotencyKeys[k.Key]; ok {
+		existing.StatusCode, existing.ResponseBody = k.StatusCode, k.ResponseBody
+	}
+	return nil
+}
+
+func (n *memoryDatabaseFinal) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	_, end := n.instrument(ctx, "DeleteIdempotencyKey")
+	defer end()
+	defer n.lock(ctx)()
+	delete(n.idempotencyKeys, key)
+	return nil
+}
+
+func (n *memoryDatabaseFinal) DeleteExpiredIdempotencyKeys(ctx context.Context, now int64) (int64, error) {
+	_, end := n.instrument(ctx, "DeleteExpiredIdempotencyKeys")
+	defer end()
+	defer n.lock(ctx)()
+	var purged int64
+	for key, k := range n.idempotencyKeys {
+		if k.ExpiresAt <= now {
+			delete(n.idempotencyKeys, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// load reads the snapshot file, a missing file is an empty database.
+func (n *memoryDatabaseFinal) load(path string) error {
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading the database snapshot: %w", err)
+	}
+	var s memorySnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("reading the database snapshot '%s': %w", path, err)
+	}
+	for _, row := range s.Purchases {
+		n.purchases[row.Id] = row
+		if row.Signature != "" {
+			n.signatures[row.Signature] = row.Id
+		}
+	}
+	n.history = s.History
+	// the revisions give the current rates, the exchanges of a snapshot saved before they were kept get their
+	// first revision recorded at 0.
+	n.revisions = s.Revisions
+	for _, r := range s.Revisions {
+		if n.exchanges[r.CountryCurrencyDesc] == nil {
+			n.exchanges[r.CountryCurrencyDesc] = make(map[string]string)
+		}
+		n.exchanges[r.CountryCurrencyDesc][r.Date] = r.ExchangeRate
+	}
+	var j journal
+	for _, ex := range s.Exchanges {
+		n.upsertExchange(&j, ex, 0)
+	}
+	for _, c := range s.Conversions {
+		n.insertConversion(&j, c)
+	}
+	n.overrides, n.overrideAudit = s.Overrides, s.OverrideAudit
+	for _, k := range s.IdempotencyKeys {
+		n.idempotencyKeys[k.Key] = k
+	}
+	return nil
+}
+
+// save writes the snapshot file, replacing the previous one only once it is complete.
+func (n *memoryDatabaseFinal) save(path string) error {
+	s := memorySnapshot{History: n.history, Revisions: n.revisions, Overrides: n.overrides, OverrideAudit: n.overrideAudit}
+	for _, row := range n.purchases {
+		s.Purchases = append(s.Purchases, row)
+	}
+	sort.Slice(s.Purchases, func(i, j int) bool { return s.Purchases[i].Id < s.Purchases[j].Id })
+	for currency, rates := range n.exchanges {
+		for date, rate := range rates {
+			s.Exchanges = append(s.Exchanges, &models.ExchangeForDate{Date: date, CountryCurrencyDesc: currency, ExchangeRate: rate})
+		}
+	}
+	sort.Slice(s.Exchanges, func(i, j int) bool {
+		if s.Exchanges[i].CountryCurrencyDesc != s.Exchanges[j].CountryCurrencyDesc {
+			return s.Exchanges[i].CountryCurrencyDesc < s.Exchanges[j].CountryCurrencyDesc
+		}
+		return s.Exchanges[i].Date < s.Exchanges[j].Date
+	})
+	for _, conversions := range n.conversions {
+		for _, c := range conversions {
+			s.Conversions = append(s.Conversions, c)
+		}
+	}
+	sort.Slice(s.Conversions, func(i, j int) bool {
+		if s.Conversions[i].CountryCurrencyDesc != s.Conversions[j].CountryCurrencyDesc {
+			return s.Conversions[i].CountryCurrencyDesc < s.Conversions[j].CountryCurrencyDesc
+		}
+		return s.Conversions[i].PurchaseId < s.Conversions[j].PurchaseId
+	})
+	for _, k := range n.idempotencyKeys {
+		s.IdempotencyKeys = append(s.IdempotencyKeys, k)
+	}
+	sort.Slice(s.IdempotencyKeys, func(i, j int) bool { return s.IdempotencyKeys[i].Key < s.IdempotencyKeys[j].Key })
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("writing the database snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing the database snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing the database snapshot: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,109 @@
+package persistence
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+func startMemoryDatabase(t *testing.T, snapshot string) services.Database {
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver, cfg.Database.Snapshot = models.DatabaseDriverMemory, snapshot
+	sm, ctx := NewManagerForTestsDatabase()
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatalf("configService.Reconfigure() error = %v", err)
+	}
+	db := sm.WithDatabase(NewMemoryDatabase()).Database()
+	if err := db.Start(ctx); err != nil {
+		t.Fatalf("memoryDatabaseFinal.Start() error = %v", err)
+	}
+	return db
+}
+
+func Test_memoryDatabaseFinal_snapshot(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "purchases.json")
+	_, ctx := NewManagerForTestsDatabase()
+
+	db := startMemoryDatabase(t, snapshot)
+	p := &models.Purchase{Id: "p-1", Description: "Dinner", Amount: "20.13", Date: "2023-09-30", Deduplicate: true}
+	if _, _, err := insertInTx(ctx, db, p); err != nil {
+		t.Fatalf("InsertPurchase() error = %v", err)
+	}
+	ex := &models.ExchangeForDate{Date: "2023-09-30", CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "5.033"}
+	if err := db.WithTx(ctx, func(tx services.Tx) error { return db.InsertExchange(tx.Context(), tx, ex) }); err != nil {
+		t.Fatalf("InsertExchange() error = %v", err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatalf("memoryDatabaseFinal.Close() error = %v", err)
+	}
+
+	db = startMemoryDatabase(t, snapshot)
+	if got, err := db.GetPurchaseById(ctx, p.Id); err != nil || got.Description != p.Description {
+		t.Errorf("GetPurchaseById() after the load = %v, %v, want %v", got, err, p)
+	}
+	if exists, err := db.ExistsBySignature(ctx, p.Signature()); err != nil || !exists {
+		t.Errorf("ExistsBySignature() after the load = %v, %v, want true", exists, err)
+	}
+	if history, err := db.ListPurchaseHistory(ctx, p.Id); err != nil || len(history) != 1 {
+		t.Errorf("ListPurchaseHistory() after the load = %d entries, %v, want 1", len(history), err)
+	}
+	if got, err := db.GetExchangeRateForCountryCurrencyAndDate(ctx, ex.CountryCurrencyDesc, "2023-10-01"); err != nil || !reflect.DeepEqual(got, ex) {
+		t.Errorf("GetExchangeRateForCountryCurrencyAndDate() after the load = %v, %v, want %v", got, err, ex)
+	}
+	if revisions, err := db.ListExchangeRevisions(ctx, ex.CountryCurrencyDesc, ex.Date); err != nil || len(revisions) != 1 || revisions[0].RecordedAt == 0 {
+		t.Errorf("ListExchangeRevisions() after the load = %v, %v, want the revision inserted", revisions, err)
+	}
+}
+
+func Test_memoryDatabaseFinal_snapshotWithoutRevisions(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "purchases.json")
+	if err := os.WriteFile(snapshot, []byte(`{"exchanges": [{"date": "2023-09-30", "country_currency_desc": "Brazil-Real", "exchange_rate": "5.033"}]}`), 0o600); err != nil {
+		t.Fatalf("an error '%s' was not expected when writing the snapshot", err)
+	}
+	_, ctx := NewManagerForTestsDatabase()
+
+	// the rates of a snapshot saved before the revisions were kept are their first revision, recorded at 0.
+	db := startMemoryDatabase(t, snapshot)
+	revisions, err := db.ListExchangeRevisions(ctx, "Brazil-Real", "2023-09-30")
+	if err != nil || len(revisions) != 1 || revisions[0].RecordedAt != 0 {
+		t.Fatalf("ListExchangeRevisions() = %v, %v, want one revision recorded at 0", revisions, err)
+	}
+	if got, err := db.GetExchangeRateForCountryCurrencyAndDate(services.WithAsOf(ctx, time.UnixMilli(0)), "Brazil-Real", "2023-10-01"); err != nil || got.ExchangeRate != "5.033" {
+		t.Errorf("GetExchangeRateForCountryCurrencyAndDate() as of 0 = %v, %v, want 5.033", got, err)
+	}
+}
+
+func Test_memoryDatabaseFinal_concurrentInserts(t *testing.T) {
+	db := startMemoryDatabase(t, "")
+	_, ctx := NewManagerForTestsDatabase()
+
+	// the same purchase sent by many clients at once is created only once.
+	var wg sync.WaitGroup
+	created := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := &models.Purchase{Id: "p-" + string(rune('a'+i)), Description: "Dinner", Amount: "20.13", Date: "2023-09-30", Deduplicate: true}
+			if id, ok, err := insertInTx(ctx, db, p); err != nil {
+				t.Errorf("InsertPurchase() error = %v", err)
+			} else if ok {
+				created <- id
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(created)
+	if len(created) != 1 {
+		t.Errorf("InsertPurchase() created %d purchases, want 1", len(created))
+	}
+	if purchases, _ := db.ListAllPurchases(ctx); len(purchases) != 1 {
+		t.Errorf("ListAllPurchases() = %d purchases, want 1", len(purchases))
+	}
+}
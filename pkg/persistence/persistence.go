@@ -2,8 +2,11 @@ package persistence
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
 )
@@ -14,12 +17,19 @@ type (
 	}
 )
 
+// reserveIdempotencyKeyAttempts bounds how many times a key released while being reserved is reserved again.
+const reserveIdempotencyKeyAttempts = 3
+
 func NewPersistenceService() services.PersistenceService {
 	return &persistenceServiceFinal{}
 }
 
 func (n *persistenceServiceFinal) Start(ctx context.Context) error {
-	n.sm.LogsService().Info(ctx, "Persistence Started!")
+	purged, err := n.PurgeExpiredIdempotencyKeys(ctx)
+	if err != nil {
+		n.sm.LogsService().Warn(ctx, err.Error())
+	}
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Persistence Started! %d expired Idempotency-Keys purged", purged))
 	return nil
 }
 
@@ -31,6 +41,10 @@ func (n *persistenceServiceFinal) Healthy(ctx context.Context) error {
 	return nil
 }
 
+func (n *persistenceServiceFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
 func (n *persistenceServiceFinal) WithServiceManager(sm services.ServiceManager) services.PersistenceService {
 	n.sm = sm
 	return n
@@ -41,65 +55,302 @@ func (n *persistenceServiceFinal) ServiceManager() services.ServiceManager {
 }
 
 func (n *persistenceServiceFinal) GetPurchaseById(ctx context.Context, id string) (*models.Purchase, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.GetPurchaseById")
+	defer span.End()
 	return n.ServiceManager().Database().GetPurchaseById(ctx, id)
 }
 
 func (n *persistenceServiceFinal) ExistsBySignature(ctx context.Context, signature string) (bool, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ExistsBySignature")
+	defer span.End()
 	return n.sm.Database().ExistsBySignature(ctx, signature)
 }
 
-func (n *persistenceServiceFinal) InsertPurchase(ctx context.Context, p *models.Purchase) error {
+func (n *persistenceServiceFinal) InsertPurchase(ctx context.Context, p *models.Purchase) (string, bool, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.InsertPurchase")
+	defer span.End()
 	db := n.ServiceManager().Database()
-	n.sm.LogsService().Info(ctx, fmt.Sprintf("Inserting new purchase {id: %s, signature: %s}", p.Id, p.Signature()))
-	tx, err := db.BeginTransaction(ctx)
-	if err != nil {
-		db.RollbackTransaction(tx)
+	n.sm.LogsService().Info(ctx, "Inserting new purchase", services.PurchaseIDKey, p.Id, "signature", p.Signature())
+	var id string
+	var created bool
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		var err error
+		id, created, err = db.InsertPurchase(tx.Context(), tx, p)
 		return err
-	}
-	err = db.InsertPurchase(ctx, tx, p)
+	})
 	if err != nil {
-		db.RollbackTransaction(tx)
+		return "", false, err
+	}
+	return id, created, nil
+}
+
+func (n *persistenceServiceFinal) BatchInsertPurchases(ctx context.Context, ps []*models.Purchase) ([]*models.PurchaseInsertResult, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.BatchInsertPurchases")
+	defer span.End()
+	db := n.ServiceManager().Database()
+	n.sm.LogsService().Info(ctx, fmt.Sprintf("Batch Inserting new purchases, purchases num: %d", len(ps)))
+	var results []*models.PurchaseInsertResult
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		var err error
+		results, err = db.BatchInsertPurchases(tx.Context(), tx, ps)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return results, nil
 }
 
-func (n *persistenceServiceFinal) BatchInsertExchanges(ctx context.Context, p *models.Purchase, exchanges []*models.ExchangeForDate) error {
+func (n *persistenceServiceFinal) UpdatePurchase(ctx context.Context, id string, update func(current *models.Purchase) (*models.Purchase, error)) (*models.Purchase, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.UpdatePurchase")
+	defer span.End()
 	db := n.ServiceManager().Database()
-	n.sm.LogsService().Info(ctx, fmt.Sprintf("Batch Inserting new exchanges for signature: '%s', exchanges num: %d", p.Signature(), len(exchanges)))
-	tx, err := db.BeginTransaction(ctx)
+	n.sm.LogsService().Info(ctx, "Updating purchase", services.PurchaseIDKey, id)
+	var updated *models.Purchase
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		current, err := db.GetPurchaseForUpdate(tx.Context(), tx, id)
+		if err != nil {
+			return err
+		}
+		if updated, err = update(current); err != nil {
+			return err
+		}
+		updated.Id = id
+		return db.UpdatePurchase(tx.Context(), tx, updated)
+	})
 	if err != nil {
-		db.RollbackTransaction(tx)
-		return err
+		return nil, err
 	}
-	err = db.BatchInsertExchanges(ctx, tx, exchanges)
+	return updated, nil
+}
+
+func (n *persistenceServiceFinal) DeletePurchase(ctx context.Context, id string) error {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.DeletePurchase")
+	defer span.End()
+	db := n.ServiceManager().Database()
+	n.sm.LogsService().Info(ctx, "Deleting purchase", services.PurchaseIDKey, id)
+	return db.WithTx(ctx, func(tx services.Tx) error {
+		return db.DeletePurchase(tx.Context(), tx, id)
+	})
+}
+
+func (n *persistenceServiceFinal) ListPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ListPurchaseHistory")
+	defer span.End()
+	return n.sm.Database().ListPurchaseHistory(ctx, id)
+}
+
+func (n *persistenceServiceFinal) BatchInsertExchanges(ctx context.Context, p *models.Purchase, exchanges []*models.ExchangeForDate) error {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.BatchInsertExchanges")
+	defer span.End()
+	db := n.ServiceManager().Database()
+	n.sm.LogsService().Info(ctx, "Batch Inserting new exchanges", "signature", p.Signature(), "exchanges", len(exchanges))
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		return db.BatchInsertExchanges(tx.Context(), tx, exchanges)
+	})
 	if err != nil {
-		db.RollbackTransaction(tx)
 		return err
 	}
+	n.invalidateRates(exchanges...)
 	return nil
 }
 
 func (n *persistenceServiceFinal) InsertExchange(ctx context.Context, p *models.Purchase, exchange *models.ExchangeForDate) error {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.InsertExchange")
+	defer span.End()
 	db := n.ServiceManager().Database()
-	n.sm.LogsService().Info(ctx, fmt.Sprintf("Inserting new exchange for '%s' and purchase signature: '%s'", exchange.CountryCurrencyDesc, p.Signature()))
-	tx, err := db.BeginTransaction(ctx)
+	n.sm.LogsService().Info(ctx, "Inserting new exchange", "countrycurrency", exchange.CountryCurrencyDesc, "signature", p.Signature())
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		return db.InsertExchange(tx.Context(), tx, exchange)
+	})
 	if err != nil {
-		db.RollbackTransaction(tx)
 		return err
 	}
-	err = db.InsertExchange(ctx, tx, exchange)
+	n.invalidateRates(exchange)
+	return nil
+}
+
+// invalidateRates tells the RateCache, when one is registered, about the rates just written.
+func (n *persistenceServiceFinal) invalidateRates(exchanges ...*models.ExchangeForDate) {
+	cache, err := services.Get[services.RateCache](n.sm, services.RateCacheName)
 	if err != nil {
-		db.RollbackTransaction(tx)
-		return err
+		return
+	}
+	for _, ex := range exchanges {
+		cache.Invalidate(ex.CountryCurrencyDesc, ex.Date)
 	}
-	return nil
 }
 
 func (n *persistenceServiceFinal) GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.GetExchangeRateForCountryCurrencyAndDate")
+	defer span.End()
 	return n.sm.Database().GetExchangeRateForCountryCurrencyAndDate(ctx, countrycurrency, date)
 }
 
+func (n *persistenceServiceFinal) GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.GetExchangeRatesForCountryCurrencyAndDates")
+	defer span.End()
+	return n.sm.Database().GetExchangeRatesForCountryCurrencyAndDates(ctx, countrycurrency, dates)
+}
+
+func (n *persistenceServiceFinal) ListExchangesSince(ctx context.Context, date string) ([]*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ListExchangesSince")
+	defer span.End()
+	return n.sm.Database().ListExchangesSince(ctx, date)
+}
+
+func (n *persistenceServiceFinal) ListExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ListExchangeRevisions")
+	defer span.End()
+	return n.sm.Database().ListExchangeRevisions(ctx, countrycurrency, date)
+}
+
+func (n *persistenceServiceFinal) LockConversions(ctx context.Context, cs []*models.PurchaseConversion) ([]*models.PurchaseConversion, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.LockConversions")
+	defer span.End()
+	db := n.ServiceManager().Database()
+	locked := make([]*models.PurchaseConversion, 0, len(cs))
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		locked = locked[:0]
+		for _, c := range cs {
+			inserted, err := db.InsertPurchaseConversion(tx.Context(), tx, c)
+			if err != nil {
+				return err
+			}
+			if inserted {
+				locked = append(locked, c)
+				continue
+			}
+			// locked before, the first lock is the one reported.
+			existing, err := db.GetPurchaseConversion(tx.Context(), c.PurchaseId, c.CountryCurrencyDesc)
+			if err != nil {
+				return err
+			}
+			locked = append(locked, existing)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locked, nil
+}
+
+func (n *persistenceServiceFinal) GetPurchaseConversion(ctx context.Context, id string, countrycurrency string) (*models.PurchaseConversion, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.GetPurchaseConversion")
+	defer span.End()
+	return n.sm.Database().GetPurchaseConversion(ctx, id, countrycurrency)
+}
+
+func (n *persistenceServiceFinal) ListPurchaseConversions(ctx context.Context, countrycurrency string) (map[string]*models.PurchaseConversion, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ListPurchaseConversions")
+	defer span.End()
+	return n.sm.Database().ListPurchaseConversions(ctx, countrycurrency)
+}
+
+func (n *persistenceServiceFinal) CreateRateOverride(ctx context.Context, o *models.RateOverride) (*models.RateOverride, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.CreateRateOverride")
+	defer span.End()
+	db := n.ServiceManager().Database()
+	created := *o
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		id, err := db.InsertRateOverride(tx.Context(), tx, o)
+		if err != nil {
+			return err
+		}
+		created.Id, created.RemovedAt = id, 0
+		return db.InsertRateOverrideAudit(tx.Context(), tx, created.AuditOf(models.RateOverrideCreated, o.CreatedBy, o.Reason, o.CreatedAt))
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.sm.LogsService().Warn(ctx, "rate override created", "id", created.Id, "countrycurrency", created.CountryCurrencyDesc, "by", created.CreatedBy)
+	return &created, nil
+}
+
+func (n *persistenceServiceFinal) RemoveRateOverride(ctx context.Context, id int64, actor string, reason string) (*models.RateOverride, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.RemoveRateOverride")
+	defer span.End()
+	db := n.ServiceManager().Database()
+	var removed *models.RateOverride
+	err := db.WithTx(ctx, func(tx services.Tx) error {
+		o, err := db.GetRateOverride(tx.Context(), id)
+		if err != nil {
+			return err
+		}
+		removedAt := time.Now().UnixMilli()
+		if err := db.RemoveRateOverride(tx.Context(), tx, id, removedAt); err != nil {
+			return err
+		}
+		o.RemovedAt, removed = removedAt, o
+		return db.InsertRateOverrideAudit(tx.Context(), tx, o.AuditOf(models.RateOverrideRemoved, actor, reason, removedAt))
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.sm.LogsService().Warn(ctx, "rate override removed", "id", id, "countrycurrency", removed.CountryCurrencyDesc, "by", actor)
+	return removed, nil
+}
+
+func (n *persistenceServiceFinal) ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ListRateOverrides")
+	defer span.End()
+	return n.sm.Database().ListRateOverrides(ctx, countrycurrency)
+}
+
+func (n *persistenceServiceFinal) ListRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ListRateOverrideAudit")
+	defer span.End()
+	return n.sm.Database().ListRateOverrideAudit(ctx, countrycurrency)
+}
+
 func (n *persistenceServiceFinal) ListAllPurchases(ctx context.Context) ([]*models.Purchase, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ListAllPurchases")
+	defer span.End()
 	return n.sm.Database().ListAllPurchases(ctx)
 }
+
+func (n *persistenceServiceFinal) StreamAllPurchases(ctx context.Context, fn func(p *models.Purchase) error) error {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.StreamAllPurchases")
+	defer span.End()
+	return n.sm.Database().StreamAllPurchases(ctx, fn)
+}
+
+func (n *persistenceServiceFinal) ReserveIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ReserveIdempotencyKey")
+	defer span.End()
+	db := n.sm.Database()
+	for attempt := 1; ; attempt++ {
+		reserved, err := db.InsertIdempotencyKey(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return nil, nil
+		}
+		existing, err := db.GetIdempotencyKey(ctx, k.Key)
+		// the request holding the key released it in between, so the key is free to be reserved again.
+		if errors.Is(err, messages.ErrNoIdempotencyKeyFound) && attempt < reserveIdempotencyKeyAttempts {
+			continue
+		}
+		return existing, err
+	}
+}
+
+func (n *persistenceServiceFinal) CompleteIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.CompleteIdempotencyKey")
+	defer span.End()
+	return n.sm.Database().UpdateIdempotencyKey(ctx, k)
+}
+
+func (n *persistenceServiceFinal) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.ReleaseIdempotencyKey")
+	defer span.End()
+	return n.sm.Database().DeleteIdempotencyKey(ctx, key)
+}
+
+func (n *persistenceServiceFinal) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "PersistenceService.PurgeExpiredIdempotencyKeys")
+	defer span.End()
+	return n.sm.Database().DeleteExpiredIdempotencyKeys(ctx, time.Now().Unix())
+}
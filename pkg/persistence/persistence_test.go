@@ -2,10 +2,12 @@ package persistence
 
 import (
 	"context"
+	"errors"
 	"reflect"
 	"testing"
 
 	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
 )
@@ -15,8 +17,8 @@ func NewManagerForTests() (services.ServiceManager, context.Context) {
 	stop := make(chan struct{})
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, logs.AppEnvKey, "TESTS")
-	ctx = context.WithValue(ctx, logs.AppNameKey, logs.AppName)
-	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.AppVersion)
+	ctx = context.WithValue(ctx, logs.AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.Version())
 	return services.NewManager(asyncWorkChannel, stop), ctx
 }
 
@@ -279,7 +281,7 @@ func Test_persistenceServiceFinal_InsertPurchase(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			sm.Start(ctx)
-			if err := tt.n.InsertPurchase(ctx, tt.args.newPurchase); (err != nil) != tt.wantErr {
+			if _, _, err := tt.n.InsertPurchase(ctx, tt.args.newPurchase); (err != nil) != tt.wantErr {
 				t.Errorf("%s: persistenceServiceFinal.InsertPurchase() error = %v, wantErr %v", tt.name, err, tt.wantErr)
 			}
 		})
@@ -345,3 +347,228 @@ func Test_persistenceServiceFinal_InsertExchange(t *testing.T) {
 		})
 	}
 }
+
+// idempotencyKeysStub answers each InsertIdempotencyKey with the next of inserted, and each GetIdempotencyKey
+// with the next of got, a nil one being a key released in between.
+type idempotencyKeysStub struct {
+	services.Database
+	inserted []bool
+	got      []*models.IdempotencyKey
+}
+
+func (s *idempotencyKeysStub) WithServiceManager(sm services.ServiceManager) services.Database {
+	return s
+}
+
+func (s *idempotencyKeysStub) InsertIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (bool, error) {
+	inserted := s.inserted[0]
+	s.inserted = s.inserted[1:]
+	return inserted, nil
+}
+
+func (s *idempotencyKeysStub) GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyKey, error) {
+	k := s.got[0]
+	s.got = s.got[1:]
+	if k == nil {
+		return nil, messages.ErrNoIdempotencyKeyFound
+	}
+	return k, nil
+}
+
+func Test_persistenceServiceFinal_ReserveIdempotencyKey(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	ps := NewPersistenceService().WithServiceManager(sm)
+	existing := &models.IdempotencyKey{Key: "some-key", RequestHash: "some-hash", StatusCode: 201}
+	tests := []struct {
+		name    string
+		n       *persistenceServiceFinal
+		db      *idempotencyKeysStub
+		k       *models.IdempotencyKey
+		want    *models.IdempotencyKey
+		wantErr bool
+	}{
+		{
+			name:    "reserved",
+			n:       ps.(*persistenceServiceFinal),
+			k:       &models.IdempotencyKey{Key: "some-key", RequestHash: "some-hash"},
+			want:    nil,
+			wantErr: false,
+		},
+		{
+			name:    "alreadyReserved",
+			db:      &idempotencyKeysStub{inserted: []bool{false}, got: []*models.IdempotencyKey{existing}},
+			k:       &models.IdempotencyKey{Key: "some-key", RequestHash: "some-hash"},
+			want:    existing,
+			wantErr: false,
+		},
+		{
+			name:    "releasedWhileReserving",
+			db:      &idempotencyKeysStub{inserted: []bool{false, true}, got: []*models.IdempotencyKey{nil}},
+			k:       &models.IdempotencyKey{Key: "some-key", RequestHash: "some-hash"},
+			want:    nil,
+			wantErr: false,
+		},
+		{
+			name:    "releasedOverAndOver",
+			db:      &idempotencyKeysStub{inserted: []bool{false, false, false}, got: []*models.IdempotencyKey{nil, nil, nil}},
+			k:       &models.IdempotencyKey{Key: "some-key", RequestHash: "some-hash"},
+			want:    nil,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.db != nil {
+				sm, _ := NewManagerForTests()
+				tt.n = NewPersistenceService().WithServiceManager(sm.WithDatabase(tt.db)).(*persistenceServiceFinal)
+			}
+			got, err := tt.n.ReserveIdempotencyKey(ctx, tt.k)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: persistenceServiceFinal.ReserveIdempotencyKey() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: persistenceServiceFinal.ReserveIdempotencyKey() = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_persistenceServiceFinal_UpdatePurchase(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	ps := NewPersistenceService().WithServiceManager(sm)
+	patched := func(current *models.Purchase) (*models.Purchase, error) {
+		return &models.Purchase{Description: current.Description, Amount: "30.50", Date: current.Date}, nil
+	}
+	tests := []struct {
+		name       string
+		n          *persistenceServiceFinal
+		id         string
+		update     func(current *models.Purchase) (*models.Purchase, error)
+		wantAmount string
+		wantErr    bool
+	}{
+		{
+			name:       "success",
+			n:          ps.(*persistenceServiceFinal),
+			id:         "1",
+			update:     patched,
+			wantAmount: "30.50",
+			wantErr:    false,
+		},
+		{
+			name:    "notFound",
+			n:       ps.(*persistenceServiceFinal),
+			id:      basicPurchase.Id,
+			update:  patched,
+			wantErr: true,
+		},
+		{
+			name: "updateRejected",
+			n:    ps.(*persistenceServiceFinal),
+			id:   "1",
+			update: func(current *models.Purchase) (*models.Purchase, error) {
+				return nil, errors.New("rejected")
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm.Start(ctx)
+			got, err := tt.n.UpdatePurchase(ctx, tt.id, tt.update)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: persistenceServiceFinal.UpdatePurchase() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				return
+			}
+			if got != nil && (got.Id != tt.id || got.Amount != tt.wantAmount) {
+				t.Errorf("%s: persistenceServiceFinal.UpdatePurchase() = %+v, want the id %s and the amount %s", tt.name, got, tt.id, tt.wantAmount)
+			}
+		})
+	}
+}
+
+func Test_persistenceServiceFinal_DeletePurchase(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	ps := NewPersistenceService().WithServiceManager(sm)
+	tests := []struct {
+		name    string
+		n       *persistenceServiceFinal
+		id      string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			n:       ps.(*persistenceServiceFinal),
+			id:      basicPurchase.Id,
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm.Start(ctx)
+			if err := tt.n.DeletePurchase(ctx, tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("%s: persistenceServiceFinal.DeletePurchase() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_persistenceServiceFinal_ListPurchaseHistory(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	ps := NewPersistenceService().WithServiceManager(sm)
+	tests := []struct {
+		name    string
+		n       *persistenceServiceFinal
+		id      string
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			n:       ps.(*persistenceServiceFinal),
+			id:      basicPurchase.Id,
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm.Start(ctx)
+			if _, err := tt.n.ListPurchaseHistory(ctx, tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("%s: persistenceServiceFinal.ListPurchaseHistory() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_persistenceServiceFinal_BatchInsertPurchases(t *testing.T) {
+	sm, ctx := NewManagerForTests()
+	ps := NewPersistenceService().WithServiceManager(sm)
+	tests := []struct {
+		name    string
+		n       *persistenceServiceFinal
+		ps      []*models.Purchase
+		want    int
+		wantErr bool
+	}{
+		{
+			name:    "success",
+			n:       ps.(*persistenceServiceFinal),
+			ps:      []*models.Purchase{basicPurchase, basicPurchase},
+			want:    2,
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm.Start(ctx)
+			got, err := tt.n.BatchInsertPurchases(ctx, tt.ps)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("%s: persistenceServiceFinal.BatchInsertPurchases() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("%s: persistenceServiceFinal.BatchInsertPurchases() = %d results, want %d", tt.name, len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package ratecache
+
+import (
+	"container/list"
+	"sort"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+type (
+	// key is a rate by its currency and its effective date.
+	key struct {
+		currency string
+		date     string
+	}
+
+	// entry is a rate known to be the nearest earlier rate of every date from its effective date up to until, so a
+	// purchase of any of these dates is converted by it.
+	entry struct {
+		key     key
+		until   string
+		rate    models.ExchangeForDate
+		expires time.Time
+	}
+
+	// lru keeps up to size entries, dropping the least recently used one first. It is not safe for concurrent use.
+	lru struct {
+		size  int
+		ttl   time.Duration
+		now   func() time.Time
+		order *list.List // the most recently used in the front
+		items map[key]*list.Element
+		dates map[string][]string // the effective dates kept of each currency, sorted
+
+		evictions     int64
+		invalidations int64
+	}
+)
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{size: size, ttl: ttl, now: time.Now, order: list.New(), items: make(map[key]*list.Element), dates: make(map[string][]string)}
+}
+
+// get returns the rate of currency for date, when it is kept and has not expired.
+func (c *lru) get(currency string, date string) (*models.ExchangeForDate, bool) {
+	el := c.covering(currency, date)
+	if el == nil {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		c.evictions++
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	rate := e.rate
+	return &rate, true
+}
+
+// put keeps rate as the nearest earlier rate of currency for date. The entries it proves wrong, the ones of an
+// earlier rate reaching its effective date and of a later rate not after date, are dropped.
+func (c *lru) put(currency string, date string, rate *models.ExchangeForDate) {
+	if rate == nil || rate.Date > date {
+		return
+	}
+	k := key{currency: currency, date: rate.Date}
+	if el := c.covering(currency, rate.Date); el != nil && el.Value.(*entry).key != k {
+		c.remove(el)
+		c.invalidations++
+	}
+	for _, d := range c.datesBetween(currency, rate.Date, date) {
+		c.remove(c.items[key{currency: currency, date: d}])
+		c.invalidations++
+	}
+
+	if el, ok := c.items[k]; ok {
+		e := el.Value.(*entry)
+		if date > e.until {
+			e.until = date
+		}
+		e.rate, e.expires = *rate, c.now().Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[k] = c.order.PushFront(&entry{key: k, until: date, rate: *rate, expires: c.now().Add(c.ttl)})
+	dates := c.dates[currency]
+	i := sort.SearchStrings(dates, rate.Date)
+	dates = append(dates, "")
+	copy(dates[i+1:], dates[i:])
+	dates[i] = rate.Date
+	c.dates[currency] = dates
+	c.trim()
+}
+
+// invalidate drops the entry a new rate of currency effective on date falls into, if any.
+func (c *lru) invalidate(currency string, date string) bool {
+	el := c.covering(currency, date)
+	if el == nil {
+		return false
+	}
+	c.remove(el)
+	c.invalidations++
+	return true
+}
+
+// resize changes how many entries are kept and for how long, the ones over the new size are dropped now.
+func (c *lru) resize(size int, ttl time.Duration) {
+	c.size, c.ttl = size, ttl
+	c.trim()
+}
+
+func (c *lru) len() int {
+	return c.order.Len()
+}
+
+// covering returns the entry of the nearest rate of currency effective on date or before, if date is not after
+// its until.
+func (c *lru) covering(currency string, date string) *list.Element {
+	dates := c.dates[currency]
+	// the index of the first rate after date, the one before it is the nearest earlier.
+	i := sort.Search(len(dates), func(i int) bool { return dates[i] > date })
+	if i == 0 {
+		return nil
+	}
+	el := c.items[key{currency: currency, date: dates[i-1]}]
+	if date > el.Value.(*entry).until {
+		return nil
+	}
+	return el
+}
+
+// datesBetween returns the effective dates kept of currency after from and up to to.
+func (c *lru) datesBetween(currency string, from string, to string) []string {
+	dates := c.dates[currency]
+	i := sort.Search(len(dates), func(i int) bool { return dates[i] > from })
+	j := sort.Search(len(dates), func(i int) bool { return dates[i] > to })
+	return append([]string(nil), dates[i:j]...)
+}
+
+func (c *lru) trim() {
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+func (c *lru) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.order.Remove(el)
+	delete(c.items, e.key)
+	dates := c.dates[e.key.currency]
+	i := sort.SearchStrings(dates, e.key.date)
+	dates = append(dates[:i], dates[i+1:]...)
+	if len(dates) == 0 {
+		delete(c.dates, e.key.currency)
+		return
+	}
+	c.dates[e.key.currency] = dates
+}
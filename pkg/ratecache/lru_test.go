@@ -0,0 +1,118 @@
+package ratecache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+func Test_lru(t *testing.T) {
+	rate := func(date string, value string) *models.ExchangeForDate {
+		return &models.ExchangeForDate{Date: date, CountryCurrencyDesc: "Brazil-Real", ExchangeRate: value}
+	}
+	type step struct {
+		advance    time.Duration
+		put        *models.ExchangeForDate
+		putDate    string
+		invalidate string
+		get        string
+		want       string // the rate value got, empty for a miss
+	}
+	tests := []struct {
+		name  string
+		size  int
+		steps []step
+	}{
+		{
+			name: "coversUpToTheDateAsked",
+			size: 10,
+			steps: []step{
+				{put: rate("2023-06-30", "4.90"), putDate: "2023-08-15"},
+				{get: "2023-06-30", want: "4.90"},
+				{get: "2023-08-15", want: "4.90"},
+				{get: "2023-08-16"},
+				{get: "2023-06-29"},
+			},
+		},
+		{
+			name: "extendsTheSameRate",
+			size: 10,
+			steps: []step{
+				{put: rate("2023-06-30", "4.90"), putDate: "2023-07-01"},
+				{put: rate("2023-06-30", "4.90"), putDate: "2023-09-01"},
+				{get: "2023-08-15", want: "4.90"},
+			},
+		},
+		{
+			name: "newerRateDropsTheOneReachingIt",
+			size: 10,
+			steps: []step{
+				{put: rate("2023-06-30", "4.90"), putDate: "2023-12-31"},
+				{put: rate("2023-09-30", "5.00"), putDate: "2023-10-15"},
+				{get: "2023-10-01", want: "5.00"},
+				{get: "2023-08-15"},
+			},
+		},
+		{
+			name: "invalidateDropsTheCoveringRate",
+			size: 10,
+			steps: []step{
+				{put: rate("2023-06-30", "4.90"), putDate: "2023-12-31"},
+				{put: rate("2023-03-31", "4.80"), putDate: "2023-04-30"},
+				{invalidate: "2023-09-30"},
+				{get: "2023-08-15"},
+				{get: "2023-04-01", want: "4.80"},
+			},
+		},
+		{
+			name: "leastRecentlyUsedEvicted",
+			size: 2,
+			steps: []step{
+				{put: rate("2023-03-31", "4.80"), putDate: "2023-03-31"},
+				{put: rate("2023-06-30", "4.90"), putDate: "2023-06-30"},
+				{get: "2023-03-31", want: "4.80"},
+				{put: rate("2023-09-30", "5.00"), putDate: "2023-09-30"},
+				{get: "2023-06-30"},
+				{get: "2023-03-31", want: "4.80"},
+				{get: "2023-09-30", want: "5.00"},
+			},
+		},
+		{
+			name: "expired",
+			size: 10,
+			steps: []step{
+				{put: rate("2023-06-30", "4.90"), putDate: "2023-06-30"},
+				{advance: 59 * time.Minute, get: "2023-06-30", want: "4.90"},
+				{advance: time.Minute, get: "2023-06-30"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2023, 9, 30, 0, 0, 0, 0, time.UTC)
+			c := newLRU(tt.size, time.Hour)
+			c.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				switch {
+				case s.put != nil:
+					c.put("Brazil-Real", s.putDate, s.put)
+				case s.invalidate != "":
+					c.invalidate("Brazil-Real", s.invalidate)
+				default:
+					got, ok := c.get("Brazil-Real", s.get)
+					if s.want == "" && ok {
+						t.Errorf("step %d: get(%s) = %v, want a miss", i, s.get, got)
+					}
+					if s.want != "" && (!ok || got.ExchangeRate != s.want) {
+						t.Errorf("step %d: get(%s) = %v, %v, want %s", i, s.get, got, ok, s.want)
+					}
+				}
+			}
+			if c.len() > tt.size {
+				t.Errorf("len() = %d, want at most %d", c.len(), tt.size)
+			}
+		})
+	}
+}
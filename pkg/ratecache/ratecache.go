@@ -0,0 +1,224 @@
+package ratecache
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+type (
+	rateCacheFinal struct {
+		sm     services.ServiceManager
+		mu     sync.Mutex
+		cache  *lru
+		writes uint64 // the rates written so far, a read started before a write is not kept
+		hits   int64
+		misses int64
+	}
+)
+
+// NewRateCache builds a RateCache to be registered under services.RateCacheName, like
+// sm.Register(services.RateCacheName, ratecache.NewRateCache().WithServiceManager(sm), services.PersistenceServiceName).
+func NewRateCache() services.RateCache {
+	defaults := models.DefaultConfig().RateCache
+	return &rateCacheFinal{cache: newLRU(defaults.Size, defaults.TTL)}
+}
+
+// Start warms the cache up with the rates of the last rateCache.warmupQuarters quarters. A failed warm-up only
+// starts it empty, the rates are then read on the first use.
+func (n *rateCacheFinal) Start(ctx context.Context) error {
+	cfg := n.sm.ConfigService().Config().RateCache
+	n.mu.Lock()
+	n.cache.resize(cfg.Size, cfg.TTL)
+	n.mu.Unlock()
+	if cfg.WarmupQuarters > 0 {
+		now := time.Now()
+		since := warmupSince(now, cfg.WarmupQuarters)
+		rates, err := n.sm.PersistenceService().ListExchangesSince(ctx, since)
+		if err != nil {
+			n.sm.LogsService().Warn(ctx, err.Error(), "since", since)
+		} else {
+			n.warm(rates, now.Format(models.DateLayout))
+		}
+	}
+	n.sm.LogsService().Info(ctx, "Rate Cache Started!", "rates", n.Stats().Size)
+	return nil
+}
+
+func (n *rateCacheFinal) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *rateCacheFinal) Healthy(ctx context.Context) error {
+	return nil
+}
+
+// Health reports the stats, the cache itself is always up.
+func (n *rateCacheFinal) Health(ctx context.Context) *models.ComponentHealth {
+	s := n.Stats()
+	h := models.NewComponentHealth("", 0, nil)
+	h.Details = map[string]any{"hits": s.Hits, "misses": s.Misses, "size": s.Size}
+	return h
+}
+
+// Reconfigure applies the new size now and the new TTL to the rates kept from now on.
+func (n *rateCacheFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cache.resize(cfg.RateCache.Size, cfg.RateCache.TTL)
+	return nil
+}
+
+func (n *rateCacheFinal) WithServiceManager(sm services.ServiceManager) services.RateCache {
+	n.sm = sm
+	return n
+}
+
+func (n *rateCacheFinal) ServiceManager() services.ServiceManager {
+	return n.sm
+}
+
+func (n *rateCacheFinal) GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "RateCache.GetExchangeRateForCountryCurrencyAndDate")
+	defer span.End()
+	if _, ok := services.AsOf(ctx); ok {
+		// only the current rates are kept, the past ones are read every time.
+		return n.sm.PersistenceService().GetExchangeRateForCountryCurrencyAndDate(ctx, countrycurrency, date)
+	}
+	n.mu.Lock()
+	rate, ok := n.cache.get(countrycurrency, date)
+	if ok {
+		n.hits++
+	} else {
+		n.misses++
+	}
+	writes := n.writes
+	n.mu.Unlock()
+	if ok {
+		return rate, nil
+	}
+
+	rate, err := n.sm.PersistenceService().GetExchangeRateForCountryCurrencyAndDate(ctx, countrycurrency, date)
+	if err != nil || rate == nil {
+		return rate, err
+	}
+	n.mu.Lock()
+	if n.writes == writes {
+		n.cache.put(countrycurrency, date, rate)
+	}
+	n.mu.Unlock()
+	return rate, nil
+}
+
+// GetExchangeRatesForCountryCurrencyAndDates reads the dates not kept in a single call to the PersistenceService.
+func (n *rateCacheFinal) GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "RateCache.GetExchangeRatesForCountryCurrencyAndDates")
+	defer span.End()
+	if _, ok := services.AsOf(ctx); ok {
+		return n.sm.PersistenceService().GetExchangeRatesForCountryCurrencyAndDates(ctx, countrycurrency, dates)
+	}
+	rates := make(map[string]*models.ExchangeForDate, len(dates))
+	seen := make(map[string]bool, len(dates))
+	var missing []string
+	n.mu.Lock()
+	for _, date := range dates {
+		if seen[date] {
+			continue
+		}
+		seen[date] = true
+		if rate, ok := n.cache.get(countrycurrency, date); ok {
+			rates[date] = rate
+			n.hits++
+			continue
+		}
+		missing = append(missing, date)
+		n.misses++
+	}
+	writes := n.writes
+	n.mu.Unlock()
+	if len(missing) == 0 {
+		return rates, nil
+	}
+
+	found, err := n.sm.PersistenceService().GetExchangeRatesForCountryCurrencyAndDates(ctx, countrycurrency, missing)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for date, rate := range found {
+		rates[date] = rate
+		if n.writes == writes {
+			n.cache.put(countrycurrency, date, rate)
+		}
+	}
+	return rates, nil
+}
+
+func (n *rateCacheFinal) Invalidate(countrycurrency string, date string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.writes++
+	n.cache.invalidate(countrycurrency, date)
+}
+
+func (n *rateCacheFinal) Stats() models.RateCacheStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return models.RateCacheStats{
+		Hits:          n.hits,
+		Misses:        n.misses,
+		Evictions:     n.cache.evictions,
+		Invalidations: n.cache.invalidations,
+		Size:          n.cache.len(),
+	}
+}
+
+// warm keeps each rate, sorted by currency and date, as the rate of every date until the next rate of the same
+// currency, or until today for the last one. The most recent rates are kept last, so they are the last dropped
+// when they do not all fit.
+func (n *rateCacheFinal) warm(rates []*models.ExchangeForDate, today string) {
+	type warmed struct {
+		rate  *models.ExchangeForDate
+		until string
+	}
+	all := make([]warmed, 0, len(rates))
+	for i, r := range rates {
+		until := today
+		if i+1 < len(rates) && rates[i+1].CountryCurrencyDesc == r.CountryCurrencyDesc {
+			until = dayBefore(rates[i+1].Date)
+		}
+		if until < r.Date {
+			until = r.Date
+		}
+		all = append(all, warmed{rate: r, until: until})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].rate.Date < all[j].rate.Date })
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, w := range all {
+		n.cache.put(w.rate.CountryCurrencyDesc, w.until, w.rate)
+	}
+}
+
+// warmupSince returns the last day of the quarter before the last quarters of now, the current one included: the
+// rates effective on it are the ones in use when they began.
+func warmupSince(now time.Time, quarters int) string {
+	firstMonth := time.Month((int(now.Month())-1)/3*3 + 1)
+	start := time.Date(now.Year(), firstMonth, 1, 0, 0, 0, 0, time.UTC).AddDate(0, -3*(quarters-1), 0)
+	return start.AddDate(0, 0, -1).Format(models.DateLayout)
+}
+
+// dayBefore returns the date before date, or date itself when it is not a valid date.
+func dayBefore(date string) string {
+	d, err := time.Parse(models.DateLayout, date)
+	if err != nil {
+		return date
+	}
+	return d.AddDate(0, 0, -1).Format(models.DateLayout)
+}
@@ -0,0 +1,222 @@
+package ratecache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/persistence"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+func NewManagerForTests() (services.ServiceManager, context.Context) {
+	asyncWorkChannel := make(chan func() error)
+	stop := make(chan struct{})
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, logs.AppEnvKey, "TESTS")
+	ctx = context.WithValue(ctx, logs.AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.Version())
+	return services.NewManager(asyncWorkChannel, stop), ctx
+}
+
+// newManagerWithRates builds a manager over an in-memory database with the rates given, and a RateCache registered
+// but not started.
+func newManagerWithRates(t *testing.T, warmupQuarters int, rates ...*models.ExchangeForDate) (services.ServiceManager, context.Context, services.RateCache) {
+	t.Helper()
+	sm, ctx := NewManagerForTests()
+	cfg := models.DefaultConfig()
+	cfg.Database.Driver, cfg.RateCache.WarmupQuarters = models.DatabaseDriverMemory, warmupQuarters
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatalf("configService.Reconfigure() error = %v", err)
+	}
+	sm.WithDatabase(persistence.NewMemoryDatabase()).WithPersistenceService(persistence.NewPersistenceService())
+	if err := sm.Database().Start(ctx); err != nil {
+		t.Fatalf("Database.Start() error = %v", err)
+	}
+	if len(rates) > 0 {
+		if err := sm.PersistenceService().BatchInsertExchanges(ctx, &models.Purchase{}, rates); err != nil {
+			t.Fatalf("BatchInsertExchanges() error = %v", err)
+		}
+	}
+	cache := NewRateCache().WithServiceManager(sm)
+	sm.Register(services.RateCacheName, cache, services.PersistenceServiceName)
+	return sm, ctx, cache
+}
+
+func Test_rateCacheFinal_readThrough(t *testing.T) {
+	sm, ctx, cache := newManagerWithRates(t, 0,
+		&models.ExchangeForDate{Date: "2023-06-30", CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "4.90"},
+		&models.ExchangeForDate{Date: "2023-09-30", CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "5.00"},
+	)
+	if err := cache.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		dates     []string
+		batched   bool
+		wantRates []string
+		wantStats models.RateCacheStats
+	}{
+		{
+			name:      "firstReadMisses",
+			dates:     []string{"2023-08-15"},
+			wantRates: []string{"4.90"},
+			wantStats: models.RateCacheStats{Misses: 1, Size: 1},
+		},
+		{
+			name:      "sameRateHits",
+			dates:     []string{"2023-07-01"},
+			wantRates: []string{"4.90"},
+			wantStats: models.RateCacheStats{Hits: 1, Misses: 1, Size: 1},
+		},
+		{
+			name:      "batchedReadsOnlyTheMissing",
+			dates:     []string{"2023-08-15", "2023-10-01", "2023-10-01"},
+			batched:   true,
+			wantRates: []string{"4.90", "5.00", "5.00"},
+			wantStats: models.RateCacheStats{Hits: 2, Misses: 2, Size: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]string, len(tt.dates))
+			if tt.batched {
+				rates, err := cache.GetExchangeRatesForCountryCurrencyAndDates(ctx, "Brazil-Real", tt.dates)
+				if err != nil {
+					t.Fatalf("GetExchangeRatesForCountryCurrencyAndDates() error = %v", err)
+				}
+				for i, d := range tt.dates {
+					if r, ok := rates[d]; ok {
+						got[i] = r.ExchangeRate
+					}
+				}
+			} else {
+				for i, d := range tt.dates {
+					r, err := cache.GetExchangeRateForCountryCurrencyAndDate(ctx, "Brazil-Real", d)
+					if err != nil {
+						t.Fatalf("GetExchangeRateForCountryCurrencyAndDate() error = %v", err)
+					}
+					got[i] = r.ExchangeRate
+				}
+			}
+			for i := range got {
+				if got[i] != tt.wantRates[i] {
+					t.Errorf("rate of %s = %s, want %s", tt.dates[i], got[i], tt.wantRates[i])
+				}
+			}
+			if s := cache.Stats(); s != tt.wantStats {
+				t.Errorf("Stats() = %+v, want %+v", s, tt.wantStats)
+			}
+		})
+	}
+
+	t.Run("newRateInvalidates", func(t *testing.T) {
+		ex := &models.ExchangeForDate{Date: "2023-08-01", CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "4.95"}
+		if err := sm.PersistenceService().InsertExchange(ctx, &models.Purchase{}, ex); err != nil {
+			t.Fatalf("InsertExchange() error = %v", err)
+		}
+		r, err := cache.GetExchangeRateForCountryCurrencyAndDate(ctx, "Brazil-Real", "2023-08-15")
+		if err != nil || r.ExchangeRate != "4.95" {
+			t.Errorf("GetExchangeRateForCountryCurrencyAndDate() = %v, %v, want 4.95", r, err)
+		}
+		if s := cache.Stats(); s.Invalidations != 1 {
+			t.Errorf("Stats().Invalidations = %d, want 1", s.Invalidations)
+		}
+	})
+
+	t.Run("asOfReadsThePersistence", func(t *testing.T) {
+		before := cache.Stats()
+		r, err := cache.GetExchangeRateForCountryCurrencyAndDate(services.WithAsOf(ctx, time.Now()), "Brazil-Real", "2023-08-15")
+		if err != nil || r.ExchangeRate != "4.95" {
+			t.Errorf("GetExchangeRateForCountryCurrencyAndDate() = %v, %v, want 4.95", r, err)
+		}
+		if s := cache.Stats(); s != before {
+			t.Errorf("Stats() = %+v, want %+v", s, before)
+		}
+	})
+}
+
+func Test_rateCacheFinal_Start(t *testing.T) {
+	now := time.Now()
+	current := now.Format(models.DateLayout)
+	// a year before the first of the quarters warmed up.
+	old := now.AddDate(-2, 0, 0).Format(models.DateLayout)
+	tests := []struct {
+		name           string
+		warmupQuarters int
+		wantSize       int
+		wantHit        bool
+	}{
+		{
+			name:           "warmed",
+			warmupQuarters: 4,
+			wantSize:       1,
+			wantHit:        true,
+		},
+		{
+			name:           "noWarmup",
+			warmupQuarters: 0,
+			wantSize:       0,
+			wantHit:        false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ctx, cache := newManagerWithRates(t, tt.warmupQuarters,
+				&models.ExchangeForDate{Date: old, CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "4.90"},
+				&models.ExchangeForDate{Date: current, CountryCurrencyDesc: "Brazil-Real", ExchangeRate: "5.00"},
+			)
+			if err := cache.Start(ctx); err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			if s := cache.Stats(); s.Size != tt.wantSize {
+				t.Errorf("Stats().Size = %d, want %d", s.Size, tt.wantSize)
+			}
+			if _, err := cache.GetExchangeRateForCountryCurrencyAndDate(ctx, "Brazil-Real", current); err != nil {
+				t.Fatalf("GetExchangeRateForCountryCurrencyAndDate() error = %v", err)
+			}
+			if s := cache.Stats(); (s.Hits == 1) != tt.wantHit {
+				t.Errorf("Stats() = %+v, want a hit %v", s, tt.wantHit)
+			}
+		})
+	}
+}
+
+func Test_warmupSince(t *testing.T) {
+	tests := []struct {
+		name     string
+		now      time.Time
+		quarters int
+		want     string
+	}{
+		{
+			name:     "currentQuarterOnly",
+			now:      time.Date(2023, 8, 15, 0, 0, 0, 0, time.UTC),
+			quarters: 1,
+			want:     "2023-06-30",
+		},
+		{
+			name:     "lastYear",
+			now:      time.Date(2023, 8, 15, 0, 0, 0, 0, time.UTC),
+			quarters: 4,
+			want:     "2022-09-30",
+		},
+		{
+			name:     "firstQuarter",
+			now:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			quarters: 2,
+			want:     "2023-09-30",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := warmupSince(tt.now, tt.quarters); got != tt.want {
+				t.Errorf("warmupSince() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
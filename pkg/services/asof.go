@@ -0,0 +1,23 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+type asOfKey struct{}
+
+// WithAsOf returns a context whose exchange rate lookups answer with the rates as they were recorded at asOf, the
+// ones reported then, instead of the current ones.
+func WithAsOf(ctx context.Context, asOf time.Time) context.Context {
+	return context.WithValue(ctx, asOfKey{}, asOf)
+}
+
+// AsOf returns the time set by WithAsOf, when there is one.
+func AsOf(ctx context.Context) (time.Time, bool) {
+	if ctx == nil {
+		return time.Time{}, false
+	}
+	asOf, ok := ctx.Value(asOfKey{}).(time.Time)
+	return asOf, ok
+}
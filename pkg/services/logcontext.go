@@ -0,0 +1,76 @@
+package services
+
+import "context"
+
+// The keys of the identifiers the LogsService adds to every line logged with a context carrying them.
+const (
+	RequestIDKey  = "request_id"
+	RouteKey      = "route"
+	PurchaseIDKey = "purchase_id"
+	JobIDKey      = "job_id"
+)
+
+type (
+	// LogContext holds the identifiers of what is being handled, kept in the context by the With functions.
+	LogContext struct {
+		RequestID  string
+		Route      string
+		PurchaseID string
+		JobID      string
+	}
+
+	logContextKey struct{}
+)
+
+// LogContextFrom returns the identifiers kept in ctx, empty when there are none.
+func LogContextFrom(ctx context.Context) LogContext {
+	if ctx == nil {
+		return LogContext{}
+	}
+	lc, _ := ctx.Value(logContextKey{}).(LogContext)
+	return lc
+}
+
+// Fields lists the identifiers set as key/value pairs, in the form the LogsService methods take.
+func (lc LogContext) Fields() []any {
+	var kv []any
+	for _, f := range [...]struct{ key, value string }{
+		{RequestIDKey, lc.RequestID},
+		{RouteKey, lc.Route},
+		{PurchaseIDKey, lc.PurchaseID},
+		{JobIDKey, lc.JobID},
+	} {
+		if f.value != "" {
+			kv = append(kv, f.key, f.value)
+		}
+	}
+	return kv
+}
+
+func withLogContext(ctx context.Context, change func(lc *LogContext)) context.Context {
+	lc := LogContextFrom(ctx)
+	change(&lc)
+	return context.WithValue(ctx, logContextKey{}, lc)
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return withLogContext(ctx, func(lc *LogContext) { lc.RequestID = id })
+}
+
+func WithRoute(ctx context.Context, route string) context.Context {
+	return withLogContext(ctx, func(lc *LogContext) { lc.Route = route })
+}
+
+func WithPurchaseID(ctx context.Context, id string) context.Context {
+	return withLogContext(ctx, func(lc *LogContext) { lc.PurchaseID = id })
+}
+
+func WithJobID(ctx context.Context, id string) context.Context {
+	return withLogContext(ctx, func(lc *LogContext) { lc.JobID = id })
+}
+
+// Detach returns a context that is never canceled, carrying only the identifiers of ctx, for work that goes on
+// after the request that started it is answered.
+func Detach(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), logContextKey{}, LogContextFrom(ctx))
+}
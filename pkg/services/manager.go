@@ -3,9 +3,23 @@ package services
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -18,54 +32,230 @@ type (
 		Start(ctx context.Context) error
 		Close(ctx context.Context) error
 		Healthy(ctx context.Context) error
+		// Reconfigure is called with the new settings before ConfigService.Config() returns them. A service that
+		// cannot apply them without a restart must return an error and keep running with the settings it has.
+		Reconfigure(ctx context.Context, cfg *models.Config) error
+	}
+
+	// HealthReporter is implemented by the services that have more to report than Healthy tells, like the state
+	// of a circuit breaker. The manager uses Healthy, timing it, for the services that do not implement it.
+	HealthReporter interface {
+		Health(ctx context.Context) *models.ComponentHealth
+	}
+
+	ConfigService interface {
+		GenericService
+		WithServiceManager(sm ServiceManager) ConfigService
+		ServiceManager() ServiceManager
+		// Config returns the settings in use, the other services read their section from it.
+		Config() *models.Config
+		// Load reads and validates the settings again from their sources, without using them.
+		Load() (*models.Config, error)
 	}
 
 	LogsService interface {
 		GenericService
 		WithServiceManager(sm ServiceManager) LogsService
 		ServiceManager() ServiceManager
-		Info(ctx context.Context, s string)
-		Warn(ctx context.Context, s string)
-		Error(ctx context.Context, s string)
-		Debug(ctx context.Context, s string)
+		// Info, Warn, Error and Debug log s with the identifiers kept in ctx (see LogContext) and the key/value
+		// pairs given, like Info(ctx, "rates collected", "dates", 3).
+		Info(ctx context.Context, s string, kv ...any)
+		Warn(ctx context.Context, s string, kv ...any)
+		Error(ctx context.Context, s string, kv ...any)
+		Debug(ctx context.Context, s string, kv ...any)
+		// Level returns the lowest level logged and SetLevel changes it until the next restart, or until the
+		// level in the settings changes.
+		Level() string
+		SetLevel(level string) error
 	}
 
+	TracingService interface {
+		GenericService
+		WithServiceManager(sm ServiceManager) TracingService
+		ServiceManager() ServiceManager
+		// StartSpan starts a span named name, child of the span in ctx, exported as the tracing settings say.
+		// A nil ctx is returned as is, with a span that is not recorded.
+		StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span)
+	}
+
+	MetricsService interface {
+		GenericService
+		WithServiceManager(sm ServiceManager) MetricsService
+		ServiceManager() ServiceManager
+		// Handler serves the metrics in the Prometheus text format.
+		Handler() http.Handler
+		ObserveHttpRequest(method string, route string, status int, d time.Duration)
+		// ObserveTreasuryCall counts a call to the Treasury API, failed when err is not nil.
+		ObserveTreasuryCall(d time.Duration, err error)
+		ObserveDatabaseQuery(method string, d time.Duration)
+		// ObserveAsyncWork counts an async work done, failed when err is not nil.
+		ObserveAsyncWork(err error)
+		// ConversionFailed counts a purchase that could not be converted to countrycurrency.
+		ConversionFailed(countrycurrency string)
+		// ConversionDegraded counts a purchase converted by a stale rate, see models.StaleRatesNewest.
+		ConversionDegraded(countrycurrency string)
+		// PurchasesInserted counts the purchases created and the ones merged into an existing one.
+		PurchasesInserted(created int, deduplicated int)
+	}
+
+	// Tx is a transaction of the Database, only valid inside the WithTx that gave it. Its Context carries it, so
+	// a WithTx called with that context joins it instead of beginning another one.
+	Tx interface {
+		Context() context.Context
+	}
+
+	// UnitOfWork runs fn in one transaction: committed when fn returns nil, rolled back when it returns an error
+	// or panics. Given the context of a Tx, fn joins that transaction and only the outermost WithTx commits or
+	// rolls back.
+	UnitOfWork interface {
+		WithTx(ctx context.Context, fn func(tx Tx) error) error
+	}
+
+	// Database writes inside the Tx of a UnitOfWork, which commits them; it reads outside of it.
 	Database interface {
 		GenericService
+		UnitOfWork
 		WithServiceManager(sm ServiceManager) Database
 		ServiceManager() ServiceManager
-		BeginTransaction(ctx context.Context) (*sql.Tx, error)
-		CommitTransaction(tx *sql.Tx) error
-		RollbackTransaction(tx *sql.Tx) error
-		InsertPurchase(ctx context.Context, tx *sql.Tx, p *models.Purchase) error
-		BatchInsertExchanges(ctx context.Context, tx *sql.Tx, exchanges []*models.ExchangeForDate) error
+		// Stats returns the statistics of the connection pool.
+		Stats() sql.DBStats
+		InsertPurchase(ctx context.Context, tx Tx, p *models.Purchase) (string, bool, error)
+		BatchInsertPurchases(ctx context.Context, tx Tx, ps []*models.Purchase) ([]*models.PurchaseInsertResult, error)
+		BatchInsertExchanges(ctx context.Context, tx Tx, exchanges []*models.ExchangeForDate) error
+		// UpdatePurchase and DeletePurchase answer ErrNoPurchaseFound when there is no live purchase with the id.
+		UpdatePurchase(ctx context.Context, tx Tx, p *models.Purchase) error
+		DeletePurchase(ctx context.Context, tx Tx, id string) error
+		ListPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error)
 		GetPurchaseById(ctx context.Context, id string) (*models.Purchase, error)
+		// GetPurchaseForUpdate reads the purchase inside tx, locking it until tx ends.
+		GetPurchaseForUpdate(ctx context.Context, tx Tx, id string) (*models.Purchase, error)
 		ExistsBySignature(ctx context.Context, signature string) (bool, error)
+		// ListAllPurchases returns the live purchases, with Deduplicate set on the ones stored with their signature.
 		ListAllPurchases(ctx context.Context) ([]*models.Purchase, error)
-		InsertExchange(ctx context.Context, tx *sql.Tx, ex *models.ExchangeForDate) error
+		StreamAllPurchases(ctx context.Context, fn func(p *models.Purchase) error) error
+		InsertExchange(ctx context.Context, tx Tx, ex *models.ExchangeForDate) error
 		GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error)
+		// GetExchangeRatesForCountryCurrencyAndDates returns the rate of each date, or of the nearest earlier one,
+		// keyed by the date asked. The dates without any rate are left out.
+		GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error)
+		// ListExchangesSince returns the rates effective on date or later, sorted by currency and then by date.
+		ListExchangesSince(ctx context.Context, date string) ([]*models.ExchangeForDate, error)
+		// ListExchangeRevisions returns every rate of countrycurrency effective on date that was ingested, the
+		// oldest first. The exchange lookups of a context given by WithAsOf read these revisions.
+		ListExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error)
+		// InsertPurchaseConversion locks c, answering false when the purchase is already locked in that currency:
+		// the first lock is kept.
+		InsertPurchaseConversion(ctx context.Context, tx Tx, c *models.PurchaseConversion) (bool, error)
+		GetPurchaseConversion(ctx context.Context, id string, countrycurrency string) (*models.PurchaseConversion, error)
+		// ListPurchaseConversions returns the conversions locked in countrycurrency by purchase id.
+		ListPurchaseConversions(ctx context.Context, countrycurrency string) (map[string]*models.PurchaseConversion, error)
+		// InsertRateOverride stores o, returning its id.
+		InsertRateOverride(ctx context.Context, tx Tx, o *models.RateOverride) (int64, error)
+		// RemoveRateOverride marks the override removed at removedAt, ErrNoOverrideFound when it is not in use.
+		RemoveRateOverride(ctx context.Context, tx Tx, id int64, removedAt int64) error
+		GetRateOverride(ctx context.Context, id int64) (*models.RateOverride, error)
+		// ListRateOverrides returns the overrides of countrycurrency, or of every currency when it is empty, the
+		// removed ones too, the oldest first.
+		ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error)
+		InsertRateOverrideAudit(ctx context.Context, tx Tx, a *models.RateOverrideAudit) error
+		// ListRateOverrideAudit returns the changes made to the overrides of countrycurrency, or of every currency
+		// when it is empty, the oldest first.
+		ListRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error)
+		InsertIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (bool, error)
+		GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyKey, error)
+		UpdateIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error
+		DeleteIdempotencyKey(ctx context.Context, key string) error
+		DeleteExpiredIdempotencyKeys(ctx context.Context, now int64) (int64, error)
 	}
 
 	PersistenceService interface {
 		GenericService
 		WithServiceManager(sm ServiceManager) PersistenceService
 		ServiceManager() ServiceManager
-		InsertPurchase(ctx context.Context, p *models.Purchase) error
+		InsertPurchase(ctx context.Context, p *models.Purchase) (string, bool, error)
+		BatchInsertPurchases(ctx context.Context, ps []*models.Purchase) ([]*models.PurchaseInsertResult, error)
+		// UpdatePurchase reads the purchase and writes the one update returns from it in one transaction, so
+		// concurrent updates are applied one after the other. It returns the purchase written.
+		UpdatePurchase(ctx context.Context, id string, update func(current *models.Purchase) (*models.Purchase, error)) (*models.Purchase, error)
+		DeletePurchase(ctx context.Context, id string) error
+		ListPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error)
 		BatchInsertExchanges(ctx context.Context, p *models.Purchase, exchanges []*models.ExchangeForDate) error
 		GetPurchaseById(ctx context.Context, id string) (*models.Purchase, error)
 		ExistsBySignature(ctx context.Context, signature string) (bool, error)
 		ListAllPurchases(ctx context.Context) ([]*models.Purchase, error)
+		StreamAllPurchases(ctx context.Context, fn func(p *models.Purchase) error) error
 		GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error)
+		// GetExchangeRatesForCountryCurrencyAndDates looks up the rates of many dates at once, see Database.
+		GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error)
+		ListExchangesSince(ctx context.Context, date string) ([]*models.ExchangeForDate, error)
+		ListExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error)
 		InsertExchange(ctx context.Context, p *models.Purchase, exchange *models.ExchangeForDate) error
+		// LockConversions locks every conversion in one transaction, returning the ones stored: for a purchase
+		// already locked in the currency, the first lock.
+		LockConversions(ctx context.Context, cs []*models.PurchaseConversion) ([]*models.PurchaseConversion, error)
+		GetPurchaseConversion(ctx context.Context, id string, countrycurrency string) (*models.PurchaseConversion, error)
+		ListPurchaseConversions(ctx context.Context, countrycurrency string) (map[string]*models.PurchaseConversion, error)
+		// CreateRateOverride and RemoveRateOverride change the overrides and record the change in the audit, in
+		// one transaction.
+		CreateRateOverride(ctx context.Context, o *models.RateOverride) (*models.RateOverride, error)
+		RemoveRateOverride(ctx context.Context, id int64, actor string, reason string) (*models.RateOverride, error)
+		ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error)
+		ListRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error)
+		ReserveIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (*models.IdempotencyKey, error)
+		CompleteIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error
+		ReleaseIdempotencyKey(ctx context.Context, key string) error
+		PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error)
+	}
+
+	// RateCache reads the exchange rates through the PersistenceService, keeping them in memory since a published
+	// rate almost never changes. It is not built-in: it is registered under RateCacheName, and without it the
+	// rates are read from the PersistenceService every time.
+	RateCache interface {
+		GenericService
+		WithServiceManager(sm ServiceManager) RateCache
+		ServiceManager() ServiceManager
+		GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error)
+		GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error)
+		// Invalidate drops what was kept for the dates a new rate of countrycurrency, effective on date, may
+		// change. It is called by the PersistenceService once the rate is written.
+		Invalidate(countrycurrency string, date string)
+		// Stats returns the hits and misses counted since the start, for monitoring.
+		Stats() models.RateCacheStats
+	}
+
+	// ConsistencyChecker scans the purchases, the rates and the locked conversions for the problems the async
+	// collect and the dedup leave behind. It is not built-in: it is registered under ConsistencyCheckerName.
+	ConsistencyChecker interface {
+		GenericService
+		WithServiceManager(sm ServiceManager) ConsistencyChecker
+		ServiceManager() ServiceManager
+		// Check reports the issues found. With repair the missing rates are collected again and the duplicated
+		// purchases merged into the oldest one, the issues fixed are marked as repaired.
+		Check(ctx context.Context, repair bool) (*models.ConsistencyReport, error)
 	}
 
 	ExchangeService interface {
 		GenericService
 		WithServiceManager(sm ServiceManager) ExchangeService
 		ServiceManager() ServiceManager
-		HandleNewPurchase(ctx context.Context, p *models.Purchase) error
+		HandleNewPurchase(ctx context.Context, p *models.Purchase) (string, bool, error)
+		ImportPurchases(ctx context.Context, d PurchaseDecoder) (*models.ImportReport, error)
+		UpdatePurchase(ctx context.Context, id string, patch *models.PurchasePatch) (*models.Purchase, error)
+		DeletePurchase(ctx context.Context, id string) error
+		GetPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error)
+		GetExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error)
 		GetAllPurchases(ctx context.Context, countrycurrency string) ([]*models.ConvertedAmount, error)
+		StreamAllPurchases(ctx context.Context, countrycurrency string, fn func(c *models.ConvertedAmount) error) error
 		SearchPurchasesById(ctx context.Context, id string, countrycurrency string) (*models.ConvertedAmount, error)
+		// LockConversions converts the purchases to countrycurrency and locks the conversions, so they are the
+		// ones answered from then on.
+		LockConversions(ctx context.Context, ids []string, countrycurrency string) ([]*models.ConvertedAmount, error)
+		// CreateRateOverride sets a rate by hand for a currency and a range of purchase dates, it is used instead
+		// of the Treasury ones from then on.
+		CreateRateOverride(ctx context.Context, o *models.RateOverride) (*models.RateOverride, error)
+		RemoveRateOverride(ctx context.Context, id int64, actor string, reason string) (*models.RateOverride, error)
+		ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error)
+		GetRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error)
 		CollectExchangeRatesForPurchase(ctx context.Context, p *models.Purchase) ([]*models.ExchangeForDate, error)
 	}
 
@@ -74,8 +264,33 @@ type (
 		WithServiceManager(sm ServiceManager) HttpService
 		ServiceManager() ServiceManager
 		PostPurchase(c *gin.Context)
+		ImportPurchases(c *gin.Context)
 		GetPurchaseById(c *gin.Context)
 		GetAllPurchases(c *gin.Context)
+		UpdatePurchase(c *gin.Context)
+		PatchPurchase(c *gin.Context)
+		DeletePurchase(c *gin.Context)
+		GetPurchaseHistory(c *gin.Context)
+		GetExchangeRevisions(c *gin.Context)
+		LockConversions(c *gin.Context)
+		CreateRateOverride(c *gin.Context)
+		ListRateOverrides(c *gin.Context)
+		RemoveRateOverride(c *gin.Context)
+		GetRateOverrideAudit(c *gin.Context)
+		CheckConsistency(c *gin.Context)
+		RepairConsistency(c *gin.Context)
+		Liveness(c *gin.Context)
+		Readiness(c *gin.Context)
+		ReloadConfig(c *gin.Context)
+		Metrics(c *gin.Context)
+		GetLogLevel(c *gin.Context)
+		SetLogLevel(c *gin.Context)
+	}
+
+	PurchaseDecoder interface {
+		// Next returns the next row read, or io.EOF when there are no more rows. Any other error means the
+		// rest of the input cannot be read, rows that are just invalid are returned with ImportRow.Err set.
+		Next() (*models.ImportRow, error)
 	}
 
 	TreasuryAccessService interface {
@@ -88,8 +303,14 @@ type (
 
 	ServiceManager interface {
 		GenericService
+		WithConfigService(c ConfigService) ServiceManager
+		ConfigService() ConfigService
 		WithLogsService(ls LogsService) ServiceManager
 		LogsService() LogsService
+		WithTracingService(t TracingService) ServiceManager
+		TracingService() TracingService
+		WithMetricsService(ms MetricsService) ServiceManager
+		MetricsService() MetricsService
 		WithDatabase(db Database) ServiceManager
 		Database() Database
 		WithPersistenceService(p PersistenceService) ServiceManager
@@ -101,10 +322,29 @@ type (
 		WithHttpService(h HttpService) ServiceManager
 		HttpService() HttpService
 		AsyncWorkChannel() chan func() error
+		// SubmitAsyncWork runs w in the background with a context that outlives ctx but keeps its identifiers,
+		// like the request ID, plus a job ID, so the lines logged by w can be traced to the request.
+		SubmitAsyncWork(ctx context.Context, w func(ctx context.Context) error)
+		// AsyncQueueDepth returns how many async works were submitted and are not finished yet.
+		AsyncQueueDepth() int64
+		Run(ctx context.Context) error
+		// Register plugs s in under name, started after the services it depends on and closed before them.
+		// Registering a name again replaces the service. The built-in services are registered by NewManager.
+		Register(name string, s GenericService, dependsOn ...string) ServiceManager
+		// Lookup returns the service registered under name, see Get for a typed one.
+		Lookup(name string) (GenericService, bool)
+		// Reload loads the settings again and reconfigures every service with them, see Reconfigure.
+		Reload(ctx context.Context) error
+		// HealthReport checks every service when readiness is true, or only the ones running inside the process
+		// (the config, the logs, the async worker and the http server) for a liveness check.
+		HealthReport(ctx context.Context, readiness bool) *models.HealthReport
 	}
 
 	serviceManagerFinal struct {
+		configService         ConfigService
 		logsService           LogsService
+		tracingService        TracingService
+		metricsService        MetricsService
 		asyncWorkChannel      chan func() error
 		stop                  chan struct{}
 		database              Database
@@ -112,12 +352,33 @@ type (
 		exchangeService       ExchangeService
 		treasuryAccessService TreasuryAccessService
 		httpService           HttpService
+		asyncWork             sync.WaitGroup
+		asyncWorkPending      atomic.Int64
+		stopOnce              sync.Once
+		worker                *asyncWorker
+		started               []GenericService
+		reconfigureMu         sync.Mutex
+		registryMu            sync.RWMutex
+		registry              map[string]*component
+		registered            []string // the names in the order they were registered
+	}
+
+	// asyncWorker runs the work sent to the asyncWorkChannel. It is started and closed by the manager like any
+	// other service, right before the HttpService, so it is drained once no more requests can submit work.
+	asyncWorker struct {
+		m       *serviceManagerFinal
+		stopped atomic.Bool
+		mu      sync.Mutex // guards closed, so no work is added to the asyncWork while Close waits for it
+		closed  bool
 	}
 )
 
 func NewManager(asyncWorkChannel chan func() error, stop chan struct{}) ServiceManager {
-	return &serviceManagerFinal{
+	m := &serviceManagerFinal{
+		configService:         NewNoOpsConfigService(),
 		logsService:           NewNoOpsLogsService(),
+		tracingService:        NewNoOpsTracingService(),
+		metricsService:        NewNoOpsMetricsService(),
 		asyncWorkChannel:      asyncWorkChannel,
 		stop:                  stop,
 		database:              NewNoOpsDatabase(),
@@ -125,80 +386,197 @@ func NewManager(asyncWorkChannel chan func() error, stop chan struct{}) ServiceM
 		exchangeService:       NewNoOpsExchangeService(),
 		treasuryAccessService: NewNoOpsTreasuryAccessService(),
 		httpService:           NewNoOpsHttpService(),
+		registry:              make(map[string]*component),
 	}
+	m.worker = &asyncWorker{m: m}
+	for _, c := range []*component{
+		{name: ConfigServiceName, service: m.configService, liveness: true},
+		{name: LogsServiceName, service: m.logsService, dependsOn: []string{ConfigServiceName}, liveness: true},
+		{name: TracingServiceName, service: m.tracingService, dependsOn: []string{ConfigServiceName, LogsServiceName}},
+		{name: MetricsServiceName, service: m.metricsService, dependsOn: []string{ConfigServiceName, LogsServiceName}},
+		{name: DatabaseName, service: m.database, dependsOn: []string{ConfigServiceName, LogsServiceName, TracingServiceName, MetricsServiceName}},
+		{name: PersistenceServiceName, service: m.persistenceService, dependsOn: []string{DatabaseName}},
+		{name: TreasuryAccessServiceName, service: m.treasuryAccessService, dependsOn: []string{ConfigServiceName, LogsServiceName, TracingServiceName, MetricsServiceName}},
+		{name: ExchangeServiceName, service: m.exchangeService, dependsOn: []string{PersistenceServiceName, TreasuryAccessServiceName}},
+		{name: AsyncWorkerName, service: m.worker, liveness: true, entryPoint: true},
+		{name: HttpServiceName, service: m.httpService, dependsOn: []string{AsyncWorkerName}, liveness: true, entryPoint: true},
+	} {
+		m.register(c)
+	}
+	return m
 }
 
-func (m *serviceManagerFinal) Start(ctx context.Context) error {
-	if err := m.logsService.Start(ctx); err != nil {
-		return err
+// components lists the services in dependency order, each one only uses the ones before it. When the
+// dependencies are broken, and so Start fails, they are listed in the order they were registered.
+func (m *serviceManagerFinal) components() []*component {
+	ordered, err := m.order()
+	if err != nil {
+		m.registryMu.RLock()
+		defer m.registryMu.RUnlock()
+		ordered = make([]*component, 0, len(m.registered))
+		for _, name := range m.registered {
+			ordered = append(ordered, m.registry[name])
+		}
 	}
+	return ordered
+}
 
-	if err := m.database.Start(ctx); err != nil {
+// Start starts the services in dependency order and returns as soon as all of them are running.
+func (m *serviceManagerFinal) Start(ctx context.Context) error {
+	m.started = nil
+	ordered, err := m.order()
+	if err != nil {
 		m.logsService.Error(ctx, err.Error())
 		return err
 	}
-
-	if err := m.persistenceService.Start(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
-		return err
+	for _, c := range ordered {
+		if err := c.service.Start(ctx); err != nil {
+			m.logsService.Error(ctx, err.Error())
+			return err
+		}
+		m.started = append(m.started, c.service)
 	}
+	return nil
+}
 
-	if err := m.exchangeService.Start(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
-		return err
+// Close closes the started services in the reverse order they were started, so each one is closed only after
+// every service that depends on it. It goes on when a service fails to close and returns all the errors joined.
+func (m *serviceManagerFinal) Close(ctx context.Context) error {
+	var errs []error
+	for i := len(m.started) - 1; i >= 0; i-- {
+		if err := m.started[i].Close(ctx); err != nil {
+			m.logsService.Error(ctx, err.Error())
+			errs = append(errs, err)
+		}
 	}
+	m.started = nil
+	return errors.Join(errs...)
+}
 
-	if err := m.treasuryAccessService.Start(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
-		return err
+// Run starts every service, waits for SIGINT, SIGTERM or ctx to be done, and then closes them all.
+// A SIGHUP reloads the settings in the meantime.
+func (m *serviceManagerFinal) Run(ctx context.Context) error {
+	signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// read only when closing, the ConfigService is not started before.
+	closeCtx := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), m.configService.Config().App.ShutdownTimeout)
 	}
-
-	if err := m.httpService.Start(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
-		return err
+	if err := m.Start(ctx); err != nil {
+		cctx, cancel := closeCtx()
+		defer cancel()
+		return errors.Join(err, m.Close(cctx))
 	}
 
-	return nil
+	for running := true; running; {
+		select {
+		case <-hup:
+			if err := m.Reload(ctx); err != nil {
+				m.logsService.Error(ctx, fmt.Sprintf("configuration not reloaded: %s", err.Error()))
+			}
+		case <-signalCtx.Done():
+			running = false
+		}
+	}
+	m.logsService.Info(ctx, "shutting down ...")
+	cctx, cancel := closeCtx()
+	defer cancel()
+	return m.Close(cctx)
 }
 
-func (m *serviceManagerFinal) Close(ctx context.Context) error {
-	if err := m.logsService.Close(ctx); err != nil {
+func (m *serviceManagerFinal) Reload(ctx context.Context) error {
+	cfg, err := m.configService.Load()
+	if err != nil {
 		return err
 	}
-
-	if err := m.persistenceService.Close(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
+	if err := m.Reconfigure(ctx, cfg); err != nil {
 		return err
 	}
+	m.logsService.Info(ctx, "configuration reloaded")
+	return nil
+}
 
-	if err := m.httpService.Close(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
-		return err
+// Reconfigure gives cfg to every service, and to the ConfigService last so Config() only returns cfg once all
+// the others took it. It is all or nothing: when a service rejects cfg, the ones that already took it get the
+// settings in use back and the error is returned.
+func (m *serviceManagerFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	m.reconfigureMu.Lock()
+	defer m.reconfigureMu.Unlock()
+	current := m.configService.Config()
+	var order []*component
+	for _, c := range m.components() {
+		if c.service != m.configService {
+			order = append(order, c)
+		}
+	}
+	order = append(order, &component{name: ConfigServiceName, service: m.configService})
+
+	for i, c := range order {
+		if err := c.service.Reconfigure(ctx, cfg); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if rerr := order[j].service.Reconfigure(ctx, current); rerr != nil {
+					m.logsService.Error(ctx, fmt.Sprintf("%s could not get its settings back: %s", order[j].name, rerr.Error()))
+				}
+			}
+			return fmt.Errorf("%w by %s: %s", messages.ErrConfigRejected, c.name, err.Error())
+		}
 	}
-
 	return nil
 }
 
 func (m *serviceManagerFinal) Healthy(ctx context.Context) error {
-	if err := m.logsService.Healthy(ctx); err != nil {
-		return err
+	report := m.HealthReport(ctx, true)
+	if report.Status != models.HealthDown {
+		return nil
+	}
+	var errs []error
+	for _, c := range report.Components {
+		if c.Status == models.HealthDown {
+			errs = append(errs, fmt.Errorf("%s is down: %s", c.Name, c.Error))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	if err := m.persistenceService.Healthy(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
-		return err
+func (m *serviceManagerFinal) HealthReport(ctx context.Context, readiness bool) *models.HealthReport {
+	var components []*models.ComponentHealth
+	for _, c := range m.components() {
+		if !readiness && !c.liveness {
+			continue
+		}
+		components = append(components, componentHealth(ctx, c))
 	}
+	return models.NewHealthReport(components)
+}
 
-	if err := m.httpService.Healthy(ctx); err != nil {
-		m.logsService.Error(ctx, err.Error())
-		return err
+func componentHealth(ctx context.Context, c *component) *models.ComponentHealth {
+	if r, ok := c.service.(HealthReporter); ok {
+		h := r.Health(ctx)
+		h.Name = c.name
+		return h
 	}
+	start := time.Now()
+	err := c.service.Healthy(ctx)
+	return models.NewComponentHealth(c.name, time.Since(start), err)
+}
 
-	return nil
+func (m *serviceManagerFinal) WithConfigService(c ConfigService) ServiceManager {
+	m.configService = c.WithServiceManager(m)
+	m.replace(ConfigServiceName, m.configService)
+	return m
+}
+
+func (m *serviceManagerFinal) ConfigService() ConfigService {
+	return m.configService
 }
 
 func (m *serviceManagerFinal) WithLogsService(ls LogsService) ServiceManager {
 	m.logsService = ls.WithServiceManager(m)
+	m.replace(LogsServiceName, m.logsService)
 	return m
 }
 
@@ -206,8 +584,29 @@ func (m *serviceManagerFinal) LogsService() LogsService {
 	return m.logsService
 }
 
+func (m *serviceManagerFinal) WithTracingService(t TracingService) ServiceManager {
+	m.tracingService = t.WithServiceManager(m)
+	m.replace(TracingServiceName, m.tracingService)
+	return m
+}
+
+func (m *serviceManagerFinal) TracingService() TracingService {
+	return m.tracingService
+}
+
+func (m *serviceManagerFinal) WithMetricsService(ms MetricsService) ServiceManager {
+	m.metricsService = ms.WithServiceManager(m)
+	m.replace(MetricsServiceName, m.metricsService)
+	return m
+}
+
+func (m *serviceManagerFinal) MetricsService() MetricsService {
+	return m.metricsService
+}
+
 func (m *serviceManagerFinal) WithHttpService(h HttpService) ServiceManager {
 	m.httpService = h.WithServiceManager(m)
+	m.replace(HttpServiceName, m.httpService)
 	return m
 }
 
@@ -217,6 +616,7 @@ func (m *serviceManagerFinal) HttpService() HttpService {
 
 func (m *serviceManagerFinal) WithPersistenceService(p PersistenceService) ServiceManager {
 	m.persistenceService = p.WithServiceManager(m)
+	m.replace(PersistenceServiceName, m.persistenceService)
 	return m
 }
 
@@ -226,6 +626,7 @@ func (m *serviceManagerFinal) PersistenceService() PersistenceService {
 
 func (m *serviceManagerFinal) WithDatabase(db Database) ServiceManager {
 	m.database = db.WithServiceManager(m)
+	m.replace(DatabaseName, m.database)
 	return m
 }
 
@@ -235,6 +636,7 @@ func (m *serviceManagerFinal) Database() Database {
 
 func (m *serviceManagerFinal) WithExchangeService(p ExchangeService) ServiceManager {
 	m.exchangeService = p.WithServiceManager(m)
+	m.replace(ExchangeServiceName, m.exchangeService)
 	return m
 }
 func (m *serviceManagerFinal) ExchangeService() ExchangeService {
@@ -243,6 +645,7 @@ func (m *serviceManagerFinal) ExchangeService() ExchangeService {
 
 func (m *serviceManagerFinal) WithTreasuryAccessService(p TreasuryAccessService) ServiceManager {
 	m.treasuryAccessService = p.WithServiceManager(m)
+	m.replace(TreasuryAccessServiceName, m.treasuryAccessService)
 	return m
 }
 func (m *serviceManagerFinal) TreasuryAccessService() TreasuryAccessService {
@@ -252,3 +655,133 @@ func (m *serviceManagerFinal) TreasuryAccessService() TreasuryAccessService {
 func (m *serviceManagerFinal) AsyncWorkChannel() chan func() error {
 	return m.asyncWorkChannel
 }
+
+// SubmitAsyncWork sends w to the async worker without blocking the caller. Close waits for every work submitted,
+// and the work submitted once the worker is closed is dropped with a warning. A failure is logged here, with the
+// context of the work, and not by the worker. The work has its own trace, linked to the span of ctx, since it
+// usually ends after the request that submitted it.
+func (m *serviceManagerFinal) SubmitAsyncWork(ctx context.Context, w func(ctx context.Context) error) {
+	jobCtx := WithJobID(Detach(ctx), uuid.NewString())
+	link := trace.LinkFromContext(ctx)
+	if !m.worker.accept() {
+		m.logsService.Warn(jobCtx, "async work dropped, the async worker is closed")
+		return
+	}
+	m.asyncWorkPending.Add(1)
+	m.logsService.Debug(jobCtx, "async work submitted")
+	done := func() {
+		m.asyncWorkPending.Add(-1)
+		m.asyncWork.Done()
+	}
+	work := func() error {
+		defer done()
+		select {
+		case <-m.stop: // the worker stopped, after a shutdown timeout, before taking the work
+			m.logsService.Warn(jobCtx, "async work dropped, the async worker is closed")
+			return nil
+		default:
+		}
+		ctx, span := m.tracingService.StartSpan(jobCtx, "async work", trace.WithLinks(link),
+			trace.WithAttributes(attribute.String(JobIDKey, LogContextFrom(jobCtx).JobID)))
+		defer span.End()
+		err := w(ctx)
+		m.metricsService.ObserveAsyncWork(err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			m.logsService.Warn(ctx, "an async work failed", "error", err.Error())
+		}
+		return nil
+	}
+	go func() {
+		select {
+		case m.asyncWorkChannel <- work:
+		case <-m.stop: // no worker takes the work anymore
+			done()
+			m.logsService.Warn(jobCtx, "async work dropped, the async worker is closed")
+		}
+	}()
+}
+
+func (m *serviceManagerFinal) AsyncQueueDepth() int64 {
+	return m.asyncWorkPending.Load()
+}
+
+func (w *asyncWorker) Start(ctx context.Context) error {
+	if w.m.asyncWorkChannel == nil {
+		return nil
+	}
+	w.stopped.Store(false)
+	w.mu.Lock()
+	w.closed = false
+	w.mu.Unlock()
+	go func() {
+		for {
+			select {
+			case work := <-w.m.asyncWorkChannel:
+				if err := work(); err != nil {
+					w.m.logsService.Warn(ctx, fmt.Sprintf("an async work failed: %s", err.Error()))
+				}
+			case <-w.m.stop: // triggered when the stop channel is closed
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close waits for the async work already submitted, until ctx is done, and then stops the worker.
+func (w *asyncWorker) Close(ctx context.Context) error {
+	if w.m.asyncWorkChannel == nil {
+		return nil
+	}
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		w.m.asyncWork.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("async work not finished before the shutdown timeout: %w", ctx.Err())
+	}
+	if w.m.stop != nil {
+		w.m.stopOnce.Do(func() { close(w.m.stop) })
+	}
+	w.stopped.Store(true)
+	return err
+}
+
+// accept adds a work to the asyncWork, unless the worker is closed.
+func (w *asyncWorker) accept() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false
+	}
+	w.m.asyncWork.Add(1)
+	return true
+}
+
+func (w *asyncWorker) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func (w *asyncWorker) Healthy(ctx context.Context) error {
+	if w.stopped.Load() {
+		return errors.New("async worker stopped")
+	}
+	return nil
+}
+
+// Health reports the queue depth: the work submitted and not finished yet.
+func (w *asyncWorker) Health(ctx context.Context) *models.ComponentHealth {
+	h := models.NewComponentHealth("", 0, w.Healthy(ctx))
+	h.Details = map[string]any{"queue_depth": w.m.AsyncQueueDepth()}
+	return h
+}
@@ -2,10 +2,115 @@ package services
 
 import (
 	"context"
+	"errors"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	closeRecorder struct {
+		name   string
+		closed *[]string
+		err    error
+	}
+
+	recordingDatabase struct {
+		Database
+		closeRecorder
+	}
+
+	recordingPersistenceService struct {
+		PersistenceService
+		closeRecorder
+	}
+
+	recordingHttpService struct {
+		HttpService
+		closeRecorder
+	}
+
+	unhealthyDatabase struct {
+		Database
+	}
+
+	degradedTreasuryAccessService struct {
+		TreasuryAccessService
+	}
+
+	reconfigureRecorder struct {
+		PersistenceService
+		got []*models.Config
+	}
+
+	rejectingHttpService struct {
+		HttpService
+	}
 )
 
+func (r closeRecorder) close() error {
+	*r.closed = append(*r.closed, r.name)
+	return r.err
+}
+
+func (d *recordingDatabase) Close(ctx context.Context) error { return d.close() }
+func (d *recordingDatabase) WithServiceManager(sm ServiceManager) Database {
+	d.Database.WithServiceManager(sm)
+	return d
+}
+
+func (p *recordingPersistenceService) Close(ctx context.Context) error { return p.close() }
+func (p *recordingPersistenceService) WithServiceManager(sm ServiceManager) PersistenceService {
+	p.PersistenceService.WithServiceManager(sm)
+	return p
+}
+
+func (h *recordingHttpService) Close(ctx context.Context) error { return h.close() }
+func (h *recordingHttpService) WithServiceManager(sm ServiceManager) HttpService {
+	h.HttpService.WithServiceManager(sm)
+	return h
+}
+
+func (d *unhealthyDatabase) Healthy(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+func (d *unhealthyDatabase) WithServiceManager(sm ServiceManager) Database {
+	d.Database.WithServiceManager(sm)
+	return d
+}
+
+func (t *degradedTreasuryAccessService) Health(ctx context.Context) *models.ComponentHealth {
+	return &models.ComponentHealth{Status: models.HealthDegraded, Details: map[string]any{"circuit": "open"}}
+}
+func (t *degradedTreasuryAccessService) WithServiceManager(sm ServiceManager) TreasuryAccessService {
+	t.TreasuryAccessService.WithServiceManager(sm)
+	return t
+}
+
+func (p *reconfigureRecorder) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	p.got = append(p.got, cfg)
+	return nil
+}
+func (p *reconfigureRecorder) WithServiceManager(sm ServiceManager) PersistenceService {
+	p.PersistenceService.WithServiceManager(sm)
+	return p
+}
+
+func (h *rejectingHttpService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return errors.New("cannot change")
+}
+func (h *rejectingHttpService) WithServiceManager(sm ServiceManager) HttpService {
+	h.HttpService.WithServiceManager(sm)
+	return h
+}
+
 func TestNewManager(t *testing.T) {
 	type args struct {
 		asyncWorkChannel chan func() error
@@ -380,3 +485,307 @@ func okServiceManager(m1 ServiceManager) bool {
 		m1T.logsService != nil &&
 		m1T.persistenceService != nil
 }
+
+func Test_serviceManagerFinal_CloseOrderAndErrors(t *testing.T) {
+	ctx := context.Background()
+	var closed []string
+	errPersistence := errors.New("persistence close error")
+	errDatabase := errors.New("database close error")
+	sm := NewManager(make(chan func() error), make(chan struct{})).
+		WithDatabase(&recordingDatabase{NewNoOpsDatabase(), closeRecorder{"database", &closed, errDatabase}}).
+		WithPersistenceService(&recordingPersistenceService{NewNoOpsPersistenceService(), closeRecorder{"persistence", &closed, errPersistence}}).
+		WithHttpService(&recordingHttpService{NewNoOpsHttpService(), closeRecorder{"http", &closed, nil}})
+
+	if err := sm.Start(ctx); err != nil {
+		t.Fatalf("serviceManagerFinal.Start() error = %v", err)
+	}
+	err := sm.Close(ctx)
+	if !errors.Is(err, errPersistence) || !errors.Is(err, errDatabase) {
+		t.Errorf("serviceManagerFinal.Close() error = %v, want both %v and %v", err, errPersistence, errDatabase)
+	}
+	if want := []string{"http", "persistence", "database"}; !reflect.DeepEqual(closed, want) {
+		t.Errorf("serviceManagerFinal.Close() closed %v, want %v", closed, want)
+	}
+}
+
+func Test_serviceManagerFinal_CloseDrainsAsyncWork(t *testing.T) {
+	tests := []struct {
+		name     string
+		work     time.Duration
+		timeout  time.Duration
+		wantDone bool
+		wantErr  bool
+	}{
+		{
+			name:     "drained",
+			work:     50 * time.Millisecond,
+			timeout:  time.Second,
+			wantDone: true,
+			wantErr:  false,
+		},
+		{
+			name:     "timedOut",
+			work:     time.Second,
+			timeout:  50 * time.Millisecond,
+			wantDone: false,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := NewManager(make(chan func() error), make(chan struct{}))
+			if err := sm.Start(context.Background()); err != nil {
+				t.Fatalf("serviceManagerFinal.Start() error = %v", err)
+			}
+			var done atomic.Bool
+			sm.SubmitAsyncWork(context.Background(), func(ctx context.Context) error {
+				time.Sleep(tt.work)
+				done.Store(true)
+				return nil
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			if err := sm.Close(ctx); (err != nil) != tt.wantErr {
+				t.Errorf("serviceManagerFinal.Close() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if done.Load() != tt.wantDone {
+				t.Errorf("serviceManagerFinal.Close() async work done = %v, want %v", done.Load(), tt.wantDone)
+			}
+		})
+	}
+}
+
+// recordingTracingService starts recorded spans, kept by its recorder once ended.
+type recordingTracingService struct {
+	TracingService
+	tracer   trace.Tracer
+	recorder *tracetest.SpanRecorder
+}
+
+func newRecordingTracingService() *recordingTracingService {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return &recordingTracingService{NewNoOpsTracingService(), provider.Tracer("tests"), recorder}
+}
+
+func (r *recordingTracingService) WithServiceManager(sm ServiceManager) TracingService {
+	r.TracingService.WithServiceManager(sm)
+	return r
+}
+
+func (r *recordingTracingService) StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return r.tracer.Start(ctx, name, opts...)
+}
+
+func Test_serviceManagerFinal_SubmitAsyncWorkAfterClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		busy        time.Duration
+		closeBefore bool
+		wantErr     bool
+	}{
+		{
+			name:        "submittedOnceClosed",
+			closeBefore: true,
+			wantErr:     false,
+		},
+		{
+			name:        "neverTakenByTheBusyWorker",
+			busy:        200 * time.Millisecond,
+			closeBefore: false,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := NewManager(make(chan func() error), make(chan struct{}))
+			if err := sm.Start(context.Background()); err != nil {
+				t.Fatalf("serviceManagerFinal.Start() error = %v", err)
+			}
+			if tt.busy > 0 {
+				busy := make(chan struct{})
+				sm.SubmitAsyncWork(context.Background(), func(ctx context.Context) error {
+					close(busy)
+					time.Sleep(tt.busy)
+					return nil
+				})
+				<-busy
+			}
+			closeManager := func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				return sm.Close(ctx)
+			}
+			var err error
+			if tt.closeBefore {
+				err = closeManager()
+			}
+			var ran atomic.Bool
+			sm.SubmitAsyncWork(context.Background(), func(ctx context.Context) error {
+				ran.Store(true)
+				return nil
+			})
+			if !tt.closeBefore {
+				err = closeManager()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("serviceManagerFinal.Close() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// the dropped work is no longer pending, and is never run
+			deadline := time.Now().Add(time.Second)
+			for sm.AsyncQueueDepth() != 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if depth := sm.AsyncQueueDepth(); depth != 0 {
+				t.Errorf("serviceManagerFinal.AsyncQueueDepth() = %d, want 0", depth)
+			}
+			if ran.Load() {
+				t.Errorf("serviceManagerFinal.SubmitAsyncWork() ran the work submitted to a closed worker")
+			}
+		})
+	}
+}
+
+func Test_serviceManagerFinal_SubmitAsyncWork(t *testing.T) {
+	tracing := newRecordingTracingService()
+	sm := NewManager(make(chan func() error), make(chan struct{})).WithTracingService(tracing)
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("serviceManagerFinal.Start() error = %v", err)
+	}
+	requestCtx, request := tracing.StartSpan(WithRequestID(context.Background(), "req-1"), "request")
+	requestCtx, cancel := context.WithCancel(requestCtx)
+	got := make(chan context.Context, 1)
+	sm.SubmitAsyncWork(requestCtx, func(ctx context.Context) error {
+		got <- ctx
+		return nil
+	})
+	cancel() // the request is answered before the work runs
+	if err := sm.Close(context.Background()); err != nil {
+		t.Fatalf("serviceManagerFinal.Close() error = %v", err)
+	}
+
+	ctx := <-got
+	lc := LogContextFrom(ctx)
+	if lc.RequestID != "req-1" || lc.JobID == "" {
+		t.Errorf("serviceManagerFinal.SubmitAsyncWork() log context = %+v, want request req-1 and a job ID", lc)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("serviceManagerFinal.SubmitAsyncWork() context error = %v, want none", ctx.Err())
+	}
+	job := trace.SpanFromContext(ctx).(sdktrace.ReadOnlySpan)
+	if job.Parent().IsValid() || len(job.Links()) != 1 || !job.Links()[0].SpanContext.Equal(request.SpanContext()) {
+		t.Errorf("serviceManagerFinal.SubmitAsyncWork() span parent %v and links %v, want a new trace linked to the request", job.Parent(), job.Links())
+	}
+}
+
+func Test_serviceManagerFinal_HealthReport(t *testing.T) {
+	tests := []struct {
+		name           string
+		sm             ServiceManager
+		readiness      bool
+		wantStatus     string
+		wantComponents int
+		wantErr        bool
+	}{
+		{
+			name:           "liveness",
+			sm:             NewManager(nil, nil).WithDatabase(&unhealthyDatabase{NewNoOpsDatabase()}),
+			readiness:      false,
+			wantStatus:     models.HealthUp,
+			wantComponents: 4,
+			wantErr:        true,
+		},
+		{
+			name:           "readinessUp",
+			sm:             NewManager(nil, nil),
+			readiness:      true,
+			wantStatus:     models.HealthUp,
+			wantComponents: 10,
+			wantErr:        false,
+		},
+		{
+			name:           "readinessDegraded",
+			sm:             NewManager(nil, nil).WithTreasuryAccessService(&degradedTreasuryAccessService{NewNoOpsTreasuryAccessService()}),
+			readiness:      true,
+			wantStatus:     models.HealthDegraded,
+			wantComponents: 10,
+			wantErr:        false,
+		},
+		{
+			name:           "readinessDown",
+			sm:             NewManager(nil, nil).WithDatabase(&unhealthyDatabase{NewNoOpsDatabase()}),
+			readiness:      true,
+			wantStatus:     models.HealthDown,
+			wantComponents: 10,
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.sm.HealthReport(context.Background(), tt.readiness)
+			if got.Status != tt.wantStatus {
+				t.Errorf("serviceManagerFinal.HealthReport() status = %s, want %s", got.Status, tt.wantStatus)
+			}
+			if len(got.Components) != tt.wantComponents {
+				t.Errorf("serviceManagerFinal.HealthReport() components = %d, want %d", len(got.Components), tt.wantComponents)
+			}
+			if err := tt.sm.Healthy(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("serviceManagerFinal.Healthy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_serviceManagerFinal_Reconfigure(t *testing.T) {
+	tests := []struct {
+		name    string
+		http    HttpService
+		wantGot int
+		wantErr bool
+	}{
+		{
+			name:    "applied",
+			http:    NewNoOpsHttpService(),
+			wantGot: 1,
+			wantErr: false,
+		},
+		{
+			name:    "rejectedAndRolledBack",
+			http:    &rejectingHttpService{NewNoOpsHttpService()},
+			wantGot: 2,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &reconfigureRecorder{PersistenceService: NewNoOpsPersistenceService()}
+			sm := NewManager(nil, nil).WithPersistenceService(recorder).WithHttpService(tt.http)
+			current := sm.ConfigService().Config()
+			cfg := models.DefaultConfig()
+			cfg.App.LogLevel = "debug"
+
+			err := sm.Reconfigure(context.Background(), cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("serviceManagerFinal.Reconfigure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(recorder.got) != tt.wantGot || recorder.got[0] != cfg {
+				t.Fatalf("serviceManagerFinal.Reconfigure() persistence got %d configs, want %d starting with the new one", len(recorder.got), tt.wantGot)
+			}
+			want := cfg
+			if tt.wantErr {
+				want = current
+				if !errors.Is(err, messages.ErrConfigRejected) {
+					t.Errorf("serviceManagerFinal.Reconfigure() error = %v, want %v", err, messages.ErrConfigRejected)
+				}
+				if recorder.got[1] != current {
+					t.Errorf("serviceManagerFinal.Reconfigure() persistence did not get the settings in use back")
+				}
+			}
+			if got := sm.ConfigService().Config(); got != want {
+				t.Errorf("serviceManagerFinal.ConfigService().Config() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+type (
+	noOpsConfigService struct {
+		sm     ServiceManager
+		config *models.Config
+	}
+)
+
+func NewNoOpsConfigService() ConfigService {
+	return &noOpsConfigService{config: models.DefaultConfig()}
+}
+
+func (n *noOpsConfigService) Start(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsConfigService) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsConfigService) Healthy(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsConfigService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	n.config = cfg
+	return nil
+}
+
+func (n *noOpsConfigService) WithServiceManager(sm ServiceManager) ConfigService {
+	n.sm = sm
+	return n
+}
+
+func (n *noOpsConfigService) ServiceManager() ServiceManager {
+	return n.sm
+}
+
+func (n *noOpsConfigService) Config() *models.Config {
+	return n.config
+}
+
+func (n *noOpsConfigService) Load() (*models.Config, error) {
+	return models.DefaultConfig(), nil
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+type (
+	noOpsConsistencyChecker struct {
+		sm ServiceManager
+	}
+)
+
+func NewNoOpsConsistencyChecker() ConsistencyChecker {
+	return &noOpsConsistencyChecker{}
+}
+
+func (n *noOpsConsistencyChecker) Start(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsConsistencyChecker) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsConsistencyChecker) Healthy(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsConsistencyChecker) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func (n *noOpsConsistencyChecker) WithServiceManager(sm ServiceManager) ConsistencyChecker {
+	n.sm = sm
+	return n
+}
+
+func (n *noOpsConsistencyChecker) ServiceManager() ServiceManager {
+	return n.sm
+}
+
+func (n *noOpsConsistencyChecker) Check(ctx context.Context, repair bool) (*models.ConsistencyReport, error) {
+	report := &models.ConsistencyReport{
+		Purchases:  1,
+		Currencies: []string{"Brazil-Real"},
+		Repair:     repair,
+		Issues: []*models.ConsistencyIssue{
+			{Kind: models.IssueMissingRate, PurchaseId: "p-1", CountryCurrencyDesc: "Brazil-Real", Detail: "no rate", Repaired: repair},
+		},
+	}
+	if repair {
+		report.Repaired = 1
+	}
+	return report, nil
+}
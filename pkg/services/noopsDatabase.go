@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 )
 
@@ -12,6 +13,10 @@ type (
 	noOpsDatabase struct {
 		sm ServiceManager
 	}
+
+	noOpsTx struct {
+		ctx context.Context
+	}
 )
 
 func NewNoOpsDatabase() Database {
@@ -30,6 +35,10 @@ func (n *noOpsDatabase) Healthy(ctx context.Context) error {
 	return nil
 }
 
+func (n *noOpsDatabase) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
 func (n *noOpsDatabase) WithServiceManager(sm ServiceManager) Database {
 	n.sm = sm
 	return n
@@ -39,34 +48,31 @@ func (n *noOpsDatabase) ServiceManager() ServiceManager {
 	return n.sm
 }
 
-func (n *noOpsDatabase) BeginTransaction(ctx context.Context) (*sql.Tx, error) {
-	if ctx != nil {
-		if ctx.Value("error") != nil {
-			return nil, errors.New("some error")
-		}
-		return &sql.Tx{}, nil
-	}
-	return nil, nil
+func (n *noOpsDatabase) Stats() sql.DBStats {
+	return sql.DBStats{}
 }
-func (n *noOpsDatabase) CommitTransaction(tx *sql.Tx) error {
-	if tx != nil {
-		return nil
+
+// WithTx runs fn with a Tx of the context given, failing with an "error" value in ctx like the other NoOps.
+func (n *noOpsDatabase) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	if ctx == nil || ctx.Value("error") != nil {
+		return errors.New("some error")
 	}
-	return errors.New("some error")
+	return fn(noOpsTx{ctx: ctx})
 }
 
-func (n *noOpsDatabase) RollbackTransaction(tx *sql.Tx) error {
-	if tx != nil {
-		return nil
-	}
-	return errors.New("some error")
+func (n *noOpsDatabase) InsertPurchase(ctx context.Context, tx Tx, p *models.Purchase) (string, bool, error) {
+	return p.Id, true, nil
 }
 
-func (n *noOpsDatabase) InsertPurchase(ctx context.Context, tx *sql.Tx, p *models.Purchase) error {
-	return nil
+func (n *noOpsDatabase) BatchInsertPurchases(ctx context.Context, tx Tx, ps []*models.Purchase) ([]*models.PurchaseInsertResult, error) {
+	results := make([]*models.PurchaseInsertResult, 0, len(ps))
+	for _, p := range ps {
+		results = append(results, &models.PurchaseInsertResult{Id: p.Id, Created: true})
+	}
+	return results, nil
 }
 
-func (n *noOpsDatabase) BatchInsertExchanges(ctx context.Context, tx *sql.Tx, exchanges []*models.ExchangeForDate) error {
+func (n *noOpsDatabase) BatchInsertExchanges(ctx context.Context, tx Tx, exchanges []*models.ExchangeForDate) error {
 	return nil
 }
 
@@ -93,10 +99,102 @@ func (n *noOpsDatabase) ListAllPurchases(ctx context.Context) ([]*models.Purchas
 	return make([]*models.Purchase, 0), nil
 }
 
-func (n *noOpsDatabase) InsertExchange(ctx context.Context, tx *sql.Tx, ex *models.ExchangeForDate) error {
+func (n *noOpsDatabase) StreamAllPurchases(ctx context.Context, fn func(p *models.Purchase) error) error {
+	return nil
+}
+
+func (n *noOpsDatabase) InsertExchange(ctx context.Context, tx Tx, ex *models.ExchangeForDate) error {
 	return nil
 }
 
 func (n *noOpsDatabase) GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
 	return nil, nil
 }
+
+func (n *noOpsDatabase) GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	return map[string]*models.ExchangeForDate{}, nil
+}
+
+func (n *noOpsDatabase) ListExchangesSince(ctx context.Context, date string) ([]*models.ExchangeForDate, error) {
+	return []*models.ExchangeForDate{}, nil
+}
+
+func (n *noOpsDatabase) ListExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error) {
+	return []*models.ExchangeRevision{}, nil
+}
+
+func (n *noOpsDatabase) InsertPurchaseConversion(ctx context.Context, tx Tx, c *models.PurchaseConversion) (bool, error) {
+	return true, nil
+}
+
+func (n *noOpsDatabase) GetPurchaseConversion(ctx context.Context, id string, countrycurrency string) (*models.PurchaseConversion, error) {
+	return nil, messages.ErrNoConversionFound
+}
+
+func (n *noOpsDatabase) ListPurchaseConversions(ctx context.Context, countrycurrency string) (map[string]*models.PurchaseConversion, error) {
+	return make(map[string]*models.PurchaseConversion), nil
+}
+
+func (n *noOpsDatabase) InsertRateOverride(ctx context.Context, tx Tx, o *models.RateOverride) (int64, error) {
+	return 1, nil
+}
+
+func (n *noOpsDatabase) RemoveRateOverride(ctx context.Context, tx Tx, id int64, removedAt int64) error {
+	return nil
+}
+
+func (n *noOpsDatabase) GetRateOverride(ctx context.Context, id int64) (*models.RateOverride, error) {
+	return nil, messages.ErrNoOverrideFound
+}
+
+func (n *noOpsDatabase) ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	return []*models.RateOverride{}, nil
+}
+
+func (n *noOpsDatabase) InsertRateOverrideAudit(ctx context.Context, tx Tx, a *models.RateOverrideAudit) error {
+	return nil
+}
+
+func (n *noOpsDatabase) ListRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error) {
+	return []*models.RateOverrideAudit{}, nil
+}
+
+func (n *noOpsDatabase) InsertIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (bool, error) {
+	return true, nil
+}
+
+func (n *noOpsDatabase) GetIdempotencyKey(ctx context.Context, key string) (*models.IdempotencyKey, error) {
+	return nil, errors.New("some error")
+}
+
+func (n *noOpsDatabase) UpdateIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	return nil
+}
+
+func (n *noOpsDatabase) DeleteIdempotencyKey(ctx context.Context, key string) error {
+	return nil
+}
+
+func (n *noOpsDatabase) DeleteExpiredIdempotencyKeys(ctx context.Context, now int64) (int64, error) {
+	return 0, nil
+}
+
+func (n *noOpsDatabase) UpdatePurchase(ctx context.Context, tx Tx, p *models.Purchase) error {
+	return nil
+}
+
+func (n *noOpsDatabase) GetPurchaseForUpdate(ctx context.Context, tx Tx, id string) (*models.Purchase, error) {
+	return n.GetPurchaseById(ctx, id)
+}
+
+func (n *noOpsDatabase) DeletePurchase(ctx context.Context, tx Tx, id string) error {
+	return nil
+}
+
+func (n *noOpsDatabase) ListPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error) {
+	return make([]*models.PurchaseHistory, 0), nil
+}
+
+func (t noOpsTx) Context() context.Context {
+	return t.ctx
+}
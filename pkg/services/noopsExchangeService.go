@@ -2,7 +2,11 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 )
 
@@ -28,6 +32,10 @@ func (n *noOpsExchangeService) Healthy(ctx context.Context) error {
 	return nil
 }
 
+func (n *noOpsExchangeService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
 func (n *noOpsExchangeService) WithServiceManager(sm ServiceManager) ExchangeService {
 	n.sm = sm
 	return n
@@ -37,18 +45,88 @@ func (n *noOpsExchangeService) ServiceManager() ServiceManager {
 	return n.sm
 }
 
-func (n *noOpsExchangeService) HandleNewPurchase(ctx context.Context, p *models.Purchase) error {
-	return nil
+func (n *noOpsExchangeService) HandleNewPurchase(ctx context.Context, p *models.Purchase) (string, bool, error) {
+	if p == nil || p.Id == "error" {
+		return "", false, errors.New("some error")
+	}
+	return p.Id, true, nil
+}
+
+func (n *noOpsExchangeService) ImportPurchases(ctx context.Context, d PurchaseDecoder) (*models.ImportReport, error) {
+	report := models.NewImportReport()
+	for {
+		row, err := d.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			return report, err
+		}
+		if row.Err != nil {
+			report.Rejected = append(report.Rejected, &models.ImportLine{Line: row.Line, Message: row.Err.Error()})
+			continue
+		}
+		report.Accepted = append(report.Accepted, &models.ImportLine{Line: row.Line, Id: row.Purchase.Id})
+	}
 }
 
 func (n *noOpsExchangeService) SearchPurchasesById(ctx context.Context, id string, countrycurrency string) (*models.ConvertedAmount, error) {
-	return nil, nil
+	switch countrycurrency {
+	case "error":
+		return nil, errors.New("some error")
+	case "unavailable":
+		return nil, fmt.Errorf("%w: status 503", messages.ErrSwApiUnavailableError)
+	}
+	c := &models.ConvertedAmount{
+		Id:              id,
+		Description:     "Some transaction",
+		PurchaseDate:    "2023-09-30",
+		OriginalAmount:  "20.13",
+		ExchangeRate:    "5.00",
+		ConvertedAmount: "100.65",
+	}
+	if countrycurrency == "stale" {
+		c.Degraded, c.RateDate = true, "2022-12-31"
+	}
+	return c, nil
 }
 
 func (n *noOpsExchangeService) GetAllPurchases(ctx context.Context, countrycurrency string) ([]*models.ConvertedAmount, error) {
+	switch countrycurrency {
+	case "error":
+		return nil, errors.New("some error")
+	case "unavailable":
+		return nil, fmt.Errorf("%w: status 503", messages.ErrSwApiUnavailableError)
+	case "stale":
+		c, err := n.SearchPurchasesById(ctx, "abcd-fghi", countrycurrency)
+		return []*models.ConvertedAmount{c}, err
+	}
 	return nil, nil
 }
 
+func (n *noOpsExchangeService) StreamAllPurchases(ctx context.Context, countrycurrency string, fn func(c *models.ConvertedAmount) error) error {
+	switch countrycurrency {
+	case "error":
+		return errors.New("some error")
+	case "unavailable":
+		return fmt.Errorf("%w: status 503", messages.ErrSwApiUnavailableError)
+	case "stale":
+		c, err := n.SearchPurchasesById(ctx, "abcd-fghi", countrycurrency)
+		if err != nil {
+			return err
+		}
+		return fn(c)
+	}
+	return fn(&models.ConvertedAmount{
+		Id:              "abcd-fghi",
+		Description:     "=Some transaction",
+		PurchaseDate:    "2023-09-30",
+		OriginalAmount:  "20.13",
+		ExchangeRate:    "5.00",
+		ConvertedAmount: "100.65",
+	})
+}
+
 func (n *noOpsExchangeService) CollectExchangeRatesForPurchase(ctx context.Context, p *models.Purchase) ([]*models.ExchangeForDate, error) {
 	return nil, nil
 }
@@ -60,3 +138,90 @@ func (n *noOpsExchangeService) SearchPurchasesByDate(ctx context.Context, id int
 func (n *noOpsExchangeService) SearchPurchasesByDescription(ctx context.Context, desc string) error {
 	return nil
 }
+
+func (n *noOpsExchangeService) UpdatePurchase(ctx context.Context, id string, patch *models.PurchasePatch) (*models.Purchase, error) {
+	if id == "error" {
+		return nil, errors.New("some error")
+	}
+	return patch.Apply(&models.Purchase{Id: id}), nil
+}
+
+func (n *noOpsExchangeService) DeletePurchase(ctx context.Context, id string) error {
+	if id == "error" {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (n *noOpsExchangeService) GetPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error) {
+	if id == "error" {
+		return nil, errors.New("some error")
+	}
+	return make([]*models.PurchaseHistory, 0), nil
+}
+
+func (n *noOpsExchangeService) GetExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error) {
+	switch countrycurrency {
+	case "error":
+		return nil, errors.New("some error")
+	case "none":
+		return nil, messages.ErrNoExchangeFound
+	}
+	return make([]*models.ExchangeRevision, 0), nil
+}
+
+func (n *noOpsExchangeService) CreateRateOverride(ctx context.Context, o *models.RateOverride) (*models.RateOverride, error) {
+	switch o.CountryCurrencyDesc {
+	case "error":
+		return nil, errors.New("some error")
+	case "invalid":
+		return nil, messages.ErrInvalidOverride
+	}
+	o.Id = 1
+	return o, nil
+}
+
+func (n *noOpsExchangeService) RemoveRateOverride(ctx context.Context, id int64, actor string, reason string) (*models.RateOverride, error) {
+	switch id {
+	case 0:
+		return nil, messages.ErrNoOverrideFound
+	case -1:
+		return nil, errors.New("some error")
+	}
+	return &models.RateOverride{Id: id, RemovedAt: 1}, nil
+}
+
+func (n *noOpsExchangeService) ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return make([]*models.RateOverride, 0), nil
+}
+
+func (n *noOpsExchangeService) GetRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return make([]*models.RateOverrideAudit, 0), nil
+}
+
+func (n *noOpsExchangeService) LockConversions(ctx context.Context, ids []string, countrycurrency string) ([]*models.ConvertedAmount, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	locked := make([]*models.ConvertedAmount, 0, len(ids))
+	for _, id := range ids {
+		locked = append(locked, &models.ConvertedAmount{
+			Id:              id,
+			Description:     "some description",
+			PurchaseDate:    "2023-09-30",
+			OriginalAmount:  "10.00",
+			ExchangeRate:    "5.00",
+			ConvertedAmount: "50.00",
+			Locked:          true,
+			RateDate:        "2023-09-30",
+			Provider:        models.ConversionProviderTreasury,
+		})
+	}
+	return locked, nil
+}
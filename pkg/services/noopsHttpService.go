@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/gin-gonic/gin"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 )
 
 type (
@@ -29,6 +30,10 @@ func (n *noOpsHttpService) Healthy(ctx context.Context) error {
 	return nil
 }
 
+func (n *noOpsHttpService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
 func (n *noOpsHttpService) WithServiceManager(sm ServiceManager) HttpService {
 	n.sm = sm
 	return n
@@ -40,6 +45,42 @@ func (n *noOpsHttpService) ServiceManager() ServiceManager {
 
 func (n *noOpsHttpService) PostPurchase(c *gin.Context) {}
 
+func (n *noOpsHttpService) ImportPurchases(c *gin.Context) {}
+
+func (n *noOpsHttpService) Liveness(c *gin.Context) {}
+
+func (n *noOpsHttpService) Readiness(c *gin.Context) {}
+
+func (n *noOpsHttpService) ReloadConfig(c *gin.Context) {}
+
+func (n *noOpsHttpService) Metrics(c *gin.Context)     {}
+func (n *noOpsHttpService) GetLogLevel(c *gin.Context) {}
+func (n *noOpsHttpService) SetLogLevel(c *gin.Context) {}
+
 func (n *noOpsHttpService) GetPurchaseById(c *gin.Context) {}
 
 func (n *noOpsHttpService) GetAllPurchases(c *gin.Context) {}
+
+func (n *noOpsHttpService) UpdatePurchase(c *gin.Context) {}
+
+func (n *noOpsHttpService) PatchPurchase(c *gin.Context) {}
+
+func (n *noOpsHttpService) DeletePurchase(c *gin.Context) {}
+
+func (n *noOpsHttpService) GetPurchaseHistory(c *gin.Context) {}
+
+func (n *noOpsHttpService) GetExchangeRevisions(c *gin.Context) {}
+
+func (n *noOpsHttpService) LockConversions(c *gin.Context) {}
+
+func (n *noOpsHttpService) CreateRateOverride(c *gin.Context) {}
+
+func (n *noOpsHttpService) ListRateOverrides(c *gin.Context) {}
+
+func (n *noOpsHttpService) RemoveRateOverride(c *gin.Context) {}
+
+func (n *noOpsHttpService) GetRateOverrideAudit(c *gin.Context) {}
+
+func (n *noOpsHttpService) CheckConsistency(c *gin.Context) {}
+
+func (n *noOpsHttpService) RepairConsistency(c *gin.Context) {}
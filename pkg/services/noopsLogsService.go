@@ -2,7 +2,10 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 )
 
 type (
@@ -24,6 +27,10 @@ func (f *noOpsLogsService) Close(ctx context.Context) error {
 func (f *noOpsLogsService) Healthy(ctx context.Context) error {
 	return nil
 }
+
+func (f *noOpsLogsService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
 func (f *noOpsLogsService) WithServiceManager(sm ServiceManager) LogsService {
 	f.sm = sm
 	return f
@@ -31,15 +38,24 @@ func (f *noOpsLogsService) WithServiceManager(sm ServiceManager) LogsService {
 func (f *noOpsLogsService) ServiceManager() ServiceManager {
 	return f.sm
 }
-func (f *noOpsLogsService) Info(ctx context.Context, s string) {
-	fmt.Println("(TESTS-INFO) " + s)
+func (f *noOpsLogsService) Level() string {
+	return "debug"
+}
+func (f *noOpsLogsService) SetLevel(level string) error {
+	if level == "" {
+		return errors.New("empty level")
+	}
+	return nil
+}
+func (f *noOpsLogsService) Info(ctx context.Context, s string, kv ...any) {
+	fmt.Println(append([]any{"(TESTS-INFO) " + s}, kv...)...)
 }
-func (f *noOpsLogsService) Warn(ctx context.Context, s string) {
-	fmt.Println("(TESTS-WARN) " + s)
+func (f *noOpsLogsService) Warn(ctx context.Context, s string, kv ...any) {
+	fmt.Println(append([]any{"(TESTS-WARN) " + s}, kv...)...)
 }
-func (f *noOpsLogsService) Error(ctx context.Context, s string) {
-	fmt.Println("(TESTS-ERROR) " + s)
+func (f *noOpsLogsService) Error(ctx context.Context, s string, kv ...any) {
+	fmt.Println(append([]any{"(TESTS-ERROR) " + s}, kv...)...)
 }
-func (f *noOpsLogsService) Debug(ctx context.Context, s string) {
-	fmt.Println("(TESTS-DEBUG) " + s)
+func (f *noOpsLogsService) Debug(ctx context.Context, s string, kv ...any) {
+	fmt.Println(append([]any{"(TESTS-DEBUG) " + s}, kv...)...)
 }
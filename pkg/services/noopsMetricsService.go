@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+type (
+	noOpsMetricsService struct {
+		sm ServiceManager
+	}
+)
+
+func NewNoOpsMetricsService() MetricsService {
+	return &noOpsMetricsService{}
+}
+
+func (n *noOpsMetricsService) Start(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsMetricsService) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsMetricsService) Healthy(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsMetricsService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func (n *noOpsMetricsService) WithServiceManager(sm ServiceManager) MetricsService {
+	n.sm = sm
+	return n
+}
+
+func (n *noOpsMetricsService) ServiceManager() ServiceManager {
+	return n.sm
+}
+
+func (n *noOpsMetricsService) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func (n *noOpsMetricsService) ObserveHttpRequest(method string, route string, status int, d time.Duration) {
+}
+
+func (n *noOpsMetricsService) ObserveTreasuryCall(d time.Duration, err error) {}
+
+func (n *noOpsMetricsService) ObserveDatabaseQuery(method string, d time.Duration) {}
+
+func (n *noOpsMetricsService) ObserveAsyncWork(err error) {}
+
+func (n *noOpsMetricsService) ConversionFailed(countrycurrency string) {}
+
+func (n *noOpsMetricsService) ConversionDegraded(countrycurrency string) {}
+
+func (n *noOpsMetricsService) PurchasesInserted(created int, deduplicated int) {}
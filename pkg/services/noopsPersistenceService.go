@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 )
 
@@ -29,6 +30,10 @@ func (n *noOpsPersistenceService) Healthy(ctx context.Context) error {
 	return nil
 }
 
+func (n *noOpsPersistenceService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
 func (n *noOpsPersistenceService) WithServiceManager(sm ServiceManager) PersistenceService {
 	n.sm = sm
 	return n
@@ -38,8 +43,25 @@ func (n *noOpsPersistenceService) ServiceManager() ServiceManager {
 	return n.sm
 }
 
-func (n *noOpsPersistenceService) InsertPurchase(ctx context.Context, p *models.Purchase) error {
-	return nil
+func (n *noOpsPersistenceService) InsertPurchase(ctx context.Context, p *models.Purchase) (string, bool, error) {
+	return p.Id, true, nil
+}
+
+func (n *noOpsPersistenceService) BatchInsertPurchases(ctx context.Context, ps []*models.Purchase) ([]*models.PurchaseInsertResult, error) {
+	results := make([]*models.PurchaseInsertResult, 0, len(ps))
+	for _, p := range ps {
+		switch p.Id {
+		case "error":
+			return nil, errors.New("some error")
+		case "duplicated":
+			results = append(results, &models.PurchaseInsertResult{Id: "existing-id"})
+		case "conflict":
+			results = append(results, &models.PurchaseInsertResult{Err: errors.New("some conflict")})
+		default:
+			results = append(results, &models.PurchaseInsertResult{Id: p.Id, Created: true})
+		}
+	}
+	return results, nil
 }
 
 func (n *noOpsPersistenceService) BatchInsertExchanges(ctx context.Context, p *models.Purchase, exchanges []*models.ExchangeForDate) error {
@@ -68,6 +90,16 @@ func (n *noOpsPersistenceService) ListAllPurchases(ctx context.Context) ([]*mode
 	}}, nil
 }
 
+func (n *noOpsPersistenceService) StreamAllPurchases(ctx context.Context, fn func(p *models.Purchase) error) error {
+	purchases, _ := n.ListAllPurchases(ctx)
+	for _, p := range purchases {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (n *noOpsPersistenceService) GetExchangeRateForCountryCurrency(ctx context.Context, countrycurrency string) (*models.ExchangeForDate, error) {
 	if countrycurrency == "error" {
 		return nil, errors.New("some error")
@@ -93,3 +125,148 @@ func (n *noOpsPersistenceService) GetExchangeRateForCountryCurrencyAndDate(ctx c
 		ExchangeRate:        "5.00",
 	}, nil
 }
+
+func (n *noOpsPersistenceService) GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	rates := make(map[string]*models.ExchangeForDate, len(dates))
+	for _, d := range dates {
+		rates[d] = &models.ExchangeForDate{
+			Date:                "2023-09-30",
+			CountryCurrencyDesc: "Brazil-Real",
+			ExchangeRate:        "5.00",
+		}
+	}
+	return rates, nil
+}
+
+func (n *noOpsPersistenceService) ListExchangesSince(ctx context.Context, date string) ([]*models.ExchangeForDate, error) {
+	if date == "error" {
+		return nil, errors.New("some error")
+	}
+	return []*models.ExchangeForDate{{
+		Date:                "2023-09-30",
+		CountryCurrencyDesc: "Brazil-Real",
+		ExchangeRate:        "5.00",
+	}}, nil
+}
+
+func (n *noOpsPersistenceService) ListExchangeRevisions(ctx context.Context, countrycurrency string, date string) ([]*models.ExchangeRevision, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return []*models.ExchangeRevision{{
+		Id:                  1,
+		Date:                date,
+		CountryCurrencyDesc: countrycurrency,
+		ExchangeRate:        "5.00",
+	}}, nil
+}
+
+func (n *noOpsPersistenceService) LockConversions(ctx context.Context, cs []*models.PurchaseConversion) ([]*models.PurchaseConversion, error) {
+	for _, c := range cs {
+		if c.CountryCurrencyDesc == "error" {
+			return nil, errors.New("some error")
+		}
+	}
+	return cs, nil
+}
+
+func (n *noOpsPersistenceService) GetPurchaseConversion(ctx context.Context, id string, countrycurrency string) (*models.PurchaseConversion, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return nil, messages.ErrNoConversionFound
+}
+
+func (n *noOpsPersistenceService) ListPurchaseConversions(ctx context.Context, countrycurrency string) (map[string]*models.PurchaseConversion, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return make(map[string]*models.PurchaseConversion), nil
+}
+
+func (n *noOpsPersistenceService) CreateRateOverride(ctx context.Context, o *models.RateOverride) (*models.RateOverride, error) {
+	if o.CountryCurrencyDesc == "error" {
+		return nil, errors.New("some error")
+	}
+	o.Id = 1
+	return o, nil
+}
+
+func (n *noOpsPersistenceService) RemoveRateOverride(ctx context.Context, id int64, actor string, reason string) (*models.RateOverride, error) {
+	if id == 0 {
+		return nil, messages.ErrNoOverrideFound
+	}
+	return &models.RateOverride{Id: id, RemovedAt: 1}, nil
+}
+
+func (n *noOpsPersistenceService) ListRateOverrides(ctx context.Context, countrycurrency string) ([]*models.RateOverride, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return []*models.RateOverride{}, nil
+}
+
+func (n *noOpsPersistenceService) ListRateOverrideAudit(ctx context.Context, countrycurrency string) ([]*models.RateOverrideAudit, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return []*models.RateOverrideAudit{}, nil
+}
+
+func (n *noOpsPersistenceService) ReserveIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) (*models.IdempotencyKey, error) {
+	switch k.Key {
+	case "error":
+		return nil, errors.New("some error")
+	case "replay":
+		return &models.IdempotencyKey{Key: k.Key, RequestHash: k.RequestHash, StatusCode: 201, ResponseBody: `{"id": "abcd-fghi"}`}, nil
+	case "conflict":
+		return &models.IdempotencyKey{Key: k.Key, RequestHash: "another-hash", StatusCode: 201, ResponseBody: `{"id": "abcd-fghi"}`}, nil
+	case "inprogress":
+		return &models.IdempotencyKey{Key: k.Key, RequestHash: k.RequestHash}, nil
+	}
+	return nil, nil
+}
+
+func (n *noOpsPersistenceService) CompleteIdempotencyKey(ctx context.Context, k *models.IdempotencyKey) error {
+	return nil
+}
+
+func (n *noOpsPersistenceService) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	return nil
+}
+
+func (n *noOpsPersistenceService) PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (n *noOpsPersistenceService) UpdatePurchase(ctx context.Context, id string, update func(current *models.Purchase) (*models.Purchase, error)) (*models.Purchase, error) {
+	if id == "error" {
+		return nil, errors.New("some error")
+	}
+	current, _ := n.GetPurchaseById(ctx, id)
+	return update(current)
+}
+
+func (n *noOpsPersistenceService) DeletePurchase(ctx context.Context, id string) error {
+	if id == "error" {
+		return errors.New("some error")
+	}
+	return nil
+}
+
+func (n *noOpsPersistenceService) ListPurchaseHistory(ctx context.Context, id string) ([]*models.PurchaseHistory, error) {
+	if id == "error" {
+		return nil, errors.New("some error")
+	}
+	return []*models.PurchaseHistory{{
+		Id:          1,
+		PurchaseId:  id,
+		Action:      models.PurchaseCreated,
+		Description: "Some transaction",
+		Amount:      "20.13",
+		Date:        "2023-09-30",
+	}}, nil
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+type (
+	noOpsRateCache struct {
+		sm ServiceManager
+	}
+)
+
+func NewNoOpsRateCache() RateCache {
+	return &noOpsRateCache{}
+}
+
+func (n *noOpsRateCache) Start(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsRateCache) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsRateCache) Healthy(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsRateCache) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func (n *noOpsRateCache) WithServiceManager(sm ServiceManager) RateCache {
+	n.sm = sm
+	return n
+}
+
+func (n *noOpsRateCache) ServiceManager() ServiceManager {
+	return n.sm
+}
+
+func (n *noOpsRateCache) GetExchangeRateForCountryCurrencyAndDate(ctx context.Context, countrycurrency string, date string) (*models.ExchangeForDate, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	return &models.ExchangeForDate{
+		Date:                "2023-09-30",
+		CountryCurrencyDesc: "Brazil-Real",
+		ExchangeRate:        "5.00",
+	}, nil
+}
+
+func (n *noOpsRateCache) GetExchangeRatesForCountryCurrencyAndDates(ctx context.Context, countrycurrency string, dates []string) (map[string]*models.ExchangeForDate, error) {
+	if countrycurrency == "error" {
+		return nil, errors.New("some error")
+	}
+	rates := make(map[string]*models.ExchangeForDate, len(dates))
+	for _, d := range dates {
+		rates[d] = &models.ExchangeForDate{
+			Date:                "2023-09-30",
+			CountryCurrencyDesc: "Brazil-Real",
+			ExchangeRate:        "5.00",
+		}
+	}
+	return rates, nil
+}
+
+func (n *noOpsRateCache) Invalidate(countrycurrency string, date string) {}
+
+func (n *noOpsRateCache) Stats() models.RateCacheStats {
+	return models.RateCacheStats{}
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type (
+	noOpsTracingService struct {
+		sm     ServiceManager
+		tracer trace.Tracer
+	}
+)
+
+func NewNoOpsTracingService() TracingService {
+	return &noOpsTracingService{tracer: noop.NewTracerProvider().Tracer("")}
+}
+
+func (n *noOpsTracingService) Start(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsTracingService) Close(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsTracingService) Healthy(ctx context.Context) error {
+	return nil
+}
+
+func (n *noOpsTracingService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func (n *noOpsTracingService) WithServiceManager(sm ServiceManager) TracingService {
+	n.sm = sm
+	return n
+}
+
+func (n *noOpsTracingService) ServiceManager() ServiceManager {
+	return n.sm
+}
+
+func (n *noOpsTracingService) StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if ctx == nil {
+		return nil, trace.SpanFromContext(context.Background())
+	}
+	return n.tracer.Start(ctx, name, opts...)
+}
@@ -28,6 +28,10 @@ func (n *noOpsTreasuryAccessService) Healthy(ctx context.Context) error {
 	return nil
 }
 
+func (n *noOpsTreasuryAccessService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
 func (n *noOpsTreasuryAccessService) WithServiceManager(sm ServiceManager) TreasuryAccessService {
 	n.sm = sm
 	return n
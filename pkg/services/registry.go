@@ -0,0 +1,159 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+)
+
+// The names the built-in services are registered under, to be used with Get and as dependencies.
+const (
+	ConfigServiceName         = "config"
+	LogsServiceName           = "logs"
+	TracingServiceName        = "tracing"
+	MetricsServiceName        = "metrics"
+	DatabaseName              = "database"
+	PersistenceServiceName    = "persistence"
+	TreasuryAccessServiceName = "treasuryAccess"
+	ExchangeServiceName       = "exchange"
+	AsyncWorkerName           = "asyncWorker"
+	HttpServiceName           = "http"
+)
+
+// RateCacheName is where the RateCache is registered, when there is one.
+const RateCacheName = "rateCache"
+
+// ConsistencyCheckerName is where the ConsistencyChecker is registered, when there is one.
+const ConsistencyCheckerName = "consistencyChecker"
+
+type (
+	component struct {
+		name      string
+		service   GenericService
+		dependsOn []string
+		liveness  bool // checked by the liveness probe too, not only by the readiness one
+		// entryPoint services depend on every service that is not an entry point, so anything a request or an
+		// async work may reach is started before and closed after them.
+		entryPoint bool
+	}
+)
+
+// Get returns the service registered under name as a T, like Get[LogsService](sm, LogsServiceName).
+func Get[T any](sm ServiceManager, name string) (T, error) {
+	var zero T
+	s, ok := sm.Lookup(name)
+	if !ok {
+		return zero, fmt.Errorf("%w: %s", messages.ErrServiceNotRegistered, name)
+	}
+	t, ok := s.(T)
+	if !ok {
+		return zero, fmt.Errorf("%w: %s is a %T", messages.ErrServiceType, name, s)
+	}
+	return t, nil
+}
+
+// register adds c, or replaces the service registered under the same name keeping its place.
+func (m *serviceManagerFinal) register(c *component) {
+	m.registryMu.Lock()
+	defer m.registryMu.Unlock()
+	if _, ok := m.registry[c.name]; !ok {
+		m.registered = append(m.registered, c.name)
+	}
+	m.registry[c.name] = c
+}
+
+// replace swaps the service registered under name, keeping its dependencies.
+func (m *serviceManagerFinal) replace(name string, s GenericService) {
+	m.registryMu.Lock()
+	defer m.registryMu.Unlock()
+	m.registry[name].service = s
+}
+
+// Register panics for the names of the built-in services, they are replaced by their With setters so their
+// typed accessors return the same service.
+func (m *serviceManagerFinal) Register(name string, s GenericService, dependsOn ...string) ServiceManager {
+	if isBuiltin(name) {
+		panic(fmt.Sprintf("services: %s is a built-in service, use its With setter", name))
+	}
+	m.register(&component{name: name, service: s, dependsOn: dependsOn})
+	return m
+}
+
+func isBuiltin(name string) bool {
+	switch name {
+	case ConfigServiceName, LogsServiceName, TracingServiceName, MetricsServiceName, DatabaseName, PersistenceServiceName, TreasuryAccessServiceName,
+		ExchangeServiceName, AsyncWorkerName, HttpServiceName:
+		return true
+	}
+	return false
+}
+
+func (m *serviceManagerFinal) Lookup(name string) (GenericService, bool) {
+	m.registryMu.RLock()
+	defer m.registryMu.RUnlock()
+	c, ok := m.registry[name]
+	if !ok {
+		return nil, false
+	}
+	return c.service, true
+}
+
+// order lists the services so that each one comes after all its dependencies. Among the services ready to
+// go, the one registered first goes first, so the order is the same on every run.
+func (m *serviceManagerFinal) order() ([]*component, error) {
+	m.registryMu.RLock()
+	defer m.registryMu.RUnlock()
+	dependencies := make(map[string][]string, len(m.registered))
+	for _, name := range m.registered {
+		c := m.registry[name]
+		deps := c.dependsOn
+		if c.entryPoint {
+			deps = append([]string(nil), deps...)
+			for _, other := range m.registered {
+				if !m.registry[other].entryPoint {
+					deps = append(deps, other)
+				}
+			}
+		}
+		for _, d := range deps {
+			if _, ok := m.registry[d]; !ok {
+				return nil, fmt.Errorf("%w: %s depends on %s", messages.ErrServiceNotRegistered, name, d)
+			}
+		}
+		dependencies[name] = deps
+	}
+
+	placed := make(map[string]bool, len(m.registered))
+	ordered := make([]*component, 0, len(m.registered))
+	for len(ordered) < len(m.registered) {
+		next := ""
+		for _, name := range m.registered {
+			if !placed[name] && allPlaced(dependencies[name], placed) {
+				next = name
+				break
+			}
+		}
+		if next == "" {
+			var left []string
+			for _, name := range m.registered {
+				if !placed[name] {
+					left = append(left, name)
+				}
+			}
+			return nil, fmt.Errorf("%w among %s", messages.ErrServiceDependencyCycle, strings.Join(left, ", "))
+		}
+		placed[next] = true
+		ordered = append(ordered, m.registry[next])
+	}
+	return ordered, nil
+}
+
+func allPlaced(names []string, placed map[string]bool) bool {
+	for _, n := range names {
+		if !placed[n] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+)
+
+type recordingService struct {
+	closeRecorder
+}
+
+func (r *recordingService) Start(ctx context.Context) error   { return nil }
+func (r *recordingService) Close(ctx context.Context) error   { return r.close() }
+func (r *recordingService) Healthy(ctx context.Context) error { return nil }
+func (r *recordingService) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	return nil
+}
+
+func names(cs []*component) []string {
+	var ns []string
+	for _, c := range cs {
+		ns = append(ns, c.name)
+	}
+	return ns
+}
+
+func Test_serviceManagerFinal_order(t *testing.T) {
+	builtins := []string{ConfigServiceName, LogsServiceName, TracingServiceName, MetricsServiceName, DatabaseName, PersistenceServiceName, TreasuryAccessServiceName, ExchangeServiceName}
+	tests := []struct {
+		name     string
+		register func(sm ServiceManager)
+		want     []string
+		wantErr  error
+	}{
+		{
+			name:     "builtins",
+			register: func(sm ServiceManager) {},
+			want:     append(append([]string{}, builtins...), AsyncWorkerName, HttpServiceName),
+		},
+		{
+			name: "beforeTheEntryPoints",
+			register: func(sm ServiceManager) {
+				sm.Register("reports", &recordingService{}, "scheduler").
+					Register("scheduler", &recordingService{}, PersistenceServiceName)
+			},
+			want: append(append([]string{}, builtins...), "scheduler", "reports", AsyncWorkerName, HttpServiceName),
+		},
+		{
+			name: "missingDependency",
+			register: func(sm ServiceManager) {
+				sm.Register("cache", &recordingService{}, "redis")
+			},
+			wantErr: messages.ErrServiceNotRegistered,
+		},
+		{
+			name: "cycle",
+			register: func(sm ServiceManager) {
+				sm.Register("a", &recordingService{}, "b").Register("b", &recordingService{}, "a")
+			},
+			wantErr: messages.ErrServiceDependencyCycle,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := NewManager(nil, nil)
+			tt.register(sm)
+			got, err := sm.(*serviceManagerFinal).order()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("serviceManagerFinal.order() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if err := sm.Start(context.Background()); !errors.Is(err, tt.wantErr) {
+					t.Errorf("serviceManagerFinal.Start() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if !reflect.DeepEqual(names(got), tt.want) {
+				t.Errorf("serviceManagerFinal.order() = %v, want %v", names(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_serviceManagerFinal_RegisterLifecycle(t *testing.T) {
+	ctx := context.Background()
+	var closed []string
+	sm := NewManager(nil, nil).
+		WithHttpService(&recordingHttpService{NewNoOpsHttpService(), closeRecorder{"http", &closed, nil}}).
+		WithPersistenceService(&recordingPersistenceService{NewNoOpsPersistenceService(), closeRecorder{"persistence", &closed, nil}}).
+		Register("cache", &recordingService{closeRecorder{"cache", &closed, nil}}, PersistenceServiceName)
+
+	if err := sm.Start(ctx); err != nil {
+		t.Fatalf("serviceManagerFinal.Start() error = %v", err)
+	}
+	if err := sm.Close(ctx); err != nil {
+		t.Fatalf("serviceManagerFinal.Close() error = %v", err)
+	}
+	if want := []string{"http", "cache", "persistence"}; !reflect.DeepEqual(closed, want) {
+		t.Errorf("serviceManagerFinal.Close() closed %v, want %v", closed, want)
+	}
+	if got := len(sm.HealthReport(ctx, true).Components); got != 11 {
+		t.Errorf("serviceManagerFinal.HealthReport() components = %d, want 11", got)
+	}
+}
+
+func Test_serviceManagerFinal_RegisterBuiltin(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("serviceManagerFinal.Register() did not panic for a built-in name")
+		}
+	}()
+	NewManager(nil, nil).Register(LogsServiceName, NewNoOpsLogsService())
+}
+
+func TestGet(t *testing.T) {
+	logs := NewNoOpsLogsService()
+	sm := NewManager(nil, nil).WithLogsService(logs).Register("cache", &recordingService{})
+	tests := []struct {
+		name    string
+		get     func() (any, error)
+		want    any
+		wantErr error
+	}{
+		{
+			name:    "builtin",
+			get:     func() (any, error) { return Get[LogsService](sm, LogsServiceName) },
+			want:    logs,
+			wantErr: nil,
+		},
+		{
+			name:    "registered",
+			get:     func() (any, error) { return Get[*recordingService](sm, "cache") },
+			want:    sm.(*serviceManagerFinal).registry["cache"].service,
+			wantErr: nil,
+		},
+		{
+			name:    "notRegistered",
+			get:     func() (any, error) { return Get[GenericService](sm, "scheduler") },
+			want:    GenericService(nil),
+			wantErr: messages.ErrServiceNotRegistered,
+		},
+		{
+			name:    "wrongType",
+			get:     func() (any, error) { return Get[Database](sm, LogsServiceName) },
+			want:    Database(nil),
+			wantErr: messages.ErrServiceType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.get()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
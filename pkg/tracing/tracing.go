@@ -0,0 +1,125 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const instrumentationName = "github.com/marcosArruda/purchases-multi-country"
+
+type (
+	tracingServiceFinal struct {
+		sm       services.ServiceManager
+		provider *sdktrace.TracerProvider
+		tracer   trace.Tracer
+		config   models.TracingConfig
+	}
+)
+
+// NewTracingService builds a TracingService that, until started, starts spans that are not recorded.
+func NewTracingService() services.TracingService {
+	return &tracingServiceFinal{tracer: noop.NewTracerProvider().Tracer(instrumentationName)}
+}
+
+// Start builds the exporter of the tracing settings and makes its provider the global one, with the W3C trace
+// context propagator, so the outbound http calls carry the trace and an incoming traceparent header is continued.
+func (n *tracingServiceFinal) Start(ctx context.Context) error {
+	cfg := n.sm.ConfigService().Config()
+	n.config = cfg.Tracing
+	exporter, err := newExporter(ctx, n.config)
+	if err != nil {
+		return err
+	}
+
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if exporter == nil {
+		n.sm.LogsService().Info(ctx, "Tracing Service Started without exporter!")
+		return nil
+	}
+	n.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(cfg.App.Name),
+			semconv.ServiceVersion(logs.Version()),
+		)),
+	)
+	otel.SetTracerProvider(n.provider)
+	n.tracer = n.provider.Tracer(instrumentationName)
+	n.sm.LogsService().Info(ctx, "Tracing Service Started!", "exporter", n.config.Exporter)
+	return nil
+}
+
+func newExporter(ctx context.Context, cfg models.TracingConfig) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case models.TracingExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case models.TracingExporterOTLP:
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tracing endpoint '%s': %w", cfg.Endpoint, err)
+		}
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+		if u.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if u.Path != "" && u.Path != "/" {
+			opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	return nil, nil
+}
+
+// Close exports the spans still buffered, until ctx is done. It is closed after the services that start spans.
+func (n *tracingServiceFinal) Close(ctx context.Context) error {
+	if n.provider == nil {
+		return nil
+	}
+	if err := n.provider.Shutdown(ctx); err != nil {
+		return fmt.Errorf("could not export the last spans: %w", err)
+	}
+	return nil
+}
+
+func (n *tracingServiceFinal) Healthy(ctx context.Context) error {
+	return nil
+}
+
+// Reconfigure rejects any change of the tracing settings, the spans already started belong to the exporter in use.
+func (n *tracingServiceFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	if n.config.Exporter != "" && cfg.Tracing != n.config {
+		return fmt.Errorf("the tracing settings cannot change from %+v to %+v without a restart", n.config, cfg.Tracing)
+	}
+	return nil
+}
+
+func (n *tracingServiceFinal) WithServiceManager(sm services.ServiceManager) services.TracingService {
+	n.sm = sm
+	return n
+}
+
+func (n *tracingServiceFinal) ServiceManager() services.ServiceManager {
+	return n.sm
+}
+
+func (n *tracingServiceFinal) StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if ctx == nil {
+		return nil, trace.SpanFromContext(context.Background())
+	}
+	return n.tracer.Start(ctx, name, opts...)
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+func NewManagerForTests(tracing models.TracingConfig) (services.ServiceManager, context.Context) {
+	sm := services.NewManager(nil, nil)
+	cfg := models.DefaultConfig()
+	cfg.Tracing = tracing
+	sm.ConfigService().Reconfigure(context.Background(), cfg)
+	return sm, context.Background()
+}
+
+func Test_tracingServiceFinal_Start(t *testing.T) {
+	tests := []struct {
+		name          string
+		tracing       models.TracingConfig
+		wantRecording bool
+	}{
+		{
+			name:          "none",
+			tracing:       models.TracingConfig{Exporter: models.TracingExporterNone},
+			wantRecording: false,
+		},
+		{
+			name:          "stdout",
+			tracing:       models.TracingConfig{Exporter: models.TracingExporterStdout},
+			wantRecording: true,
+		},
+		{
+			name:          "otlp",
+			tracing:       models.TracingConfig{Exporter: models.TracingExporterOTLP, Endpoint: "http://127.0.0.1:0/v1/traces"},
+			wantRecording: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTests(tt.tracing)
+			s := NewTracingService().WithServiceManager(sm)
+			if err := s.Start(ctx); err != nil {
+				t.Fatalf("tracingServiceFinal.Start() error = %v", err)
+			}
+			_, span := s.StartSpan(ctx, "test")
+			if got := span.IsRecording(); got != tt.wantRecording {
+				t.Errorf("tracingServiceFinal.StartSpan() recording = %v, want %v", got, tt.wantRecording)
+			}
+			// not ended, so Close has nothing to export to the unreachable collector.
+			if err := s.Close(ctx); err != nil {
+				t.Errorf("tracingServiceFinal.Close() error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_tracingServiceFinal_StartSpanNilContext(t *testing.T) {
+	ctx, span := NewTracingService().StartSpan(nil, "test")
+	if ctx != nil || span.IsRecording() {
+		t.Errorf("tracingServiceFinal.StartSpan() = %v, %v, want a nil context and a span not recorded", ctx, span)
+	}
+}
+
+func Test_tracingServiceFinal_Reconfigure(t *testing.T) {
+	sm, ctx := NewManagerForTests(models.DefaultConfig().Tracing)
+	s := NewTracingService().WithServiceManager(sm)
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("tracingServiceFinal.Start() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		tracing models.TracingConfig
+		wantErr bool
+	}{
+		{
+			name:    "unchanged",
+			tracing: models.DefaultConfig().Tracing,
+			wantErr: false,
+		},
+		{
+			name:    "exporterChanged",
+			tracing: models.TracingConfig{Exporter: models.TracingExporterStdout, Endpoint: models.DefaultConfig().Tracing.Endpoint},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := models.DefaultConfig()
+			cfg.Tracing = tt.tracing
+			if err := s.Reconfigure(ctx, cfg); (err != nil) != tt.wantErr {
+				t.Errorf("tracingServiceFinal.Reconfigure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
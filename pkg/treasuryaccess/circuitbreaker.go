@@ -0,0 +1,90 @@
+package treasuryaccess
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// circuitBreaker stops calling the Treasury API after failureThreshold failures in a row. Once open, it lets a
+// single trial call through after the cooldown: a success closes the circuit again and a failure reopens it.
+type circuitBreaker struct {
+	mu               sync.Mutex
+	state            string
+	failures         int
+	failureThreshold int
+	cooldown         time.Duration
+	openedAt         time.Time
+	trialInFlight    bool
+	now              func() time.Time
+}
+
+func newCircuitBreaker(failureThreshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{state: circuitClosed, failureThreshold: failureThreshold, cooldown: cooldown, now: time.Now}
+}
+
+// Configure changes the threshold and the cooldown, keeping the current state.
+func (b *circuitBreaker) Configure(failureThreshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failureThreshold = failureThreshold
+	b.cooldown = cooldown
+}
+
+// Allow tells if a call can be made now.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.trialInFlight = true
+		return true
+	case circuitHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.trialInFlight = true
+		return true
+	}
+	return true
+}
+
+// Record registers the outcome of a call allowed by Allow.
+func (b *circuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialInFlight = false
+	if err == nil {
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.failureThreshold {
+		b.state = circuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// Abandon gives back a call allowed by Allow whose outcome tells nothing about the API, like one its caller gave
+// up on: another trial call can then be made.
+func (b *circuitBreaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialInFlight = false
+}
+
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,92 @@
+package treasuryaccess
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_circuitBreaker(t *testing.T) {
+	errCall := errors.New("some error")
+	type step struct {
+		advance   time.Duration
+		wantAllow bool
+		record    bool
+		abandon   bool
+		err       error
+		wantState string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opensAfterThreshold",
+			steps: []step{
+				{wantAllow: true, record: true, err: errCall, wantState: circuitClosed},
+				{wantAllow: true, record: true, err: errCall, wantState: circuitOpen},
+				{wantAllow: false, wantState: circuitOpen},
+			},
+		},
+		{
+			name: "successResetsFailures",
+			steps: []step{
+				{wantAllow: true, record: true, err: errCall, wantState: circuitClosed},
+				{wantAllow: true, record: true, wantState: circuitClosed},
+				{wantAllow: true, record: true, err: errCall, wantState: circuitClosed},
+			},
+		},
+		{
+			name: "halfOpenTrialCloses",
+			steps: []step{
+				{wantAllow: true, record: true, err: errCall},
+				{wantAllow: true, record: true, err: errCall, wantState: circuitOpen},
+				{advance: time.Minute, wantAllow: true, wantState: circuitHalfOpen},
+				{wantAllow: false, record: true, wantState: circuitClosed},
+				{wantAllow: true, wantState: circuitClosed},
+			},
+		},
+		{
+			name: "halfOpenTrialReopens",
+			steps: []step{
+				{wantAllow: true, record: true, err: errCall},
+				{wantAllow: true, record: true, err: errCall, wantState: circuitOpen},
+				{advance: time.Minute, wantAllow: true, record: true, err: errCall, wantState: circuitOpen},
+				{wantAllow: false, wantState: circuitOpen},
+			},
+		},
+		{
+			name: "abandonedTrialLetsAnother",
+			steps: []step{
+				{wantAllow: true, record: true, err: errCall},
+				{wantAllow: true, record: true, err: errCall, wantState: circuitOpen},
+				{advance: time.Minute, wantAllow: true, abandon: true, wantState: circuitHalfOpen},
+				{wantAllow: true, record: true, wantState: circuitClosed},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2023, 9, 30, 0, 0, 0, 0, time.UTC)
+			b := newCircuitBreaker(2, 30*time.Second)
+			b.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				if got := b.Allow(); got != s.wantAllow {
+					t.Fatalf("step %d: circuitBreaker.Allow() = %v, want %v", i, got, s.wantAllow)
+				}
+				if s.record {
+					b.Record(s.err)
+				}
+				if s.abandon {
+					b.Abandon()
+				}
+				if s.wantState != "" {
+					if got := b.State(); got != s.wantState {
+						t.Errorf("step %d: circuitBreaker.State() = %s, want %s", i, got, s.wantState)
+					}
+				}
+			}
+		})
+	}
+}
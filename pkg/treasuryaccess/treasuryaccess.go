@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
 	"github.com/marcosArruda/purchases-multi-country/pkg/models"
 	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 type (
@@ -19,18 +21,25 @@ type (
 	treasuryAccessClientFinal struct {
 		sm                   services.ServiceManager
 		searchableHttpClient BasicHttpClient
+		breaker              *circuitBreaker
 	}
 )
 
 var (
-	baseURL = "https://api.fiscaldata.treasury.gov/services/api/fiscal_service/v1/accounting/od/rates_of_exchange?fields=record_date,country_currency_desc,exchange_rate,effective_date&filter=%s&sort=-effective_date&page[number]=1&page[size]=200"
+	errTreasuryCircuitOpen = fmt.Errorf("%w: circuit open", messages.ErrSwApiUnavailableError)
+
+	// ratesQuery is added to the configured treasury base url.
+	ratesQuery = "?fields=record_date,country_currency_desc,exchange_rate,effective_date&filter=%s&sort=-effective_date&page[number]=1&page[size]=200"
 )
 
 func NewTreasuryAccessService() services.TreasuryAccessService {
-	return &treasuryAccessClientFinal{searchableHttpClient: http.DefaultClient}
+	defaults := models.DefaultConfig().Treasury
+	return &treasuryAccessClientFinal{searchableHttpClient: &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}, breaker: newCircuitBreaker(defaults.FailureThreshold, defaults.OpenCooldown)}
 }
 
 func (n *treasuryAccessClientFinal) Start(ctx context.Context) error {
+	cfg := n.sm.ConfigService().Config().Treasury
+	n.breaker.Configure(cfg.FailureThreshold, cfg.OpenCooldown)
 	n.sm.LogsService().Info(ctx, "TreasuryAccess Service Started Started!")
 	return nil
 }
@@ -40,6 +49,27 @@ func (n *treasuryAccessClientFinal) Close(ctx context.Context) error {
 }
 
 func (n *treasuryAccessClientFinal) Healthy(ctx context.Context) error {
+	if n.breaker.State() == circuitOpen {
+		return errTreasuryCircuitOpen
+	}
+	return nil
+}
+
+// Health reports the circuit state. An open circuit only degrades the service, the exchange rates already
+// stored can still be used.
+func (n *treasuryAccessClientFinal) Health(ctx context.Context) *models.ComponentHealth {
+	state := n.breaker.State()
+	h := models.NewComponentHealth("", 0, nil)
+	if state != circuitClosed {
+		h.Status = models.HealthDegraded
+	}
+	h.Details = map[string]any{"circuit": state}
+	return h
+}
+
+// Reconfigure applies the new circuit breaker settings, the url, timeout and retries are read on each call.
+func (n *treasuryAccessClientFinal) Reconfigure(ctx context.Context, cfg *models.Config) error {
+	n.breaker.Configure(cfg.Treasury.FailureThreshold, cfg.Treasury.OpenCooldown)
 	return nil
 }
 
@@ -53,25 +83,16 @@ func (n *treasuryAccessClientFinal) ServiceManager() services.ServiceManager {
 }
 
 func (n *treasuryAccessClientFinal) GetExchangesForDate(ctx context.Context, date string) ([]*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "TreasuryAccessService.GetExchangesForDate")
+	defer span.End()
 	filterDates, err := n.getDateRangeFilter(ctx, date)
 	if err != nil {
 		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: error creating filters: %s", err.Error()))
 		return nil, err
 	}
-	url := fmt.Sprintf(baseURL, filterDates)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	url := n.sm.ConfigService().Config().Treasury.BaseURL + fmt.Sprintf(ratesQuery, filterDates)
+	resBody, err := n.get(ctx, url)
 	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not create request: %s", err.Error()))
-		return nil, err
-	}
-	res, err := n.searchableHttpClient.Do(req)
-	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: error making http request: %s", err.Error()))
-		return nil, err
-	}
-	resBody, err := io.ReadAll(res.Body)
-	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not read response body: %s", err.Error()))
 		return nil, err
 	}
 	var body models.ExchangesReturn
@@ -84,35 +105,92 @@ func (n *treasuryAccessClientFinal) GetExchangesForDate(ctx context.Context, dat
 }
 
 func (n *treasuryAccessClientFinal) GetSpecificExchangeForDateAndCurrency(ctx context.Context, date string, countrycurrency string) (*models.ExchangeForDate, error) {
+	ctx, span := n.sm.TracingService().StartSpan(ctx, "TreasuryAccessService.GetSpecificExchangeForDateAndCurrency")
+	defer span.End()
 	filterCurrency := fmt.Sprintf("country_currency_desc:in:(%s)", countrycurrency)
 	filterDates, err := n.getDateRangeFilter(ctx, date)
 	if err != nil {
 		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: error creating filters: %s", err.Error()))
 		return nil, err
 	}
-	url := fmt.Sprintf(baseURL, filterDates+","+filterCurrency)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	url := n.sm.ConfigService().Config().Treasury.BaseURL + fmt.Sprintf(ratesQuery, filterDates+","+filterCurrency)
+	resBody, err := n.get(ctx, url)
 	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not create request: %s", err.Error()))
 		return nil, err
 	}
+	var body models.ExchangesReturn
+	err = json.Unmarshal(resBody, &body)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not unmarshall the body: %s", err.Error()))
+		return nil, fmt.Errorf("%w: %s", messages.ErrSwApiUnavailableError, err.Error())
+	}
+	exchanges := n.convertTreasuryResponse(ctx, &body)
+	if len(exchanges) == 0 {
+		// the API answered, there is just no rate of countrycurrency in the 6 months before date.
+		return nil, fmt.Errorf("%w: %s in the 6 months before %s", messages.ErrNoExchangeFound, countrycurrency, date)
+	}
+	return exchanges[0], nil
+}
+
+// get calls the Treasury API, retrying the failed calls up to treasury.maxRetries times.
+func (n *treasuryAccessClientFinal) get(ctx context.Context, url string) ([]byte, error) {
+	cfg := n.sm.ConfigService().Config().Treasury
+	for attempt := 0; ; attempt++ {
+		resBody, retry, err := n.getOnce(ctx, url, cfg.Timeout)
+		if err == nil || !retry || attempt >= cfg.MaxRetries {
+			return resBody, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(cfg.RetryBackoff * time.Duration(attempt+1)):
+		}
+	}
+}
+
+// getOnce calls the Treasury API through the circuit breaker, so a failing API is not called again and again.
+// Every answer but a 2xx means the API is unavailable, a 429 or a 408 as much as a 5xx. retry tells if the call
+// failed in a way another call may not. A call given up by the caller is not the API failing, so it is left out
+// of the breaker.
+func (n *treasuryAccessClientFinal) getOnce(ctx context.Context, url string, timeout time.Duration) (resBody []byte, retry bool, err error) {
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not create request: %s", err.Error()))
+		return nil, false, err
+	}
+	if !n.breaker.Allow() {
+		n.sm.LogsService().Warn(ctx, "client: not calling the Treasury API, the circuit is open")
+		return nil, false, errTreasuryCircuitOpen
+	}
+	start := time.Now()
+	defer func() { n.sm.MetricsService().ObserveTreasuryCall(time.Since(start), err) }()
 	res, err := n.searchableHttpClient.Do(req)
+	retry = true
 	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: error making http request: %s", err.Error()))
-		return nil, err
+		err = fmt.Errorf("%w: %s", messages.ErrSwApiUnavailableError, err.Error())
+	} else if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		res.Body.Close()
+		err = fmt.Errorf("%w: status %d", messages.ErrSwApiUnavailableError, res.StatusCode)
+		retry = res.StatusCode >= http.StatusInternalServerError || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout
+	}
+	if ctx.Err() != nil {
+		n.breaker.Abandon()
+	} else {
+		n.breaker.Record(err)
 	}
-	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not read response body: %s", err.Error()))
-		return nil, err
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: error making http request: %s", err.Error()))
+		return nil, retry, err
 	}
-	var body models.ExchangesReturn
-	err = json.Unmarshal(resBody, &body)
+	defer res.Body.Close()
+	resBody, err = io.ReadAll(res.Body)
 	if err != nil {
-		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not unmarshall the body: %s", err.Error()))
-		return nil, err
+		n.sm.LogsService().Error(ctx, fmt.Sprintf("client: could not read response body: %s", err.Error()))
+		return nil, true, fmt.Errorf("%w: %s", messages.ErrSwApiUnavailableError, err.Error())
 	}
-	return n.convertTreasuryResponse(ctx, &body)[0], nil
+	return resBody, false, nil
 }
 
 func (n *treasuryAccessClientFinal) convertTreasuryResponse(ctx context.Context, body *models.ExchangesReturn) []*models.ExchangeForDate {
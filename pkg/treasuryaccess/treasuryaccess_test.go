@@ -0,0 +1,86 @@
+package treasuryaccess
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/marcosArruda/purchases-multi-country/pkg/logs"
+	"github.com/marcosArruda/purchases-multi-country/pkg/messages"
+	"github.com/marcosArruda/purchases-multi-country/pkg/models"
+	"github.com/marcosArruda/purchases-multi-country/pkg/services"
+)
+
+// httpClientStub answers every request with status and body, or fails with err.
+type httpClientStub struct {
+	status int
+	body   string
+	err    error
+	calls  int
+}
+
+func (s *httpClientStub) Do(req *http.Request) (*http.Response, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &http.Response{StatusCode: s.status, Body: io.NopCloser(strings.NewReader(s.body))}, nil
+}
+
+func NewManagerForTests(t *testing.T) (services.ServiceManager, context.Context) {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, logs.AppEnvKey, "TESTS")
+	ctx = context.WithValue(ctx, logs.AppNameKey, "purchases-multi-country-app")
+	ctx = context.WithValue(ctx, logs.AppVersionKey, logs.Version())
+	sm := services.NewManager(make(chan func() error), make(chan struct{}))
+	cfg := models.DefaultConfig()
+	cfg.Treasury.MaxRetries, cfg.Treasury.FailureThreshold = 0, 1
+	if err := sm.ConfigService().Reconfigure(ctx, cfg); err != nil {
+		t.Fatalf("configService.Reconfigure() error = %v", err)
+	}
+	return sm, ctx
+}
+
+func Test_treasuryAccessClientFinal_GetSpecificExchangeForDateAndCurrency(t *testing.T) {
+	rate := `{"data": [{"country_currency_desc": "Brazil-Real", "exchange_rate": "5.033", "effective_date": "2023-09-30"}]}`
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name        string
+		client      *httpClientStub
+		canceled    bool
+		wantErr     error
+		wantCircuit string
+	}{
+		{name: "rate", client: &httpClientStub{status: http.StatusOK, body: rate}, wantCircuit: circuitClosed},
+		{name: "noRate", client: &httpClientStub{status: http.StatusOK, body: `{"data": []}`}, wantErr: messages.ErrNoExchangeFound, wantCircuit: circuitClosed},
+		{name: "serverError", client: &httpClientStub{status: http.StatusBadGateway}, wantErr: messages.ErrSwApiUnavailableError, wantCircuit: circuitOpen},
+		{name: "tooManyRequests", client: &httpClientStub{status: http.StatusTooManyRequests}, wantErr: messages.ErrSwApiUnavailableError, wantCircuit: circuitOpen},
+		{name: "requestTimeout", client: &httpClientStub{status: http.StatusRequestTimeout}, wantErr: messages.ErrSwApiUnavailableError, wantCircuit: circuitOpen},
+		{name: "notFound", client: &httpClientStub{status: http.StatusNotFound}, wantErr: messages.ErrSwApiUnavailableError, wantCircuit: circuitOpen},
+		{name: "callerGaveUp", client: &httpClientStub{err: context.Canceled}, canceled: true, wantErr: messages.ErrSwApiUnavailableError, wantCircuit: circuitClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm, ctx := NewManagerForTests(t)
+			n := NewTreasuryAccessService().WithServiceManager(sm).(*treasuryAccessClientFinal)
+			n.searchableHttpClient = tt.client
+			if err := n.Start(ctx); err != nil {
+				t.Fatalf("treasuryAccessClientFinal.Start() error = %v", err)
+			}
+			if tt.canceled {
+				ctx = canceled
+			}
+			_, err := n.GetSpecificExchangeForDateAndCurrency(ctx, "2023-09-30", "Brazil-Real")
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Errorf("treasuryAccessClientFinal.GetSpecificExchangeForDateAndCurrency() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := n.breaker.State(); got != tt.wantCircuit {
+				t.Errorf("treasuryAccessClientFinal.GetSpecificExchangeForDateAndCurrency() left the circuit %s, want %s", got, tt.wantCircuit)
+			}
+		})
+	}
+}